@@ -0,0 +1,133 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gathererOf(t *testing.T, exposition *string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		parser := expfmt.TextParser{}
+		parsed, err := parser.TextToMetricFamilies(strings.NewReader(*exposition))
+		require.NoError(t, err)
+		families := []*dto.MetricFamily{}
+		for _, f := range parsed {
+			families = append(families, f)
+		}
+		return families, nil
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	var (
+		alertmanager [][]Alert
+		webhook      []webhookMessage
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/alerts":
+			var alerts []Alert
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+			alertmanager = append(alertmanager, alerts)
+		case "/hook":
+			var msg webhookMessage
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+			webhook = append(webhook, msg)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		AlertmanagerURL: srv.URL,
+		WebhookURL:      srv.URL + "/hook",
+		Rules: []*Rule{
+			{
+				Alert:       "TooManyErrors",
+				Metric:      "errors_total",
+				Match:       map[string]string{"code": "500"},
+				Op:          ">",
+				Threshold:   10,
+				For:         model.Duration(30 * time.Second),
+				Labels:      map[string]string{"severity": "page"},
+				Annotations: map[string]string{"summary": "{{ $labels.job }} has {{ $value }} errors"},
+			},
+			{Alert: "SlowRequests", Metric: "latency_seconds_sum", Op: ">=", Threshold: 5},
+		},
+	}
+	require.NoError(t, cfg.validate())
+
+	exposition := "# TYPE errors_total counter\nerrors_total{job=\"api\",code=\"500\"} 12\nerrors_total{job=\"api\",code=\"404\"} 50\n# TYPE latency_seconds histogram\nlatency_seconds_bucket{le=\"+Inf\"} 1\nlatency_seconds_sum 1\nlatency_seconds_count 1\n"
+	e := NewEvaluator(cfg, gathererOf(t, &exposition))
+	start := time.Now()
+
+	// pending for 30s before firing
+	e.Evaluate(context.Background(), start)
+	assert.Empty(t, alertmanager)
+	assert.Empty(t, webhook)
+
+	e.Evaluate(context.Background(), start.Add(30*time.Second))
+	require.Len(t, alertmanager, 1)
+	require.Len(t, alertmanager[0], 1)
+	alert := alertmanager[0][0]
+	assert.Equal(t, map[string]string{"alertname": "TooManyErrors", "job": "api", "code": "500", "severity": "page"}, alert.Labels)
+	assert.Equal(t, "api has 12 errors", alert.Annotations["summary"])
+	require.Len(t, webhook, 1)
+	assert.Equal(t, "firing", webhook[0].Status)
+
+	// still firing: resent to alertmanager, the webhook only hears of changes
+	exposition = strings.Replace(exposition, "latency_seconds_sum 1", "latency_seconds_sum 6", 1)
+	e.Evaluate(context.Background(), start.Add(60*time.Second))
+	require.Len(t, alertmanager, 2)
+	require.Len(t, alertmanager[1], 2)
+	require.Len(t, webhook, 2)
+	assert.Equal(t, "SlowRequests", webhook[1].Alerts[0].Labels["alertname"])
+
+	exposition = "# TYPE errors_total counter\nerrors_total{job=\"api\",code=\"500\"} 3\n"
+	now := start.Add(90 * time.Second)
+	e.Evaluate(context.Background(), now)
+	require.Len(t, alertmanager, 3)
+	require.Len(t, alertmanager[2], 2)
+	for _, a := range alertmanager[2] {
+		assert.Equal(t, "resolved", a.Status)
+		assert.True(t, a.EndsAt.Equal(now))
+	}
+	require.Len(t, webhook, 3)
+	assert.Equal(t, "resolved", webhook[2].Status)
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+alertmanager_url: http://alertmanager:9093/
+rules:
+  - alert: QueueBacklog
+    metric: queue_depth
+    op: ">"
+    threshold: 1000
+    for: 5m
+`), 0o644))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "http://alertmanager:9093", cfg.AlertmanagerURL)
+	assert.Equal(t, defaultEvaluationInterval, cfg.EvaluationInterval)
+	assert.Equal(t, 5*time.Minute, time.Duration(cfg.Rules[0].For))
+
+	require.NoError(t, os.WriteFile(path, []byte("webhook_url: http://hook\nrules:\n  - alert: A\n    metric: a\n    op: \"=~\"\n"), 0o644))
+	_, err = LoadConfig(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,288 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+var Notifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: metrics.MetricsNamespace,
+		Name:      "alert_notifications",
+		Help:      "Total number of alert notifications sent, per receiver and result",
+	},
+	[]string{
+		"receiver",
+		"result",
+	},
+)
+
+var AlertsFiring = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: metrics.MetricsNamespace,
+		Name:      "alerts_firing",
+		Help:      "Number of alerts currently firing",
+	},
+)
+
+func init() {
+	metrics.PromRegistry.MustRegister(Notifications, AlertsFiring)
+}
+
+// notifyTimeout bounds a single notification
+const notifyTimeout = 10 * time.Second
+
+type alertState struct {
+	labels      map[string]string
+	annotations map[string]string
+	activeSince time.Time
+	firing      bool
+}
+
+// Alert is the Alertmanager API representation of an alert
+type Alert struct {
+	Status      string            `json:"status,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+type webhookMessage struct {
+	Version string  `json:"version"`
+	Status  string  `json:"status"`
+	Alerts  []Alert `json:"alerts"`
+}
+
+type Evaluator struct {
+	cfg      *Config
+	gatherer prometheus.Gatherer
+	client   *http.Client
+
+	// active holds the alerts whose threshold is crossed, by fingerprint
+	active map[string]*alertState
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewEvaluator(cfg *Config, gatherer prometheus.Gatherer) *Evaluator {
+	return &Evaluator{
+		cfg:      cfg,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: notifyTimeout},
+		active:   map[string]*alertState{},
+	}
+}
+
+// Start evaluates the rules on the configured interval until Stop
+func (e *Evaluator) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(time.Duration(e.cfg.EvaluationInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				e.Evaluate(ctx, now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (e *Evaluator) Stop() {
+	e.cancel()
+	e.wg.Wait()
+}
+
+// Evaluate runs every rule once against the current aggregate and sends the
+// resulting notifications
+func (e *Evaluator) Evaluate(ctx context.Context, now time.Time) {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		log.Printf("Could not gather metrics to evaluate alerts: %s\n", err.Error())
+		return
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+
+	var started, firing, resolved []Alert
+	seen := map[string]struct{}{}
+	for _, rule := range e.cfg.Rules {
+		compare := comparisons[rule.Op]
+		for _, s := range samples(byName, rule.Metric) {
+			if !rule.matches(s.labels) || !compare(s.value, rule.Threshold) {
+				continue
+			}
+
+			labels := rule.alertLabels(s.labels)
+			fp := fingerprint(labels)
+			seen[fp] = struct{}{}
+			state, ok := e.active[fp]
+			if !ok {
+				state = &alertState{labels: labels, activeSince: now}
+				e.active[fp] = state
+			}
+			state.annotations = rule.expandAnnotations(s.labels, s.value)
+
+			if !state.firing && now.Sub(state.activeSince) >= time.Duration(rule.For) {
+				state.firing = true
+				started = append(started, state.alert("firing", time.Time{}))
+			}
+			if state.firing {
+				// as Prometheus does, firing alerts are resent with an end
+				// far enough out to survive a few missed evaluations
+				firing = append(firing, state.alert("firing", now.Add(4*time.Duration(e.cfg.EvaluationInterval))))
+			}
+		}
+	}
+
+	for fp, state := range e.active {
+		if _, ok := seen[fp]; ok {
+			continue
+		}
+		delete(e.active, fp)
+		if state.firing {
+			resolved = append(resolved, state.alert("resolved", now))
+		}
+	}
+
+	count := 0
+	for _, state := range e.active {
+		if state.firing {
+			count++
+		}
+	}
+	AlertsFiring.Set(float64(count))
+
+	if e.cfg.AlertmanagerURL != "" && len(firing)+len(resolved) > 0 {
+		e.send(ctx, "alertmanager", e.cfg.AlertmanagerURL+"/api/v2/alerts", append(firing, resolved...))
+	}
+	if e.cfg.WebhookURL != "" {
+		if len(started) > 0 {
+			e.send(ctx, "webhook", e.cfg.WebhookURL, webhookMessage{Version: "4", Status: "firing", Alerts: started})
+		}
+		if len(resolved) > 0 {
+			e.send(ctx, "webhook", e.cfg.WebhookURL, webhookMessage{Version: "4", Status: "resolved", Alerts: resolved})
+		}
+	}
+}
+
+func (s *alertState) alert(status string, endsAt time.Time) Alert {
+	return Alert{
+		Status:      status,
+		Labels:      s.labels,
+		Annotations: s.annotations,
+		StartsAt:    s.activeSince,
+		EndsAt:      endsAt,
+	}
+}
+
+func (e *Evaluator) send(ctx context.Context, receiver, url string, payload any) {
+	if err := e.post(ctx, url, payload); err != nil {
+		Notifications.WithLabelValues(receiver, "error").Inc()
+		log.Printf("Could not notify %s: %s\n", url, err.Error())
+		return
+	}
+	Notifications.WithLabelValues(receiver, "ok").Inc()
+}
+
+func (e *Evaluator) post(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+// samples returns the values of metric, resolving _sum and _count to the
+// histogram or summary they belong to
+func samples(families map[string]*dto.MetricFamily, metric string) []sample {
+	family, suffix := families[metric], ""
+	if family == nil {
+		for _, s := range []string{"_sum", "_count"} {
+			base, ok := strings.CutSuffix(metric, s)
+			if f := families[base]; ok && f != nil && (f.GetType() == dto.MetricType_HISTOGRAM || f.GetType() == dto.MetricType_SUMMARY) {
+				family, suffix = f, s
+			}
+		}
+	}
+	histogramLike := family.GetType() == dto.MetricType_HISTOGRAM || family.GetType() == dto.MetricType_SUMMARY
+	if family == nil || (suffix == "") == histogramLike {
+		// a bare histogram or summary name has no single value
+		return nil
+	}
+
+	out := make([]sample, 0, len(family.Metric))
+	for _, m := range family.Metric {
+		labels := make(map[string]string, len(m.Label))
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+
+		var value float64
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			value = m.GetCounter().GetValue()
+		case dto.MetricType_GAUGE:
+			value = m.GetGauge().GetValue()
+		case dto.MetricType_UNTYPED:
+			value = m.GetUntyped().GetValue()
+		case dto.MetricType_HISTOGRAM:
+			value = m.GetHistogram().GetSampleSum()
+			if suffix == "_count" {
+				value = float64(m.GetHistogram().GetSampleCount())
+			}
+		case dto.MetricType_SUMMARY:
+			value = m.GetSummary().GetSampleSum()
+			if suffix == "_count" {
+				value = float64(m.GetSummary().GetSampleCount())
+			}
+		default:
+			continue
+		}
+		out = append(out, sample{labels: labels, value: value})
+	}
+	return out
+}
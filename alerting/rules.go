@@ -0,0 +1,160 @@
+// Package alerting evaluates simple threshold rules against the aggregate and
+// notifies a webhook or Alertmanager, for edge deployments without a
+// Prometheus nearby to evaluate rules
+package alerting
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultEvaluationInterval = model.Duration(30 * time.Second)
+
+type Config struct {
+	EvaluationInterval model.Duration `yaml:"evaluation_interval"`
+	// AlertmanagerURL is the base URL of an Alertmanager, alerts are posted
+	// to its /api/v2/alerts
+	AlertmanagerURL string `yaml:"alertmanager_url"`
+	// WebhookURL receives the alerts starting and stopping to fire, in the
+	// Alertmanager webhook format
+	WebhookURL string  `yaml:"webhook_url"`
+	Rules      []*Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	Alert string `yaml:"alert"`
+	// Metric is a counter, gauge or untyped family, or a histogram or summary
+	// family suffixed with _sum or _count
+	Metric string `yaml:"metric"`
+	// Match restricts the rule to the series with these label values
+	Match     map[string]string `yaml:"match"`
+	Op        string            `yaml:"op"`
+	Threshold float64           `yaml:"threshold"`
+	// For is how long the threshold must be crossed before the alert fires
+	For         model.Duration    `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	annotations map[string]*template.Template
+}
+
+// LoadConfig reads an alerting rules file
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("parsing alerting rules %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid alerting rules %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.EvaluationInterval == 0 {
+		c.EvaluationInterval = defaultEvaluationInterval
+	}
+	if c.AlertmanagerURL == "" && c.WebhookURL == "" {
+		return fmt.Errorf("alertmanager_url or webhook_url must be set")
+	}
+	c.AlertmanagerURL = strings.TrimSuffix(c.AlertmanagerURL, "/")
+
+	for i, rule := range c.Rules {
+		if rule.Alert == "" || rule.Metric == "" {
+			return fmt.Errorf("rule %d: alert and metric must be set", i+1)
+		}
+		if _, ok := comparisons[rule.Op]; !ok {
+			return fmt.Errorf("rule %s: unknown op %q", rule.Alert, rule.Op)
+		}
+
+		rule.annotations = map[string]*template.Template{}
+		for name, text := range rule.Annotations {
+			// the variables Prometheus alerting rules templates have
+			tmpl, err := template.New(name).Option("missingkey=zero").Parse("{{$labels := .Labels}}{{$value := .Value}}" + text)
+			if err != nil {
+				return fmt.Errorf("rule %s: annotation %s: %w", rule.Alert, name, err)
+			}
+			rule.annotations[name] = tmpl
+		}
+	}
+	return nil
+}
+
+var comparisons = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+func (r *Rule) matches(labels map[string]string) bool {
+	for name, value := range r.Match {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// alertLabels are the series labels, with the rule's labels and alertname on top
+func (r *Rule) alertLabels(series map[string]string) map[string]string {
+	labels := make(map[string]string, len(series)+len(r.Labels)+1)
+	for name, value := range series {
+		labels[name] = value
+	}
+	for name, value := range r.Labels {
+		labels[name] = value
+	}
+	labels[model.AlertNameLabel] = r.Alert
+	return labels
+}
+
+func (r *Rule) expandAnnotations(labels map[string]string, value float64) map[string]string {
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{labels, value}
+
+	annotations := make(map[string]string, len(r.annotations))
+	for name, tmpl := range r.annotations {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			b.Reset()
+			b.WriteString(r.Annotations[name])
+		}
+		annotations[name] = b.String()
+	}
+	return annotations
+}
+
+// fingerprint identifies an alert by its labels
+func fingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+// Package bench generates push load against a running gateway
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// URL pushes are sent to, including any label path
+	URL         string
+	Families    int
+	Series      int
+	Concurrency int
+	// Duration the load runs for, unless Requests is set
+	Duration time.Duration
+	// Requests is the total number of pushes to send, 0 runs for Duration instead
+	Requests int
+	User     string
+	Password string
+}
+
+type Result struct {
+	Requests  int
+	Errors    int
+	Series    int
+	Elapsed   time.Duration
+	latencies []time.Duration
+}
+
+// Payload renders the synthetic push body: Families counters of Series series each
+func Payload(families, series int) []byte {
+	var b bytes.Buffer
+	for f := 0; f < families; f++ {
+		fmt.Fprintf(&b, "# TYPE pag_bench_family_%d counter\n", f)
+		for s := 0; s < series; s++ {
+			fmt.Fprintf(&b, "pag_bench_family_%d{series=\"%d\"} 1\n", f, s)
+		}
+	}
+	return b.Bytes()
+}
+
+// Run pushes the synthetic payload from cfg.Concurrency workers until the
+// duration or request count is reached, or ctx is done
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	if cfg.Concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1, got %d", cfg.Concurrency)
+	}
+	if cfg.Requests <= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	payload := Payload(cfg.Families, cfg.Series)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency}}
+
+	var (
+		lock     sync.Mutex
+		result   = &Result{}
+		wg       sync.WaitGroup
+		requests = make(chan struct{})
+	)
+	go func() {
+		defer close(requests)
+		for n := 0; cfg.Requests <= 0 || n < cfg.Requests; n++ {
+			select {
+			case requests <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	wg.Add(cfg.Concurrency)
+	for w := 0; w < cfg.Concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			var latencies []time.Duration
+			errs := 0
+			for range requests {
+				began := time.Now()
+				if err := push(ctx, client, cfg, payload); err != nil {
+					if ctx.Err() != nil {
+						// cut short by the end of the run, not a gateway error
+						break
+					}
+					errs++
+				}
+				latencies = append(latencies, time.Since(began))
+			}
+
+			lock.Lock()
+			result.latencies = append(result.latencies, latencies...)
+			result.Errors += errs
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	result.Requests = len(result.latencies)
+	result.Series = cfg.Families * cfg.Series
+	slices.Sort(result.latencies)
+	return result, nil
+}
+
+func push(ctx context.Context, client *http.Client, cfg Config, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if cfg.User != "" {
+		req.SetBasicAuth(cfg.User, cfg.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Percentile returns the latency under which p percent of the pushes completed
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(r.latencies))*p/100+0.5) - 1
+	return r.latencies[min(max(idx, 0), len(r.latencies)-1)]
+}
+
+func (r *Result) String() string {
+	var b strings.Builder
+	seconds := r.Elapsed.Seconds()
+	fmt.Fprintf(&b, "pushes:     %d (%d errors) in %s\n", r.Requests, r.Errors, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput: %.1f pushes/s, %.0f series/s\n", float64(r.Requests)/seconds, float64(r.Requests*r.Series)/seconds)
+	fmt.Fprintf(&b, "latency:    p50 %s  p90 %s  p99 %s  max %s\n",
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package bench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	var pushes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if user != "user" || password != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		pushes.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	cfg := Config{URL: srv.URL, Families: 2, Series: 3, Concurrency: 3, Requests: 20, User: "user", Password: "password"}
+	result, err := Run(context.Background(), cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 20, result.Requests)
+	assert.Equal(t, 0, result.Errors)
+	assert.EqualValues(t, 20, pushes.Load())
+	assert.LessOrEqual(t, result.Percentile(50), result.Percentile(100))
+
+	cfg.Password = "wrong"
+	cfg.Requests = 0
+	cfg.Duration = 50 * time.Millisecond
+	result, err = Run(context.Background(), cfg)
+	require.NoError(t, err)
+	assert.Positive(t, result.Requests)
+	assert.Equal(t, result.Requests, result.Errors)
+}
+
+func TestPayload(t *testing.T) {
+	payload := string(Payload(2, 2))
+	assert.Equal(t, 2, strings.Count(payload, "# TYPE"))
+	assert.Contains(t, payload, "pag_bench_family_1{series=\"1\"} 1\n")
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/zapier/prom-aggregation-gateway/bench"
+)
+
+var benchCfg = bench.Config{}
+
+func init() {
+	benchCmd.Flags().StringVar(&benchCfg.URL, "url", "http://localhost:80/metrics/job/pag_bench", "URL to push the synthetic payloads to.")
+	benchCmd.Flags().IntVar(&benchCfg.Families, "families", 10, "Number of metric families in each push.")
+	benchCmd.Flags().IntVar(&benchCfg.Series, "series", 100, "Number of series in each family.")
+	benchCmd.Flags().IntVar(&benchCfg.Concurrency, "concurrency", 4, "Number of concurrent pushers.")
+	benchCmd.Flags().DurationVar(&benchCfg.Duration, "duration", 10*time.Second, "How long to push for.")
+	benchCmd.Flags().IntVar(&benchCfg.Requests, "requests", 0, "Stop after this many pushes instead of after --duration. 0 runs for --duration.")
+	benchCmd.Flags().StringVar(&benchCfg.User, "user", "", "Basic auth user to push as.")
+	benchCmd.Flags().StringVar(&benchCfg.Password, "password", "", "Basic auth password to push with.")
+
+	rootCmd.AddCommand(benchCmd)
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "pushes synthetic load against a gateway",
+	Long:  `Pushes synthetic payloads against a running gateway and reports throughput and latency percentiles`,
+	RunE:  benchFunc,
+}
+
+func benchFunc(cmd *cobra.Command, args []string) error {
+	result, err := bench.Run(cmd.Context(), benchCfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(cmd.OutOrStdout(), result.String())
+	return nil
+}
@@ -1,8 +1,30 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
 	"github.com/spf13/cobra"
+	"github.com/zapier/prom-aggregation-gateway/alerting"
+	"github.com/zapier/prom-aggregation-gateway/config"
+	"github.com/zapier/prom-aggregation-gateway/consul"
+	"github.com/zapier/prom-aggregation-gateway/graphite"
+	"github.com/zapier/prom-aggregation-gateway/handoff"
+	"github.com/zapier/prom-aggregation-gateway/hook"
+	"github.com/zapier/prom-aggregation-gateway/lambda"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+	"github.com/zapier/prom-aggregation-gateway/pkg/aggregation"
 	"github.com/zapier/prom-aggregation-gateway/routers"
+	"github.com/zapier/prom-aggregation-gateway/scrape"
+	"github.com/zapier/prom-aggregation-gateway/wasm"
 )
 
 func init() {
@@ -17,13 +39,465 @@ var startCmd = &cobra.Command{
 }
 
 func startFunc(cmd *cobra.Command, args []string) error {
+	if cfg.Router != routers.GinRouter && cfg.Router != routers.StdlibRouter {
+		return fmt.Errorf("unknown router %q, must be %q or %q", cfg.Router, routers.GinRouter, routers.StdlibRouter)
+	}
+	if cfg.FlushFormat != metrics.FlushPush && cfg.FlushFormat != metrics.FlushRemoteWrite {
+		return fmt.Errorf("unknown flush format %q, must be %q or %q", cfg.FlushFormat, metrics.FlushPush, metrics.FlushRemoteWrite)
+	}
+	if cfg.GraphiteAddress != "" && cfg.GraphiteInterval <= 0 {
+		return fmt.Errorf("invalid graphiteInterval %s, must be positive", cfg.GraphiteInterval)
+	}
+	switch cfg.RenderTimestamps {
+	case "", metrics.TimestampsPush, metrics.TimestampsAggregation:
+	default:
+		return fmt.Errorf("unknown render timestamps %q, must be %q or %q", cfg.RenderTimestamps, metrics.TimestampsPush, metrics.TimestampsAggregation)
+	}
+	if cfg.HistorySize > 0 && cfg.HistoryInterval <= 0 {
+		return fmt.Errorf("invalid historyInterval %s, must be positive", cfg.HistoryInterval)
+	}
+	if cfg.QuarantineFailures > 0 && cfg.QuarantineDuration <= 0 {
+		return fmt.Errorf("invalid quarantineDuration %s, must be positive", cfg.QuarantineDuration)
+	}
+	if cfg.NativeHistograms && (cfg.NativeHistogramSchema < metrics.MinNativeHistogramSchema || cfg.NativeHistogramSchema > metrics.MaxNativeHistogramSchema) {
+		return fmt.Errorf("invalid nativeHistogramSchema %d, must be between %d and %d", cfg.NativeHistogramSchema, metrics.MinNativeHistogramSchema, metrics.MaxNativeHistogramSchema)
+	}
+
+	if cfg.PersistFile != "" && cfg.PersistInterval <= 0 {
+		return fmt.Errorf("invalid persistInterval %s, must be positive", cfg.PersistInterval)
+	}
+	if cfg.RestoreTTL != metrics.RestoreResetTTL && cfg.RestoreTTL != metrics.RestoreHonorTTL {
+		return fmt.Errorf("unknown restoreTTL %q, must be %q or %q", cfg.RestoreTTL, metrics.RestoreResetTTL, metrics.RestoreHonorTTL)
+	}
+	if cfg.RealIPHeader != metrics.RealIPForwardedFor && cfg.RealIPHeader != metrics.RealIPHeader {
+		return fmt.Errorf("unknown realIPHeader %q, must be %q or %q", cfg.RealIPHeader, metrics.RealIPForwardedFor, metrics.RealIPHeader)
+	}
+	trustedProxies, err := metrics.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if cfg.BootstrapFrom != "" && cfg.ReplicaOf != "" {
+		return errors.New("bootstrapFrom and replicaOf are exclusive, a replica mirrors its primary already")
+	}
+	if cfg.CounterJumpFactor != 0 && cfg.CounterJumpFactor <= 1 {
+		return fmt.Errorf("invalid counterJumpFactor %g, must be greater than 1", cfg.CounterJumpFactor)
+	}
+	if cfg.CounterJumpWebhook != "" && cfg.CounterJumpFactor == 0 {
+		return errors.New("counterJumpWebhook requires counterJumpFactor")
+	}
+	if cfg.PushAnomalyFactor != 0 && cfg.PushAnomalyFactor <= 1 {
+		return fmt.Errorf("invalid pushAnomalyFactor %g, must be greater than 1", cfg.PushAnomalyFactor)
+	}
+	if cfg.PushAnomalyWebhook != "" && cfg.PushAnomalyFactor == 0 {
+		return errors.New("pushAnomalyWebhook requires pushAnomalyFactor")
+	}
+	if cfg.ScrapeReceipts < 0 {
+		return fmt.Errorf("invalid scrapeReceipts %s, must not be negative", cfg.ScrapeReceipts)
+	}
+	if cfg.ScrapeReceiptWebhook != "" && cfg.ScrapeReceipts == 0 {
+		return errors.New("scrapeReceiptWebhook requires scrapeReceipts")
+	}
+	if cfg.ErrorFormat != metrics.ErrorFormatText && cfg.ErrorFormat != metrics.ErrorFormatJSON {
+		return fmt.Errorf("unknown errorFormat %q, must be %q or %q", cfg.ErrorFormat, metrics.ErrorFormatText, metrics.ErrorFormatJSON)
+	}
+	if cfg.DuplicateSeries != metrics.DuplicateSeriesReject && cfg.DuplicateSeries != metrics.DuplicateSeriesMerge {
+		return fmt.Errorf("unknown duplicateSeries %q, must be %q or %q", cfg.DuplicateSeries, metrics.DuplicateSeriesReject, metrics.DuplicateSeriesMerge)
+	}
+	if cfg.MaxRenderSeriesMode != metrics.SeriesLimitTruncate && cfg.MaxRenderSeriesMode != metrics.SeriesLimitSplit {
+		return fmt.Errorf("unknown maxRenderSeriesMode %q, must be %q or %q", cfg.MaxRenderSeriesMode, metrics.SeriesLimitTruncate, metrics.SeriesLimitSplit)
+	}
 
 	apiCfg := routers.ApiRouterConfig{
-		CorsDomain: cfg.CorsDomain,
-		Accounts:   cfg.AuthUsers,
+		CorsDomain:  cfg.CorsDomain,
+		Accounts:    cfg.AuthUsers,
+		MaxBodySize: cfg.MaxBodySize,
+		GzipIngest:  cfg.GzipIngest,
+		Router:      cfg.Router,
+		ReadSocket:  cfg.ReadSocket,
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		apiCfg.MaxConcurrentRequests = cfg.MaxConcurrentRequests
+		apiCfg.RequestQueueTimeout = cfg.RequestQueueTimeout
+		var err error
+		if apiCfg.RoutePriorities, err = aggregation.ParsePriorities(cfg.RoutePriorities); err != nil {
+			return err
+		}
+		if apiCfg.UserPriorities, err = aggregation.ParsePriorities(cfg.UserPriorities); err != nil {
+			return err
+		}
+	}
+	if cfg.Listeners != "" {
+		listeners, err := routers.LoadListeners(cfg.Listeners)
+		if err != nil {
+			return err
+		}
+		apiCfg.Listeners = listeners
+	}
+	if cfg.ApiListen == "" && len(apiCfg.Listeners) == 0 {
+		return fmt.Errorf("apiListen is empty, and no --listeners were given")
+	}
+	if cfg.LifecycleListen == "" {
+		return errors.New("lifecycleListen is empty, the lifecycle server must listen somewhere")
+	}
+
+	var honorLabels *bool
+	if cfg.HonorLabels != "" {
+		honor, err := strconv.ParseBool(cfg.HonorLabels)
+		if err != nil {
+			return fmt.Errorf("invalid honorLabels %q, must be true or false", cfg.HonorLabels)
+		}
+		honorLabels = &honor
+	}
+
+	var rollupRules []metrics.RollupRule
+	if cfg.RollupRules != "" {
+		var err error
+		if rollupRules, err = metrics.LoadRollupRules(cfg.RollupRules); err != nil {
+			return err
+		}
+	}
+
+	var metadataOverrides *metrics.MetadataOverrides
+	if cfg.MetadataOverrides != "" {
+		var err error
+		if metadataOverrides, err = metrics.LoadMetadataOverrides(cfg.MetadataOverrides); err != nil {
+			return err
+		}
+	}
+
+	var splitRules []metrics.SplitRule
+	if cfg.SplitRules != "" {
+		var err error
+		if splitRules, err = metrics.LoadSplitRules(cfg.SplitRules); err != nil {
+			return err
+		}
+	}
+
+	var subAggregates []metrics.SubAggregate
+	if cfg.SubAggregates != "" {
+		var err error
+		if subAggregates, err = metrics.LoadSubAggregates(cfg.SubAggregates); err != nil {
+			return err
+		}
+	}
+
+	var schema *metrics.Schema
+	if cfg.MetricSchema != "" {
+		var err error
+		if schema, err = metrics.LoadSchema(cfg.MetricSchema); err != nil {
+			return err
+		}
+	}
+
+	var ingestHooks []*hook.Hook
+	if cfg.IngestHooks != "" {
+		var err error
+		if ingestHooks, err = hook.Load(cfg.IngestHooks); err != nil {
+			return err
+		}
+	}
+
+	var persistKeys *metrics.SnapshotKeys
+	if cfg.PersistKeys != "" {
+		var err error
+		if persistKeys, err = metrics.LoadSnapshotKeys(cfg.PersistKeys); err != nil {
+			return err
+		}
+	}
+
+	var wasmFilters []*wasm.Filter
+	for _, path := range cfg.WASMFilters {
+		filter, err := wasm.Load(context.Background(), path)
+		if err != nil {
+			return err
+		}
+		defer filter.Close(context.Background())
+		wasmFilters = append(wasmFilters, filter)
+	}
+
+	mergeStrategies, err := mergeStrategyOptions("mergeStrategies", cfg.MergeStrategies)
+	if err != nil {
+		return err
+	}
+	shadowOpts, err := mergeStrategyOptions("shadowMergeStrategies", cfg.ShadowMergeStrategies)
+	if err != nil {
+		return err
+	}
+	if cfg.ShadowRollupRules != "" {
+		shadowRules, err := metrics.LoadRollupRules(cfg.ShadowRollupRules)
+		if err != nil {
+			return err
+		}
+		shadowOpts = append(shadowOpts, metrics.SetRollupRules(shadowRules))
+	}
+	if cfg.ShadowHonorLabels != "" {
+		honor, err := strconv.ParseBool(cfg.ShadowHonorLabels)
+		if err != nil {
+			return fmt.Errorf("invalid shadowHonorLabels %q, must be true or false", cfg.ShadowHonorLabels)
+		}
+		shadowOpts = append(shadowOpts, metrics.SetHonorLabels(&honor))
+	}
+
+	maxLabelValues := make(map[string]int, len(cfg.MaxLabelValues))
+	for _, limit := range cfg.MaxLabelValues {
+		name, value, _ := strings.Cut(limit, "=")
+		count, err := strconv.Atoi(value)
+		if name == "" || err != nil || count <= 0 {
+			return fmt.Errorf("invalid maxLabelValues %q, must be <label>=<positive count>", limit)
+		}
+		maxLabelValues[name] = count
+	}
+
+	var labelAllowlists map[string][]string
+	if cfg.LabelAllowlists != "" {
+		var err error
+		if labelAllowlists, err = metrics.LoadLabelAllowlists(cfg.LabelAllowlists); err != nil {
+			return err
+		}
+		// allowlists are of verified users, without auth a push could claim any
+		if len(cfg.AuthUsers) == 0 {
+			return fmt.Errorf("labelAllowlists requires AuthUsers, pushes are only checked against the allowlist of the user they authenticated as")
+		}
+		for _, l := range apiCfg.Listeners {
+			if l.AuthUsers != nil && len(*l.AuthUsers) == 0 {
+				return fmt.Errorf("labelAllowlists requires auth users on listener %s", l.Address)
+			}
+		}
+	}
+
+	var localPushLabels map[string]string
+	if cfg.K8sSidecar {
+		localPushLabels = config.DownwardAPILabels()
+	}
+
+	var storage metrics.Storage
+	if cfg.SpillDir != "" {
+		var err error
+		if storage, err = metrics.NewDiskStorage(cfg.SpillDir, cfg.HotBytes); err != nil {
+			return fmt.Errorf("invalid spillDir %s: %w", cfg.SpillDir, err)
+		}
+	}
+
+	aggOpts := []metrics.Option{
+		metrics.SetTTLMetricTime(&cfg.MetricTTL),
+		metrics.SetScrapeTTL(cfg.ScrapeTTL),
+		metrics.SetTombstoneTTL(cfg.TombstoneTTL),
+		metrics.SetAsyncIngest(cfg.AsyncWorkers, cfg.AsyncQueueSize),
+		metrics.SetMaxConcurrentPushes(cfg.MaxInFlight),
+		metrics.SetPushDeadline(cfg.PushDeadline),
+		metrics.SetMemoryBudget(cfg.MemoryBudget),
+		metrics.SetOpenMetrics(cfg.OpenMetrics),
+		metrics.SetLoadShedding(cfg.ShedHeapBytes),
+		metrics.SetStreamingRender(cfg.RenderFlush, cfg.RenderTimeout),
+		metrics.SetReplicaOf(cfg.ReplicaOf, cfg.ReplicaInterval),
+		metrics.SetLocalPushLabels(localPushLabels),
+		metrics.SetHonorLabels(honorLabels),
+		metrics.SetRollupRules(rollupRules),
+		metrics.SetSplitRules(splitRules),
+		metrics.SetMetadataOverrides(metadataOverrides),
+		metrics.SetHistory(cfg.HistorySize, cfg.HistoryInterval),
+		metrics.SetRenderTimestamps(cfg.RenderTimestamps),
+		metrics.SetIdempotencyWindow(cfg.IdempotencyWindow),
+		metrics.SetTenantLabel(cfg.TenantLabel),
+		metrics.SetUpstream(cfg.Upstream, cfg.OwnedTenants, cfg.OwnedPaths),
+		metrics.SetSchema(schema),
+		metrics.SetMaxLabelValues(maxLabelValues),
+		metrics.SetLabelAllowlists(labelAllowlists),
+		metrics.SetPushLog(cfg.PushLogSize, cfg.PushLogBytes, cfg.RedactLabels),
+		metrics.SetIngestHooks(ingestHooks),
+		metrics.SetWASMFilters(wasmFilters),
+		metrics.SetPusherUp(cfg.PusherUp),
+		metrics.SetUsageAccounting(cfg.UsageAccounting),
+		metrics.SetQuarantine(cfg.QuarantineFailures, cfg.QuarantineDuration),
+		metrics.SetNativeHistograms(cfg.NativeHistograms, cfg.NativeHistogramSchema),
+		metrics.SetMaxRenderSeries(cfg.MaxRenderSeries, cfg.MaxRenderSeriesMode),
+		metrics.SetIgnoreLabelsAtRender(cfg.IgnoreLabelsAtRender),
+		metrics.SetDuplicateSeries(cfg.DuplicateSeries),
+		metrics.SetGaugeSpread(cfg.GaugeSpread),
+		metrics.SetErrorFormat(cfg.ErrorFormat),
+		metrics.SetTrustedProxies(trustedProxies, cfg.RealIPHeader),
+		metrics.SetFamilyInventory(cfg.FamilyInventory || cfg.NewFamilyWebhook != "", cfg.NewFamilyWebhook),
+		metrics.SetCounterJumpGuard(cfg.CounterJumpFactor, cfg.CounterJumpWebhook),
+		metrics.SetPushAnomalies(cfg.PushAnomalyFactor, cfg.PushAnomalyWebhook),
+		metrics.SetScrapeReceipts(cfg.ScrapeReceipts, cfg.ScrapeReceiptWebhook),
+		metrics.SetPersistence(cfg.PersistFile, cfg.PersistInterval, persistKeys),
+		metrics.SetRestoreTTL(cfg.RestoreTTL),
+		metrics.SetShadow(shadowOpts...),
+		metrics.SetSubAggregates(subAggregates),
+	}
+	if storage != nil {
+		aggOpts = append(aggOpts, metrics.SetStorage(storage))
+	}
+	agg := metrics.NewAggregate(append(aggOpts, mergeStrategies...)...)
+	// not closed on failure, that would overwrite the snapshot it couldn't
+	// read. Restored before taking over to fail while the previous gateway
+	// still serves, the handed off state replacing it.
+	if err := agg.Restore(); err != nil {
+		return err
+	}
+
+	var scrapeCfg *scrape.Config
+	if cfg.ScrapeConfig != "" {
+		var err error
+		if scrapeCfg, err = scrape.LoadConfig(cfg.ScrapeConfig); err != nil {
+			return err
+		}
+	}
+
+	var alertCfg *alerting.Config
+	if cfg.AlertRules != "" {
+		var err error
+		if alertCfg, err = alerting.LoadConfig(cfg.AlertRules); err != nil {
+			return err
+		}
 	}
 
-	routers.RunServers(apiCfg, cfg.ApiListen, cfg.LifecycleListen)
+	// the platform's deadline for the shutdown flush, if it gives one
+	shutdownDeadline := make(chan time.Time, 1)
+	if cfg.LambdaExtension {
+		ext, err := lambda.Register(os.Getenv(lambda.RuntimeAPIEnv))
+		if err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		apiCfg.Stop = stop
+		go func() {
+			defer close(stop)
+			deadline, err := ext.WaitForShutdown()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			shutdownDeadline <- deadline
+		}()
+	}
+
+	var handoffServer *handoff.Server
+	if cfg.HandoffSocket != "" {
+		var err error
+		if handoffServer, err = handoff.Listen(cfg.HandoffSocket); err != nil {
+			return fmt.Errorf("invalid handoffSocket %s: %w", cfg.HandoffSocket, err)
+		}
+		defer handoffServer.Close()
+	}
+
+	// until the previous gateway, if any, hands off, the registration may
+	// be its own
+	handedOff := cfg.HandoffSocket != ""
+	if cfg.ConsulAddr != "" {
+		registration, err := consul.Register(consul.Config{
+			AgentURL:        cfg.ConsulAddr,
+			Token:           cfg.ConsulToken,
+			ServiceName:     cfg.ConsulServiceName,
+			ServiceAddress:  cfg.ConsulServiceAddress,
+			ApiListen:       cfg.ApiListen,
+			LifecycleListen: cfg.LifecycleListen,
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// the next gateway registered already
+			if handedOff {
+				return
+			}
+			if err := registration.Deregister(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// from here on, the previous gateway has stopped serving, and nothing
+	// may fail anymore
+	if cfg.HandoffSocket != "" {
+		transfer, err := handoff.Request(cfg.HandoffSocket)
+		if err != nil {
+			return fmt.Errorf("could not take over from the gateway at %s: %w", cfg.HandoffSocket, err)
+		}
+		handedOff = false
+		if transfer != nil {
+			apiCfg.Inherited = transfer.Listeners
+			if err := agg.RestoreHandoff(transfer.State); err == nil {
+				log.Printf("Took over %d listeners and the aggregate from the previous gateway\n", len(transfer.Listeners))
+			} else if restoreErr := agg.Restore(); restoreErr == nil {
+				// the previous gateway wrote its final snapshot
+				log.Printf("Could not restore the handed off aggregate, restored the snapshot instead: %s\n", err.Error())
+			} else {
+				log.Printf("Could not restore the handed off aggregate, nor the snapshot, serving the snapshot restored on start: %s, %s\n", err.Error(), restoreErr.Error())
+			}
+		}
+		if err := handoffServer.Serve(); err != nil {
+			log.Printf("Could not serve handoffs at %s, the next gateway will start without one: %s\n", cfg.HandoffSocket, err.Error())
+		} else {
+			apiCfg.Handoff = handoffServer
+		}
+	}
+	if cfg.BootstrapFrom != "" {
+		from := cfg.BootstrapFrom
+		if u, err := url.Parse(from); err == nil {
+			from = u.Redacted()
+		}
+		// the gateway being replaced may be gone already, start without it
+		if seeded, err := agg.Bootstrap(cfg.BootstrapFrom); err != nil {
+			log.Printf("Could not bootstrap from %s: %s\n", from, err.Error())
+		} else {
+			log.Printf("Seeded %d metric families from %s\n", seeded, from)
+		}
+	}
+
+	var scraper *scrape.Scraper
+	if scrapeCfg != nil {
+		scraper = scrape.Start(scrapeCfg, agg)
+	}
+
+	if alertCfg != nil {
+		evaluator := alerting.NewEvaluator(alertCfg, agg)
+		evaluator.Start()
+		defer evaluator.Stop()
+	}
+
+	if cfg.GraphiteAddress != "" {
+		pusher := graphite.Start(cfg.GraphiteAddress, cfg.GraphitePrefix, cfg.GraphiteInterval, agg)
+		defer pusher.Stop()
+	}
+
+	handedOff = routers.RunServers(apiCfg, agg, cfg.ApiListen, cfg.LifecycleListen)
+
+	if scraper != nil {
+		scraper.Stop()
+	}
+
+	// the next gateway has the aggregate, flushing it would count it twice
+	if cfg.FlushTo != "" && !handedOff {
+		deadline := time.Now().Add(cfg.FlushTimeout)
+		select {
+		case deadline = <-shutdownDeadline:
+		default:
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := agg.Flush(ctx, cfg.FlushTo, cfg.FlushFormat); err != nil {
+			log.Printf("Could not flush metrics to %s: %s\n", cfg.FlushTo, err.Error())
+		}
+	}
 
 	return nil
 }
+
+// mergeStrategyOptions parses <type>=<strategy> flag values
+func mergeStrategyOptions(flagName string, values []string) ([]metrics.Option, error) {
+	var opts []metrics.Option
+	for _, value := range values {
+		typeName, strategyName, _ := strings.Cut(value, "=")
+		ty, ok := dto.MetricType_value[strings.ToUpper(typeName)]
+		if !ok {
+			return nil, fmt.Errorf("invalid %s %q, must be <type>=<strategy> with one of the metric types", flagName, value)
+		}
+		strategy, err := metrics.MergeStrategyByName(strategyName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", flagName, value, err)
+		}
+		opts = append(opts, metrics.SetMergeStrategy(dto.MetricType(ty), strategy))
+	}
+	return opts, nil
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -18,8 +19,123 @@ var (
 type Server struct {
 	ApiListen       string
 	LifecycleListen string
+	Listeners       string
+	TrustedProxies  []string
+	RealIPHeader    string
 	CorsDomain      string
 	AuthUsers       []string
+	MetricTTL       time.Duration
+	ScrapeTTL       int
+	TombstoneTTL    time.Duration
+	MaxBodySize     int64
+	GzipIngest      bool
+	Profile         string
+	AsyncWorkers    int
+	AsyncQueueSize  int
+	MaxInFlight     int
+
+	MaxConcurrentRequests int
+	RequestQueueTimeout   time.Duration
+	RoutePriorities       []string
+	UserPriorities        []string
+	PushDeadline          time.Duration
+	Router                string
+	MemoryBudget          int64
+	SpillDir              string
+	HandoffSocket         string
+	ReadSocket            string
+	HotBytes              int64
+	OpenMetrics           bool
+	ShedHeapBytes         int64
+	RenderFlush           int
+	RenderTimeout         time.Duration
+	ReplicaOf             string
+	ReplicaInterval       time.Duration
+	BootstrapFrom         string
+	K8sSidecar            bool
+
+	ConsulAddr           string
+	ConsulToken          string
+	ConsulServiceName    string
+	ConsulServiceAddress string
+
+	FlushTo         string
+	FlushFormat     string
+	FlushTimeout    time.Duration
+	LambdaExtension bool
+
+	ScrapeConfig      string
+	HonorLabels       string
+	RollupRules       string
+	SplitRules        string
+	MetadataOverrides string
+	SubAggregates     string
+	AlertRules        string
+
+	GraphiteAddress  string
+	GraphitePrefix   string
+	GraphiteInterval time.Duration
+
+	HistorySize     int
+	HistoryInterval time.Duration
+
+	RenderTimestamps  string
+	IdempotencyWindow time.Duration
+	TenantLabel       string
+
+	Upstream     string
+	OwnedTenants []string
+	OwnedPaths   []string
+
+	MetricSchema    string
+	MaxLabelValues  []string
+	LabelAllowlists string
+
+	PushLogSize  int
+	PushLogBytes int64
+	RedactLabels []string
+
+	ShadowRollupRules     string
+	ShadowHonorLabels     string
+	ShadowMergeStrategies []string
+
+	MergeStrategies []string
+	IngestHooks     string
+	WASMFilters     []string
+	PusherUp        bool
+	UsageAccounting bool
+
+	QuarantineFailures int
+	QuarantineDuration time.Duration
+
+	NativeHistograms      bool
+	NativeHistogramSchema int32
+
+	MaxRenderSeries     int
+	MaxRenderSeriesMode string
+
+	IgnoreLabelsAtRender bool
+	DuplicateSeries      string
+
+	FamilyInventory  bool
+	NewFamilyWebhook string
+
+	CounterJumpFactor  float64
+	CounterJumpWebhook string
+
+	PushAnomalyFactor  float64
+	PushAnomalyWebhook string
+
+	ScrapeReceipts       time.Duration
+	ScrapeReceiptWebhook string
+
+	PersistFile     string
+	PersistInterval time.Duration
+	PersistKeys     string
+	RestoreTTL      string
+
+	GaugeSpread bool
+	ErrorFormat string
 }
 
 const (
@@ -46,7 +162,13 @@ func Initialize(cmd *cobra.Command) error {
 	v.AutomaticEnv()
 	bindFlags(cmd, v)
 
-	return nil
+	profile, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		// this command doesn't support profiles
+		return nil
+	}
+
+	return applyProfile(cmd, profile)
 }
 
 func bindFlags(cmd *cobra.Command, v *viper.Viper) {
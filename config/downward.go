@@ -0,0 +1,23 @@
+package config
+
+import "os"
+
+// downwardAPIEnv maps the env vars a pod spec conventionally fills from the
+// downward API (fieldRef metadata.name, metadata.namespace, spec.nodeName)
+// to the label each one is attached as
+var downwardAPIEnv = map[string]string{
+	"POD_NAME":      "pod",
+	"POD_NAMESPACE": "namespace",
+	"NODE_NAME":     "node",
+}
+
+// DownwardAPILabels returns the pod identity labels found in the environment
+func DownwardAPILabels() map[string]string {
+	labels := map[string]string{}
+	for env, label := range downwardAPIEnv {
+		if value := os.Getenv(env); value != "" {
+			labels[label] = value
+		}
+	}
+	return labels
+}
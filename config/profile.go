@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// profiles are presets of flag values tuned for a common deployment shape.
+// A profile only fills in flags the user hasn't set by CLI, env or config file.
+var profiles = map[string]map[string]string{
+	// serverless is tuned for thousands of short-lived pushers such as
+	// Lambda or Cloud Functions that push once right before they exit.
+	"serverless": {
+		"metricTTL":   "5m",
+		"gzipIngest":  "true",
+		"maxBodySize": "1048576",
+	},
+}
+
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func applyProfile(cmd *cobra.Command, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	preset, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, must be one of: %s", name, strings.Join(ProfileNames(), ", "))
+	}
+
+	for flagName, value := range preset {
+		f := cmd.Flags().Lookup(flagName)
+		if f == nil || f.Changed {
+			continue
+		}
+		if err := cmd.Flags().Set(flagName, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Package consul registers the gateway in a Consul agent through its HTTP
+// API, for Prometheus setups discovering scrape targets with consul_sd
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// deregisterCriticalAfter lets Consul drop registrations of gateways that
+// died without deregistering
+const deregisterCriticalAfter = "10m"
+
+type Config struct {
+	// AgentURL of the Consul agent API, e.g. http://localhost:8500
+	AgentURL string
+	// Token is the ACL token sent to the agent, if any
+	Token string
+	// ServiceName the gateway is registered as
+	ServiceName string
+	// ServiceAddress advertised to Consul, empty uses the agent's node address
+	ServiceAddress string
+	// ApiListen and LifecycleListen are the gateway's listen addresses, the
+	// ports are taken from them
+	ApiListen       string
+	LifecycleListen string
+}
+
+type Registration struct {
+	cfg    Config
+	id     string
+	client *http.Client
+}
+
+type agentService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   agentCheck        `json:"Check"`
+}
+
+type agentCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// Register registers the API port as the service, with the lifecycle port
+// in its metadata and its health endpoint as the service check
+func Register(cfg Config) (*Registration, error) {
+	apiPort, err := listenPort(cfg.ApiListen)
+	if err != nil {
+		return nil, err
+	}
+	lifecyclePort, err := listenPort(cfg.LifecycleListen)
+	if err != nil {
+		return nil, err
+	}
+
+	checkHost := cfg.ServiceAddress
+	if checkHost == "" {
+		// the check runs on the agent, which usually shares the node
+		checkHost = "127.0.0.1"
+	}
+
+	r := &Registration{
+		cfg:    cfg,
+		id:     fmt.Sprintf("%s-%s-%d", cfg.ServiceName, hostname(), apiPort),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	service := agentService{
+		ID:      r.id,
+		Name:    cfg.ServiceName,
+		Address: cfg.ServiceAddress,
+		Port:    apiPort,
+		Meta:    map[string]string{"lifecycle_port": strconv.Itoa(lifecyclePort)},
+		Check: agentCheck{
+			HTTP:                           "http://" + net.JoinHostPort(checkHost, strconv.Itoa(lifecyclePort)) + "/healthy",
+			Interval:                       "10s",
+			Timeout:                        "2s",
+			DeregisterCriticalServiceAfter: deregisterCriticalAfter,
+		},
+	}
+
+	body, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.put("/v1/agent/service/register", body); err != nil {
+		return nil, fmt.Errorf("registering in consul: %w", err)
+	}
+	return r, nil
+}
+
+// Deregister removes the registration from the agent
+func (r *Registration) Deregister() error {
+	if err := r.put("/v1/agent/service/deregister/"+url.PathEscape(r.id), nil); err != nil {
+		return fmt.Errorf("deregistering from consul: %w", err)
+	}
+	return nil
+}
+
+func (r *Registration) put(path string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, r.cfg.AgentURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", r.cfg.Token)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func listenPort(listen string) (int, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen address %q: %w", listen, err)
+	}
+	return strconv.Atoi(port)
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
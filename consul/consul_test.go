@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDeregister(t *testing.T) {
+	var (
+		registered   agentService
+		deregistered string
+	)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&registered))
+		default:
+			deregistered = r.URL.Path
+		}
+	}))
+	defer agent.Close()
+
+	reg, err := Register(Config{
+		AgentURL:        agent.URL,
+		Token:           "secret",
+		ServiceName:     "pag",
+		ServiceAddress:  "10.0.0.1",
+		ApiListen:       ":80",
+		LifecycleListen: "0.0.0.0:8888",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "pag", registered.Name)
+	assert.Equal(t, 80, registered.Port)
+	assert.Equal(t, "8888", registered.Meta["lifecycle_port"])
+	assert.Equal(t, "http://10.0.0.1:8888/healthy", registered.Check.HTTP)
+
+	require.NoError(t, reg.Deregister())
+	assert.Equal(t, "/v1/agent/service/deregister/"+registered.ID, deregistered)
+}
+
+func TestRegisterInvalidListen(t *testing.T) {
+	_, err := Register(Config{ApiListen: "80", LifecycleListen: ":8888"})
+	require.Error(t, err)
+}
@@ -0,0 +1,96 @@
+// Package graphite periodically sends the aggregate to a carbon endpoint in
+// the Graphite plaintext protocol
+package graphite
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+var Pushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: metrics.MetricsNamespace,
+		Name:      "graphite_pushes",
+		Help:      "Total number of pushes to the Graphite carbon endpoint, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+func init() {
+	metrics.PromRegistry.MustRegister(Pushes)
+}
+
+// dialTimeout bounds connecting to carbon, writing is bounded by the interval
+const dialTimeout = 5 * time.Second
+
+// Source writes the samples to push, the Aggregate implements it
+type Source interface {
+	WriteGraphite(w io.Writer, prefix string, now time.Time) error
+}
+
+type Pusher struct {
+	address  string
+	prefix   string
+	interval time.Duration
+	source   Source
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start pushes source to the carbon plaintext listener at address (host:port)
+// every interval, until Stop
+func Start(address, prefix string, interval time.Duration, source Source) *Pusher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pusher{address: address, prefix: prefix, interval: interval, source: source, cancel: cancel}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := p.Push(ctx, now); err != nil {
+					Pushes.WithLabelValues("error").Inc()
+					log.Printf("Could not push metrics to Graphite %s: %s\n", address, err.Error())
+				} else {
+					Pushes.WithLabelValues("ok").Inc()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *Pusher) Stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// Push sends the samples once, over a new connection
+func (p *Pusher) Push(ctx context.Context, now time.Time) error {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(p.interval)); err != nil {
+		return err
+	}
+	return p.source.WriteGraphite(conn, p.prefix, now)
+}
@@ -0,0 +1,49 @@
+package graphite
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+func TestPush(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		body, _ := io.ReadAll(conn)
+		received <- string(body)
+	}()
+
+	agg := metrics.NewAggregate()
+	defer agg.Close()
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(strings.NewReader("# TYPE jobs_total counter\njobs_total{queue=\"a b\",empty=\"\"} 4\n# TYPE depth gauge\ndepth NaN\n"))
+	require.NoError(t, err)
+	require.NoError(t, agg.MergeFamilies(families, map[string]string{"job": "batch"}, false))
+
+	p := &Pusher{address: listener.Addr().String(), prefix: "gateway.", interval: time.Second, source: agg}
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, p.Push(context.Background(), now))
+
+	select {
+	case body := <-received:
+		require.Equal(t, "gateway.jobs_total;job=batch;queue=a_b 4 1700000000\n", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("carbon received nothing")
+	}
+}
@@ -0,0 +1,256 @@
+// Package handoff passes the listeners and the aggregate of a running
+// gateway to the process replacing it over a local Unix socket, so binary
+// upgrades on bare metal neither refuse connections nor lose pushes: the
+// new process inherits the listening sockets, connections queue in their
+// backlog while the old process finishes its requests and hands its state
+// off, then the new process serves them.
+package handoff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Timeout bounds how long the new process waits for the old one to hand off
+const Timeout = 2 * time.Minute
+
+// maxListeners bounds the listeners one handoff passes, sizing the buffer
+// of their file descriptors
+const maxListeners = 64
+
+// Transfer is what the process being replaced handed off
+type Transfer struct {
+	// Listeners are the inherited listeners, by address
+	Listeners map[string]net.Listener
+	// State is the aggregate, for metrics.Aggregate.RestoreHandoff
+	State []byte
+}
+
+// Request asks the process listening on socket to hand off, returning nil
+// when there is none, e.g. on first start. Once Request returns, the old
+// process has stopped serving and closed its aggregate.
+func Request(socket string) (*Transfer, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socket, Net: "unix"})
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(Timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(4*maxListeners))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("receiving the listeners: %w", err)
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	transfer := &Transfer{Listeners: map[string]net.Listener{}}
+	fail := func(err error) (*Transfer, error) {
+		for _, file := range files {
+			file.Close()
+		}
+		for _, l := range transfer.Listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	r := io.MultiReader(bytes.NewReader(buf[:n]), conn)
+	header, err := readField(r)
+	if err != nil {
+		return fail(fmt.Errorf("receiving the listeners: %w", err))
+	}
+	var addresses []string
+	if err := json.Unmarshal(header, &addresses); err != nil || len(addresses) != len(files) {
+		return fail(fmt.Errorf("invalid listeners message, %d addresses for %d sockets", len(addresses), len(files)))
+	}
+	for i, file := range files {
+		l, err := net.FileListener(file)
+		file.Close()
+		files[i] = nil
+		if err != nil {
+			return fail(fmt.Errorf("inheriting the listener of %s: %w", addresses[i], err))
+		}
+		transfer.Listeners[addresses[i]] = l
+	}
+
+	if transfer.State, err = io.ReadAll(r); err != nil {
+		// serve the inherited listeners anyway, the state may be restored
+		// from a snapshot instead
+		log.Printf("Could not receive the handed off state: %s\n", err.Error())
+	}
+	return transfer, nil
+}
+
+func parseRights(oob []byte) ([]*os.File, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("receiving the listeners: %w", err)
+	}
+	var files []*os.File
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "inherited listener"))
+		}
+	}
+	return files, nil
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	field := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err := io.ReadFull(r, field)
+	return field, err
+}
+
+// Server waits for the next process to request a handoff
+type Server struct {
+	listener *net.UnixListener
+	requests chan *Handoff
+	// socket is where Serve moves next, the path the listener is bound to
+	socket string
+	next   string
+	served bool
+}
+
+// Listen binds the socket handoff requests are served on next to socket,
+// so it can be done before Request: the process handing off to this one
+// keeps socket until Serve moves this one in place
+func Listen(socket string) (*Server, error) {
+	next := socket + ".next"
+	if err := os.Remove(next); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// bound with the owner's permissions only, the aggregate being handed
+	// off over it. The umask is the process's, files created meanwhile are
+	// at most more restricted.
+	umask := syscall.Umask(0o177)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: next, Net: "unix"})
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	// the next process replaces the socket before this one closes it
+	listener.SetUnlinkOnClose(false)
+
+	s := &Server{listener: listener, requests: make(chan *Handoff), socket: socket, next: next}
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Could not accept a handoff request: %s\n", err.Error())
+				}
+				return
+			}
+			s.requests <- &Handoff{conn: conn}
+		}
+	}()
+	return s, nil
+}
+
+// Serve replaces the socket of the process that handed off to this one, if
+// any, the next process requesting its handoff from this one
+func (s *Server) Serve() error {
+	if err := os.Rename(s.next, s.socket); err != nil {
+		return err
+	}
+	s.served = true
+	return nil
+}
+
+// Requests are the handoffs the next processes request, one after another
+func (s *Server) Requests() <-chan *Handoff {
+	if s == nil {
+		return nil
+	}
+	return s.requests
+}
+
+// Close stops serving handoff requests
+func (s *Server) Close() error {
+	if s == nil {
+		return nil
+	}
+	if !s.served {
+		os.Remove(s.next)
+	}
+	return s.listener.Close()
+}
+
+// Handoff is a handoff to the next process. Once its listeners are sent,
+// the process stops serving, writes its state and closes the handoff.
+type Handoff struct {
+	conn *net.UnixConn
+}
+
+// SendListeners passes the listeners by address. They must be TCP or Unix
+// listeners, which the process keeps until it stops serving.
+func (h *Handoff) SendListeners(listeners map[string]net.Listener) error {
+	if len(listeners) > maxListeners {
+		return fmt.Errorf("%d listeners, at most %d can be handed off", len(listeners), maxListeners)
+	}
+	addresses := make([]string, 0, len(listeners))
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	fds := make([]int, 0, len(listeners))
+	for address, l := range listeners {
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("the listener of %s can't be handed off", address)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		addresses = append(addresses, address)
+		fds = append(fds, int(file.Fd()))
+	}
+
+	header, err := json.Marshal(addresses)
+	if err != nil {
+		return err
+	}
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(header)))
+	message = append(message, header...)
+	_, _, err = h.conn.WriteMsgUnix(message, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// Write sends the state, once the process stopped serving
+func (h *Handoff) Write(p []byte) (int, error) {
+	return h.conn.Write(p)
+}
+
+// Close completes the handoff, the next process then serving the listeners
+func (h *Handoff) Close() error {
+	return h.conn.Close()
+}
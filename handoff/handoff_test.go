@@ -0,0 +1,78 @@
+package handoff
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandoff(t *testing.T) {
+	// short, Unix socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "handoff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gateway.sock")
+
+	transfer, err := Request(socket)
+	require.NoError(t, err)
+	require.Nil(t, transfer, "nothing to take over on first start")
+
+	server, err := Listen(socket)
+	require.NoError(t, err)
+	defer server.Close()
+	info, err := os.Stat(socket + ".next")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "only the owner may request the aggregate")
+	transfer, err = Request(socket)
+	require.NoError(t, err)
+	require.Nil(t, transfer, "not served before Serve")
+	require.NoError(t, server.Serve())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+
+	done := make(chan error, 1)
+	go func() {
+		h := <-server.Requests()
+		if err := h.SendListeners(map[string]net.Listener{address: l}); err != nil {
+			done <- err
+			return
+		}
+		// connections queue in the backlog meanwhile
+		l.Close()
+		_, err := h.Write([]byte("state"))
+		done <- err
+		h.Close()
+	}()
+
+	transfer, err = Request(socket)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	require.Equal(t, []byte("state"), transfer.State)
+	inherited := transfer.Listeners[address]
+	require.NotNil(t, inherited)
+	defer inherited.Close()
+
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	accepted, err := inherited.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	_, err = conn.Write([]byte("push"))
+	require.NoError(t, err)
+	received := make([]byte, 4)
+	_, err = io.ReadFull(accepted, received)
+	require.NoError(t, err)
+	require.Equal(t, "push", string(received))
+
+	// a stale socket is nothing to take over either
+	server.Close()
+	transfer, err = Request(socket)
+	require.NoError(t, err)
+	require.Nil(t, transfer)
+}
@@ -0,0 +1,559 @@
+package hook
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindNumber
+	kindBool
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindBool:
+		return "bool"
+	default:
+		return "string"
+	}
+}
+
+// series is what expressions are evaluated against
+type series struct {
+	name, ty string
+	labels   map[string]string
+	value    float64
+}
+
+type value struct {
+	s string
+	f float64
+	b bool
+}
+
+// node is a typechecked expression, its kind known at parse time so hooks
+// can't fail while ingesting
+type node interface {
+	kind() kind
+	eval(s *series) value
+}
+
+// compile parses an expression, checking it evaluates to want
+func compile(input string, want kind) (node, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	if n.kind() != want {
+		return nil, fmt.Errorf("expression is a %s, must be a %s", n.kind(), want)
+	}
+	return n, nil
+}
+
+type literal struct {
+	k kind
+	v value
+}
+
+func (l *literal) kind() kind         { return l.k }
+func (l *literal) eval(*series) value { return l.v }
+
+type field struct {
+	k   kind
+	get func(s *series) value
+}
+
+func (f *field) kind() kind           { return f.k }
+func (f *field) eval(s *series) value { return f.get(s) }
+
+type unary struct {
+	op   string
+	expr node
+}
+
+func (u *unary) kind() kind { return u.expr.kind() }
+func (u *unary) eval(s *series) value {
+	v := u.expr.eval(s)
+	if u.op == "!" {
+		return value{b: !v.b}
+	}
+	return value{f: -v.f}
+}
+
+type binary struct {
+	op          string
+	k           kind
+	left, right node
+	re          *regexp.Regexp
+}
+
+func (b *binary) kind() kind { return b.k }
+
+func (b *binary) eval(s *series) value {
+	switch b.op {
+	case "&&":
+		return value{b: b.left.eval(s).b && b.right.eval(s).b}
+	case "||":
+		return value{b: b.left.eval(s).b || b.right.eval(s).b}
+	case "=~":
+		return value{b: b.re.MatchString(b.left.eval(s).s)}
+	case "!~":
+		return value{b: !b.re.MatchString(b.left.eval(s).s)}
+	}
+
+	l, r := b.left.eval(s), b.right.eval(s)
+	operands := b.left.kind()
+	switch b.op {
+	case "+":
+		if operands == kindString {
+			return value{s: l.s + r.s}
+		}
+		return value{f: l.f + r.f}
+	case "-":
+		return value{f: l.f - r.f}
+	case "*":
+		return value{f: l.f * r.f}
+	case "/":
+		return value{f: l.f / r.f}
+	case "%":
+		return value{f: math.Mod(l.f, r.f)}
+	}
+
+	var cmp int
+	switch operands {
+	case kindString:
+		cmp = strings.Compare(l.s, r.s)
+	case kindNumber:
+		switch {
+		case l.f < r.f:
+			cmp = -1
+		case l.f > r.f:
+			cmp = 1
+		case l.f != r.f:
+			// NaN is neither equal to nor ordered with anything
+			return value{b: b.op == "!="}
+		}
+	default:
+		if l.b != r.b {
+			cmp = 1
+		}
+	}
+	switch b.op {
+	case "==":
+		return value{b: cmp == 0}
+	case "!=":
+		return value{b: cmp != 0}
+	case "<":
+		return value{b: cmp < 0}
+	case "<=":
+		return value{b: cmp <= 0}
+	case ">":
+		return value{b: cmp > 0}
+	default:
+		return value{b: cmp >= 0}
+	}
+}
+
+type call struct {
+	k    kind
+	args []node
+	fn   builtin
+}
+
+type builtin func(s *series, args []value) value
+
+func (c *call) kind() kind { return c.k }
+func (c *call) eval(s *series) value {
+	args := make([]value, len(c.args))
+	for i, arg := range c.args {
+		args[i] = arg.eval(s)
+	}
+	return c.fn(s, args)
+}
+
+type function struct {
+	args   []kind
+	result kind
+	fn     builtin
+	// build, when set, checks or precomputes the arguments instead, e.g.
+	// compiles a regular expression
+	build func(args []node) (builtin, error)
+}
+
+var functions = map[string]function{
+	"label": {args: []kind{kindString}, result: kindString, fn: func(s *series, args []value) value {
+		return value{s: s.labels[args[0].s]}
+	}},
+	"has": {args: []kind{kindString}, result: kindBool, fn: func(s *series, args []value) value {
+		_, ok := s.labels[args[0].s]
+		return value{b: ok}
+	}},
+	"lower": {args: []kind{kindString}, result: kindString, fn: func(_ *series, args []value) value {
+		return value{s: strings.ToLower(args[0].s)}
+	}},
+	"upper": {args: []kind{kindString}, result: kindString, fn: func(_ *series, args []value) value {
+		return value{s: strings.ToUpper(args[0].s)}
+	}},
+	"number": {args: []kind{kindString}, result: kindNumber, fn: func(_ *series, args []value) value {
+		f, err := strconv.ParseFloat(args[0].s, 64)
+		if err != nil {
+			return value{f: math.NaN()}
+		}
+		return value{f: f}
+	}},
+	"string": {args: []kind{kindNumber}, result: kindString, fn: func(_ *series, args []value) value {
+		return value{s: strconv.FormatFloat(args[0].f, 'g', -1, 64)}
+	}},
+	"replace": {args: []kind{kindString, kindString, kindString}, result: kindString, build: func(args []node) (builtin, error) {
+		pattern, ok := args[1].(*literal)
+		if !ok {
+			return nil, fmt.Errorf("the regular expression of replace must be a string literal")
+		}
+		re, err := regexp.Compile(pattern.v.s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", pattern.v.s, err)
+		}
+		return func(_ *series, args []value) value {
+			return value{s: re.ReplaceAllString(args[0].s, args[2].s)}
+		}, nil
+	}},
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expect(text string) error {
+	if tok := p.next(); !tok.is(tokenPunct, text) {
+		return fmt.Errorf("expected %q at position %d, got %s", text, tok.pos, tok)
+	}
+	return nil
+}
+
+// binaryLevel parses left-associative operators of one precedence level
+func (p *parser) binaryLevel(ops []string, operand func() (node, error), check func(op string, left, right node) (node, error)) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		op := ""
+		for _, candidate := range ops {
+			if tok.is(tokenPunct, candidate) {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = check(op, left, right); err != nil {
+			return nil, fmt.Errorf("%w at position %d", err, tok.pos)
+		}
+	}
+}
+
+func (p *parser) or() (node, error) {
+	return p.binaryLevel([]string{"||"}, p.and, logical)
+}
+
+func (p *parser) and() (node, error) {
+	return p.binaryLevel([]string{"&&"}, p.not, logical)
+}
+
+func logical(op string, left, right node) (node, error) {
+	if left.kind() != kindBool || right.kind() != kindBool {
+		return nil, fmt.Errorf("%s needs bool operands, got %s and %s", op, left.kind(), right.kind())
+	}
+	return &binary{op: op, k: kindBool, left: left, right: right}, nil
+}
+
+func (p *parser) not() (node, error) {
+	if tok := p.peek(); tok.is(tokenPunct, "!") {
+		p.next()
+		expr, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		if expr.kind() != kindBool {
+			return nil, fmt.Errorf("! needs a bool operand at position %d, got a %s", tok.pos, expr.kind())
+		}
+		return &unary{op: "!", expr: expr}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	return p.binaryLevel([]string{"==", "!=", "<", "<=", ">", ">=", "=~", "!~"}, p.additive, func(op string, left, right node) (node, error) {
+		if op == "=~" || op == "!~" {
+			pattern, ok := right.(*literal)
+			if left.kind() != kindString || !ok || pattern.k != kindString {
+				return nil, fmt.Errorf("%s needs a string and a string literal", op)
+			}
+			re, err := regexp.Compile("^(?:" + pattern.v.s + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %w", pattern.v.s, err)
+			}
+			return &binary{op: op, k: kindBool, left: left, right: right, re: re}, nil
+		}
+		if left.kind() != right.kind() {
+			return nil, fmt.Errorf("cannot compare a %s with a %s", left.kind(), right.kind())
+		}
+		if left.kind() == kindBool && op != "==" && op != "!=" {
+			return nil, fmt.Errorf("bools can't be ordered with %s", op)
+		}
+		return &binary{op: op, k: kindBool, left: left, right: right}, nil
+	})
+}
+
+func (p *parser) additive() (node, error) {
+	return p.binaryLevel([]string{"+", "-"}, p.multiplicative, arithmetic)
+}
+
+func (p *parser) multiplicative() (node, error) {
+	return p.binaryLevel([]string{"*", "/", "%"}, p.negation, arithmetic)
+}
+
+func arithmetic(op string, left, right node) (node, error) {
+	if op == "+" && left.kind() == kindString && right.kind() == kindString {
+		return &binary{op: op, k: kindString, left: left, right: right}, nil
+	}
+	if left.kind() != kindNumber || right.kind() != kindNumber {
+		return nil, fmt.Errorf("%s needs number operands, got %s and %s", op, left.kind(), right.kind())
+	}
+	return &binary{op: op, k: kindNumber, left: left, right: right}, nil
+}
+
+func (p *parser) negation() (node, error) {
+	if tok := p.peek(); tok.is(tokenPunct, "-") {
+		p.next()
+		expr, err := p.negation()
+		if err != nil {
+			return nil, err
+		}
+		if expr.kind() != kindNumber {
+			return nil, fmt.Errorf("- needs a number operand at position %d, got a %s", tok.pos, expr.kind())
+		}
+		return &unary{op: "-", expr: expr}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenString:
+		return &literal{k: kindString, v: value{s: tok.text}}, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return &literal{k: kindNumber, v: value{f: f}}, nil
+	case tokenIdent:
+		if p.peek().is(tokenPunct, "(") {
+			return p.call(tok)
+		}
+		return identifier(tok)
+	}
+	if tok.is(tokenPunct, "(") {
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+}
+
+func identifier(tok token) (node, error) {
+	switch tok.text {
+	case "true", "false":
+		return &literal{k: kindBool, v: value{b: tok.text == "true"}}, nil
+	case "name":
+		return &field{k: kindString, get: func(s *series) value { return value{s: s.name} }}, nil
+	case "type":
+		return &field{k: kindString, get: func(s *series) value { return value{s: s.ty} }}, nil
+	case "value":
+		return &field{k: kindNumber, get: func(s *series) value { return value{f: s.value} }}, nil
+	}
+	if label, ok := strings.CutPrefix(tok.text, "labels."); ok && label != "" {
+		return &field{k: kindString, get: func(s *series) value { return value{s: s.labels[label]} }}, nil
+	}
+	return nil, fmt.Errorf("unknown identifier %q at position %d, must be name, type, value or labels.<name>", tok.text, tok.pos)
+}
+
+func (p *parser) call(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+	p.next()
+	var args []node
+	for !p.peek().is(tokenPunct, ")") {
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.peek().is(tokenPunct, ",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if len(args) != len(fn.args) {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d at position %d", name.text, len(fn.args), len(args), name.pos)
+	}
+	for i, arg := range args {
+		if arg.kind() != fn.args[i] {
+			return nil, fmt.Errorf("argument %d of %s must be a %s, got a %s at position %d", i+1, name.text, fn.args[i], arg.kind(), name.pos)
+		}
+	}
+
+	impl := fn.fn
+	if fn.build != nil {
+		var err error
+		if impl, err = fn.build(args); err != nil {
+			return nil, fmt.Errorf("%w at position %d", err, name.pos)
+		}
+	}
+	return &call{k: fn.result, args: args, fn: impl}, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of input"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+var twoCharPuncts = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||"}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(input) && (input[i] == '_' || input[i] == '.' || isLetter(input[i]) || isDigit(input[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, input[start:i], start})
+		case isDigit(c):
+			start := i
+			for i < len(input) && (isDigit(input[i]) || input[i] == '.' || input[i] == 'e' || input[i] == 'E' ||
+				((input[i] == '+' || input[i] == '-') && (input[i-1] == 'e' || input[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, input[start:i], start})
+		case c == '"':
+			start := i
+			i++
+			for i < len(input) && input[i] != '"' {
+				if input[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(input) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			s, err := strconv.Unquote(input[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %w", start, err)
+			}
+			tokens = append(tokens, token{tokenString, s, start})
+		default:
+			matched := false
+			for _, punct := range twoCharPuncts {
+				if strings.HasPrefix(input[i:], punct) {
+					tokens = append(tokens, token{tokenPunct, punct, i})
+					i += 2
+					matched = true
+					break
+				}
+			}
+			if matched {
+				continue
+			}
+			if strings.IndexByte("()<>!+-*/%,", c) < 0 {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{tokenPunct, input[i : i+1], i})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,191 @@
+// Package hook evaluates small expressions against every series pushed to
+// the gateway, dropping them, rewriting their labels or adjusting their
+// value, for the edge cases static rollup rules can't express.
+package hook
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Hook is one entry of an ingest hooks file. Expressions see the family's
+// name and type, the series' labels as labels.<name> and its value, the sum
+// of histograms and summaries.
+type Hook struct {
+	// If is the bool expression selecting the series the hook applies to,
+	// every series when empty
+	If string `yaml:"if"`
+	// Drop removes the selected series
+	Drop bool `yaml:"drop"`
+	// SetLabels maps label names to string expressions giving their new
+	// value, an empty value removes the label
+	SetLabels map[string]string `yaml:"set_labels"`
+	// SetValue is the number expression giving the series' new value
+	SetValue string `yaml:"set_value"`
+
+	cond      node
+	labels    []labelRewrite
+	valueExpr node
+}
+
+type labelRewrite struct {
+	name string
+	expr node
+}
+
+type hooksFile struct {
+	IngestHooks []*Hook `yaml:"ingest_hooks"`
+}
+
+// Load reads the ingest_hooks list of a YAML file
+func Load(path string) ([]*Hook, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := hooksFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing ingest hooks %s: %w", path, err)
+	}
+	for i, h := range file.IngestHooks {
+		if err := h.Compile(); err != nil {
+			return nil, fmt.Errorf("invalid ingest hook %d in %s: %w", i+1, path, err)
+		}
+	}
+	return file.IngestHooks, nil
+}
+
+// Compile checks and compiles the hook's expressions
+func (h *Hook) Compile() error {
+	var err error
+	if h.If != "" {
+		if h.cond, err = compile(h.If, kindBool); err != nil {
+			return fmt.Errorf("if: %w", err)
+		}
+	}
+	if !h.Drop && len(h.SetLabels) == 0 && h.SetValue == "" {
+		return fmt.Errorf("the hook has no drop, set_labels or set_value")
+	}
+
+	h.labels = nil
+	for name, expr := range h.SetLabels {
+		if name == "" || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("set_labels: invalid label name %q", name)
+		}
+		n, err := compile(expr, kindString)
+		if err != nil {
+			return fmt.Errorf("set_labels %s: %w", name, err)
+		}
+		h.labels = append(h.labels, labelRewrite{name: name, expr: n})
+	}
+	// all rewrites see the labels from before the hook, the order only
+	// matters to keep evaluation deterministic
+	sort.Slice(h.labels, func(i, j int) bool { return h.labels[i].name < h.labels[j].name })
+
+	if h.SetValue != "" {
+		if h.valueExpr, err = compile(h.SetValue, kindNumber); err != nil {
+			return fmt.Errorf("set_value: %w", err)
+		}
+	}
+	return nil
+}
+
+// Apply runs the hooks in order over the series of a family, returning the
+// series left and whether any of their labels changed, which may leave
+// series with the same labels or unsorted ones
+func Apply(hooks []*Hook, family *dto.MetricFamily) ([]*dto.Metric, bool) {
+	relabeled := false
+	kept := family.Metric[:0]
+	for _, m := range family.Metric {
+		s := &series{name: family.GetName(), ty: strings.ToLower(family.GetType().String())}
+		s.labels = make(map[string]string, len(m.Label))
+		for _, l := range m.Label {
+			s.labels[l.GetName()] = l.GetValue()
+		}
+		s.value = metricValue(family.GetType(), m)
+
+		drop, labelsChanged, valueChanged := false, false, false
+		for _, h := range hooks {
+			if h.cond != nil && !h.cond.eval(s).b {
+				continue
+			}
+			if h.Drop {
+				drop = true
+				break
+			}
+			if len(h.labels) > 0 {
+				values := make([]string, len(h.labels))
+				for i, rewrite := range h.labels {
+					values[i] = rewrite.expr.eval(s).s
+				}
+				for i, rewrite := range h.labels {
+					if values[i] == "" {
+						delete(s.labels, rewrite.name)
+					} else {
+						s.labels[rewrite.name] = values[i]
+					}
+				}
+				labelsChanged = true
+			}
+			if h.valueExpr != nil {
+				s.value = h.valueExpr.eval(s).f
+				valueChanged = true
+			}
+		}
+		if drop {
+			continue
+		}
+
+		if labelsChanged {
+			relabeled = true
+			m.Label = m.Label[:0]
+			for name, value := range s.labels {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+			}
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		}
+		if valueChanged {
+			setMetricValue(family.GetType(), m, s.value)
+		}
+		kept = append(kept, m)
+	}
+	clear(family.Metric[len(kept):])
+	return kept, relabeled
+}
+
+func metricValue(ty dto.MetricType, m *dto.Metric) float64 {
+	switch ty {
+	case dto.MetricType_COUNTER:
+		return m.GetCounter().GetValue()
+	case dto.MetricType_GAUGE:
+		return m.GetGauge().GetValue()
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return m.GetHistogram().GetSampleSum()
+	case dto.MetricType_SUMMARY:
+		return m.GetSummary().GetSampleSum()
+	default:
+		return m.GetUntyped().GetValue()
+	}
+}
+
+func setMetricValue(ty dto.MetricType, m *dto.Metric, value float64) {
+	switch {
+	case m.Counter != nil && ty == dto.MetricType_COUNTER:
+		m.Counter.Value = proto.Float64(value)
+	case m.Gauge != nil && ty == dto.MetricType_GAUGE:
+		m.Gauge.Value = proto.Float64(value)
+	case m.Histogram != nil:
+		m.Histogram.SampleSum = proto.Float64(value)
+	case m.Summary != nil:
+		m.Summary.SampleSum = proto.Float64(value)
+	case m.Untyped != nil:
+		m.Untyped.Value = proto.Float64(value)
+	}
+}
@@ -0,0 +1,100 @@
+package hook
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpressions(t *testing.T) {
+	s := &series{name: "latency_ms", ty: "gauge", labels: map[string]string{"env": "Dev", "code": "503"}, value: 1500}
+	for expr, want := range map[string]bool{
+		`name == "latency_ms"`:                            true,
+		`labels.env == "Dev" && value > 1000`:             true,
+		`lower(labels.env) == "prod" || type != "gauge"`:  false,
+		`name =~ "latency_.*"`:                            true,
+		`labels.env !~ "D.*"`:                             false,
+		`has("code") && number(labels.code) >= 500`:       true,
+		`!has("region")`:                                  true,
+		`labels.missing == ""`:                            true,
+		`value / 1000 == 1.5 && -value < 0`:               true,
+		`replace(labels.code, "^5", "x") + "!" == "x03!"`: true,
+		`(1 + 2) * 3 % 5 == 4`:                            true,
+		`string(value) == "1500"`:                         true,
+	} {
+		n, err := compile(expr, kindBool)
+		require.NoError(t, err, expr)
+		require.Equal(t, want, n.eval(s).b, expr)
+	}
+
+	for _, expr := range []string{
+		`value == "1"`,
+		`name + 1`,
+		`lower(value)`,
+		`unknown(name)`,
+		`labels.`,
+		`name =~ labels.env`,
+		`name =~ "("`,
+		`replace(name, labels.env, "")`,
+		`"unterminated`,
+		`name ==`,
+		`name)`,
+		`value`,
+	} {
+		_, err := compile(expr, kindBool)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+ingest_hooks:
+  - if: 'labels.env == "dev"'
+    drop: true
+  - if: 'name == "latency_ms"'
+    set_value: 'value / 1000'
+    set_labels:
+      unit: '"seconds"'
+  - set_labels:
+      pod: '""'
+`), 0o644))
+	hooks, err := Load(path)
+	require.NoError(t, err)
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(`# TYPE latency_ms gauge
+latency_ms{env="dev",pod="a"} 10
+latency_ms{env="prod",pod="b"} 1500
+latency_ms{env="prod",pod="c"} 500
+`))
+	require.NoError(t, err)
+	family := families["latency_ms"]
+
+	metrics, relabeled := Apply(hooks, family)
+	require.True(t, relabeled)
+	require.Len(t, metrics, 2)
+	for i, want := range []float64{1.5, 0.5} {
+		require.Equal(t, want, metrics[i].GetGauge().GetValue())
+		require.Equal(t, []*dto.LabelPair{
+			{Name: strPtr("env"), Value: strPtr("prod")},
+			{Name: strPtr("unit"), Value: strPtr("seconds")},
+		}, metrics[i].Label)
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("ingest_hooks:\n  - if: 'value'\n    drop: true\n"), 0o644))
+	_, err = Load(path)
+	require.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("ingest_hooks:\n  - if: 'value > 1'\n"), 0o644))
+	_, err = Load(path)
+	require.Error(t, err)
+}
+
+func strPtr(s string) *string {
+	return &s
+}
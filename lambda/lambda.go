@@ -0,0 +1,109 @@
+// Package lambda runs the gateway as an AWS Lambda extension, so functions
+// can push to it on localhost and have it flush on the SHUTDOWN event
+package lambda
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RuntimeAPIEnv holds the host/port of the Extensions API inside the sandbox
+const RuntimeAPIEnv = "AWS_LAMBDA_RUNTIME_API"
+
+const (
+	extensionNameHeader = "Lambda-Extension-Name"
+	extensionIDHeader   = "Lambda-Extension-Identifier"
+
+	eventShutdown = "SHUTDOWN"
+)
+
+type Extension struct {
+	baseURL string
+	id      string
+	client  *http.Client
+}
+
+type event struct {
+	EventType      string `json:"eventType"`
+	DeadlineMs     int64  `json:"deadlineMs"`
+	ShutdownReason string `json:"shutdownReason"`
+}
+
+// Register registers the running binary as an extension subscribed to the
+// SHUTDOWN event, with the Extensions API at runtimeAPI (host/port)
+func Register(runtimeAPI string) (*Extension, error) {
+	if runtimeAPI == "" {
+		return nil, fmt.Errorf("%s is not set, not running inside Lambda", RuntimeAPIEnv)
+	}
+
+	e := &Extension{
+		baseURL: "http://" + runtimeAPI + "/2020-01-01/extension",
+		// event/next blocks until the next event, possibly for a long time
+		client: &http.Client{},
+	}
+
+	body, err := json.Marshal(map[string][]string{"events": {eventShutdown}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.baseURL+"/register", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// the name must match the file name of the extension in /opt/extensions
+	req.Header.Set(extensionNameHeader, filepath.Base(os.Args[0]))
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("registering lambda extension: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registering lambda extension: unexpected status %s", resp.Status)
+	}
+
+	e.id = resp.Header.Get(extensionIDHeader)
+	return e, nil
+}
+
+// WaitForShutdown blocks until the SHUTDOWN event and returns its deadline,
+// by which the extension must have exited
+func (e *Extension) WaitForShutdown() (time.Time, error) {
+	for {
+		ev, err := e.next()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ev.EventType == eventShutdown {
+			return time.UnixMilli(ev.DeadlineMs), nil
+		}
+	}
+}
+
+func (e *Extension) next() (*event, error) {
+	req, err := http.NewRequest(http.MethodGet, e.baseURL+"/event/next", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(extensionIDHeader, e.id)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for lambda event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("waiting for lambda event: unexpected status %s", resp.Status)
+	}
+
+	ev := &event{}
+	if err := json.NewDecoder(resp.Body).Decode(ev); err != nil {
+		return nil, fmt.Errorf("decoding lambda event: %w", err)
+	}
+	return ev, nil
+}
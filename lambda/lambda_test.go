@@ -0,0 +1,52 @@
+package lambda
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterAndWaitForShutdown(t *testing.T) {
+	var (
+		subscribed map[string][]string
+		events     = []event{
+			{EventType: "INVOKE"},
+			{EventType: eventShutdown, DeadlineMs: 1700000002000, ShutdownReason: "spindown"},
+		}
+	)
+	runtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2020-01-01/extension/register":
+			assert.NotEmpty(t, r.Header.Get(extensionNameHeader))
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&subscribed))
+			w.Header().Set(extensionIDHeader, "ext-id")
+		case "/2020-01-01/extension/event/next":
+			assert.Equal(t, "ext-id", r.Header.Get(extensionIDHeader))
+			assert.NoError(t, json.NewEncoder(w).Encode(events[0]))
+			events = events[1:]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer runtime.Close()
+
+	ext, err := Register(strings.TrimPrefix(runtime.URL, "http://"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{eventShutdown}, subscribed["events"])
+
+	deadline, err := ext.WaitForShutdown()
+	require.NoError(t, err)
+	assert.Equal(t, time.UnixMilli(1700000002000), deadline)
+	assert.Empty(t, events)
+}
+
+func TestRegisterOutsideLambda(t *testing.T) {
+	_, err := Register("")
+	require.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pushAck follows a push through its merge, for the acknowledgement sent to
+// clients asking for one with Accept: application/json
+type pushAck struct {
+	// seen holds the families already merged, a family may appear only once
+	seen          map[string]struct{}
+	series        int
+	samples       int
+	ignoredLabels map[string]struct{}
+	warnings      []string
+	// created holds the families the push was the first to merge
+	created []string
+	// producer pushed the families, for watches
+	producer producerKey
+	// labelNames holds the label names of the series, when tracked
+	labelNames map[string]struct{}
+	// opts are the options the push is merged with, loaded once so a
+	// change of options doesn't apply to part of it
+	opts *aggregateOptions
+}
+
+func newPushAck(opts *aggregateOptions) *pushAck {
+	return &pushAck{seen: map[string]struct{}{}, opts: opts}
+}
+
+type ackBody struct {
+	// Status is "merged", "queued" for asynchronous ingest, which merges
+	// after responding, or "duplicate" for a repeated Idempotency-Key
+	Status   string   `json:"status"`
+	Families int      `json:"families"`
+	Series   int      `json:"series"`
+	Samples  int      `json:"samples"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Receipt is the ID of the scrape receipt the push asked for
+	Receipt string `json:"receipt,omitempty"`
+}
+
+func (p *pushAck) add(family *dto.MetricFamily) {
+	p.series += len(family.Metric)
+	for _, m := range family.Metric {
+		if p.labelNames != nil {
+			for _, l := range m.Label {
+				p.labelNames[l.GetName()] = struct{}{}
+			}
+		}
+		switch family.GetType() {
+		case dto.MetricType_HISTOGRAM:
+			// the _sum and _count samples, and one per bucket
+			p.samples += 2 + len(m.GetHistogram().GetBucket())
+		case dto.MetricType_SUMMARY:
+			p.samples += 2 + len(m.GetSummary().GetQuantile())
+		default:
+			p.samples++
+		}
+	}
+}
+
+// observe records the shape of the merged push of job
+func (p *pushAck) observe(job string, bytes int) {
+	PushFamilies.WithLabelValues(job).Observe(float64(len(p.seen)))
+	PushSeries.WithLabelValues(job).Observe(float64(p.series))
+	PushBodyBytes.WithLabelValues(job).Observe(float64(bytes))
+}
+
+// noteIgnoredLabels records the ignored labels the series carries, before
+// they are dropped
+func (p *pushAck) noteIgnoredLabels(m *dto.Metric, ignored ignoredLabels) {
+	for _, l := range m.Label {
+		if l.Name != nil && ignored.labelInIgnoredList(l) {
+			if p.ignoredLabels == nil {
+				p.ignoredLabels = map[string]struct{}{}
+			}
+			p.ignoredLabels[l.GetName()] = struct{}{}
+		}
+	}
+}
+
+func (p *pushAck) body() ackBody {
+	body := ackBody{Status: "merged", Families: len(p.seen), Series: p.series, Samples: p.samples}
+	names := make([]string, 0, len(p.ignoredLabels))
+	for name := range p.ignoredLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		body.Warnings = append(body.Warnings, fmt.Sprintf("ignored label %q was dropped", name))
+	}
+	body.Warnings = append(body.Warnings, p.warnings...)
+	return body
+}
+
+func wantsAck(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// acceptPush answers a push that was accepted, with the JSON
+// acknowledgement when the client asked for it
+func acceptPush(w http.ResponseWriter, r *http.Request, body ackBody) {
+	if !wantsAck(r) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, body)
+}
@@ -1,55 +1,259 @@
 package metrics
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/zapier/prom-aggregation-gateway/hook"
+	"github.com/zapier/prom-aggregation-gateway/wasm"
+	"google.golang.org/protobuf/proto"
 )
 
-type metricFamily struct {
-	*dto.MetricFamily
-	lock sync.RWMutex
+// Family publishes its state copy-on-write: merges build a new
+// compactFamily and swap it in atomically, so renders can encode the
+// current value without taking any lock or blocking merges.
+type Family struct {
+	current    atomic.Pointer[compactFamily]
+	lock       sync.RWMutex
+	lastUpdate time.Time
+	sizeBytes  int64
+	// mergedGen is the aggregate generation its last merge published
+	mergedGen atomic.Uint64
+
+	// metricCount is this family's MetricCountByFamily child, looked up once
+	metricCount prometheus.Gauge
+
+	// pending holds the series of pushes waiting to be merged in one pass
+	pendingLock sync.Mutex
+	pending     [][]compactSeries
+	// pendingHelp is the HELP of the latest of those pushes sending one,
+	// taken over by the merge with SetMetadataOverrides' latest policy
+	pendingHelp *string
+
+	// spillPath is where a disk storage spills the series of the family,
+	// cold holding what is left of it in memory while they are on disk
+	spillPath string
+	cold      atomic.Pointer[compactFamily]
+
+	// restored is set from a restore until the family is merged into again
+	restored atomic.Bool
+
+	// incarnation tells this family apart from those of the same name
+	// created before or after it
+	incarnation uint64
+	// version counts the states published, spilling not being one, so a
+	// state can be told apart from the previous ones without keeping them
+	version atomic.Uint64
+}
+
+// incarnations numbers the families as they are created
+var incarnations atomic.Uint64
+
+// newMetricFamily returns a family of the state compact, which it takes
+// over
+func newMetricFamily(compact *compactFamily, byFamily *prometheus.GaugeVec) *Family {
+	mf := &Family{
+		incarnation: incarnations.Add(1),
+		lastUpdate:  time.Now(),
+		sizeBytes:   estimateFamilyBytes(compact),
+		metricCount: byFamily.WithLabelValues(compact.name),
+	}
+	mf.publish(compact)
+	mf.metricCount.Set(float64(len(compact.series)))
+	return mf
+}
+
+// publish makes state the family's current one. It must be called with the
+// lock held, or before the family is shared.
+func (mf *Family) publish(state *compactFamily) {
+	mf.current.Store(state)
+	mf.version.Add(1)
+}
+
+// load returns the latest published state, which must be treated as
+// read-only, failing when a spilled family can't be read back
+func (mf *Family) load() (*compactFamily, error) {
+	if current := mf.current.Load(); current != nil {
+		return current, nil
+	}
+	return mf.unspill()
 }
 
 type Aggregate struct {
-	familiesLock sync.RWMutex
-	families     map[string]*metricFamily
-	options      aggregateOptions
+	families Storage
+	// commits is held shared by merges of a batch of normalized families,
+	// and exclusively by point-in-time reads while they take every
+	// family's state, or open its spill file
+	commits sync.RWMutex
+	// options is what Option functions configure while the aggregate is
+	// built, current the published options read everywhere else
+	options       aggregateOptions
+	current       atomic.Pointer[aggregateOptions]
+	updateLock    sync.Mutex
+	generation    atomic.Uint64
+	renderCache   renderCache
+	checksumCache checksums
+	ingestQueue   *ingestQueue
+	limiter       ingestLimiter
+	memoryBytes   atomic.Int64
+	completions   completions
+	snapshots     snapshots
+	maintenance   maintenance
+	frozen        frozenFamilies
+	tombstones    tombstones
+	watches       watches
+	scrapeClock   scrapeClock
+
+	memoryMonitor *memoryMonitor
+	replica       *replica
+	history       *history
+	persister     *persister
+	// familyMetrics are the self-metrics on the families
+	familyMetrics *familyMetrics
+
+	idempotencyKeys *idempotencyKeys
+	labelValues     *labelValues
+	pushLog         *pushLog
+	pushers         *pushers
+	quarantine      *quarantine
+	inventory       *inventory
+	counterGuard    *counterGuard
+	anomalyGuard    *anomalyGuard
+	receipts        *receipts
+	usage           *usageAccounting
+	shadow          *Aggregate
+	subAggregates   []subAggregate
+	upstream        *httputil.ReverseProxy
 }
 
 type ignoredLabels []string
 
 type aggregateOptions struct {
-	ignoredLabels     ignoredLabels
-	metricTTLDuration *time.Duration
+	ignoredLabels      ignoredLabels
+	metricTTLDuration  *time.Duration
+	asyncWorkers       int
+	asyncQueueSize     int
+	maxInFlight        int
+	pushDeadline       time.Duration
+	gaugeSpread        bool
+	errorFormat        string
+	scrapeTTL          int
+	memoryBudget       int64
+	openMetrics        bool
+	shedHeapBytes      int64
+	renderFlushEvery   int
+	renderTimeout      time.Duration
+	replicaOf          string
+	replicaInterval    time.Duration
+	localPushLabels    []labelPair
+	honorLabels        *bool
+	rollupRules        []RollupRule
+	splitRules         []SplitRule
+	metadataOverrides  []MetadataOverride
+	metadataMatches    *metadataMatches
+	latestHelp         bool
+	historySize        int
+	historyInterval    time.Duration
+	renderTimestamps   string
+	idempotencyWindow  time.Duration
+	tenantLabel        string
+	upstreamURL        string
+	ownedTenants       []string
+	ownedPaths         []string
+	schema             *Schema
+	maxLabelValues     map[string]int
+	labelAllowlists    map[string][]string
+	pushLogEntries     int
+	pushLogBytes       int64
+	redactLabels       []string
+	shadowOptions      []Option
+	subAggregates      []SubAggregate
+	mergeStrategies    map[dto.MetricType]MergeStrategy
+	ingestHooks        []*hook.Hook
+	ingestFilters      []*wasm.Filter
+	renderFilters      []*wasm.Filter
+	pusherUp           bool
+	nativeSchema       *int32
+	usageAccounting    bool
+	maxRenderSeries    int
+	renderSeriesMode   string
+	ignoreAtRender     bool
+	duplicateSeries    string
+	trustedProxies     []netip.Prefix
+	realIPHeader       string
+	inventory          bool
+	inventoryWebhook   string
+	counterJumpFactor  float64
+	counterJumpWebhook string
+	anomalyFactor      float64
+	anomalyWebhook     string
+	receiptRetention   time.Duration
+	receiptWebhook     string
+	tombstoneTTL       time.Duration
+
+	quarantineFailures int
+	quarantineDuration time.Duration
+
+	persistPath     string
+	persistInterval time.Duration
+	persistKeys     *SnapshotKeys
+	restoreTTL      string
+
+	// unregisteredMetrics keeps the family self-metrics out of PromRegistry
+	unregisteredMetrics bool
 }
 
-type aggregateOptionsFunc func(a *Aggregate)
+// Option configures an Aggregate, see the Set* functions
+type Option func(a *Aggregate)
 
-func AddIgnoredLabels(ignoredLabels ...string) aggregateOptionsFunc {
+func AddIgnoredLabels(ignoredLabels ...string) Option {
 	return func(a *Aggregate) {
 		a.options.ignoredLabels = ignoredLabels
 	}
 }
 
-func SetTTLMetricTime(duration *time.Duration) aggregateOptionsFunc {
+func SetTTLMetricTime(duration *time.Duration) Option {
 	return func(a *Aggregate) {
 		a.options.metricTTLDuration = duration
 	}
 }
 
-func NewAggregate(opts ...aggregateOptionsFunc) *Aggregate {
+// SetAsyncIngest makes pushes return as soon as their body is read, with
+// workers parsing and merging up to queueSize queued pushes in the background.
+func SetAsyncIngest(workers, queueSize int) Option {
+	return func(a *Aggregate) {
+		a.options.asyncWorkers = workers
+		a.options.asyncQueueSize = queueSize
+	}
+}
+
+// SetMaxConcurrentPushes rejects pushes with 429 while limit pushes are
+// already being parsed and merged
+func SetMaxConcurrentPushes(limit int) Option {
+	return func(a *Aggregate) {
+		a.options.maxInFlight = limit
+	}
+}
+
+func NewAggregate(opts ...Option) *Aggregate {
 	a := &Aggregate{
-		families: map[string]*metricFamily{},
+		families: newFamilyShards(),
 		options: aggregateOptions{
 			ignoredLabels: []string{},
 		},
@@ -60,169 +264,1020 @@ func NewAggregate(opts ...aggregateOptionsFunc) *Aggregate {
 	}
 
 	a.options.formatOptions()
+	a.current.Store(&a.options)
+
+	a.familyMetrics = registeredFamilyMetrics
+	if a.options.unregisteredMetrics {
+		a.familyMetrics = newUnregisteredFamilyMetrics()
+	}
+
+	if hot, ok := a.families.(hotStorage); ok {
+		hot.accountSpills(a.addMemoryBytes)
+	}
+	a.limiter = newIngestLimiter(a.options.maxInFlight)
+	if a.options.asyncWorkers > 0 {
+		a.ingestQueue = newIngestQueue(a, a.options.asyncWorkers, a.options.asyncQueueSize)
+	}
+	if a.options.shedHeapBytes > 0 {
+		a.memoryMonitor = newMemoryMonitor(a.options.shedHeapBytes)
+	}
+	if a.options.replicaOf != "" {
+		a.replica = newReplica(a, a.options.replicaOf, a.options.replicaInterval)
+	}
+	if a.options.upstreamURL != "" {
+		a.upstream = newUpstreamProxy(a.options.upstreamURL)
+	}
+	if a.options.idempotencyWindow > 0 {
+		a.idempotencyKeys = newIdempotencyKeys(a.options.idempotencyWindow)
+	}
+	if len(a.options.maxLabelValues) > 0 {
+		a.labelValues = newLabelValues(a.options.maxLabelValues)
+	}
+	if a.options.pushLogEntries > 0 {
+		a.pushLog = newPushLog(a.options.pushLogEntries, a.options.pushLogBytes, a.options.redactLabels)
+	}
+	if a.options.pusherUp {
+		a.pushers = newPushers()
+	}
+	if a.options.quarantineFailures > 0 {
+		a.quarantine = newQuarantine(a.options.quarantineFailures, a.options.quarantineDuration)
+	}
+	if a.options.inventory {
+		a.inventory = newInventory(a.options.inventoryWebhook)
+	}
+	if a.options.counterJumpFactor > 0 {
+		a.counterGuard = newCounterGuard(a.options.counterJumpFactor, a.options.counterJumpWebhook)
+	}
+	if a.options.anomalyFactor > 0 {
+		a.anomalyGuard = newAnomalyGuard(a.options.anomalyFactor, a.options.anomalyWebhook)
+	}
+	if a.options.receiptRetention > 0 {
+		a.receipts = newReceipts(a.options.receiptRetention, a.options.receiptWebhook)
+	}
+	if a.options.usageAccounting {
+		a.usage = newUsageAccounting()
+	}
+	if a.options.historySize > 0 {
+		a.history = newHistory(a, a.options.historySize, a.options.historyInterval)
+	}
+	if a.options.persistPath != "" {
+		a.persister = newPersister(a, a.options.persistPath, a.options.persistInterval, a.options.persistKeys)
+	}
+	if a.options.shadowOptions != nil {
+		a.shadow = newShadow(opts, a.options.shadowOptions)
+	}
+	for _, sub := range a.options.subAggregates {
+		a.subAggregates = append(a.subAggregates, newSubAggregate(opts, sub))
+	}
 
 	return a
 }
 
+// Close waits for pushes still queued for asynchronous ingest to be merged
+func (a *Aggregate) Close() {
+	if a.ingestQueue != nil {
+		a.ingestQueue.close()
+	}
+	if a.memoryMonitor != nil {
+		a.memoryMonitor.close()
+	}
+	if a.replica != nil {
+		a.replica.close()
+	}
+	if a.history != nil {
+		a.history.close()
+	}
+	if a.persister != nil {
+		a.persister.close(a)
+	}
+	if a.inventory != nil {
+		a.inventory.close()
+	}
+	if a.counterGuard != nil {
+		a.counterGuard.close()
+	}
+	if a.anomalyGuard != nil {
+		a.anomalyGuard.close()
+	}
+	if a.receipts != nil {
+		a.receipts.close()
+	}
+	if a.shadow != nil {
+		a.shadow.Close()
+	}
+	for _, sub := range a.subAggregates {
+		sub.agg.Close()
+	}
+	if closer, ok := a.families.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Could not close the storage: %s\n", err.Error())
+		}
+	}
+}
+
 func (ao *aggregateOptions) formatOptions() {
 	ao.formatIgnoredLabels()
 }
 
 func (ao *aggregateOptions) formatIgnoredLabels() {
-	if ao.ignoredLabels != nil {
-		for i, v := range ao.ignoredLabels {
-			ao.ignoredLabels[i] = strings.ToLower(v)
-		}
+	// copied, the labels may be shared with published options
+	labels := make(ignoredLabels, len(ao.ignoredLabels))
+	for i, v := range ao.ignoredLabels {
+		labels[i] = strings.ToLower(v)
 	}
-
-	sort.Strings(ao.ignoredLabels)
+	sort.Strings(labels)
+	ao.ignoredLabels = labels
 }
 
 func (a *Aggregate) Len() int {
-	a.familiesLock.RLock()
-	count := len(a.families)
-	a.familiesLock.RUnlock()
-	return count
-}
-
-// setFamilyOrGetExistingFamily either sets a new family or returns an existing family
-func (a *Aggregate) setFamilyOrGetExistingFamily(familyName string, family *dto.MetricFamily) *metricFamily {
-	a.familiesLock.Lock()
-	defer a.familiesLock.Unlock()
-	existingFamily, ok := a.families[familyName]
-	if !ok {
-		a.families[familyName] = &metricFamily{MetricFamily: family}
-		return nil
+	return a.families.Len()
+}
+
+// setFamilyOrGetExistingFamily either sets a new family or returns an existing family.
+// Pushes to existing families, by far the common case, only take the shard read lock.
+func (a *Aggregate) setFamilyOrGetExistingFamily(familyName string, family *compactFamily, opts *aggregateOptions) *Family {
+	if existingFamily, ok := a.families.Get(familyName); ok {
+		return existingFamily
+	}
+
+	// Someone may have created the family between our read and write
+	var sizeBytes int64
+	existingFamily, ok := a.families.GetOrCreate(familyName, func() *Family {
+		newFamily := newMetricFamily(family, a.familyMetrics.byFamily)
+		if opts.renderTimestamps == TimestampsAggregation {
+			// not published yet, merges keep it up to date from now on
+			newFamily.head().stampMs = time.Now().UnixMilli()
+		}
+		if opts.gaugeSpread && family.ty == dto.MetricType_GAUGE {
+			trackSpread(newFamily.head().series)
+		}
+		// the merge creating it sets the exact generation, this keeps it
+		// from expiring in between
+		newFamily.mergedGen.Store(a.generation.Load() + 1)
+		// merges may change it as soon as it is published
+		sizeBytes = newFamily.sizeBytes
+		return newFamily
+	})
+	if ok {
+		return existingFamily
 	}
-	return existingFamily
+	a.addMemoryBytes(sizeBytes)
+	a.familyMetrics.total.Inc()
+	a.familyMetrics.byType.WithLabelValues(family.ty.String()).Inc()
+	return nil
 }
 
-func (a *Aggregate) saveFamily(familyName string, family *dto.MetricFamily) error {
-	existingFamily := a.setFamilyOrGetExistingFamily(familyName, family)
+// saveFamily merges a pushed family, reporting whether the push created it
+func (a *Aggregate) saveFamily(familyName string, family *compactFamily, opts *aggregateOptions) (bool, error) {
+	existingFamily := a.setFamilyOrGetExistingFamily(familyName, family, opts)
 	if existingFamily != nil {
-		err := existingFamily.mergeFamily(family)
+		sizeDelta, err := existingFamily.mergeFamily(family, opts.mergeStrategy(family.ty), opts.gaugeSpread, opts.latestHelp, opts.renderTimestamps != "")
 		if err != nil {
-			return err
+			return false, err
+		}
+		a.addMemoryBytes(sizeDelta)
+		a.familyMerged(familyName, existingFamily)
+		if existingFamily.restored.Load() && existingFamily.restored.CompareAndSwap(true, false) {
+			a.familyMetrics.restoredAge.DeleteLabelValues(familyName)
 		}
 	}
 
-	return nil
+	generation := a.generation.Add(1)
+	merged := existingFamily
+	if merged == nil {
+		merged, _ = a.families.Get(familyName)
+	}
+	if merged != nil {
+		merged.mergedGen.Store(generation)
+	}
+	return existingFamily == nil, nil
+}
+
+// parserPool recycles text parsers, so their read buffer, token buffer and
+// histogram/summary scratch maps are reused across pushes
+var parserPool = sync.Pool{
+	New: func() any {
+		return new(expfmt.TextParser)
+	},
 }
 
 func (a *Aggregate) parseAndMerge(r io.Reader, labels []labelPair) error {
-	var parser expfmt.TextParser
-	inFamilies, err := parser.TextToMetricFamilies(r)
+	return a.parseAndMergeAck(context.Background(), r, labels, newPushAck(a.opts()))
+}
+
+// parseAndMergeAck merges a push body, recording what it merged in ack. The
+// whole push is parsed and normalized before any of it is merged, then
+// committed at once, so a push failing anywhere, or whose ctx is done
+// before it is committed, leaves the aggregate as it was and its retry
+// doesn't count part of it twice.
+func (a *Aggregate) parseAndMergeAck(ctx context.Context, r io.Reader, labels []labelPair, ack *pushAck) error {
+	timings := &pushTimings{}
+	defer timings.observe()
+	staged, err := a.stagePush(ctx, r, labels, ack, timings)
 	if err != nil {
 		return err
 	}
+	if err := pushAborted(ctx); err != nil {
+		return err
+	}
 
-	for name, family := range inFamilies {
-		// Sort labels in case source sends them inconsistently
-		for _, m := range family.Metric {
-			if err := a.formatLabels(m, labels); err != nil {
+	start := time.Now()
+	defer func() { timings.merge += time.Since(start) }()
+	if err := a.commit(staged, ack); err != nil {
+		return err
+	}
+	a.enforceMemoryBudget()
+	return nil
+}
+
+// stagePush parses and normalizes a push body a chunk of families at a
+// time, staging each family in its compact form, so a push is only ever
+// held as the parsed families of one chunk next to the compact series of
+// those before it
+func (a *Aggregate) stagePush(ctx context.Context, r io.Reader, labels []labelPair, ack *pushAck, timings *pushTimings) ([]stagedFamily, error) {
+	var staged []stagedFamily
+	err := parseFamilies(r, timings, func(inFamilies map[string]*dto.MetricFamily) error {
+		for name, family := range inFamilies {
+			if err := pushAborted(ctx); err != nil {
 				return err
 			}
+			keep, err := a.normalizeFamily(name, family, labels, ack)
+			if err != nil {
+				return &familyError{family: name, err: err}
+			}
+			if keep {
+				staged = append(staged, stageFamily(name, family))
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
 
-		if err := validateFamily(family); err != nil {
-			return err
+// parseFamilies parses a push body a chunk of families at a time, handing
+// each chunk to fn, adding the time spent in each to timings unless nil
+func parseFamilies(r io.Reader, timings *pushTimings, fn func(map[string]*dto.MetricFamily) error) error {
+	chunks := getFamilyChunker(r)
+	defer chunks.release()
+
+	for {
+		chunk, startLine, readErr := chunks.next()
+		if readErr != nil && readErr != io.EOF {
+			return readErr
 		}
 
-		// family must be sorted for the merge
-		sort.Sort(byLabel(family.Metric))
+		if len(chunk) > 0 {
+			start := time.Now()
+			inFamilies, err := parseChunk(chunk, startLine)
+			parsed := time.Now()
+			if timings != nil {
+				timings.parse += parsed.Sub(start)
+			}
+			if err != nil {
+				return err
+			}
+			err = fn(inFamilies)
+			if timings != nil {
+				timings.merge += time.Since(parsed)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// MergeFamilies folds families parsed elsewhere (e.g. scraped) into the
+// aggregate, with labels added to every series as a push to a label path
+// would, honorLabels deciding which wins when a series has them already. The
+// families are modified and must not be used afterwards.
+func (a *Aggregate) MergeFamilies(families map[string]*dto.MetricFamily, labels map[string]string, honorLabels bool) error {
+	if a.replica != nil {
+		return ErrReadOnlyReplica
+	}
 
-		if err := a.saveFamily(name, family); err != nil {
-			return err
+	labelPairs := withHonorLabels(sortedLabelPairs(labels), &honorLabels)
+	if err := a.mergeFamilies(families, labelPairs, newPushAck(a.opts())); err != nil {
+		return err
+	}
+	a.enforceMemoryBudget()
+	return nil
+}
+
+// FamilyIncarnations returns an identifier of each family of names the
+// aggregate holds, families it doesn't being left out. A family dropped,
+// e.g. expired or evicted, and created again gets another identifier, so
+// callers merging deltas, like the scraper, can tell their earlier merges
+// into it are gone.
+func (a *Aggregate) FamilyIncarnations(names []string) map[string]uint64 {
+	incarnations := make(map[string]uint64, len(names))
+	for _, name := range names {
+		if family, ok := a.families.Get(name); ok {
+			incarnations[name] = family.incarnation
 		}
+	}
+	return incarnations
+}
+
+// Push merges a body in the text exposition format as a push to the label
+// path giving labels does, for services embedding the aggregate
+func (a *Aggregate) Push(body io.Reader, labels map[string]string) error {
+	if a.replica != nil {
+		return ErrReadOnlyReplica
+	}
+	return a.parseAndMerge(body, withHonorLabels(sortedLabelPairs(labels), a.opts().honorLabels))
+}
 
-		MetricCountByFamily.WithLabelValues(name).Set(float64(len(family.Metric)))
+func sortedLabelPairs(labels map[string]string) []labelPair {
+	labelPairs := make([]labelPair, 0, len(labels))
+	for name, value := range labels {
+		labelPairs = append(labelPairs, labelPair{name: name, value: value})
+	}
+	sort.Slice(labelPairs, func(i, j int) bool { return labelPairs[i].name < labelPairs[j].name })
+	return labelPairs
+}
 
+func (a *Aggregate) mergeFamilies(inFamilies map[string]*dto.MetricFamily, labels []labelPair, ack *pushAck) error {
+	staged := make([]stagedFamily, 0, len(inFamilies))
+	for name, family := range inFamilies {
+		keep, err := a.normalizeFamily(name, family, labels, ack)
+		if err != nil {
+			return &familyError{family: name, err: err}
+		}
+		if keep {
+			staged = append(staged, stageFamily(name, family))
+		}
 	}
 
-	TotalFamiliesGauge.Set(float64(a.Len()))
+	return a.commit(staged, ack)
+}
 
+// saveNormalized merges a normalized family, noting it in ack if it is new
+func (a *Aggregate) saveNormalized(name string, family *compactFamily, ack *pushAck) error {
+	watched := a.watches.watching(name, time.Now())
+	var pushed []compactSeries
+	var before map[labelSet]float64
+	if watched {
+		pushed, before = family.series, a.seriesValues(name)
+	}
+	created, err := a.saveFamily(name, family, ack.opts)
+	if err != nil {
+		return err
+	}
+	if watched {
+		a.watches.record(name, ack.producer, pushed, before, a.seriesValues(name), time.Now(), ack.opts.redactLabels)
+	}
+	if created {
+		ack.created = append(ack.created, name)
+	}
 	return nil
 }
 
-func (a *Aggregate) HandleRender(c *gin.Context) {
-	contentType := expfmt.Negotiate(c.Request.Header)
-	c.Header("Content-Type", string(contentType))
-	a.encodeAllMetrics(c.Writer, contentType)
+// normalizeFamily turns a pushed family into what is merged: labels
+// formatted and ignored ones dropped, split, ingest hooks run, schema checked,
+// rolled up, validated and sorted. It reports false when the family is
+// frozen or the hooks or tombstones dropped every series, leaving nothing
+// to merge.
+func (a *Aggregate) normalizeFamily(name string, family *dto.MetricFamily, labels []labelPair, ack *pushAck) (bool, error) {
+	if _, repeated := ack.seen[name]; repeated {
+		return false, errFamilyRepeated(name)
+	}
+	ack.seen[name] = struct{}{}
+	if a.skipFrozen(name, ack) {
+		return false, nil
+	}
+	opts := ack.opts
+
+	// Sort labels in case source sends them inconsistently
+	for _, m := range family.Metric {
+		if opts.dropsIgnoredLabels() {
+			ack.noteIgnoredLabels(m, opts.ignoredLabels)
+		}
+		if err := opts.formatLabels(m, labels); err != nil {
+			return false, err
+		}
+	}
+	if len(opts.splitRules) > 0 {
+		opts.splitLabels(family)
+	}
+	if len(opts.ingestHooks) > 0 {
+		var relabeled bool
+		if family.Metric, relabeled = hook.Apply(opts.ingestHooks, family); len(family.Metric) == 0 {
+			return false, nil
+		}
+		if relabeled {
+			collapseSeries(family)
+		}
+	}
+	if len(opts.ingestFilters) > 0 {
+		filtered, err := opts.filterIngest(family)
+		if err != nil || filtered == nil || len(filtered.Metric) == 0 {
+			return false, err
+		}
+		family.Type, family.Help, family.Unit, family.Metric = filtered.Type, filtered.Help, filtered.Unit, filtered.Metric
+	}
+	if len(opts.metadataOverrides) > 0 {
+		opts.overrideType(family)
+	}
+	if opts.schema != nil {
+		if err := opts.enforceSchema(family, ack); err != nil {
+			return false, err
+		}
+	}
+	if len(opts.rollupRules) > 0 {
+		opts.rollup(family)
+	}
+	if opts.duplicateSeries == DuplicateSeriesMerge {
+		opts.mergeDuplicates(family, ack)
+	}
+	if !a.dropTombstoned(family, ack) {
+		return false, nil
+	}
+
+	if err := validateFamily(family); err != nil {
+		return false, err
+	}
+
+	// family must be sorted for the merge
+	if !metricsSorted(family.Metric) {
+		sort.Sort(byLabel(family.Metric))
+	}
+
+	if opts.openMetrics {
+		stampCreated(family, time.Now())
+	}
+	if opts.renderTimestamps == TimestampsPush {
+		stampPushed(family, time.Now())
+	}
+
+	ack.add(family)
+	return true, nil
+}
+
+// expireFamilies drops every family that hasn't been pushed to within the
+// metric TTL, and marks the jobs that stopped pushing down
+func (a *Aggregate) expireFamilies(now time.Time) {
+	ttl, scrapes := a.metricTTL(), a.opts().scrapeTTL
+	if ttl <= 0 && scrapes <= 0 {
+		return
+	}
+	if ttl > 0 && a.pushers != nil && a.pushers.expire(now, ttl) {
+		a.generation.Add(1)
+	}
+	var horizon uint64
+	if scrapes > 0 {
+		var scraped bool
+		if horizon, scraped = a.scrapeClock.horizon(scrapes); !scraped {
+			return
+		}
+	}
+	pinned := a.completions.pinned()
+	expired := func(name string, family *Family) bool {
+		family.lock.RLock()
+		expired := (ttl <= 0 || now.Sub(family.lastUpdate) > ttl) && (scrapes <= 0 || family.mergedGen.Load() <= horizon)
+		family.lock.RUnlock()
+
+		// pinned completed groups wait for their scrape, frozen families
+		// for being thawed
+		// a pinned family that can't be read back is kept, it may
+		// have some
+		if !expired || a.frozen.has(name) {
+			return false
+		}
+		if len(pinned) == 0 {
+			return true
+		}
+		current, err := family.load()
+		return err == nil && !current.hasSeriesInGroups(pinned)
+	}
+
+	// only the expired families are deleted, checked again as they are in
+	// case they were merged into meanwhile
+	var names []string
+	a.families.Range(func(name string, family *Family) bool {
+		if expired(name, family) {
+			names = append(names, name)
+		}
+		return true
+	})
+	for _, name := range names {
+		family, ok := a.families.Delete(name, func(family *Family) bool {
+			return expired(name, family)
+		})
+		if ok {
+			a.familyDeleted(name, family)
+		}
+	}
+}
+
+// ServeRender renders the aggregate, or the sub-aggregate of its label path,
+// in the format the scraper negotiates
+func (a *Aggregate) ServeRender(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.PathValue("labels"), "/") != "" {
+		a.serveSubAggregateRender(w, r)
+		return
+	}
+	tenant, err := a.renderTenant(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tenant != "" {
+		a.serveTenantRender(w, r, tenant)
+		return
+	}
+	shard, shards, err := a.requestShard(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if shards > 0 {
+		a.serveShardRender(w, r, shard, shards)
+		return
+	}
+
+	contentType := a.negotiateFormat(r.Header)
+	completed := a.completions.current()
+	opts := a.opts()
+	if opts.renderFlushEvery > 0 {
+		generation := a.generation.Load()
+		if a.streamRender(w, r, contentType, opts) {
+			a.dropServedGroups(completed)
+			a.noteScraped(generation, opts)
+		}
+		return
+	}
+
+	rendered, err := a.render(contentType, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gzipped := acceptsGzip(r.Header.Get("Accept-Encoding"))
+	etag := rendered.etag
+	if gzipped {
+		etag = gzipETag(etag)
+	}
+	w.Header().Set("Content-Type", string(contentType))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		if rendered.complete {
+			a.dropServedGroups(completed)
+			a.noteScraped(rendered.generation, opts)
+		}
+		return
+	}
+
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		err = writeGzipped(w, rendered.body)
+	} else {
+		_, err = w.Write(rendered.body)
+	}
+	if err != nil {
+		log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+	} else if rendered.complete {
+		a.dropServedGroups(completed)
+		a.noteScraped(rendered.generation, opts)
+	}
 
 	// TODO reset gauges
 }
 
-func (a *Aggregate) encodeAllMetrics(writer io.Writer, contentType expfmt.Format) {
-	enc := expfmt.NewEncoder(writer, contentType)
+func (a *Aggregate) encodeAllMetrics(writer io.Writer, contentType expfmt.Format) error {
+	_, err := a.encodeRender(writer, contentType, a.opts())
+	return err
+}
 
-	a.familiesLock.RLock()
-	defer a.familiesLock.RUnlock()
+// encodeRender encodes the render of /metrics with opts, reporting whether
+// it is complete, see eachRendered. Families are encoded in parallel unless
+// some are read back from disk, which are encoded one at a time.
+func (a *Aggregate) encodeRender(writer io.Writer, contentType expfmt.Format, opts *aggregateOptions) (bool, error) {
+	in, err := a.instantOf(nil)
+	if err != nil {
+		return false, err
+	}
+	defer in.close()
 
-	metricNames := []string{}
-	metricTypeCounts := make(map[string]int)
-	for name, family := range a.families {
-		metricNames = append(metricNames, name)
-		var typeName string
-		if family.Type == nil {
-			typeName = "unknown"
-		} else {
-			typeName = dto.MetricType_name[int32(*family.Type)]
+	var complete bool
+	if workers := runtime.GOMAXPROCS(0); workers > 1 && len(in) >= parallelEncodeThreshold && !in.spilled() {
+		var families []*compactFamily
+		complete, err = a.eachRendered(in, opts, nil, func(family *compactFamily) error {
+			families = append(families, family)
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		encodeFamiliesParallel(writer, contentType, families, workers, opts.encoderOptions(contentType)...)
+	} else {
+		fe := newFamilyEncoder(writer, contentType, opts.encoderOptions(contentType)...)
+		var writeErr error
+		complete, err = a.eachRendered(in, opts, nil, func(family *compactFamily) error {
+			writeErr = fe.encode(family)
+			return writeErr
+		})
+		if writeErr != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", writeErr.Error())
+		} else if err != nil {
+			return false, err
 		}
-		metricTypeCounts[typeName]++
 	}
+	if contentType.FormatType() == expfmt.TypeOpenMetrics {
+		if _, err := expfmt.FinalizeOpenMetrics(writer); err != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+		}
+	}
+	return complete, nil
+}
 
-	sort.Strings(metricNames)
+// eachRendered calls visit with the families of in as the render of
+// /metrics with opts encodes them, sorted by name, after the render filters
+// and the series limit, reporting whether the view is complete, no family
+// or series dropped by a filter or truncated. Only complete renders count
+// as scrapes of every family: for --scrapeTTL, completed groups and scrape
+// receipts. keep is that of eachRenderFamily.
+func (a *Aggregate) eachRendered(in instant, opts *aggregateOptions, keep func(name string) bool, visit func(*compactFamily) error) (bool, error) {
+	// dropped and series count the families and series filters left out
+	var dropped, series int
+	eachFiltered := func(visit func(*compactFamily) error) error {
+		dropped, series = 0, 0
+		return a.eachRenderFamily(in, opts, keep, func(family *compactFamily) error {
+			filtered := opts.filterRender(family)
+			if filtered == nil {
+				dropped++
+				series += len(family.series)
+				return nil
+			}
+			series += len(family.series) - len(filtered.series)
+			return visit(filtered)
+		})
+	}
+	limit := opts.maxRenderSeries
+	if limit <= 0 {
+		err := eachFiltered(visit)
+		return dropped == 0 && series <= 0, err
+	}
 
-	for _, name := range metricNames {
-		if a.encodeMetric(name, enc) {
-			return
+	// the warning counting the truncated families sorts before most of
+	// them, so they are found first: among the families kept for it when
+	// they are all in memory, else in a first pass reading spilled ones
+	// back, rather than holding them
+	var kept []*compactFamily
+	truncated := &dto.MetricFamily{
+		Name: proto.String(TruncatedSeriesMetric),
+		Help: proto.String(truncatedSeriesHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	err := eachFiltered(func(family *compactFamily) error {
+		if !in.spilled() {
+			kept = append(kept, family)
 		}
+		if len(family.series) > limit {
+			// families are sorted by name, so are the warning's series
+			truncated.Metric = append(truncated.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{{Name: proto.String("family"), Value: proto.String(family.name)}},
+				Gauge: &dto.Gauge{Value: proto.Float64(float64(len(family.series) - limit))},
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	complete := len(truncated.Metric) == 0
+	var warning *compactFamily
+	if !complete {
+		warning = compactFamilyFromDTO(truncated)
+	}
+	limited := func(family *compactFamily) error {
+		// the warning is left out for a family of its name
+		if warning != nil && warning.name <= family.name {
+			if warning.name < family.name {
+				if err := visit(warning); err != nil {
+					return err
+				}
+			}
+			warning = nil
+		}
+		if len(family.series) > limit {
+			truncated := *family
+			truncated.series = family.series[:limit]
+			family = &truncated
+		}
+		return visit(family)
+	}
+	if in.spilled() {
+		err = eachFiltered(limited)
+	} else {
+		for _, family := range kept {
+			if err = limited(family); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && warning != nil {
+		err = visit(warning)
 	}
+	return complete && dropped == 0 && series <= 0, err
+}
 
-	MetricCountByType.Reset()
-	for typeName, count := range metricTypeCounts {
-		MetricCountByType.WithLabelValues(typeName).Set(float64(count))
+// serveFamilies encodes families for an uncached render with opts
+func serveFamilies(w http.ResponseWriter, r *http.Request, contentType expfmt.Format, families []*compactFamily, opts *aggregateOptions) {
+	buf := new(bytes.Buffer)
+	encodeFamilies(buf, contentType, families, opts.encoderOptions(contentType)...)
+	if contentType.FormatType() == expfmt.TypeOpenMetrics {
+		if _, err := expfmt.FinalizeOpenMetrics(buf); err != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+		}
 	}
 
+	w.Header().Set("Content-Type", string(contentType))
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+	var err error
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		err = writeGzipped(w, buf.Bytes())
+	} else {
+		_, err = w.Write(buf.Bytes())
+	}
+	if err != nil {
+		log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+	}
 }
 
-func (a *Aggregate) encodeMetric(name string, enc expfmt.Encoder) bool {
-	a.families[name].lock.RLock()
-	defer a.families[name].lock.RUnlock()
+// Gather returns every family currently aggregated, sorted by name, making
+// the aggregate a prometheus.Gatherer. The families point into the aggregate's
+// state and must be treated as read-only.
+func (a *Aggregate) Gather() ([]*dto.MetricFamily, error) {
+	snapshot, err := a.pointInTime()
+	if err != nil {
+		return nil, err
+	}
+	opts := a.opts()
+	families := make([]*dto.MetricFamily, len(snapshot))
+	for i, family := range snapshot {
+		families[i] = opts.overrideMetadata(opts.collapseIgnored(family)).toDTO()
+	}
+	return families, nil
+}
+
+// encodeMetric reports whether the family could be encoded, failures are logged and counted
+func encodeMetric(family *dto.MetricFamily, enc expfmt.Encoder) bool {
+	if err := enc.Encode(family); err != nil {
+		RenderEncodeErrors.Inc()
+		log.Printf("Skipping metric family %s, an error has occurred during metrics encoding:\n\n%s\n", family.GetName(), err.Error())
+		return false
+	}
+	return true
+}
 
-	if err := enc.Encode(a.families[name].MetricFamily); err != nil {
-		log.Printf("An error has occurred during metrics encoding:\n\n%s\n", err.Error())
+// familyNeedsEscaping reports whether any name in the family falls outside the legacy character set
+func familyNeedsEscaping(family *dto.MetricFamily) bool {
+	if !model.IsValidLegacyMetricName(family.GetName()) {
 		return true
 	}
+	for _, m := range family.Metric {
+		for _, l := range m.Label {
+			if !model.IsValidLegacyMetricName(l.GetName()) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
 var ErrOddNumberOfLabelParts = errors.New("labels must be defined in pairs")
 
-func (a *Aggregate) HandleInsert(c *gin.Context) {
-	labelParts, jobName, err := parseLabelsInPath(c)
+// ServeInsert merges a push, it reads the label path from the "labels" path
+// value
+func (a *Aggregate) ServeInsert(w http.ResponseWriter, r *http.Request) {
+	if a.replica != nil {
+		a.pushError(w, r, http.StatusForbidden, ErrReadOnlyReplica)
+		return
+	}
+
+	if a.rejectMaintenance(w, r) {
+		return
+	}
+
+	if a.pushLog != nil {
+		var logPush func()
+		w, logPush = a.pushLog.capture(w, r, a.clientAddr(r))
+		defer logPush()
+	}
+
+	labelParts, jobName, err := parseLabelsInPath(r.PathValue("labels"))
+	if err != nil {
+		log.Println(err)
+		a.pushError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.checkLabelAllowlist(r, labelParts); err != nil {
+		IngestRejected.WithLabelValues("label_allowlist").Inc()
+		log.Println(err)
+		a.pushError(w, r, http.StatusForbidden, err)
+		return
+	}
+	honor, err := a.pushHonorLabels(r)
+	if err != nil {
+		log.Println(err)
+		a.pushError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	wantReceipt, err := a.wantsReceipt(r)
+	if err != nil {
+		log.Println(err)
+		a.pushError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	tenant, err := a.requestTenant(r)
 	if err != nil {
 		log.Println(err)
-		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		a.pushError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if a.proxyUnowned(w, r, tenant) {
+		return
+	}
+	// owned pushes only, the sub-aggregates proxying nothing
+	if sub := a.subAggregateFor(labelParts); sub != nil {
+		sub.ServeInsert(w, r)
+		return
+	}
+	producer := a.requestProducer(r, jobName, tenant)
+	if a.rejectQuarantined(w, r, producer) {
+		return
+	}
+	if a.labelValues != nil {
+		if err := a.labelValues.admit(labelParts, time.Now(), a.metricTTL()); err != nil {
+			a.noteOutcome(producer, err)
+			IngestRejected.WithLabelValues("label_values").Inc()
+			log.Println(err)
+			a.pushError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	a.completions.reopen(labelParts)
+	var shadowLabels []labelPair
+	shadowed := a.shadow != nil
+	if shadowed {
+		shadowLabels, shadowed = a.shadowLabels(r, labelParts, tenant)
+	}
+	labelParts = a.pushLabels(r, labelParts, honor, tenant)
+
+	idempotencyKey, claimed := a.claimIdempotencyKey(r, producer)
+	switch claimed {
+	case keyDuplicate:
+		acceptPush(w, r, ackBody{Status: "duplicate"})
+		return
+	case keyInProgress:
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		a.pushError(w, r, http.StatusConflict, ErrPushInProgress)
+		return
+	}
+
+	opts := a.opts()
+	if deadline := opts.pushDeadline; deadline > 0 {
+		var cancel context.CancelFunc
+		r, cancel = withPushDeadline(w, r, deadline)
+		defer cancel()
+	}
+
+	if a.ingestQueue != nil {
+		if !a.enqueueInsert(w, r, labelParts, shadowLabels, shadowed, jobName, producer, wantReceipt, idempotencyKey) {
+			a.settleIdempotencyKey(idempotencyKey, ErrIngestQueueFull)
+		}
 		return
 	}
 
-	if err := a.parseAndMerge(c.Request.Body, labelParts); err != nil {
+	if !a.limiter.tryAcquire() {
+		a.settleIdempotencyKey(idempotencyKey, ErrIngestSaturated)
+		a.rejectOverloaded(w, r, ErrIngestSaturated, "saturated")
+		return
+	}
+	defer a.limiter.release()
+
+	body := &countingReader{r: r.Body}
+	var shadowBody bytes.Buffer
+	if shadowed {
+		body.r = io.TeeReader(r.Body, &shadowBody)
+	}
+
+	ack := newPushAck(opts)
+	ack.producer = producer
+	a.trackPushShape(ack)
+	err = a.parseAndMergeAck(r.Context(), body, labelParts, ack)
+	a.noteOutcome(producer, err)
+	a.noteNewFamilies(producer, ack)
+	a.settleIdempotencyKey(idempotencyKey, err)
+	if err != nil {
+		if errors.Is(err, ErrMemoryPressure) {
+			IngestRejected.WithLabelValues("memory_pressure").Inc()
+			w.Header().Set("Retry-After", retryAfterSeconds)
+		}
+		if reason := abortReason(err); reason != "" {
+			IngestRejected.WithLabelValues(reason).Inc()
+		}
 		log.Println(err)
-		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		a.pushError(w, r, insertErrorStatus(err), err)
 		return
 	}
 
 	MetricPushes.WithLabelValues(jobName).Inc()
-	c.Status(http.StatusAccepted)
+	a.notePush(jobName, producer.tenant)
+	a.noteUsage(producer, body.n, ack)
+	a.checkPushShape(producer, ack)
+	ack.observe(jobName, body.n)
+	if shadowed {
+		a.feedShadow(shadowBody.Bytes(), shadowLabels)
+	}
+	receipt := a.issueReceipt(w, wantReceipt, jobName)
+	a.noteMerged(receipt, nil)
+	ackBody := ack.body()
+	ackBody.Receipt = receiptID(receipt)
+	acceptPush(w, r, ackBody)
+}
+
+// pushLabels returns the labels a push adds to its series, from its label
+// path and request
+func (a *Aggregate) pushLabels(r *http.Request, labelParts []labelPair, honor *bool, tenant string) []labelPair {
+	labelParts = withHonorLabels(labelParts, honor)
+	labelParts = a.withLocalPushLabels(r, labelParts)
+	if tenant != "" {
+		labelParts = a.withTenantLabel(labelParts, tenant)
+	}
+	return labelParts
+}
+
+// enqueueInsert reports whether the push was queued
+func (a *Aggregate) enqueueInsert(w http.ResponseWriter, r *http.Request, labelParts, shadowLabels []labelPair, shadowed bool, jobName string, producer producerKey, wantReceipt bool, idempotencyKey string) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		a.pushError(w, r, insertErrorStatus(err), err)
+		return false
+	}
+
+	receipt := a.issueReceipt(w, wantReceipt, jobName)
+	if err := a.ingestQueue.enqueue(ingestJob{body: body, labels: labelParts, shadowLabels: shadowLabels, shadowed: shadowed, jobName: jobName, producer: producer, receipt: receipt, idempotencyKey: idempotencyKey}); err != nil {
+		a.noteMerged(receipt, err)
+		w.Header().Del("Scrape-Receipt")
+		if errors.Is(err, ErrIngestClosed) {
+			a.pushError(w, r, http.StatusServiceUnavailable, err)
+			return false
+		}
+		a.rejectOverloaded(w, r, err, "queue_full")
+		return false
+	}
+
+	acceptPush(w, r, ackBody{Status: "queued", Receipt: receiptID(receipt)})
+	return true
+}
+
+func (a *Aggregate) rejectOverloaded(w http.ResponseWriter, r *http.Request, err error, reason string) {
+	IngestRejected.WithLabelValues(reason).Inc()
+	w.Header().Set("Retry-After", retryAfterSeconds)
+	a.pushError(w, r, http.StatusTooManyRequests, err)
+}
+
+func insertErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, ErrMemoryPressure) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, ErrFilterFailed) {
+		return http.StatusInternalServerError
+	}
+	if errors.Is(err, ErrPushDeadline) || errors.Is(err, ErrPushCanceled) {
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
 }
 
 type labelPair struct {
 	name, value string
+	// ifAbsent labels are only added to series that don't have them already
+	ifAbsent bool
+	// override labels replace the series' own, which is kept as exported_<name>
+	override bool
 }
 
-func parseLabelsInPath(c *gin.Context) ([]labelPair, string, error) {
-	labelString := c.Param("labels")
+func parseLabelsInPath(labelString string) ([]labelPair, string, error) {
 	labelString = strings.Trim(labelString, "/")
 	if labelString == "" {
 		return nil, "", nil
@@ -240,7 +1295,7 @@ func parseLabelsInPath(c *gin.Context) ([]labelPair, string, error) {
 	for idx := 0; idx < len(labelParts); idx += 2 {
 		name := labelParts[idx]
 		value := labelParts[idx+1]
-		labelPairs = append(labelPairs, labelPair{name, value})
+		labelPairs = append(labelPairs, labelPair{name: name, value: value})
 		if name == "job" {
 			jobName = value
 		}
@@ -3,14 +3,40 @@ package metrics
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/snappy"
 	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/require"
+	"github.com/zapier/prom-aggregation-gateway/hook"
+	"github.com/zapier/prom-aggregation-gateway/wasm"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -168,7 +194,7 @@ time_ms_count{a="a",b="b",job="test"} 2
 )
 
 var testLabels = []labelPair{
-	{"job", "test"},
+	{name: "job", value: "test"},
 }
 
 func TestAggregate(t *testing.T) {
@@ -277,3 +303,3759 @@ func BenchmarkConcurrentAggregate(b *testing.B) {
 		})
 	}
 }
+
+func TestMetricTTL(t *testing.T) {
+	ttl := time.Minute
+	agg := NewAggregate(SetTTLMetricTime(&ttl))
+
+	err := agg.parseAndMerge(strings.NewReader(in1), testLabels)
+	require.NoError(t, err)
+	require.Equal(t, 3, agg.Len())
+
+	counter, ok := agg.families.Get("counter")
+	require.True(t, ok)
+	counter.lastUpdate = time.Now().Add(-2 * ttl)
+
+	agg.expireFamilies(time.Now())
+	require.Equal(t, 2, agg.Len())
+	_, ok = agg.families.Get("counter")
+	require.False(t, ok)
+
+	// the other renders leave out expired families too
+	gauge, ok := agg.families.Get("gauge")
+	require.True(t, ok)
+	gauge.lastUpdate = time.Now().Add(-2 * ttl)
+	w := httptest.NewRecorder()
+	agg.ServeRenderJSON(w, httptest.NewRequest("GET", "/api/v1/metrics.json?name=gauge", nil))
+	require.JSONEq(t, `{"status":"success","data":[]}`, w.Body.String())
+	require.Equal(t, 1, agg.Len())
+
+	histogram, ok := agg.families.Get("histogram")
+	require.True(t, ok)
+	histogram.lastUpdate = time.Now().Add(-2 * ttl)
+	w = httptest.NewRecorder()
+	agg.ServeRenderCSV(w, httptest.NewRequest("GET", "/api/v1/metrics.csv", nil))
+	require.Equal(t, "name,labels,value,timestamp\n", w.Body.String())
+	require.Equal(t, 0, agg.Len())
+}
+
+func TestRenderDuringMerge(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	g, _ := errgroup.WithContext(context.Background())
+	for n := 0; n < 10; n++ {
+		g.Go(func() error {
+			return agg.parseAndMerge(strings.NewReader(in2), testLabels)
+		})
+		g.Go(func() error {
+			agg.encodeAllMetrics(io.Discard, expfmt.FmtText)
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), `counter{job="test"} 321`)
+}
+
+func TestRenderCacheInvalidation(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	first, err := agg.render(expfmt.FmtText, agg.opts())
+	require.NoError(t, err)
+	require.Contains(t, string(first.body), `counter{job="test"} 31`)
+	cached, err := agg.render(expfmt.FmtText, agg.opts())
+	require.NoError(t, err)
+	require.Equal(t, first, cached)
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in2), testLabels))
+	second, err := agg.render(expfmt.FmtText, agg.opts())
+	require.NoError(t, err)
+	require.Contains(t, string(second.body), `counter{job="test"} 60`)
+	require.NotEqual(t, first.etag, second.etag)
+}
+
+func TestStreamingParse(t *testing.T) {
+	t.Run("chunks per family", func(t *testing.T) {
+		chunks := getFamilyChunker(strings.NewReader(in1))
+		defer chunks.release()
+
+		var starts []int
+		for {
+			chunk, start, err := chunks.next()
+			if len(chunk) > 0 {
+				starts = append(starts, start)
+			}
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.Equal(t, []int{1, 5, 8}, starts)
+	})
+
+	t.Run("parse error line is relative to the push", func(t *testing.T) {
+		agg := NewAggregate()
+		err := agg.parseAndMerge(strings.NewReader(in1+"histogram_count{ 1\n"), testLabels)
+		require.ErrorContains(t, err, "line 23")
+	})
+
+	t.Run("repeated family", func(t *testing.T) {
+		agg := NewAggregate()
+		err := agg.parseAndMerge(strings.NewReader("# TYPE a counter\na 1\n# TYPE b counter\nb 1\n# TYPE a counter\na 2\n"), testLabels)
+		require.EqualError(t, err, "metric family a appears more than once in the push")
+	})
+}
+
+func TestAsyncIngest(t *testing.T) {
+	agg := NewAggregate(SetAsyncIngest(2, 10))
+
+	require.NoError(t, agg.ingestQueue.enqueue(ingestJob{body: []byte(in1), labels: testLabels, jobName: "test"}))
+	require.NoError(t, agg.ingestQueue.enqueue(ingestJob{body: []byte(in2), labels: testLabels, jobName: "test"}))
+	agg.Close()
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, want, buf.String())
+
+	// pushes racing the shutdown are refused, not sent on the closed queue
+	require.ErrorIs(t, agg.ingestQueue.enqueue(ingestJob{body: []byte(in1), labels: testLabels, jobName: "test"}), ErrIngestClosed)
+	w := httptest.NewRecorder()
+	agg.ServeInsert(w, httptest.NewRequest("POST", "/metrics", strings.NewReader(in1)))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestIngestBackpressure(t *testing.T) {
+	agg := NewAggregate(SetMaxConcurrentPushes(1))
+	require.True(t, agg.limiter.tryAcquire())
+
+	w := httptest.NewRecorder()
+	agg.ServeInsert(w, httptest.NewRequest("POST", "/metrics", strings.NewReader(in1)))
+
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, retryAfterSeconds, w.Header().Get("Retry-After"))
+
+	agg.limiter.release()
+	w = httptest.NewRecorder()
+	agg.ServeInsert(w, httptest.NewRequest("POST", "/metrics", strings.NewReader(in1)))
+
+	require.Equal(t, 202, w.Code)
+}
+
+func benchmarkAggregate(b testing.TB, families, series int) *Aggregate {
+	a := NewAggregate()
+	for f := 0; f < families; f++ {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "# HELP family_%d A counter\n# TYPE family_%d counter\n", f, f)
+		for s := 0; s < series; s++ {
+			fmt.Fprintf(&sb, "family_%d{series=\"%d\"} %d\n", f, s, s)
+		}
+		if err := a.parseAndMerge(strings.NewReader(sb.String()), testLabels); err != nil {
+			b.Fatalf("unexpected error %s", err)
+		}
+	}
+	return a
+}
+
+func BenchmarkEncodeAllMetrics(b *testing.B) {
+	a := benchmarkAggregate(b, 10000, 3)
+	for _, contentType := range []expfmt.Format{expfmt.FmtText, expfmt.FmtProtoDelim} {
+		b.Run(string(contentType), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				a.encodeAllMetrics(io.Discard, contentType)
+			}
+		})
+	}
+}
+
+func BenchmarkServeRender(b *testing.B) {
+	a := benchmarkAggregate(b, 10000, 3)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		// a push between scrapes forces a full re-encode every time
+		if err := a.parseAndMerge(strings.NewReader(gaugeInput), testLabels); err != nil {
+			b.Fatalf("unexpected error %s", err)
+		}
+
+		a.ServeRender(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	}
+}
+
+func TestProtoDelimEncoderMatchesExpfmt(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	have := new(bytes.Buffer)
+	agg.encodeAllMetrics(have, expfmt.FmtProtoDelim)
+
+	wantBuf := new(bytes.Buffer)
+	enc := expfmt.NewEncoder(wantBuf, expfmt.FmtProtoDelim)
+	for _, f := range agg.snapshot() {
+		require.NoError(t, enc.Encode(f.family.head().toDTO()))
+	}
+
+	require.Equal(t, wantBuf.Bytes(), have.Bytes())
+}
+
+func TestMemoryBudgetEviction(t *testing.T) {
+	var old strings.Builder
+	old.WriteString("# TYPE old counter\n")
+	for s := 0; s < 20; s++ {
+		fmt.Fprintf(&old, "old{series=\"%d\"} 1\n", s)
+	}
+
+	sizeOf := func(input string) int64 {
+		agg := NewAggregate()
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(input), testLabels))
+		return agg.memoryBytes.Load()
+	}
+	budget := sizeOf(old.String()) + sizeOf(in1) - 1
+
+	agg := NewAggregate(SetMemoryBudget(budget))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(old.String()), testLabels))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	// old is the least recently pushed family, so it goes first
+	_, ok := agg.families.Get("old")
+	require.False(t, ok)
+	require.Equal(t, 3, agg.Len())
+	require.LessOrEqual(t, agg.memoryBytes.Load(), budget)
+}
+
+func TestParallelEncodeMatchesSequential(t *testing.T) {
+	agg := benchmarkAggregate(t, parallelEncodeThreshold+10, 2)
+	snapshot := agg.snapshot()
+	families := make([]*compactFamily, len(snapshot))
+	for i, f := range snapshot {
+		families[i] = f.family.head()
+	}
+
+	for _, contentType := range []expfmt.Format{expfmt.FmtText, expfmt.FmtProtoDelim} {
+		sequential := new(bytes.Buffer)
+		require.True(t, encodeFamilies(sequential, contentType, families))
+
+		parallel := new(bytes.Buffer)
+		encodeFamiliesParallel(parallel, contentType, families, 7)
+
+		require.Equal(t, sequential.Bytes(), parallel.Bytes())
+	}
+}
+
+func TestMergeFamilyCoalescesPendingPushes(t *testing.T) {
+	parse := func(input string) *dto.MetricFamily {
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(strings.NewReader(input))
+		require.NoError(t, err)
+		return families["counter"]
+	}
+
+	mf := newMetricFamily(compactFamilyFromDTO(parse("# TYPE counter counter\ncounter{a=\"1\"} 1\n")), MetricCountByFamily)
+	// a concurrent push that queued its metrics but hasn't got the lock yet
+	mf.pending = append(mf.pending, compactSeriesFromDTO(dto.MetricType_COUNTER, parse("# TYPE counter counter\ncounter{a=\"2\"} 2\n").Metric))
+
+	_, err := mf.mergeFamily(compactFamilyFromDTO(parse("# TYPE counter counter\ncounter{a=\"1\"} 3\n")), nil, false, false, false)
+	require.NoError(t, err)
+	require.Empty(t, mf.pending)
+
+	buf := new(bytes.Buffer)
+	require.True(t, encodeFamilies(buf, expfmt.FmtText, []*compactFamily{mf.head()}))
+	require.Equal(t, "# TYPE counter counter\ncounter{a=\"1\"} 4\ncounter{a=\"2\"} 2\n", buf.String())
+}
+
+func BenchmarkParallelDistinctFamilies(b *testing.B) {
+	const families = 64
+	inputs := make([]string, families)
+	for f := range inputs {
+		inputs[f] = fmt.Sprintf("# TYPE family_%d counter\nfamily_%d{a=\"a\"} 1\n", f, f)
+	}
+
+	a := NewAggregate()
+	for _, input := range inputs {
+		if err := a.parseAndMerge(strings.NewReader(input), testLabels); err != nil {
+			b.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		input := inputs[next.Add(1)%families]
+		for pb.Next() {
+			if err := a.parseAndMerge(strings.NewReader(input), testLabels); err != nil {
+				b.Fatalf("unexpected error %s", err)
+			}
+		}
+	})
+}
+
+func TestOpenMetricsRender(t *testing.T) {
+	push := "# TYPE some_counter_total counter\nsome_counter_total 1\n"
+	accept := "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5"
+
+	render := func(agg *Aggregate) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Accept", accept)
+		agg.ServeRender(w, r)
+		return w
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		agg := NewAggregate()
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(push), nil))
+
+		w := render(agg)
+		require.Equal(t, expfmt.TypeTextPlain, expfmt.Format(w.Header().Get("Content-Type")).FormatType())
+		require.Equal(t, push, w.Body.String())
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		agg := NewAggregate(SetOpenMetrics(true))
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(push), nil))
+		family, ok := agg.families.Get("some_counter_total")
+		require.True(t, ok)
+		created := family.head().toDTO().Metric[0].Counter.CreatedTimestamp
+		require.NotNil(t, created)
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(push), nil))
+
+		w := render(agg)
+		require.Equal(t, expfmt.TypeOpenMetrics, expfmt.Format(w.Header().Get("Content-Type")).FormatType())
+		body := w.Body.String()
+		require.Contains(t, body, "# TYPE some_counter counter\nsome_counter_total 2.0\n")
+		require.Contains(t, body, fmt.Sprintf("some_counter_created %g\n", float64(created.AsTime().UnixNano())/1e9))
+		require.True(t, strings.HasSuffix(body, "# EOF\n"), body)
+	})
+}
+
+func TestCountGaugesFollowMergeAndExpiry(t *testing.T) {
+	ttl := time.Minute
+	agg := NewAggregate(SetTTLMetricTime(&ttl))
+	totalBefore := testutil.ToFloat64(TotalFamiliesGauge)
+	countersBefore := testutil.ToFloat64(MetricCountByType.WithLabelValues("COUNTER"))
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE gauge_test_a counter\ngauge_test_a{a=\"1\"} 1\n# TYPE gauge_test_b gauge\ngauge_test_b 1\n"), nil))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE gauge_test_a counter\ngauge_test_a{a=\"2\"} 1\n"), nil))
+
+	require.Equal(t, totalBefore+2, testutil.ToFloat64(TotalFamiliesGauge))
+	require.Equal(t, countersBefore+1, testutil.ToFloat64(MetricCountByType.WithLabelValues("COUNTER")))
+	require.Equal(t, 2.0, testutil.ToFloat64(MetricCountByFamily.WithLabelValues("gauge_test_a")))
+
+	family, ok := agg.families.Get("gauge_test_a")
+	require.True(t, ok)
+	family.lastUpdate = time.Now().Add(-2 * ttl)
+	agg.expireFamilies(time.Now())
+
+	require.Equal(t, totalBefore+1, testutil.ToFloat64(TotalFamiliesGauge))
+	require.Equal(t, countersBefore, testutil.ToFloat64(MetricCountByType.WithLabelValues("COUNTER")))
+	require.False(t, MetricCountByFamily.DeleteLabelValues("gauge_test_a"))
+}
+
+func TestLoadShedding(t *testing.T) {
+	// any live heap is over a one byte threshold
+	agg := NewAggregate(SetLoadShedding(1))
+	defer agg.Close()
+	require.True(t, agg.shedding())
+
+	agg.memoryMonitor.shedding.Store(false)
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE existing counter\nexisting 1\n"), nil))
+	agg.memoryMonitor.shedding.Store(true)
+
+	push := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, httptest.NewRequest("POST", "/metrics", strings.NewReader(body)))
+		return w
+	}
+
+	w := push("# TYPE existing counter\nexisting 1\n")
+	require.Equal(t, 202, w.Code)
+
+	w = push("# TYPE fresh counter\nfresh 1\n")
+	require.Equal(t, 503, w.Code)
+	require.Equal(t, retryAfterSeconds, w.Header().Get("Retry-After"))
+	_, ok := agg.families.Get("fresh")
+	require.False(t, ok)
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, "# TYPE existing counter\nexisting 2\n", buf.String())
+}
+
+func TestStreamingRender(t *testing.T) {
+	buffered := NewAggregate()
+	require.NoError(t, buffered.parseAndMerge(strings.NewReader(in1), testLabels))
+	want := httptest.NewRecorder()
+	buffered.ServeRender(want, httptest.NewRequest("GET", "/metrics", nil))
+
+	streamed := NewAggregate(SetStreamingRender(1, 0))
+	require.NoError(t, streamed.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	t.Run("matches buffered", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		streamed.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		require.Equal(t, want.Body.String(), w.Body.String())
+		require.True(t, w.Flushed)
+		require.Empty(t, w.Header().Get("ETag"))
+	})
+
+	t.Run("aborts on timeout", func(t *testing.T) {
+		streamed.options.renderTimeout = time.Nanosecond
+		defer func() { streamed.options.renderTimeout = 0 }()
+
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			streamed.ServeRender(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		})
+	})
+
+	t.Run("keeps the options it started with", func(t *testing.T) {
+		opts := *streamed.opts()
+		// as if reloaded in between, streaming turned off
+		streamed.options.renderFlushEvery = 0
+		defer func() { streamed.options.renderFlushEvery = 1 }()
+
+		w := httptest.NewRecorder()
+		require.True(t, streamed.streamRender(w, httptest.NewRequest("GET", "/metrics", nil), expfmt.FmtText, &opts))
+		require.Equal(t, want.Body.String(), w.Body.String())
+	})
+}
+
+func TestReplicaSync(t *testing.T) {
+	primary := NewAggregate()
+	require.NoError(t, primary.parseAndMerge(strings.NewReader(in1), testLabels))
+	srv := httptest.NewServer(http.HandlerFunc(primary.ServeRender))
+	defer srv.Close()
+
+	replica := NewAggregate(SetReplicaOf(srv.URL, time.Hour))
+	defer replica.Close()
+
+	render := func(agg *Aggregate) string {
+		buf := new(bytes.Buffer)
+		agg.encodeAllMetrics(buf, expfmt.FmtText)
+		return buf.String()
+	}
+
+	require.NoError(t, replica.replica.sync(replica))
+	require.Equal(t, render(primary), render(replica))
+
+	// the background sync may run concurrently, and then be unmodified too
+	notModified := testutil.ToFloat64(ReplicaSyncs.WithLabelValues("not_modified"))
+	require.NoError(t, replica.replica.sync(replica))
+	require.GreaterOrEqual(t, testutil.ToFloat64(ReplicaSyncs.WithLabelValues("not_modified")), notModified+1)
+
+	require.NoError(t, primary.parseAndMerge(strings.NewReader(in2), testLabels))
+	require.True(t, primary.removeFamily("gauge"))
+	require.NoError(t, replica.replica.sync(replica))
+	require.Equal(t, render(primary), render(replica))
+	require.Equal(t, primary.Len(), replica.Len())
+
+	w := httptest.NewRecorder()
+	replica.ServeInsert(w, httptest.NewRequest("POST", "/metrics", strings.NewReader(in1)))
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRenderSkipsFamilyFailingToEncode(t *testing.T) {
+	family := func(name string, ty dto.MetricType) *compactFamily {
+		return &compactFamily{name: name, ty: ty, series: []compactSeries{{labels: makeLabelSet(nil), value: 1}}}
+	}
+	// gauge histograms can't be expressed in the text format
+	families := []*compactFamily{
+		family("before", dto.MetricType_GAUGE),
+		family("broken", dto.MetricType_GAUGE_HISTOGRAM),
+		family("after", dto.MetricType_GAUGE),
+	}
+
+	errorsBefore := testutil.ToFloat64(RenderEncodeErrors)
+	buf := new(bytes.Buffer)
+	require.True(t, encodeFamilies(buf, expfmt.FmtText, families))
+	require.Equal(t, "# TYPE before gauge\nbefore 1\n# TYPE after gauge\nafter 1\n", buf.String())
+	require.Equal(t, errorsBefore+1, testutil.ToFloat64(RenderEncodeErrors))
+}
+
+func TestLocalPushLabels(t *testing.T) {
+	agg := NewAggregate(SetLocalPushLabels(map[string]string{"pod": "app-0", "namespace": "prod"}))
+
+	for _, c := range []struct {
+		remoteAddr, path, body string
+	}{
+		{"127.0.0.1:4321", "/metrics", "# TYPE local counter\nlocal 1\n"},
+		{"[::1]:4321", "/metrics/namespace/override", "# TYPE override counter\noverride 1\n"},
+		{"127.0.0.1:4321", "/metrics", "# TYPE own counter\nown{pod=\"own\"} 1\n"},
+		{"192.0.2.1:4321", "/metrics", "# TYPE remote counter\nremote 1\n"},
+	} {
+		r := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+		r.RemoteAddr = c.remoteAddr
+		r.SetPathValue("labels", strings.TrimPrefix(c.path, "/metrics"))
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, r)
+		require.Equal(t, 202, w.Code, w.Body.String())
+	}
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, `# TYPE local counter
+local{namespace="prod",pod="app-0"} 1
+# TYPE override counter
+override{namespace="override",pod="app-0"} 1
+# TYPE own counter
+own{namespace="prod",pod="own"} 1
+# TYPE remote counter
+remote 1
+`, buf.String())
+}
+
+func TestFlush(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	t.Run("push", func(t *testing.T) {
+		central := NewAggregate()
+		srv := httptest.NewServer(http.HandlerFunc(central.ServeInsert))
+		defer srv.Close()
+
+		require.NoError(t, agg.Flush(context.Background(), srv.URL+"/metrics", FlushPush))
+
+		want, got := new(bytes.Buffer), new(bytes.Buffer)
+		agg.encodeAllMetrics(want, expfmt.FmtText)
+		central.encodeAllMetrics(got, expfmt.FmtText)
+		require.Equal(t, want.String(), got.String())
+	})
+
+	t.Run("remote_write", func(t *testing.T) {
+		var series []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			series = decodeRemoteWrite(t, body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		require.NoError(t, agg.Flush(context.Background(), srv.URL, FlushRemoteWrite))
+		require.Equal(t, []string{
+			`{__name__="counter",job="test"} 31`,
+			`{__name__="gauge",job="test"} 42`,
+			`{__name__="histogram_bucket",job="test",le="1"} 0`,
+			`{__name__="histogram_bucket",job="test",le="2"} 0`,
+			`{__name__="histogram_bucket",job="test",le="3"} 3`,
+			`{__name__="histogram_bucket",job="test",le="4"} 4`,
+			`{__name__="histogram_bucket",job="test",le="5"} 4`,
+			`{__name__="histogram_bucket",job="test",le="6"} 4`,
+			`{__name__="histogram_bucket",job="test",le="7"} 4`,
+			`{__name__="histogram_bucket",job="test",le="8"} 4`,
+			`{__name__="histogram_bucket",job="test",le="9"} 4`,
+			`{__name__="histogram_bucket",job="test",le="10"} 4`,
+			`{__name__="histogram_bucket",job="test",le="+Inf"} 4`,
+			`{__name__="histogram_sum",job="test"} 2.5`,
+			`{__name__="histogram_count",job="test"} 1`,
+		}, series)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		require.Error(t, agg.Flush(context.Background(), srv.URL, FlushRemoteWrite))
+	})
+}
+
+// decodeRemoteWrite renders the series of a snappy compressed WriteRequest
+func decodeRemoteWrite(t *testing.T, body []byte) []string {
+	request, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+
+	fields := func(b []byte, each func(num protowire.Number, value []byte, fixed uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				each(num, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				each(num, nil, v)
+				b = b[n:]
+			default:
+				n := protowire.ConsumeFieldValue(num, typ, b)
+				b = b[n:]
+			}
+		}
+	}
+
+	var series []string
+	fields(request, func(_ protowire.Number, ts []byte, _ uint64) {
+		var labels []string
+		var value float64
+		fields(ts, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case 1:
+				var name, val string
+				fields(v, func(num protowire.Number, s []byte, _ uint64) {
+					if num == 1 {
+						name = string(s)
+					} else {
+						val = string(s)
+					}
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", name, val))
+			case 2:
+				fields(v, func(num protowire.Number, _ []byte, fixed uint64) {
+					if num == 1 {
+						value = math.Float64frombits(fixed)
+					}
+				})
+			}
+		})
+		series = append(series, fmt.Sprintf("{%s} %s", strings.Join(labels, ","), formatFloat(value)))
+	})
+	return series
+}
+
+func TestCompletedGroupDroppedAfterScrape(t *testing.T) {
+	ttl := time.Nanosecond
+	agg := NewAggregate(SetTTLMetricTime(&ttl))
+	push := func(job, body string) {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(body), []labelPair{{name: "job", value: job}}))
+	}
+	complete := func(path string) int {
+		req := httptest.NewRequest("POST", path, nil)
+		req.SetPathValue("labels", strings.TrimPrefix(req.URL.Path, "/api/v1/complete"))
+		w := httptest.NewRecorder()
+		agg.ServeComplete(w, req)
+		return w.Code
+	}
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+
+	push("batch", "# TYPE batch_runs counter\nbatch_runs 1\n# TYPE shared counter\nshared 1\n")
+	push("other", "# TYPE shared counter\nshared 2\n")
+
+	require.Equal(t, http.StatusBadRequest, complete("/api/v1/complete"))
+	require.Equal(t, http.StatusBadRequest, complete("/api/v1/complete/job/batch?pin=maybe"))
+	require.Equal(t, http.StatusAccepted, complete("/api/v1/complete/job/batch?pin=true"))
+	require.Equal(t, 1.0, testutil.ToFloat64(CompletedGroups))
+
+	// the pinned group (and the families it is part of, the TTL applies to
+	// whole families) outlives the TTL until it is scraped, then it's gone
+	first := scrape()
+	require.Contains(t, first, `batch_runs{job="batch"} 1`)
+	require.Contains(t, first, `shared{job="batch"} 1`)
+	require.Contains(t, first, `shared{job="other"} 2`)
+	require.Equal(t, 0.0, testutil.ToFloat64(CompletedGroups))
+	require.Equal(t, "", scrape())
+	require.Equal(t, 0, agg.Len())
+
+	// a group pushed to again after completing is not dropped anymore
+	agg = NewAggregate()
+	push("batch", "# TYPE batch_runs counter\nbatch_runs 1\n")
+	push("other", "# TYPE batch_runs counter\nbatch_runs 1\n")
+	require.Equal(t, http.StatusAccepted, complete("/api/v1/complete/job/batch"))
+	require.Equal(t, http.StatusAccepted, complete("/api/v1/complete/job/other"))
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/metrics/job/other", strings.NewReader("# TYPE batch_runs counter\nbatch_runs 1\n"))
+	req.SetPathValue("labels", "job/other")
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	scrape()
+	require.Equal(t, "# TYPE batch_runs counter\nbatch_runs{job=\"other\"} 2\n", scrape())
+
+	// groups are the same whatever order their labels are given in
+	var c completions
+	c.complete([]labelPair{{name: "job", value: "batch"}, {name: "env", value: "prod"}}, false)
+	c.reopen([]labelPair{{name: "env", value: "prod"}, {name: "job", value: "batch"}})
+	require.Empty(t, c.groups)
+}
+
+func TestHonorLabels(t *testing.T) {
+	honor, override := true, false
+	body := "# TYPE conflict counter\nconflict{job=\"own\",instance=\"a\"} 1\n"
+
+	for _, c := range []struct {
+		name     string
+		option   *bool
+		query    string
+		code     int
+		rendered string
+	}{
+		{name: "rejected by default", code: http.StatusBadRequest},
+		{name: "honored by default", option: &honor, code: http.StatusAccepted, rendered: `conflict{instance="a",job="own"} 1`},
+		{name: "overridden by default", option: &override, code: http.StatusAccepted, rendered: `conflict{exported_job="own",instance="a",job="path"} 1`},
+		{name: "honored by the push", option: &override, query: "?honor_labels=true", code: http.StatusAccepted, rendered: `conflict{instance="a",job="own"} 1`},
+		{name: "overridden by the push", query: "?honor_labels=false", code: http.StatusAccepted, rendered: `conflict{exported_job="own",instance="a",job="path"} 1`},
+		{name: "invalid", query: "?honor_labels=sometimes", code: http.StatusBadRequest},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			agg := NewAggregate(SetHonorLabels(c.option))
+			r := httptest.NewRequest("POST", "/metrics/job/path"+c.query, strings.NewReader(body))
+			r.SetPathValue("labels", "job/path")
+			w := httptest.NewRecorder()
+			agg.ServeInsert(w, r)
+			require.Equal(t, c.code, w.Code, w.Body.String())
+
+			buf := new(bytes.Buffer)
+			agg.encodeAllMetrics(buf, expfmt.FmtText)
+			if c.rendered == "" {
+				require.Empty(t, buf.String())
+			} else {
+				require.Equal(t, "# TYPE conflict counter\n"+c.rendered+"\n", buf.String())
+			}
+		})
+	}
+}
+
+func TestDiffAgainstSnapshot(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+
+	w := httptest.NewRecorder()
+	agg.ServeDiff(w, httptest.NewRequest("GET", "/api/v1/admin/diff", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	agg.ServeSnapshot(w, httptest.NewRequest("POST", "/api/v1/admin/snapshot?name=before", nil))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE counter counter\ncounter 2\ncounter{other=\"x\"} 1\n# TYPE fresh gauge\nfresh 1\n"), testLabels))
+	require.True(t, agg.removeFamily("gauge"))
+
+	w = httptest.NewRecorder()
+	agg.ServeDiff(w, httptest.NewRequest("GET", "/api/v1/admin/diff?snapshot=before", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var diff map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &diff))
+	delete(diff, "taken_at")
+	require.Equal(t, map[string]any{
+		"snapshot":         "before",
+		"added_families":   []any{"fresh"},
+		"removed_families": []any{"gauge"},
+		"added_series": []any{
+			map[string]any{"family": "counter", "labels": map[string]any{"job": "test", "other": "x"}, "after": map[string]any{"value": 1.0}},
+		},
+		"removed_series": []any{},
+		"changed_series": []any{
+			map[string]any{
+				"family": "counter",
+				"labels": map[string]any{"job": "test"},
+				"before": map[string]any{"value": 31.0},
+				"after":  map[string]any{"value": 33.0},
+				"delta":  map[string]any{"value": 2.0},
+			},
+		},
+	}, diff)
+}
+
+func TestRollupRules(t *testing.T) {
+	maxBucket := 5.0
+	agg := NewAggregate(SetRollupRules([]RollupRule{
+		{Match: "histogram", MaxBucket: &maxBucket, Buckets: []float64{4, 2}},
+		{Match: "requests?_.*", DropLabels: []string{"endpoint"}},
+	}))
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE request_duration histogram
+request_duration_bucket{endpoint="/a",service="api",le="1"} 1
+request_duration_bucket{endpoint="/a",service="api",le="+Inf"} 2
+request_duration_sum{endpoint="/a",service="api"} 3
+request_duration_count{endpoint="/a",service="api"} 2
+request_duration_bucket{endpoint="/b",service="api",le="1"} 0
+request_duration_bucket{endpoint="/b",service="api",le="+Inf"} 1
+request_duration_sum{endpoint="/b",service="api"} 4
+request_duration_count{endpoint="/b",service="api"} 1
+# TYPE requests_total counter
+requests_total{endpoint="/a"} 1
+requests_total{endpoint="/b"} 2
+`), testLabels))
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), `# TYPE histogram histogram
+histogram_bucket{job="test",le="2"} 0
+histogram_bucket{job="test",le="4"} 4
+histogram_bucket{job="test",le="+Inf"} 4
+histogram_sum{job="test"} 2.5
+histogram_count{job="test"} 1
+`)
+	require.Contains(t, buf.String(), `# TYPE request_duration histogram
+request_duration_bucket{job="test",service="api",le="1"} 1
+request_duration_bucket{job="test",service="api",le="+Inf"} 3
+request_duration_sum{job="test",service="api"} 7
+request_duration_count{job="test",service="api"} 3
+# TYPE requests_total counter
+requests_total{job="test"} 3
+`)
+}
+
+func TestSplitRules(t *testing.T) {
+	agg := NewAggregate(SetSplitRules([]SplitRule{
+		{Match: "jobs_total", Label: "tags"},
+		{Match: "features", Label: "flags", Separator: "|", Into: SplitIntoLabels, Prefix: "feature_"},
+		{Label: "bogus", Into: "rows"},
+	}))
+	require.Len(t, agg.opts().splitRules, 2)
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE jobs_total counter
+jobs_total{tags="a, b,a"} 2
+jobs_total{tags="b"} 1
+jobs_total{tags=""} 4
+# TYPE features gauge
+features{flags="dark-mode|beta"} 1
+features{flags="beta",feature_beta="false"} 2
+`), testLabels))
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), `# TYPE jobs_total counter
+jobs_total{job="test"} 4
+jobs_total{job="test",tags="a"} 2
+jobs_total{job="test",tags="b"} 3
+`)
+	require.Contains(t, buf.String(), `# TYPE features gauge
+features{feature_beta="false",job="test"} 2
+features{feature_beta="true",feature_dark_mode="true",job="test"} 1
+`)
+}
+
+func TestLoadRollupRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollup.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+rollup_rules:
+  - match: http_.*_seconds
+    drop_labels: [endpoint]
+    max_bucket: 10
+`), 0o644))
+	rules, err := LoadRollupRules(path)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Equal(t, []string{"endpoint"}, rules[0].DropLabels)
+	require.Equal(t, 10.0, *rules[0].MaxBucket)
+	require.True(t, rules[0].re.MatchString("http_request_duration_seconds"))
+	require.False(t, rules[0].re.MatchString("xhttp_request_duration_seconds"))
+
+	require.NoError(t, os.WriteFile(path, []byte("rollup_rules:\n  - match: \"(\"\n"), 0o644))
+	_, err = LoadRollupRules(path)
+	require.Error(t, err)
+}
+
+func TestMetadataOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+help_conflicts: latest
+overrides:
+  - match: jobs_.*
+    help: Jobs processed.
+  - match: jobs_done
+    type: counter
+  - match: latency_seconds
+    type: gauge
+    unit: seconds
+`), 0o644))
+	overrides, err := LoadMetadataOverrides(path)
+	require.NoError(t, err)
+	agg := NewAggregate(SetMetadataOverrides(overrides))
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# HELP jobs_done Done by the first worker.
+# TYPE jobs_done untyped
+jobs_done 1
+# HELP queue_depth Jobs waiting.
+# TYPE queue_depth gauge
+queue_depth 4
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 2
+latency_seconds_count 1
+`), testLabels))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# HELP jobs_done Done by the second worker.
+# TYPE jobs_done untyped
+jobs_done 2
+# HELP queue_depth Jobs waiting, per queue.
+# TYPE queue_depth gauge
+queue_depth 1
+`), testLabels))
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), `# HELP jobs_done Jobs processed.
+# TYPE jobs_done counter
+jobs_done{job="test"} 3
+`)
+	// histograms keep their type
+	require.Contains(t, buf.String(), "# TYPE latency_seconds histogram\n")
+	// without an override the HELP of the latest push is kept
+	require.Contains(t, buf.String(), "# HELP queue_depth Jobs waiting, per queue.\n")
+	// pushes are merged as the overridden type, so producers moving to it
+	// keep merging into the family
+	merged, err := agg.pointInTime()
+	require.NoError(t, err)
+	require.Equal(t, dto.MetricType_COUNTER, merged[0].ty)
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs_done counter\njobs_done 4\n"), testLabels))
+	buf.Reset()
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), "jobs_done{job=\"test\"} 7\n")
+
+	w := httptest.NewRecorder()
+	agg.ServeMetadata(w, httptest.NewRequest("GET", "/api/v1/metadata?metric=latency_seconds", nil))
+	require.JSONEq(t, `{"status":"success","data":{"latency_seconds":[{"type":"histogram","help":"","unit":"seconds"}]}}`, w.Body.String())
+
+	// the first HELP is kept by default
+	agg = NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# HELP queue_depth Jobs waiting.\n# TYPE queue_depth gauge\nqueue_depth 4\n"), testLabels))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# HELP queue_depth Jobs waiting, per queue.\n# TYPE queue_depth gauge\nqueue_depth 1\n"), testLabels))
+	buf.Reset()
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), "# HELP queue_depth Jobs waiting.\n")
+
+	require.NoError(t, os.WriteFile(path, []byte("overrides:\n  - match: jobs_.*\n    type: histogram\n"), 0o644))
+	_, err = LoadMetadataOverrides(path)
+	require.EqualError(t, err, `invalid metadata override 1 in `+path+`: invalid type "histogram", must be counter, gauge or untyped`)
+	require.NoError(t, os.WriteFile(path, []byte("help_conflicts: longest\n"), 0o644))
+	_, err = LoadMetadataOverrides(path)
+	require.Error(t, err)
+}
+
+func TestRenderJSON(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{code="200"} 3
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 1
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 1.5
+latency_seconds_count 2
+# TYPE temperature gauge
+temperature NaN
+`), testLabels))
+
+	w := httptest.NewRecorder()
+	agg.ServeRenderJSON(w, httptest.NewRequest("GET", "/api/v1/metrics.json?name=requests_total&name=latency_seconds&name=missing", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, map[string]any{
+		"status": "success",
+		"data": []any{
+			map[string]any{
+				"name": "latency_seconds",
+				"type": "histogram",
+				"metrics": []any{
+					map[string]any{
+						"labels":  map[string]any{"job": "test"},
+						"count":   "2",
+						"sum":     "1.5",
+						"buckets": map[string]any{"0.5": "1", "+Inf": "2"},
+					},
+				},
+			},
+			map[string]any{
+				"name": "requests_total",
+				"help": "Requests served",
+				"type": "counter",
+				"metrics": []any{
+					map[string]any{"labels": map[string]any{"code": "200", "job": "test"}, "value": "3"},
+				},
+			},
+		},
+	}, body)
+
+	w = httptest.NewRecorder()
+	agg.ServeRenderJSON(w, httptest.NewRequest("GET", "/api/v1/metrics.json", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body["data"], 3)
+	require.Contains(t, w.Body.String(), `"value":"NaN"`)
+}
+
+func TestRenderCSV(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE requests_total counter
+requests_total{code="200",path="/a,b"} 3 1700000000000
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="+Inf"} 2 1700000000000
+latency_seconds_sum 1.5 1700000000000
+latency_seconds_count 2 1700000000000
+# TYPE temperature gauge
+temperature 21
+`), testLabels))
+
+	w := httptest.NewRecorder()
+	agg.ServeRenderCSV(w, httptest.NewRequest("GET", "/api/v1/metrics.csv?name=latency_seconds&name=requests_total", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, `name,labels,value,timestamp
+latency_seconds_bucket,"job=""test"", le=""+Inf""",2,2023-11-14T22:13:20Z
+latency_seconds_sum,"job=""test""",1.5,2023-11-14T22:13:20Z
+latency_seconds_count,"job=""test""",2,2023-11-14T22:13:20Z
+requests_total,"code=""200"", job=""test"", path=""/a,b""",3,2023-11-14T22:13:20Z
+`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	agg.ServeRenderCSV(w, httptest.NewRequest("GET", "/api/v1/metrics.csv", nil))
+	require.Contains(t, w.Body.String(), "\ntemperature,\"job=\"\"test\"\"\",21,")
+}
+
+func TestHistory(t *testing.T) {
+	agg := NewAggregate(SetHistory(2, time.Hour))
+	defer agg.Close()
+
+	start := time.Now()
+	record := func(in string, at time.Time) {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(in), testLabels))
+		snapshot, err := agg.takeSnapshot("")
+		require.NoError(t, err)
+		snapshot.takenAt = at
+		agg.history.record(snapshot)
+	}
+	record("# TYPE jobs counter\njobs 1\n", start)
+	record("# TYPE jobs counter\njobs 2\n", start.Add(time.Minute))
+	record("# TYPE jobs counter\njobs 4\n", start.Add(2*time.Minute))
+
+	get := func(ts string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeHistory(w, httptest.NewRequest("GET", "/api/v1/history?ts="+ts, nil))
+		return w
+	}
+
+	w := get(strconv.FormatInt(start.Add(90*time.Second).Unix(), 10))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "# TYPE jobs counter\njobs{job=\"test\"} 3\n", w.Body.String())
+	require.Equal(t, start.Add(time.Minute).UTC().Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	w = get(start.Add(3 * time.Minute).Format(time.RFC3339Nano))
+	require.Equal(t, "# TYPE jobs counter\njobs{job=\"test\"} 7\n", w.Body.String())
+
+	// the oldest state was dropped
+	require.Equal(t, http.StatusNotFound, get(start.Format(time.RFC3339Nano)).Code)
+	require.Equal(t, http.StatusBadRequest, get("yesterday").Code)
+
+	w = get("")
+	var list map[string][]time.Time
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list["snapshots"], 2)
+}
+
+func TestRenderTimestamps(t *testing.T) {
+	renderTimestamps := func(agg *Aggregate) map[string]int64 {
+		buf := new(bytes.Buffer)
+		agg.encodeAllMetrics(buf, expfmt.FmtText)
+		parser := expfmt.TextParser{}
+		families, err := parser.TextToMetricFamilies(buf)
+		require.NoError(t, err)
+		out := map[string]int64{}
+		for _, m := range families["jobs"].Metric {
+			out[m.Label[0].GetValue()] = m.GetTimestampMs()
+		}
+		return out
+	}
+
+	t.Run("push", func(t *testing.T) {
+		agg := NewAggregate(SetRenderTimestamps(TimestampsPush))
+		before := time.Now().UnixMilli()
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs counter\njobs{queue=\"a\"} 1\njobs{queue=\"b\"} 1\n"), nil))
+		time.Sleep(5 * time.Millisecond)
+		between := time.Now().UnixMilli()
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs counter\njobs{queue=\"b\"} 1\n"), nil))
+
+		ts := renderTimestamps(agg)
+		require.GreaterOrEqual(t, ts["a"], before)
+		require.Less(t, ts["a"], between)
+		require.GreaterOrEqual(t, ts["b"], between)
+	})
+
+	t.Run("aggregation", func(t *testing.T) {
+		agg := NewAggregate(SetRenderTimestamps(TimestampsAggregation))
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs counter\njobs{queue=\"a\"} 1\njobs{queue=\"c\"} 1 1000\n"), nil))
+		time.Sleep(5 * time.Millisecond)
+		between := time.Now().UnixMilli()
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs counter\njobs{queue=\"b\"} 1\n"), nil))
+
+		ts := renderTimestamps(agg)
+		require.GreaterOrEqual(t, ts["a"], between)
+		require.Equal(t, ts["a"], ts["b"])
+		// pushed timestamps are kept
+		require.Equal(t, int64(1000), ts["c"])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		agg := NewAggregate()
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs counter\njobs{queue=\"a\"} 1\njobs{queue=\"c\"} 1 1000\n"), nil))
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs counter\njobs{queue=\"c\"} 1 2000\n"), nil))
+		require.Equal(t, map[string]int64{"a": 0, "c": 0}, renderTimestamps(agg))
+		// merges don't track pushed timestamps nothing renders
+		family, ok := agg.families.Get("jobs")
+		require.True(t, ok)
+		for _, s := range family.head().series {
+			require.Nil(t, s.extra)
+		}
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total 3
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="+Inf"} 2
+latency_seconds_sum 1.5
+latency_seconds_count 2
+plain 1
+`), testLabels))
+
+	get := func(query string) map[string]any {
+		w := httptest.NewRecorder()
+		agg.ServeMetadata(w, httptest.NewRequest("GET", "/api/v1/metadata"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, "success", body["status"])
+		return body["data"].(map[string]any)
+	}
+
+	require.Equal(t, map[string]any{
+		"latency_seconds": []any{map[string]any{"type": "histogram", "help": "", "unit": ""}},
+		"plain":           []any{map[string]any{"type": "unknown", "help": "", "unit": ""}},
+		"requests_total":  []any{map[string]any{"type": "counter", "help": "Requests served", "unit": ""}},
+	}, get(""))
+	require.Len(t, get("?limit=2"), 2)
+	filtered := get("?metric=requests_total")
+	require.Len(t, filtered, 1)
+	require.Contains(t, filtered, "requests_total")
+
+	w := httptest.NewRecorder()
+	agg.ServeMetadata(w, httptest.NewRequest("GET", "/api/v1/metadata?limit=ten", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	agg := NewAggregate(SetIdempotencyWindow(time.Minute))
+	push := func(labels, key, body string) int {
+		req := httptest.NewRequest("POST", "/metrics"+labels, strings.NewReader(body))
+		req.SetPathValue("labels", labels)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w.Code
+	}
+	render := func() string {
+		buf := new(bytes.Buffer)
+		agg.encodeAllMetrics(buf, expfmt.FmtText)
+		return buf.String()
+	}
+
+	body := "# TYPE builds counter\nbuilds 1\n"
+	require.Equal(t, http.StatusAccepted, push("/job/ci", "run-1", body))
+	require.Equal(t, http.StatusAccepted, push("/job/ci", "run-1", body))
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\"} 1\n", render())
+
+	// keys are scoped to the label path, and pushes without one always merge
+	require.Equal(t, http.StatusAccepted, push("/job/deploy", "run-1", body))
+	require.Equal(t, http.StatusAccepted, push("/job/ci", "", body))
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\"} 2\nbuilds{job=\"deploy\"} 1\n", render())
+
+	// a failed push can be retried under the same key
+	require.Equal(t, http.StatusBadRequest, push("/job/ci", "run-2", "builds{ 1\n"))
+	require.Equal(t, http.StatusAccepted, push("/job/ci", "run-2", body))
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\"} 3\nbuilds{job=\"deploy\"} 1\n", render())
+
+	w := httptest.NewRecorder()
+	agg.ServeDuplicates(w, httptest.NewRequest("GET", "/api/v1/admin/duplicates", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats struct {
+		Window    string           `json:"window"`
+		Keys      int              `json:"keys"`
+		Producers []duplicateStats `json:"producers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Equal(t, "1m0s", stats.Window)
+	require.Equal(t, 3, stats.Keys)
+	require.Len(t, stats.Producers, 2)
+	require.NotNil(t, stats.Producers[0].LastDuplicate)
+	stats.Producers[0].LastDuplicate = nil
+	require.Equal(t, []duplicateStats{
+		{Job: "ci", Source: "192.0.2.1", KeyedPushes: 4, Duplicates: 1},
+		{Job: "deploy", Source: "192.0.2.1", KeyedPushes: 1},
+	}, stats.Producers)
+	require.Equal(t, 3.0, testutil.ToFloat64(IdempotencyKeys))
+
+	keys := newIdempotencyKeys(time.Minute)
+	now := time.Now()
+	require.Equal(t, keyClaimed, keys.claim("a", producerKey{}, now))
+	// a retry while the push is merged waits for its outcome
+	require.Equal(t, keyInProgress, keys.claim("a", producerKey{}, now.Add(time.Second)))
+	keys.merged("a", now.Add(time.Second))
+	require.Equal(t, keyDuplicate, keys.claim("a", producerKey{}, now.Add(30*time.Second)))
+	require.Equal(t, keyClaimed, keys.claim("a", producerKey{}, now.Add(2*time.Minute)))
+	keys.release("a")
+	require.Equal(t, keyClaimed, keys.claim("a", producerKey{}, now.Add(2*time.Minute)))
+	// producers that stopped pushing with a key are forgotten
+	keys.claim("b", producerKey{job: "gone"}, now.Add(2*time.Minute))
+	keys.claim("c", producerKey{}, now.Add(4*time.Minute))
+	producers, _ := keys.duplicates()
+	require.Len(t, producers, 1)
+	require.Equal(t, "", producers[0].Job)
+
+	// with async ingest the key is merging until the push is merged
+	async := NewAggregate(SetIdempotencyWindow(time.Minute), SetAsyncIngest(1, 1))
+	key, claimed := async.claimIdempotencyKey(keyedRequest("/job/ci", "run-1"), producerKey{job: "ci"})
+	require.Equal(t, keyClaimed, claimed)
+	_, claimed = async.claimIdempotencyKey(keyedRequest("/job/ci", "run-1"), producerKey{job: "ci"})
+	require.Equal(t, keyInProgress, claimed)
+	require.NoError(t, async.ingestQueue.enqueue(ingestJob{body: []byte("# TYPE builds counter\nbuilds 1\n"), jobName: "ci", idempotencyKey: key}))
+	async.Close()
+	_, claimed = async.claimIdempotencyKey(keyedRequest("/job/ci", "run-1"), producerKey{job: "ci"})
+	require.Equal(t, keyDuplicate, claimed)
+
+	w = httptest.NewRecorder()
+	NewAggregate().ServeDuplicates(w, httptest.NewRequest("GET", "/api/v1/admin/duplicates", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func keyedRequest(labels, key string) *http.Request {
+	req := httptest.NewRequest("POST", "/metrics"+labels, nil)
+	req.SetPathValue("labels", labels)
+	req.Header.Set(IdempotencyKeyHeader, key)
+	return req
+}
+
+func TestPushAck(t *testing.T) {
+	agg := NewAggregate(AddIgnoredLabels("instance"), SetIdempotencyWindow(time.Minute))
+	push := func(accept, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(`# TYPE builds counter
+builds{instance="a"} 1
+builds{instance="b",status="ok"} 1
+# TYPE build_seconds histogram
+build_seconds_bucket{le="60"} 1
+build_seconds_bucket{le="+Inf"} 1
+build_seconds_sum 42
+build_seconds_count 1
+`))
+		req.SetPathValue("labels", "/job/ci")
+		req.Header.Set("Accept", accept)
+		req.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		return w
+	}
+
+	require.Empty(t, push("", "").Body.String())
+
+	w := push("application/json", "run-1")
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var ack map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ack))
+	require.Equal(t, map[string]any{
+		"status":   "merged",
+		"families": 2.0,
+		"series":   3.0,
+		"samples":  6.0,
+		"warnings": []any{`ignored label "instance" was dropped`},
+	}, ack)
+
+	w = push("application/json", "run-1")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ack))
+	require.Equal(t, "duplicate", ack["status"])
+}
+
+func TestMaintenance(t *testing.T) {
+	agg := NewAggregate()
+	toggle := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeMaintenance(w, httptest.NewRequest("POST", "/api/v1/admin/maintenance"+query, nil))
+		return w
+	}
+	push := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, httptest.NewRequest("POST", "/metrics", strings.NewReader("# TYPE builds counter\nbuilds 1\n")))
+		return w
+	}
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+	require.Equal(t, http.StatusBadRequest, toggle("?enabled=soon").Code)
+
+	w := toggle("?enabled=true&retry_after=120")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"enabled":true}`, w.Body.String())
+
+	w = push()
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "120", w.Header().Get("Retry-After"))
+
+	// scrapes are still served
+	w = httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "counter")
+
+	require.JSONEq(t, `{"enabled":false}`, toggle("?enabled=false").Body.String())
+	require.Equal(t, http.StatusAccepted, push().Code)
+}
+
+func TestTenants(t *testing.T) {
+	agg := NewAggregate(SetTenantLabel("tenant"))
+	push := func(tenant, labels, body string) int {
+		req := httptest.NewRequest("POST", "/metrics"+labels, strings.NewReader(body))
+		req.SetPathValue("labels", labels)
+		if tenant != "" {
+			req.Header.Set(TenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w.Code
+	}
+	render := func(tenant string) string {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tenant != "" {
+			req.Header.Set(TenantHeader, tenant)
+		}
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	require.Equal(t, http.StatusAccepted, push("team-a", "/job/ci", "# TYPE builds counter\nbuilds{a=\"1\",b=\"2\"} 1\nbuilds{a=\"1\"} 1\n"))
+	// the payload can't claim another tenant, nor can the path
+	require.Equal(t, http.StatusAccepted, push("team-b", "/job/ci/tenant/team-a", "# TYPE builds counter\nbuilds{tenant=\"team-a\"} 5\n"))
+	require.Equal(t, http.StatusBadRequest, push("team|a", "/job/ci", "# TYPE builds counter\nbuilds 1\n"))
+
+	require.Equal(t, "# TYPE builds counter\nbuilds{a=\"1\",b=\"2\",job=\"ci\"} 1\nbuilds{a=\"1\",job=\"ci\"} 1\n", render("team-a"))
+	require.Equal(t, "# TYPE builds counter\nbuilds{exported_tenant=\"team-a\",job=\"ci\"} 5\n", render("team-b"))
+	require.Equal(t, "", render("team-c"))
+	require.Equal(t, `# TYPE builds counter
+builds{a="1",b="2",job="ci",tenant="team-a"} 1
+builds{a="1",job="ci",tenant="team-a"} 1
+builds{exported_tenant="team-a",job="ci",tenant="team-b"} 5
+`, render(""))
+
+	// so are the other renders
+	serve := func(handler http.HandlerFunc, path, tenant string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(TenantHeader, tenant)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	require.JSONEq(t, `{"status":"success","data":[{"name":"builds","type":"counter","metrics":[{"labels":{"exported_tenant":"team-a","job":"ci"},"value":"5"}]}]}`, serve(agg.ServeRenderJSON, "/api/v1/render.json", "team-b"))
+	require.JSONEq(t, `{"status":"success","data":[{"name":"builds","type":"counter","metrics":[{"labels":{"exported_tenant":"team-a","job":"ci"},"value":"5"}]}]}`, serve(agg.ServeRenderJSON, "/api/v1/render.json?name=builds", "team-b"))
+	require.NotContains(t, serve(agg.ServeRenderCSV, "/api/v1/render.csv", "team-b"), "team-b")
+	require.Contains(t, serve(agg.ServeRenderCSV, "/api/v1/render.csv", "team-b"), ",5,")
+	require.Equal(t, 1, strings.Count(serve(agg.ServeRenderGraphite, "/api/v1/render.graphite", "team-a"), "builds;a=1;job=ci "))
+	require.NotContains(t, serve(agg.ServeRenderGraphite, "/api/v1/render.graphite", "team-a"), "team-b")
+	require.Contains(t, serve(agg.ServeQuery, "/api/v1/query?query=builds", "team-b"), `"value":[`)
+	require.NotContains(t, serve(agg.ServeQuery, "/api/v1/query?query=builds", "team-a"), `"5"`)
+
+	// and idempotency keys
+	keyed := NewAggregate(SetTenantLabel("tenant"), SetIdempotencyWindow(time.Minute))
+	for _, tenant := range []string{"team-a", "team-b", "team-a"} {
+		req := keyedRequest("/job/ci", "run-1")
+		req.Body = io.NopCloser(strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+		req.Header.Set(TenantHeader, tenant)
+		keyed.ServeInsert(httptest.NewRecorder(), req)
+	}
+	buf := new(bytes.Buffer)
+	keyed.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\",tenant=\"team-a\"} 1\nbuilds{job=\"ci\",tenant=\"team-b\"} 1\n", buf.String())
+
+	// tenant renders have the liveness of their own jobs
+	agg = NewAggregate(SetTenantLabel("tenant"), SetPusherUp(true))
+	require.Equal(t, http.StatusAccepted, push("team-a", "/job/ci", "# TYPE builds counter\nbuilds 1\n"))
+	require.Equal(t, http.StatusAccepted, push("team-b", "/job/cd", "# TYPE builds counter\nbuilds 1\n"))
+	require.Contains(t, render("team-a"), "aggregation_gateway_pusher_up{job=\"ci\"} 1\n")
+	require.NotContains(t, render("team-a"), `job="cd"`)
+	require.Contains(t, render(""), "aggregation_gateway_pusher_up{job=\"cd\",tenant=\"team-b\"} 1\n")
+	require.Contains(t, serve(agg.ServeRenderJSON, "/api/v1/render.json", "team-b"), PusherUpMetric)
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	var proxied []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		proxied = append(proxied, r.URL.Path+" "+r.Header.Get(TenantHeader)+" "+string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	agg := NewAggregate(SetTenantLabel("tenant"), SetUpstream(upstream.URL, []string{"team-a"}, []string{"/job/ci"}))
+	push := func(tenant, labels string) int {
+		req := httptest.NewRequest("POST", "/metrics"+labels, strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+		req.SetPathValue("labels", labels)
+		req.Header.Set(TenantHeader, tenant)
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusAccepted, push("team-a", "/job/ci/instance/x"))
+	require.Equal(t, http.StatusAccepted, push("team-a", "/job/cd"))
+	require.Equal(t, http.StatusAccepted, push("team-b", "/job/ci"))
+	require.Equal(t, []string{
+		"/metrics/job/cd team-a # TYPE builds counter\nbuilds 1\n",
+		"/metrics/job/ci team-b # TYPE builds counter\nbuilds 1\n",
+	}, proxied)
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, "# TYPE builds counter\nbuilds{instance=\"x\",job=\"ci\",tenant=\"team-a\"} 1\n", buf.String())
+
+	upstream.Close()
+	require.Equal(t, http.StatusBadGateway, push("team-b", "/job/ci"))
+}
+
+func TestSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.yml")
+	write := func(enforcement string) *Schema {
+		require.NoError(t, os.WriteFile(path, []byte(`
+enforcement: `+enforcement+`
+strict: true
+families:
+  - name: builds
+    type: counter
+    labels: [job, status]
+  - name: build_seconds
+    type: histogram
+`), 0o644))
+		schema, err := LoadSchema(path)
+		require.NoError(t, err)
+		return schema
+	}
+	push := func(agg *Aggregate, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(body))
+		req.SetPathValue("labels", "/job/ci")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w
+	}
+
+	agg := NewAggregate(SetSchema(write("reject")))
+	require.Equal(t, http.StatusAccepted, push(agg, "# TYPE builds counter\nbuilds{status=\"ok\"} 1\n").Code)
+	w := push(agg, "# TYPE builds gauge\nbuilds{branch=\"main\"} 1\n")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "family builds is a gauge, the schema expects a counter")
+	require.Contains(t, w.Body.String(), "family builds has label branch, which the schema doesn't allow")
+	w = push(agg, "# TYPE deploys counter\ndeploys 1\n")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "family deploys is not in the schema")
+	require.Equal(t, 1.0, testutil.ToFloat64(SchemaViolations.WithLabelValues("", "reject")))
+	// a rejected push leaves every family of it out
+	w = push(agg, "# TYPE builds counter\nbuilds{status=\"ok\"} 1\n# TYPE deploys counter\ndeploys 1\n")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\",status=\"ok\"} 1\n", buf.String())
+
+	agg = NewAggregate(SetSchema(write("warn")))
+	w = push(agg, "# TYPE deploys counter\ndeploys 1\n")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Contains(t, w.Body.String(), "family deploys is not in the schema")
+	_, ok := agg.families.Get("deploys")
+	require.True(t, ok)
+
+	require.NoError(t, os.WriteFile(path, []byte("families:\n  - name: builds\n    type: counterr\n"), 0o644))
+	_, err := LoadSchema(path)
+	require.Error(t, err)
+}
+
+func TestMaxLabelValues(t *testing.T) {
+	ttl := time.Minute
+	agg := NewAggregate(SetMaxLabelValues(map[string]int{"job": 2}), SetTTLMetricTime(&ttl))
+	push := func(path string) int {
+		req := httptest.NewRequest("POST", "/metrics"+path, strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+		req.SetPathValue("labels", path)
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusAccepted, push("/job/a"))
+	require.Equal(t, http.StatusAccepted, push("/job/b/instance/x"))
+	require.Equal(t, http.StatusBadRequest, push("/job/c"))
+	require.Equal(t, http.StatusAccepted, push("/job/a/instance/y"))
+	require.Equal(t, http.StatusAccepted, push("/instance/z"))
+
+	// values not pushed for the TTL make room for new ones
+	require.NoError(t, agg.labelValues.admit([]labelPair{{name: "job", value: "a"}}, time.Now().Add(2*time.Minute), agg.metricTTL()))
+	require.NoError(t, agg.labelValues.admit([]labelPair{{name: "job", value: "c"}}, time.Now().Add(2*time.Minute), agg.metricTTL()))
+}
+
+func TestDebugParse(t *testing.T) {
+	agg := NewAggregate(AddIgnoredLabels("instance"))
+	req := httptest.NewRequest("POST", "/api/v1/debug/parse/job/ci?honor_labels=false", strings.NewReader(`# TYPE builds counter
+builds{instance="a",status="ok"} 1
+builds{job="other",instance="b",status="ok"} 2
+`))
+	req.SetPathValue("labels", "/job/ci")
+	w := httptest.NewRecorder()
+	agg.ServeDebugParse(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Data     []jsonFamily `json:"data"`
+		Warnings []string     `json:"warnings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Equal(t, []jsonFamily{{
+		Name: "builds",
+		Type: "counter",
+		Metrics: []jsonSeries{
+			{Labels: map[string]string{"exported_job": "other", "job": "ci", "status": "ok"}, Value: "2"},
+			{Labels: map[string]string{"job": "ci", "status": "ok"}, Value: "1"},
+		},
+	}}, body.Data)
+	require.Equal(t, []string{`ignored label "instance" was dropped`}, body.Warnings)
+	require.Equal(t, 0, agg.Len())
+}
+
+func TestPushLog(t *testing.T) {
+	agg := NewAggregate(SetPushLog(2, 128, []string{"user", "account"}))
+	push := func(path, body string) {
+		req := httptest.NewRequest("POST", "/metrics"+path, strings.NewReader(body))
+		req.SetPathValue("labels", path)
+		agg.ServeInsert(httptest.NewRecorder(), req)
+	}
+	push("/job/ci", "# TYPE builds counter\nbuilds 1\n")
+	push("/job/ci/user/alice", "# TYPE logins counter\nlogins{account=\"bob\",realm=\"x\"} 1\n")
+	push("/job/ci", "builds{ 1\n")
+
+	w := httptest.NewRecorder()
+	agg.ServePushLog(w, httptest.NewRequest("GET", "/api/v1/admin/pushes", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Pushes []loggedPush `json:"pushes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Pushes, 2)
+
+	require.Equal(t, "/job/ci/user/"+redactedValue, body.Pushes[0].LabelPath)
+	require.Equal(t, http.StatusAccepted, body.Pushes[0].Status)
+	require.Equal(t, "# TYPE logins counter\nlogins{account=\"<redacted>\",realm=\"x\"} 1\n", body.Pushes[0].Body)
+
+	// unparsed, so left out
+	require.Equal(t, http.StatusBadRequest, body.Pushes[1].Status)
+	require.NotEmpty(t, body.Pushes[1].Error)
+	require.Empty(t, body.Pushes[1].Body)
+	require.True(t, body.Pushes[1].Truncated)
+
+	// redacted even where the log's size cuts the body
+	push("/job/ci", "# TYPE logins counter\nlogins{account=\"bob\"} 1\n"+strings.Repeat("logins{account=\"carol\",n=\"1\"} 1\n", 10))
+	w = httptest.NewRecorder()
+	agg.ServePushLog(w, httptest.NewRequest("GET", "/api/v1/admin/pushes", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	last := body.Pushes[len(body.Pushes)-1]
+	require.True(t, last.Truncated)
+	require.NotContains(t, last.Body, "bob")
+	require.NotContains(t, last.Body, "car")
+
+	w = httptest.NewRecorder()
+	NewAggregate().ServePushLog(w, httptest.NewRequest("GET", "/api/v1/admin/pushes", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestShadow(t *testing.T) {
+	bucket := 10.0
+	for _, async := range []bool{false, true} {
+		opts := []Option{SetShadow(SetRollupRules([]RollupRule{{Match: "build_seconds", MaxBucket: &bucket}}))}
+		if async {
+			opts = append(opts, SetAsyncIngest(1, 10))
+		}
+		agg := NewAggregate(opts...)
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(`# TYPE build_seconds histogram
+build_seconds_bucket{le="1"} 1
+build_seconds_bucket{le="60"} 2
+build_seconds_bucket{le="+Inf"} 2
+build_seconds_sum 42
+build_seconds_count 2
+`))
+		req.SetPathValue("labels", "/job/ci")
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		agg.Close()
+
+		render := func(serve http.HandlerFunc) string {
+			w := httptest.NewRecorder()
+			serve(w, httptest.NewRequest("GET", "/metrics", nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			return w.Body.String()
+		}
+		require.Contains(t, render(agg.ServeRender), `build_seconds_bucket{job="ci",le="60"} 2`)
+		shadow := render(agg.ServeShadowRender)
+		require.Contains(t, shadow, `build_seconds_bucket{job="ci",le="1"} 1`)
+		require.NotContains(t, shadow, `le="60"`)
+	}
+
+	w := httptest.NewRecorder()
+	NewAggregate().ServeShadowRender(w, httptest.NewRequest("GET", "/api/v1/shadow/metrics", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMergeStrategies(t *testing.T) {
+	push := func(agg *Aggregate, body string) {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(body), []labelPair{{name: "job", value: "ci"}}))
+	}
+	render := func(agg *Aggregate) string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+
+	agg := NewAggregate(SetMergeStrategy(dto.MetricType_GAUGE, LastStrategy), SetMergeStrategy(dto.MetricType_COUNTER, MaxStrategy))
+	push(agg, "# TYPE queue_depth gauge\nqueue_depth 5\n# TYPE builds counter\nbuilds 7\n")
+	push(agg, "# TYPE queue_depth gauge\nqueue_depth 3\n# TYPE builds counter\nbuilds 4\n")
+	require.Equal(t, `# TYPE builds counter
+builds{job="ci"} 7
+# TYPE queue_depth gauge
+queue_depth{job="ci"} 3
+`, render(agg))
+
+	// the sum strategy through the custom strategy path merges as the built-in one
+	histograms := []string{`# TYPE build_seconds histogram
+build_seconds_bucket{le="1"} 1
+build_seconds_bucket{le="+Inf"} 2
+build_seconds_sum 30
+build_seconds_count 2
+`, `# TYPE build_seconds histogram
+build_seconds_bucket{le="1"} 0
+build_seconds_bucket{le="10"} 1
+build_seconds_bucket{le="+Inf"} 1
+build_seconds_sum 5
+build_seconds_count 1
+`}
+	builtin := NewAggregate()
+	custom := NewAggregate(SetMergeStrategy(dto.MetricType_HISTOGRAM, MergeStrategyFunc(SumStrategy.Merge)))
+	for _, body := range histograms {
+		push(builtin, body)
+		push(custom, body)
+	}
+	require.Equal(t, render(builtin), render(custom))
+
+	RegisterMergeStrategy("keep_first", MergeStrategyFunc(func(aggregated, _ Sample) Sample { return aggregated }))
+	strategy, err := MergeStrategyByName("keep_first")
+	require.NoError(t, err)
+	require.Equal(t, Sample{Value: 1}, strategy.Merge(Sample{Value: 1}, Sample{Value: 2}))
+	_, err = MergeStrategyByName("avg")
+	require.Error(t, err)
+}
+
+func TestIngestHooks(t *testing.T) {
+	drop := &hook.Hook{If: `name == "debug_total"`, Drop: true}
+	strip := &hook.Hook{If: `has("pod")`, SetLabels: map[string]string{"pod": `""`}}
+	for _, h := range []*hook.Hook{drop, strip} {
+		require.NoError(t, h.Compile())
+	}
+	agg := NewAggregate(SetIngestHooks([]*hook.Hook{drop, strip}))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE debug_total counter
+debug_total 1
+# TYPE requests_total counter
+requests_total{pod="a"} 1
+requests_total{pod="b"} 2
+`), []labelPair{{name: "job", value: "api"}}))
+
+	w := httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "# TYPE requests_total counter\nrequests_total{job=\"api\"} 3\n", w.Body.String())
+}
+
+// enrichModule filters ingest through unchanged and renders every family
+// as builds{team="infra"} 42, the WAT would read
+//
+//	(memory (export "memory") 1)
+//	(data (i32.const 0) "# TYPE builds counter\nbuilds{team=\"infra\"} 42\n")
+//	(func (export "alloc") (param i32) (result i32) (i32.const 1024))
+//	(func (export "filter_ingest") (param i32 i32) (result i64)
+//	  (i64.or (i64.shl (i64.extend_i32_u (local.get 0)) (i64.const 32)) (i64.extend_i32_u (local.get 1))))
+//	(func (export "filter_render") (param i32 i32) (result i64) (i64.const 46))
+var enrichModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x02, 0x60,
+	0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x03, 0x04,
+	0x03, 0x00, 0x01, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01, 0x07, 0x32, 0x04,
+	0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x05, 0x61, 0x6c,
+	0x6c, 0x6f, 0x63, 0x00, 0x00, 0x0d, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72,
+	0x5f, 0x69, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x00, 0x01, 0x0d, 0x66, 0x69,
+	0x6c, 0x74, 0x65, 0x72, 0x5f, 0x72, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x00,
+	0x02, 0x0a, 0x19, 0x03, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x0c, 0x00,
+	0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad, 0x84, 0x0b, 0x04,
+	0x00, 0x42, 0x2e, 0x0b, 0x0b, 0x34, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x2e,
+	0x23, 0x20, 0x54, 0x59, 0x50, 0x45, 0x20, 0x62, 0x75, 0x69, 0x6c, 0x64,
+	0x73, 0x20, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x65, 0x72, 0x0a, 0x62, 0x75,
+	0x69, 0x6c, 0x64, 0x73, 0x7b, 0x74, 0x65, 0x61, 0x6d, 0x3d, 0x22, 0x69,
+	0x6e, 0x66, 0x72, 0x61, 0x22, 0x7d, 0x20, 0x34, 0x32, 0x0a,
+}
+
+func TestWASMFilters(t *testing.T) {
+	ctx := context.Background()
+	filter, err := wasm.New(ctx, "enrich", enrichModule)
+	require.NoError(t, err)
+	defer filter.Close(ctx)
+
+	agg := NewAggregate(SetWASMFilters([]*wasm.Filter{filter}))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE builds counter
+builds{job="ci"} 3
+# TYPE deploys counter
+deploys 1
+`), nil))
+
+	// ingest kept the pushed series
+	builds, ok := agg.families.Get("builds")
+	require.True(t, ok)
+	require.Equal(t, "ci", builds.head().toDTO().Metric[0].Label[0].GetValue())
+
+	// the filter fails on deploys, which is rendered unfiltered
+	failures := testutil.ToFloat64(WASMFilterErrors.WithLabelValues("render"))
+	w := httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "# TYPE builds counter\nbuilds{team=\"infra\"} 42\n# TYPE deploys counter\ndeploys 1\n", w.Body.String())
+	require.Equal(t, failures+1, testutil.ToFloat64(WASMFilterErrors.WithLabelValues("render")))
+}
+
+func TestPusherUp(t *testing.T) {
+	ttl := time.Minute
+	agg := NewAggregate(SetTTLMetricTime(&ttl), SetPusherUp(true))
+	for _, job := range []string{"ci", "deploy"} {
+		req := httptest.NewRequest("POST", "/metrics/job/"+job, strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+		req.SetPathValue("labels", "/job/"+job)
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	render := func() string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	header := "# HELP aggregation_gateway_pusher_up " + pusherUpHelp + "\n# TYPE aggregation_gateway_pusher_up gauge\n"
+	require.Equal(t, header+`aggregation_gateway_pusher_up{job="ci"} 1
+aggregation_gateway_pusher_up{job="deploy"} 1
+# TYPE builds counter
+builds{job="ci"} 1
+builds{job="deploy"} 1
+`, render())
+
+	// ci stopped pushing a TTL ago, it's down until another TTL passed
+	agg.pushers.jobs[pusherKey{job: "ci"}].lastPush = time.Now().Add(-ttl - time.Second)
+	agg.pushers.jobs[pusherKey{job: "deploy"}].lastPush = time.Now().Add(-ttl / 2)
+	require.Contains(t, render(), header+`aggregation_gateway_pusher_up{job="ci"} 0
+aggregation_gateway_pusher_up{job="deploy"} 1
+`)
+
+	agg.pushers.jobs[pusherKey{job: "ci"}].lastPush = time.Now().Add(-2*ttl - time.Second)
+	require.Contains(t, render(), header+`aggregation_gateway_pusher_up{job="deploy"} 1
+# TYPE builds counter
+`)
+}
+
+func TestNativeHistograms(t *testing.T) {
+	agg := NewAggregate(SetNativeHistograms(true, 0))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="2"} 3
+latency_seconds_bucket{le="4"} 4
+latency_seconds_bucket{le="+Inf"} 5
+latency_seconds_sum 12
+latency_seconds_count 5
+`), nil))
+
+	render := func(accept string) *dto.Histogram {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, req)
+
+		family := &dto.MetricFamily{}
+		require.NoError(t, expfmt.NewDecoder(w.Body, expfmt.ResponseFormat(w.Header())).Decode(family))
+		return family.Metric[0].Histogram
+	}
+
+	native := render(string(expfmt.FmtProtoDelim))
+	require.Empty(t, native.Bucket)
+	require.Equal(t, int32(0), native.GetSchema())
+	require.Equal(t, uint64(5), native.GetSampleCount())
+	require.Equal(t, 12.0, native.GetSampleSum())
+	// (0.5, 1], (1, 2], (2, 4] and the +Inf overflow in (4, 8]
+	require.Len(t, native.PositiveSpan, 1)
+	require.Equal(t, int32(0), native.PositiveSpan[0].GetOffset())
+	require.Equal(t, uint32(4), native.PositiveSpan[0].GetLength())
+	require.Equal(t, []int64{1, 1, -1, 0}, native.PositiveDelta)
+
+	// text can't carry native histograms
+	require.Len(t, render(string(expfmt.FmtText)).Bucket, 4)
+
+	empty := nativeHistogram(&dto.Histogram{SampleCount: new(uint64), SampleSum: new(float64)}, 3)
+	require.Len(t, empty.PositiveSpan, 1)
+	require.Zero(t, empty.PositiveSpan[0].GetLength())
+
+	// observations only known to be below +Inf can't go in any native bucket
+	infOnly := &dto.Histogram{SampleCount: proto.Uint64(2), SampleSum: proto.Float64(3), Bucket: []*dto.Bucket{{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(2)}}}
+	require.Nil(t, nativeHistogram(infOnly, 3))
+	family := &dto.MetricFamily{Type: dto.MetricType_HISTOGRAM.Enum(), Metric: []*dto.Metric{{Histogram: infOnly}}}
+	toNativeHistograms(family, 3)
+	require.Same(t, infOnly, family.Metric[0].Histogram)
+}
+
+func TestMergedNativeHistograms(t *testing.T) {
+	// scraped in protobuf, the only format carrying them
+	agg := NewAggregate()
+	push := func(h *dto.Histogram) {
+		family := &dto.MetricFamily{Name: proto.String("latency_seconds"), Type: dto.MetricType_HISTOGRAM.Enum(), Metric: []*dto.Metric{{Histogram: h}}}
+		require.NoError(t, agg.MergeFamilies(map[string]*dto.MetricFamily{"latency_seconds": family}, nil, false))
+	}
+	push(&dto.Histogram{
+		SampleCount: proto.Uint64(6), SampleSum: proto.Float64(6),
+		Schema: proto.Int32(1), ZeroThreshold: proto.Float64(0.001), ZeroCount: proto.Uint64(1),
+		PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(1), Length: proto.Uint32(2)}},
+		PositiveDelta: []int64{2, 1},
+	})
+	push(&dto.Histogram{
+		SampleCount: proto.Uint64(4), SampleSum: proto.Float64(4),
+		Schema: proto.Int32(0), ZeroThreshold: proto.Float64(0.001), ZeroCount: proto.Uint64(0),
+		PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(1), Length: proto.Uint32(1)}},
+		PositiveDelta: []int64{4},
+	})
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, agg.encodeAllMetrics(buf, expfmt.FmtProtoDelim))
+	family := &dto.MetricFamily{}
+	require.NoError(t, expfmt.NewDecoder(buf, expfmt.FmtProtoDelim).Decode(family))
+	native := family.Metric[0].Histogram
+	require.Equal(t, uint64(10), native.GetSampleCount())
+	// merged at the coarser schema, (1, 2] holding both buckets of schema 1
+	require.Equal(t, int32(0), native.GetSchema())
+	require.Equal(t, uint64(1), native.GetZeroCount())
+	require.Len(t, native.PositiveSpan, 1)
+	require.Equal(t, int32(1), native.PositiveSpan[0].GetOffset())
+	require.Equal(t, uint32(1), native.PositiveSpan[0].GetLength())
+	require.Equal(t, []int64{9}, native.PositiveDelta)
+}
+
+func TestUsageAccounting(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		opts := []Option{SetUsageAccounting(true)}
+		if async {
+			opts = append(opts, SetAsyncIngest(1, 10))
+		}
+		agg := NewAggregate(opts...)
+		push := func(job, source, body string) {
+			req := httptest.NewRequest("POST", "/metrics/job/"+job, strings.NewReader(body))
+			req.SetPathValue("labels", "/job/"+job)
+			req.RemoteAddr = source + ":1234"
+			w := httptest.NewRecorder()
+			agg.ServeInsert(w, req)
+			require.Equal(t, http.StatusAccepted, w.Code)
+		}
+		small := "# TYPE builds counter\nbuilds 1\n"
+		large := "# TYPE latency_seconds histogram\nlatency_seconds_bucket{le=\"1\"} 1\nlatency_seconds_bucket{le=\"+Inf\"} 1\nlatency_seconds_sum 1\nlatency_seconds_count 1\n"
+		push("ci", "10.0.0.1", small)
+		push("ci", "10.0.0.1", small)
+		push("etl", "10.0.0.2", large)
+		agg.Close()
+
+		w := httptest.NewRecorder()
+		agg.ServeUsage(w, httptest.NewRequest("GET", "/api/v1/admin/usage", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var report struct {
+			Sources []sourceUsage `json:"sources"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		require.Len(t, report.Sources, 2)
+		assert := func(have sourceUsage, job, source string, pushes, bytes, samples int) {
+			require.Equal(t, job, have.Job)
+			require.Equal(t, source, have.Source)
+			require.Equal(t, uint64(pushes), have.Pushes)
+			require.Equal(t, uint64(bytes), have.Bytes)
+			require.Equal(t, uint64(samples), have.Samples)
+		}
+		assert(report.Sources[0], "etl", "10.0.0.2", 1, len(large), 4)
+		assert(report.Sources[1], "ci", "10.0.0.1", 2, 2*len(small), 2)
+
+		w = httptest.NewRecorder()
+		agg.ServeUsage(w, httptest.NewRequest("GET", "/api/v1/admin/usage?limit=1", nil))
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		require.Len(t, report.Sources, 1)
+	}
+
+	// idle sources are forgotten as others push, without reports
+	u := newUsageAccounting()
+	now := time.Now()
+	u.record(producerKey{job: "gone", source: "10.0.0.3"}, 10, 1, now, time.Minute)
+	u.record(producerKey{job: "ci", source: "10.0.0.1"}, 10, 1, now.Add(2*time.Minute), time.Minute)
+	require.Len(t, u.sources, 1)
+}
+
+func TestQuarantine(t *testing.T) {
+	agg := NewAggregate(SetQuarantine(3, time.Minute))
+	push := func(source, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(body))
+		req.SetPathValue("labels", "/job/ci")
+		req.RemoteAddr = source + ":1234"
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w
+	}
+	valid, invalid := "# TYPE builds counter\nbuilds 1\n", "builds{\n"
+
+	// a valid push resets the failures
+	for _, body := range []string{invalid, invalid, valid, invalid, invalid} {
+		push("10.0.0.1", body)
+	}
+	require.Equal(t, http.StatusAccepted, push("10.0.0.1", valid).Code)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusBadRequest, push("10.0.0.1", invalid).Code)
+	}
+	w := push("10.0.0.1", valid)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Contains(t, w.Body.String(), `job "ci" from 10.0.0.1 is quarantined`)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+	require.Equal(t, 1.0, testutil.ToFloat64(QuarantinedProducers))
+	// other hosts of the job are still accepted
+	require.Equal(t, http.StatusAccepted, push("10.0.0.2", valid).Code)
+
+	w = httptest.NewRecorder()
+	agg.ServeQuarantine(w, httptest.NewRequest("GET", "/api/v1/admin/quarantine", nil))
+	var list struct {
+		Producers []quarantinedProducer `json:"producers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Producers, 1)
+	require.Equal(t, "10.0.0.1", list.Producers[0].Source)
+	require.Equal(t, 3, list.Producers[0].Failures)
+
+	w = httptest.NewRecorder()
+	agg.ServeQuarantine(w, httptest.NewRequest("DELETE", "/api/v1/admin/quarantine?job=ci", nil))
+	require.JSONEq(t, `{"released": 1}`, w.Body.String())
+	require.Equal(t, http.StatusAccepted, push("10.0.0.1", valid).Code)
+	require.Equal(t, 0.0, testutil.ToFloat64(QuarantinedProducers))
+
+	// producers that never push again are dropped in time
+	q := newQuarantine(2, time.Minute)
+	now := time.Now()
+	failure := &familyError{family: "builds", err: ErrOddNumberOfLabelParts}
+	q.record(producerKey{job: "gone", source: "10.0.0.3"}, failure, now)
+	q.record(producerKey{job: "quarantined", source: "10.0.0.4"}, failure, now)
+	q.record(producerKey{job: "quarantined", source: "10.0.0.4"}, failure, now)
+	q.record(producerKey{job: "new", source: "10.0.0.5"}, failure, now.Add(2*time.Minute))
+	require.Len(t, q.producers, 1)
+}
+
+func TestUpdateOptions(t *testing.T) {
+	agg := NewAggregate()
+	serve := func(method, query string) runtimeOptions {
+		w := httptest.NewRecorder()
+		agg.ServeOptions(w, httptest.NewRequest(method, "/api/v1/admin/options"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var opts runtimeOptions
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &opts))
+		return opts
+	}
+	require.Equal(t, runtimeOptions{MetricTTL: "0s", IgnoredLabels: []string{}}, serve("GET", ""))
+
+	// pushes racing with the update see either options
+	g := errgroup.Group{}
+	for i := 0; i < 4; i++ {
+		g.Go(func() error {
+			return agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds{pod=\"a\"} 1\n"), nil)
+		})
+	}
+	require.Equal(t, runtimeOptions{MetricTTL: "0s", IgnoredLabels: []string{"pod"}}, serve("POST", "?ignored_labels=Pod"))
+	require.NoError(t, g.Wait())
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE deploys counter\ndeploys{pod=\"a\"} 1\n"), nil))
+	deploys, ok := agg.families.Get("deploys")
+	require.True(t, ok)
+	require.Empty(t, deploys.head().toDTO().Metric[0].Label)
+
+	w := httptest.NewRecorder()
+	agg.ServeOptions(w, httptest.NewRequest("POST", "/api/v1/admin/options?metric_ttl=soon", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	require.Equal(t, runtimeOptions{MetricTTL: "1ns", IgnoredLabels: []string{"pod"}}, serve("POST", "?metric_ttl=1ns"))
+	w = httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Empty(t, w.Body.String())
+
+	require.Equal(t, runtimeOptions{MetricTTL: "0s", IgnoredLabels: []string{}}, serve("POST", "?metric_ttl=0&ignored_labels="))
+}
+
+func TestPushShapeHistograms(t *testing.T) {
+	agg := NewAggregate()
+	body := "# TYPE builds counter\nbuilds{branch=\"main\"} 1\nbuilds{branch=\"dev\"} 1\n# TYPE deploys counter\ndeploys 1\n"
+	req := httptest.NewRequest("POST", "/metrics/job/shape", strings.NewReader(body))
+	req.SetPathValue("labels", "/job/shape")
+	w := httptest.NewRecorder()
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	observed := func(h *prometheus.HistogramVec) *dto.Histogram {
+		m := &dto.Metric{}
+		require.NoError(t, h.WithLabelValues("shape").(prometheus.Histogram).Write(m))
+		return m.Histogram
+	}
+	require.Equal(t, uint64(1), observed(PushFamilies).GetSampleCount())
+	require.Equal(t, 2.0, observed(PushFamilies).GetSampleSum())
+	require.Equal(t, 3.0, observed(PushSeries).GetSampleSum())
+	require.Equal(t, float64(len(body)), observed(PushBodyBytes).GetSampleSum())
+}
+
+func TestMaxRenderSeries(t *testing.T) {
+	body := `# TYPE builds counter
+builds{branch="a"} 1
+builds{branch="b"} 1
+builds{branch="c"} 1
+# TYPE deploys counter
+deploys 1
+`
+	render := func(agg *Aggregate, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics"+query, nil))
+		return w
+	}
+
+	agg := NewAggregate(SetMaxRenderSeries(2, SeriesLimitTruncate))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(body), nil))
+	require.Equal(t, `# HELP aggregation_gateway_truncated_series `+truncatedSeriesHelp+`
+# TYPE aggregation_gateway_truncated_series gauge
+aggregation_gateway_truncated_series{family="builds"} 1
+# TYPE builds counter
+builds{branch="a"} 1
+builds{branch="b"} 1
+# TYPE deploys counter
+deploys 1
+`, render(agg, "").Body.String())
+	require.Equal(t, http.StatusBadRequest, render(agg, "?shard=0&shards=2").Code)
+
+	agg = NewAggregate(SetMaxRenderSeries(2, SeriesLimitSplit))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(body), nil))
+	var series []string
+	for shard := 0; shard < 3; shard++ {
+		w := render(agg, fmt.Sprintf("?shard=%d&shards=3", shard))
+		require.Equal(t, http.StatusOK, w.Code)
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				series = append(series, line)
+			}
+		}
+	}
+	// every series is in exactly one shard, none over the limit
+	sort.Strings(series)
+	require.Equal(t, []string{`builds{branch="a"} 1`, `builds{branch="b"} 1`, `builds{branch="c"} 1`, `deploys 1`}, series)
+	require.Equal(t, http.StatusBadRequest, render(agg, "?shard=3&shards=3").Code)
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "aggregate.snap")
+	keysPath := filepath.Join(dir, "keys.yaml")
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	require.NoError(t, os.WriteFile(keysPath, []byte(fmt.Sprintf("default_key: %s\ntenant_keys:\n  acme: %s\n", key(1), key(2))), 0o600))
+	keys, err := LoadSnapshotKeys(keysPath)
+	require.NoError(t, err)
+
+	in := `# TYPE builds counter
+builds{tenant="acme"} 2
+builds{tenant="globex"} 3
+# TYPE deploys counter
+deploys 1
+`
+	agg := NewAggregate(SetTenantLabel("tenant"), SetPersistence(path, time.Hour, keys))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in), nil))
+	agg.Close()
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "builds")
+
+	restored := NewAggregate(SetTenantLabel("tenant"), SetPersistence(path, time.Hour, keys))
+	require.NoError(t, restored.Restore())
+	w := httptest.NewRecorder()
+	restored.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, in, w.Body.String())
+
+	// without the keys, or with another key for a tenant, nothing is restored
+	require.ErrorContains(t, NewAggregate(SetPersistence(path, time.Hour, nil)).Restore(), "no keys were given")
+	require.NoError(t, os.WriteFile(keysPath, []byte(fmt.Sprintf("default_key: %s\ntenant_keys:\n  acme: %s\n", key(1), key(3))), 0o600))
+	wrongKeys, err := LoadSnapshotKeys(keysPath)
+	require.NoError(t, err)
+	require.ErrorContains(t, NewAggregate(SetPersistence(path, time.Hour, wrongKeys)).Restore(), `tenant "acme"`)
+
+	require.NoError(t, os.WriteFile(keysPath, []byte("tenant_keys:\n  acme: "+key(2)+"\n"), 0o600))
+	_, err = LoadSnapshotKeys(keysPath)
+	require.ErrorContains(t, err, "default_key is required")
+
+	// a missing snapshot starts the aggregate empty
+	require.NoError(t, NewAggregate(SetPersistence(filepath.Join(dir, "missing.snap"), time.Hour, nil)).Restore())
+}
+
+func TestRestoreTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aggregate.snap")
+	ttl := time.Hour
+	agg := NewAggregate(SetPersistence(path, time.Hour, nil))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 2\n# TYPE deploys counter\ndeploys 1\n"), nil))
+	deploys, _ := agg.families.Get("deploys")
+	deploys.lock.Lock()
+	deploys.lastUpdate = time.Now().Add(-2 * ttl)
+	deploys.lock.Unlock()
+	agg.Close()
+
+	render := func(agg *Aggregate) string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	reset := NewAggregate(SetPersistence(path, time.Hour, nil), SetTTLMetricTime(&ttl), SetRestoreTTL(RestoreResetTTL))
+	require.NoError(t, reset.Restore())
+	require.Equal(t, "# TYPE builds counter\nbuilds 2\n# TYPE deploys counter\ndeploys 1\n", render(reset))
+	require.InDelta(t, (2 * ttl).Seconds(), testutil.ToFloat64(RestoredFamilyAge.WithLabelValues("deploys")), 60)
+
+	// stale restored families expire before they are rendered
+	honor := NewAggregate(SetPersistence(path, time.Hour, nil), SetTTLMetricTime(&ttl), SetRestoreTTL(RestoreHonorTTL))
+	require.NoError(t, honor.Restore())
+	require.Equal(t, "# TYPE builds counter\nbuilds 2\n", render(honor))
+	require.False(t, RestoredFamilyAge.DeleteLabelValues("deploys"))
+
+	// the age is dropped once the family is pushed to again
+	require.Less(t, testutil.ToFloat64(RestoredFamilyAge.WithLabelValues("builds")), 60.0)
+	require.NoError(t, honor.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 1\n"), nil))
+	require.False(t, RestoredFamilyAge.DeleteLabelValues("builds"))
+
+	// snapshots written before last pushes were kept still restore
+	var v1 bytes.Buffer
+	_, err := protodelim.MarshalTo(&v1, &dto.MetricFamily{Name: proto.String("builds"), Type: dto.MetricType_COUNTER.Enum(), Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}}}})
+	require.NoError(t, err)
+	content := append([]byte(snapshotMagicV1), 0, sectionPlain)
+	content = append(binary.AppendUvarint(content, uint64(v1.Len())), v1.Bytes()...)
+	families, pushed, err := readSnapshot(content, nil)
+	require.NoError(t, err)
+	require.Nil(t, pushed)
+	require.Equal(t, 3.0, families["builds"].Metric[0].GetCounter().GetValue())
+}
+
+func TestSubAggregates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub_aggregates.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("sub_aggregates:\n  - label: env\n    value: prod\n    merge_strategies:\n      gauge: max\n"), 0o600))
+	subs, err := LoadSubAggregates(path)
+	require.NoError(t, err)
+	agg := NewAggregate(SetSubAggregates(subs))
+	defer agg.Close()
+
+	push := func(labels, body string) {
+		req := httptest.NewRequest("POST", "/metrics"+labels, strings.NewReader(body))
+		req.SetPathValue("labels", labels)
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+	render := func(labels string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics"+labels, nil)
+		req.SetPathValue("labels", labels)
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, req)
+		return w
+	}
+	push("/env/prod/job/ci", "# TYPE workers gauge\nworkers 4\n")
+	push("/env/prod/job/ci", "# TYPE workers gauge\nworkers 6\n")
+	push("/env/dev/job/ci", "# TYPE workers gauge\nworkers 1\n")
+
+	// the sub-aggregate has its own series and merge strategies
+	require.Equal(t, "# TYPE workers gauge\nworkers{env=\"prod\",job=\"ci\"} 6\n", render("/env/prod").Body.String())
+	require.Equal(t, "# TYPE workers gauge\nworkers{env=\"dev\",job=\"ci\"} 1\n", render("").Body.String())
+	require.Equal(t, http.StatusNotFound, render("/env/dev").Code)
+	require.Equal(t, http.StatusNotFound, render("/env/prod/job/ci").Code)
+	// its families aren't counted with those of the main aggregate
+	sub := agg.subAggregateFor([]labelPair{{name: "env", value: "prod"}})
+	require.NotSame(t, registeredFamilyMetrics, sub.familyMetrics)
+	require.Equal(t, 1.0, testutil.ToFloat64(sub.familyMetrics.total))
+
+	// admin requests select it with ?sub_aggregate
+	req := httptest.NewRequest("POST", "/api/v1/admin/freeze?name=workers&sub_aggregate=env%3Dprod", nil)
+	w := httptest.NewRecorder()
+	agg.ServeFreeze(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.False(t, agg.frozen.has("workers"))
+	require.True(t, sub.frozen.has("workers"))
+	req = httptest.NewRequest("GET", "/api/v1/admin/freeze?sub_aggregate=env%3Ddev", nil)
+	w = httptest.NewRecorder()
+	agg.ServeFreeze(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	// and series deletes by their label path
+	req = httptest.NewRequest("DELETE", "/api/v1/admin/series/env/prod/job/ci", nil)
+	req.SetPathValue("labels", "/env/prod/job/ci")
+	w = httptest.NewRecorder()
+	agg.ServeSeries(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, render("/env/prod").Body.String())
+	require.Equal(t, "# TYPE workers gauge\nworkers{env=\"dev\",job=\"ci\"} 1\n", render("").Body.String())
+
+	require.NoError(t, os.WriteFile(path, []byte("sub_aggregates:\n  - label: env\n    value: prod\n  - label: env\n    value: prod\n"), 0o600))
+	_, err = LoadSubAggregates(path)
+	require.ErrorContains(t, err, "env=prod is defined twice")
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	agg := NewAggregate(SetTenantLabel("tenant"), SetSubAggregates([]SubAggregate{{Label: "env", Value: "prod"}}))
+	defer agg.Close()
+	for _, tenant := range []string{"team-b", "team-a"} {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+		req.SetPathValue("labels", "/job/ci")
+		req.Header.Set(TenantHeader, tenant)
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/sd", nil)
+	req.Host = "gateway:8080"
+	w := httptest.NewRecorder()
+	agg.ServeSD(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var groups []sdTargetGroup
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &groups))
+	require.Equal(t, []sdTargetGroup{
+		{Targets: []string{"gateway:8080"}, Labels: map[string]string{"__metrics_path__": "/metrics", sdLabelPrefix + "endpoint": "main"}},
+		{Targets: []string{"gateway:8080"}, Labels: map[string]string{"__metrics_path__": "/metrics", "__param_tenant": "team-a", sdLabelPrefix + "endpoint": "main_tenant", sdLabelPrefix + "tenant": "team-a"}},
+		{Targets: []string{"gateway:8080"}, Labels: map[string]string{"__metrics_path__": "/metrics", "__param_tenant": "team-b", sdLabelPrefix + "endpoint": "main_tenant", sdLabelPrefix + "tenant": "team-b"}},
+		{Targets: []string{"gateway:8080"}, Labels: map[string]string{"__metrics_path__": "/metrics/env/prod", sdLabelPrefix + "endpoint": "sub_aggregate", sdLabelPrefix + "sub_aggregate": "env=prod"}},
+	}, groups)
+
+	// the tenant targets render through ?tenant
+	req = httptest.NewRequest("GET", "/metrics?tenant=team-a", nil)
+	w = httptest.NewRecorder()
+	agg.ServeRender(w, req)
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\"} 1\n", w.Body.String())
+
+	req = httptest.NewRequest("GET", "/api/v1/sd?shards=2", nil)
+	w = httptest.NewRecorder()
+	agg.ServeSD(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// behind a TLS terminating proxy, with sub-aggregate paths escaped
+	proxies, err := ParseTrustedProxies([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	agg = NewAggregate(SetTrustedProxies(proxies, RealIPForwardedFor), SetSubAggregates([]SubAggregate{{Label: "region", Value: "eu west"}}))
+	defer agg.Close()
+	sd := func(path, remote string) []sdTargetGroup {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "gateway:8080"
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		agg.ServeSD(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var groups []sdTargetGroup
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &groups))
+		return groups
+	}
+	groups = sd("/api/v1/sd", "192.0.2.1:1234")
+	require.Equal(t, "https", groups[0].Labels["__scheme__"])
+	require.Equal(t, "/metrics/region/eu%20west", groups[1].Labels["__metrics_path__"])
+	// the header of other clients is ignored, ?scheme overrides both
+	require.Empty(t, sd("/api/v1/sd", "198.51.100.1:1234")[0].Labels["__scheme__"])
+	require.Equal(t, "https", sd("/api/v1/sd?scheme=https", "198.51.100.1:1234")[0].Labels["__scheme__"])
+	w = httptest.NewRecorder()
+	agg.ServeSD(w, httptest.NewRequest("GET", "/api/v1/sd?scheme=ftp", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	require.ErrorContains(t, (&SubAggregate{Label: "path", Value: "a/b"}).compile(), "can't carry a slash")
+}
+
+func TestIgnoreLabelsAtRender(t *testing.T) {
+	agg := NewAggregate(AddIgnoredLabels("instance"), SetIgnoreLabelsAtRender(true), SetMergeStrategy(dto.MetricType_GAUGE, MaxStrategy))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# TYPE builds counter
+builds{instance="a"} 2
+builds{instance="b"} 3
+# TYPE workers gauge
+workers{instance="a"} 4
+workers{instance="b"} 6
+`), nil))
+
+	w := httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "# TYPE builds counter\nbuilds 5\n# TYPE workers gauge\nworkers 6\n", w.Body.String())
+
+	// the raw series are still there for admins
+	w = httptest.NewRecorder()
+	agg.ServeRawRender(w, httptest.NewRequest("GET", "/api/v1/admin/raw?name=builds", nil))
+	require.Equal(t, "# TYPE builds counter\nbuilds{instance=\"a\"} 2\nbuilds{instance=\"b\"} 3\n", w.Body.String())
+
+	families, err := agg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families[0].Metric, 1)
+
+	// without ignored labels, renders are the raw series
+	agg.UpdateOptions(AddIgnoredLabels())
+	w = httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Contains(t, w.Body.String(), "builds{instance=\"b\"} 3\n")
+}
+
+func TestFamilyInventory(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		messages []newFamiliesMessage
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message newFamiliesMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		lock.Lock()
+		messages = append(messages, message)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	agg := NewAggregate(SetFamilyInventory(true, hook.URL))
+	push := func(job, source, body string) {
+		req := httptest.NewRequest("POST", "/metrics/job/"+job, strings.NewReader(body))
+		req.SetPathValue("labels", "/job/"+job)
+		req.RemoteAddr = source + ":1234"
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+	push("ci", "10.0.0.1", "# TYPE builds counter\nbuilds 1\n# TYPE deploys counter\ndeploys 1\n")
+	push("ci", "10.0.0.1", "# TYPE builds counter\nbuilds 1\n")
+	push("etl", "10.0.0.2", "# TYPE builds counter\nbuilds 1\n# TYPE rows counter\nrows 1\n")
+	agg.Close()
+
+	list := func(query string) []inventoryEntry {
+		w := httptest.NewRecorder()
+		agg.ServeInventory(w, httptest.NewRequest("GET", "/api/v1/admin/inventory"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var body struct {
+			Families []inventoryEntry `json:"families"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body.Families
+	}
+	families := list("")
+	require.Len(t, families, 3)
+	require.Equal(t, "rows", families[0].Family)
+	require.Equal(t, "etl", families[0].Job)
+	require.Equal(t, "10.0.0.2", families[0].Source)
+	byName := map[string]string{}
+	for _, f := range families {
+		byName[f.Family] = f.Job
+	}
+	require.Equal(t, map[string]string{"builds": "ci", "deploys": "ci", "rows": "etl"}, byName)
+	require.Len(t, list("?job=ci"), 2)
+	require.Len(t, list("?since=1h"), 3)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, messages, 2)
+	require.Equal(t, []string{"builds", "deploys"}, []string{messages[0].Families[0].Family, messages[0].Families[1].Family})
+	require.Equal(t, "rows", messages[1].Families[0].Family)
+}
+
+func TestCounterJumpGuard(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		messages []counterJumpsMessage
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message counterJumpsMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&message))
+		lock.Lock()
+		messages = append(messages, message)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	agg := NewAggregate(SetCounterJumpGuard(3, hook.URL))
+	push := func(body string) {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(body), testLabels))
+	}
+	render := func() {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	jumps := func(family string) float64 {
+		return testutil.ToFloat64(CounterJumps.WithLabelValues(family))
+	}
+	before := jumps("requests_total")
+
+	push("# TYPE requests_total counter\nrequests_total{code=\"200\"} 10\nrequests_total{code=\"500\"} 0\n# TYPE queue gauge\nqueue 1\n")
+	render()
+	// a steady increase, a counter coming from 0 and a gauge aren't jumps
+	push("# TYPE requests_total counter\nrequests_total{code=\"200\"} 5\nrequests_total{code=\"500\"} 100\n# TYPE queue gauge\nqueue 100\n")
+	render()
+	require.Equal(t, before, jumps("requests_total"))
+
+	// a replayed backlog
+	push("# TYPE requests_total counter\nrequests_total{code=\"200\"} 60\n")
+	render()
+	// renders of the same generation aren't checked again
+	render()
+	require.Equal(t, before+1, jumps("requests_total"))
+	agg.Close()
+
+	require.Equal(t, []counterJumpsMessage{{Factor: 3, Jumps: []counterJump{{
+		Family: "requests_total", Labels: map[string]string{"code": "200", "job": "test"}, Previous: 15, Current: 75,
+	}}}}, messages)
+
+	// counters are checked as rendered, here merged over their pods
+	agg = NewAggregate(SetCounterJumpGuard(3, ""), AddIgnoredLabels("pod"), SetIgnoreLabelsAtRender(true))
+	before = jumps("requests_total")
+	push("# TYPE requests_total counter\nrequests_total{pod=\"a\"} 10\n")
+	render()
+	push("# TYPE requests_total counter\nrequests_total{pod=\"b\"} 100\n")
+	render()
+	require.Equal(t, before+1, jumps("requests_total"))
+}
+
+func TestPushAnomalies(t *testing.T) {
+	var (
+		lock      sync.Mutex
+		anomalies []pushAnomaly
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var anomaly pushAnomaly
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&anomaly))
+		lock.Lock()
+		anomalies = append(anomalies, anomaly)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	agg := NewAggregate(SetPushAnomalies(10, hook.URL))
+	push := func(body string) ackBody {
+		req := httptest.NewRequest("POST", "/metrics/job/anomalies", strings.NewReader(body))
+		req.SetPathValue("labels", "/job/anomalies")
+		req.Header.Set("Accept", "application/json")
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		var ack ackBody
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ack))
+		return ack
+	}
+	series := func(n int, label string) string {
+		var b strings.Builder
+		b.WriteString("# TYPE requests counter\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "requests{%s=\"%d\"} 1\n", label, i)
+		}
+		return b.String()
+	}
+	count := func(kind string) float64 {
+		return testutil.ToFloat64(PushAnomalies.WithLabelValues("anomalies", kind))
+	}
+	before := count("series")
+
+	// the warmup learns the baseline, whatever the pushes look like
+	for _, n := range []int{2, 3, 40, 3, 2} {
+		require.Empty(t, push(series(n, "path")).Warnings)
+	}
+	require.Empty(t, push(series(12, "path")).Warnings)
+	require.Equal(t, before, count("series"))
+
+	ack := push(series(400, "path") + "# TYPE errors counter\nerrors{code=\"500\"} 1\n")
+	require.Len(t, ack.Warnings, 2)
+	require.Equal(t, `the push has 401 series, more than 10 times the usual 10 of job "anomalies"`, ack.Warnings[0])
+	require.Equal(t, `job "anomalies" never pushed the label names code before`, ack.Warnings[1])
+	require.Equal(t, before+1, count("series"))
+	// new label names are only flagged once
+	require.Empty(t, push(series(3, "path")+"# TYPE errors counter\nerrors{code=\"500\"} 1\n").Warnings)
+	// the baselines of jobs gone idle are forgotten
+	key := producerKey{job: "idle", source: "10.0.0.2"}
+	agg.anomalyGuard.check(key, 1, nil, time.Now().Add(-2*anomalyBaselineIdle))
+	agg.anomalyGuard.swept = time.Time{}
+	agg.anomalyGuard.check(producerKey{job: "anomalies", source: "10.0.0.1"}, 3, nil, time.Now())
+	require.NotContains(t, agg.anomalyGuard.baselines, jobKey{job: "idle"})
+	require.Contains(t, agg.anomalyGuard.baselines, jobKey{job: "anomalies"})
+	agg.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, anomalies, 1)
+	require.Equal(t, []string{"series", "label_names"}, anomalies[0].Anomalies)
+	require.Equal(t, "10.0.0.1", anomalies[0].Source)
+	require.Equal(t, 401, anomalies[0].Series)
+	require.Equal(t, []string{"code"}, anomalies[0].NewLabelNames)
+}
+
+func TestEscapingNegotiation(t *testing.T) {
+	const (
+		prometheus2 = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+		prometheus3 = "application/openmetrics-text;version=1.0.0;escaping=allow-utf-8;q=0.6,application/openmetrics-text;version=0.0.1;q=0.5,text/plain;version=1.0.0;escaping=allow-utf-8;q=0.4,text/plain;version=0.0.4;q=0.3,*/*;q=0.2"
+		protobuf    = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+	)
+	for _, openMetrics := range []bool{false, true} {
+		agg := NewAggregate(SetOpenMetrics(openMetrics))
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(`{"http.requests","code.class"="2xx"} 3`+"\n"), testLabels))
+		render := func(accept string) (string, []byte) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			w := httptest.NewRecorder()
+			agg.ServeRender(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, "Accept, Accept-Encoding", w.Header().Get("Vary"))
+			return w.Header().Get("Content-Type"), w.Body.Bytes()
+		}
+
+		contentType, body := render("")
+		require.Equal(t, "text/plain; version=0.0.4; charset=utf-8; escaping=underscores", contentType)
+		require.Contains(t, string(body), `http_requests{code_class="2xx",job="test"} 3`)
+
+		contentType, body = render(prometheus2)
+		if openMetrics {
+			require.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=underscores", contentType)
+		} else {
+			require.Equal(t, "text/plain; version=0.0.4; charset=utf-8; escaping=underscores", contentType)
+		}
+		require.Contains(t, string(body), `http_requests{code_class="2xx",job="test"} 3`)
+
+		contentType, body = render(prometheus3)
+		if openMetrics {
+			require.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=allow-utf-8", contentType)
+		} else {
+			// from the text/plain;version=1.0.0 entry
+			require.Equal(t, "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf-8", contentType)
+		}
+		require.Contains(t, string(body), `{"http.requests","code.class"="2xx",job="test"} 3`)
+
+		// the escaping asked for with OpenMetrics doesn't carry over to text
+		contentType, body = render("application/openmetrics-text;version=1.0.0;escaping=allow-utf-8,text/plain;version=0.0.4;q=0.5")
+		if !openMetrics {
+			require.Equal(t, "text/plain; version=0.0.4; charset=utf-8; escaping=underscores", contentType)
+			require.Contains(t, string(body), `http_requests{code_class="2xx",job="test"} 3`)
+		}
+
+		// unknown schemes are ignored
+		contentType, _ = render("text/plain;version=0.0.4;escaping=rot13")
+		require.Equal(t, "text/plain; version=0.0.4; charset=utf-8; escaping=underscores", contentType)
+
+		// the protobuf encoder escapes too
+		for accept, name := range map[string]string{
+			protobuf + ";q=0.9,text/plain;q=0.5":                      "http_requests",
+			protobuf + ";escaping=allow-utf-8;q=0.9,text/plain;q=0.5": "http.requests",
+		} {
+			contentType, body = render(accept)
+			require.Equal(t, expfmt.TypeProtoDelim, expfmt.Format(contentType).FormatType())
+			family := &dto.MetricFamily{}
+			require.NoError(t, expfmt.NewDecoder(bytes.NewReader(body), expfmt.Format(contentType)).Decode(family))
+			require.Equal(t, name, family.GetName())
+		}
+		agg.Close()
+	}
+}
+
+func TestScrapeReceipts(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		settled []scrapeReceipt
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var receipt scrapeReceipt
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&receipt))
+		lock.Lock()
+		settled = append(settled, receipt)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	push := func(agg *Aggregate, query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/job/batch"+query, strings.NewReader(body))
+		req.SetPathValue("labels", "/job/batch")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w
+	}
+	get := func(agg *Aggregate, query string) (int, scrapeReceipt) {
+		w := httptest.NewRecorder()
+		agg.ServeReceipt(w, httptest.NewRequest("GET", "/api/v1/receipt"+query, nil))
+		var receipt scrapeReceipt
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+		}
+		return w.Code, receipt
+	}
+	render := func(agg *Aggregate, path string) {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := push(NewAggregate(), "?receipt=true", "builds 1\n")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), ErrReceiptsDisabled.Error())
+
+	agg := NewAggregate(SetScrapeReceipts(time.Hour, hook.URL))
+	// a scrape before the push doesn't count
+	render(agg, "/metrics")
+	w = push(agg, "?receipt=true", "builds 1\n")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	id := w.Header().Get("Scrape-Receipt")
+	require.NotEmpty(t, id)
+	var ack ackBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ack))
+	require.Equal(t, id, ack.Receipt)
+	require.Empty(t, push(agg, "", "builds 1\n").Header().Get("Scrape-Receipt"))
+
+	code, receipt := get(agg, "?id="+id)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, ReceiptPending, receipt.Status)
+	require.Equal(t, "batch", receipt.Job)
+
+	// a wait returns once the receipt is scraped
+	waited := make(chan scrapeReceipt)
+	go func() {
+		_, receipt := get(agg, "?wait=10s&id="+id)
+		waited <- receipt
+	}()
+	time.Sleep(20 * time.Millisecond)
+	render(agg, "/metrics")
+	receipt = <-waited
+	require.Equal(t, ReceiptScraped, receipt.Status)
+	require.NotNil(t, receipt.ScrapedAt)
+	code, _ = get(agg, "?id=unknown")
+	require.Equal(t, http.StatusNotFound, code)
+	agg.Close()
+
+	// truncated renders, streamed or not, don't settle receipts
+	for _, streamed := range []int{0, 1} {
+		agg = NewAggregate(SetScrapeReceipts(time.Hour, ""), SetMaxRenderSeries(1, SeriesLimitTruncate), SetStreamingRender(streamed, 0))
+		w = push(agg, "?receipt=true", "builds{a=\"1\"} 1\nbuilds{a=\"2\"} 1\n")
+		require.Equal(t, http.StatusAccepted, w.Code)
+		render(agg, "/metrics")
+		_, receipt = get(agg, "?id="+w.Header().Get("Scrape-Receipt"))
+		require.Equal(t, ReceiptPending, receipt.Status)
+		agg.Close()
+	}
+
+	// asynchronous pushes are queued until merged, and may fail
+	agg = NewAggregate(SetAsyncIngest(1, 4), SetScrapeReceipts(time.Hour, hook.URL))
+	w = push(agg, "?receipt=true", "builds{\n")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	_, receipt = get(agg, "?wait=10s&id="+w.Header().Get("Scrape-Receipt"))
+	require.Equal(t, ReceiptFailed, receipt.Status)
+	require.NotEmpty(t, receipt.Error)
+	agg.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, settled, 2)
+	require.Equal(t, id, settled[0].ID)
+	require.Equal(t, ReceiptScraped, settled[0].Status)
+	require.Equal(t, ReceiptFailed, settled[1].Status)
+}
+
+func TestReadAPI(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(`# HELP queue_depth Jobs waiting.
+# TYPE queue_depth gauge
+queue_depth{queue="a"} 4
+queue_depth{queue="b"} 6
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 4.5
+latency_seconds_count 3
+`), testLabels))
+
+	w := httptest.NewRecorder()
+	agg.ServeReadFamilies(w, httptest.NewRequest("GET", "/v1/families", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"families":[
+		{"name":"latency_seconds","type":"histogram","series":1},
+		{"name":"queue_depth","type":"gauge","help":"Jobs waiting.","series":2}
+	]}`, w.Body.String())
+
+	stream := func(query string) []readSeries {
+		w := httptest.NewRecorder()
+		agg.ServeReadSeries(w, httptest.NewRequest("GET", "/v1/series"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+		var lines []readSeries
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var line readSeries
+			require.NoError(t, dec.Decode(&line))
+			lines = append(lines, line)
+		}
+		return lines
+	}
+	lines := stream("")
+	require.Len(t, lines, 3)
+	require.Equal(t, "latency_seconds", lines[0].Family)
+	require.Equal(t, map[string]string{"1": "2", "+Inf": "3"}, lines[0].Buckets)
+	require.Equal(t, readSeries{Family: "queue_depth", Type: "gauge", jsonSeries: jsonSeries{Labels: map[string]string{"job": "test", "queue": "b"}, Value: "6"}}, lines[2])
+
+	lines = stream("?name=queue_depth&match=queue=a")
+	require.Len(t, lines, 1)
+	require.Equal(t, "4", lines[0].Value)
+	require.Empty(t, stream("?name=queue_depth&match=queue=c"))
+
+	w = httptest.NewRecorder()
+	agg.ServeReadSeries(w, httptest.NewRequest("GET", "/v1/series?match=queue", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// families are read as rendered
+	agg = NewAggregate(SetGaugeSpread(true), SetMaxRenderSeries(1, SeriesLimitTruncate))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 4\nqueue_depth{queue=\"b\"} 6\n"), testLabels))
+	lines = stream("?name=queue_depth")
+	require.Len(t, lines, 1)
+	require.Equal(t, "queue_depth", lines[0].Family)
+	families := map[string]bool{}
+	for _, line := range stream("") {
+		families[line.Family] = true
+	}
+	require.True(t, families["queue_depth_max"])
+	require.True(t, families[TruncatedSeriesMetric])
+}
+
+func TestDuplicateSeries(t *testing.T) {
+	in := `# TYPE builds counter
+builds{branch="a"} 1
+builds{branch="b"} 1
+builds{branch="a"} 2
+# TYPE workers gauge
+workers{instance="x"} 4
+workers{instance="y"} 6
+workers{instance="z"} 5
+`
+	agg := NewAggregate(AddIgnoredLabels("instance"))
+	require.ErrorContains(t, agg.parseAndMerge(strings.NewReader(in), nil), "duplicate labels")
+
+	agg = NewAggregate(AddIgnoredLabels("instance"), SetDuplicateSeries(DuplicateSeriesMerge), SetMergeStrategy(dto.MetricType_GAUGE, LastStrategy))
+	ack := newPushAck(agg.opts())
+	require.NoError(t, agg.parseAndMergeAck(context.Background(), strings.NewReader(in), nil, ack))
+	w := httptest.NewRecorder()
+	agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+	// counters are summed, the last gauge in the push wins
+	require.Equal(t, "# TYPE builds counter\nbuilds{branch=\"a\"} 3\nbuilds{branch=\"b\"} 1\n# TYPE workers gauge\nworkers 5\n", w.Body.String())
+	require.Equal(t, 3, ack.series)
+	require.Contains(t, ack.body().Warnings, "2 duplicate series of workers were merged")
+	require.Equal(t, 1.0, testutil.ToFloat64(DuplicateSeries.WithLabelValues("builds")))
+}
+
+func TestExport(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds{branch=\"a\"} 1\n# TYPE deploys counter\ndeploys 2\n# TYPE jobs gauge\njobs 3\n"), testLabels))
+
+	export := func(query string) []*dto.MetricFamily {
+		w := httptest.NewRecorder()
+		agg.ServeExport(w, httptest.NewRequest("GET", "/api/v1/admin/export"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, string(expfmt.NewFormat(expfmt.TypeProtoDelim)), w.Header().Get("Content-Type"))
+
+		var families []*dto.MetricFamily
+		dec := expfmt.NewDecoder(w.Body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+		for {
+			family := &dto.MetricFamily{}
+			if err := dec.Decode(family); err == io.EOF {
+				break
+			} else {
+				require.NoError(t, err)
+			}
+			families = append(families, family)
+		}
+		return families
+	}
+
+	families := export("")
+	require.Len(t, families, 3)
+	require.Equal(t, "builds", families[0].GetName())
+	require.Equal(t, "job", families[0].Metric[0].Label[1].GetName())
+	require.Equal(t, "test", families[0].Metric[0].Label[1].GetValue())
+	require.Equal(t, 3.0, families[2].Metric[0].GetGauge().GetValue())
+
+	families = export("?name=deploys&name=jobs")
+	require.Len(t, families, 2)
+	require.Equal(t, "deploys", families[0].GetName())
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+	_, err = ParseTrustedProxies([]string{"ingress"})
+	require.Error(t, err)
+
+	forwarded := NewAggregate(SetTrustedProxies(proxies, RealIPForwardedFor))
+	realIP := NewAggregate(SetTrustedProxies(proxies, RealIPHeader))
+	for _, c := range []struct {
+		name       string
+		agg        *Aggregate
+		remoteAddr string
+		headers    map[string]string
+		client     string
+	}{
+		{"no proxy", forwarded, "203.0.113.9:1234", nil, "203.0.113.9"},
+		{"untrusted peer", forwarded, "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer", forwarded, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", forwarded, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"only proxies", forwarded, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "10.0.0.1"}, "10.0.0.1"},
+		{"garbage", forwarded, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "unknown"}, "10.1.2.3"},
+		{"real ip", realIP, "[::ffff:10.1.2.3]:1234", map[string]string{"X-Real-IP": "2001:db8::1", "X-Forwarded-For": "1.1.1.1"}, "2001:db8::1"},
+		{"real ip untrusted", realIP, "203.0.113.9:1234", map[string]string{"X-Real-IP": "2001:db8::1"}, "203.0.113.9"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/metrics", nil)
+			req.RemoteAddr = c.remoteAddr
+			for name, value := range c.headers {
+				req.Header.Set(name, value)
+			}
+			require.Equal(t, c.client, c.agg.clientAddr(req))
+		})
+	}
+}
+
+// abortingBody returns body, then runs abort and fails like a reset
+// connection
+type abortingBody struct {
+	body  io.Reader
+	abort func()
+}
+
+func (b *abortingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.abort()
+		return n, errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestPushDeadline(t *testing.T) {
+	agg := NewAggregate(SetPushDeadline(time.Second))
+	var families strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&families, "# TYPE family_%d counter\nfamily_%d 1\n", i, i)
+	}
+
+	// a client going away mid-upload merges none of the families it sent
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/metrics/job/ci", &abortingBody{body: strings.NewReader(families.String()), abort: cancel})
+	req = req.WithContext(ctx)
+	req.SetPathValue("labels", "/job/ci")
+	w := httptest.NewRecorder()
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusRequestTimeout, w.Code)
+	require.Contains(t, w.Body.String(), ErrPushCanceled.Error())
+	require.Empty(t, agg.snapshot())
+
+	// as does a push outliving the deadline
+	agg = NewAggregate(SetPushDeadline(10 * time.Millisecond))
+	slow := &abortingBody{body: strings.NewReader(families.String()), abort: func() { time.Sleep(50 * time.Millisecond) }}
+	req = httptest.NewRequest("POST", "/metrics/job/ci", slow)
+	req.SetPathValue("labels", "/job/ci")
+	w = httptest.NewRecorder()
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusRequestTimeout, w.Code)
+	require.Contains(t, w.Body.String(), ErrPushDeadline.Error())
+	require.Empty(t, agg.snapshot())
+
+	agg = NewAggregate(SetPushDeadline(time.Second))
+	req = httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(families.String()))
+	req.SetPathValue("labels", "/job/ci")
+	w = httptest.NewRecorder()
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Len(t, agg.snapshot(), 1000)
+}
+
+func TestBootstrap(t *testing.T) {
+	blue := NewAggregate(SetPusherUp(true))
+	require.NoError(t, blue.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds{job=\"ci\"} 5\n# TYPE deploys counter\ndeploys{job=\"cd\"} 2\n"), nil))
+	blue.notePush("ci", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); r.URL.Path != "/api/v1/admin/export" || user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		blue.ServeExport(w, r)
+	}))
+	defer srv.Close()
+	base := strings.Replace(srv.URL, "://", "://admin:secret@", 1)
+
+	green := NewAggregate(SetPusherUp(true))
+	// restored families are kept
+	require.NoError(t, green.parseAndMerge(strings.NewReader("# TYPE deploys counter\ndeploys{job=\"cd\"} 7\n"), nil))
+	_, err := green.Bootstrap(srv.URL)
+	require.ErrorContains(t, err, "401")
+	seeded, err := green.Bootstrap(base)
+	require.NoError(t, err)
+	require.Equal(t, 1, seeded)
+
+	builds, ok := green.families.Get("builds")
+	require.True(t, ok)
+	require.Equal(t, 5.0, builds.head().toDTO().Metric[0].GetCounter().GetValue())
+	deploys, _ := green.families.Get("deploys")
+	require.Equal(t, 7.0, deploys.head().toDTO().Metric[0].GetCounter().GetValue())
+	_, ok = green.families.Get(PusherUpMetric)
+	require.False(t, ok)
+
+	// pushes keep merging into the seeded families
+	require.NoError(t, green.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds{job=\"ci\"} 1\n"), nil))
+	builds, _ = green.families.Get("builds")
+	require.Equal(t, 6.0, builds.head().toDTO().Metric[0].GetCounter().GetValue())
+
+	srv.Close()
+	_, err = NewAggregate().Bootstrap(base)
+	require.Error(t, err)
+}
+
+func TestPushAllOrNothing(t *testing.T) {
+	agg := NewAggregate()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE jobs_total counter\njobs_total 1\n"), testLabels))
+
+	// the second family doesn't parse, the first isn't merged either
+	err := agg.parseAndMerge(strings.NewReader("# TYPE jobs_total counter\njobs_total 2\n# TYPE queue_depth gauge\nqueue_depth{ 4\n"), testLabels)
+	require.Error(t, err)
+	families, _ := agg.Gather()
+	require.Len(t, families, 1)
+	require.Equal(t, 1.0, families[0].Metric[0].GetCounter().GetValue())
+
+	// nor when a family doesn't merge, whatever the order of the families
+	err = agg.parseAndMerge(strings.NewReader("# TYPE queue_depth gauge\nqueue_depth 4\n# TYPE jobs_total gauge\njobs_total 2\n# TYPE workers gauge\nworkers 3\n"), testLabels)
+	require.ErrorContains(t, err, "type COUNTER != GAUGE")
+	families, _ = agg.Gather()
+	require.Len(t, families, 1)
+	require.Equal(t, 1.0, families[0].Metric[0].GetCounter().GetValue())
+
+	// nor when the push is canceled before it is committed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = agg.parseAndMergeAck(ctx, strings.NewReader("# TYPE jobs_total counter\njobs_total 2\n"), testLabels, newPushAck(agg.opts()))
+	require.ErrorIs(t, err, ErrPushCanceled)
+	families, _ = agg.Gather()
+	require.Equal(t, 1.0, families[0].Metric[0].GetCounter().GetValue())
+}
+
+func TestStagedPushMemory(t *testing.T) {
+	var body strings.Builder
+	for f := 0; f < 20; f++ {
+		fmt.Fprintf(&body, "# TYPE family_%d counter\n", f)
+		for s := 0; s < 1000; s++ {
+			fmt.Fprintf(&body, "family_%d{pod=\"pod-%d\",instance=\"10.0.0.%d:9100\"} %d\n", f, s, s%256, s)
+		}
+	}
+	heap := func() int64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return int64(stats.HeapAlloc)
+	}
+
+	// what holding every parsed family of the push until its commit takes
+	before := heap()
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(strings.NewReader(body.String()))
+	require.NoError(t, err)
+	parsedBytes := heap() - before
+	runtime.KeepAlive(parsed)
+	parsed = nil
+
+	// a staged push only holds the compact series of its families
+	agg := NewAggregate()
+	before = heap()
+	staged, err := agg.stagePush(context.Background(), strings.NewReader(body.String()), testLabels, newPushAck(agg.opts()), nil)
+	require.NoError(t, err)
+	stagedBytes := heap() - before
+	require.Len(t, staged, 20)
+	runtime.KeepAlive(staged)
+	require.Less(t, stagedBytes, parsedBytes/2, "staged %d bytes, parsed %d", stagedBytes, parsedBytes)
+}
+
+func TestPointInTimeRender(t *testing.T) {
+	agg := NewAggregate()
+	var body strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&body, "# TYPE family_%02d_total counter\nfamily_%02d_total 1\n", i, i)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				// every push is committed at once
+				require.NoError(t, agg.parseAndMergeAck(context.Background(), strings.NewReader(body.String()), nil, newPushAck(agg.opts())))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// families pushed together are always rendered at the same point
+	for rendered := false; !rendered; {
+		select {
+		case <-done:
+			rendered = true
+		default:
+		}
+		families, err := agg.Gather()
+		require.NoError(t, err)
+		if len(families) == 0 {
+			continue
+		}
+		require.Len(t, families, 20)
+		for _, family := range families {
+			require.Equal(t, families[0].Metric[0].GetCounter().GetValue(), family.Metric[0].GetCounter().GetValue())
+		}
+	}
+	families, _ := agg.Gather()
+	require.Equal(t, 800.0, families[19].Metric[0].GetCounter().GetValue())
+}
+
+// countingStorage counts the families stored in another storage, and the
+// deletes asked for
+type countingStorage struct {
+	Storage
+	created, deleted, deletes atomic.Int64
+}
+
+func (s *countingStorage) GetOrCreate(name string, create func() *Family) (*Family, bool) {
+	family, ok := s.Storage.GetOrCreate(name, create)
+	if !ok {
+		s.created.Add(1)
+	}
+	return family, ok
+}
+
+func (s *countingStorage) Delete(name string, drop func(*Family) bool) (*Family, bool) {
+	s.deletes.Add(1)
+	family, ok := s.Storage.Delete(name, drop)
+	if ok {
+		s.deleted.Add(1)
+	}
+	return family, ok
+}
+
+func TestStorage(t *testing.T) {
+	storage := &countingStorage{Storage: newFamilyShards()}
+	ttl := time.Minute
+	agg := NewAggregate(SetStorage(storage), SetTTLMetricTime(&ttl))
+
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+	require.Equal(t, int64(3), storage.created.Load())
+	require.Equal(t, 3, storage.Len())
+
+	families, err := agg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 3)
+
+	counter, ok := storage.Get("counter")
+	require.True(t, ok)
+	counter.lastUpdate = time.Now().Add(-2 * ttl)
+	agg.expireFamilies(time.Now())
+	require.Equal(t, int64(1), storage.deleted.Load())
+	require.Equal(t, int64(1), storage.deletes.Load(), "only the expired family is deleted")
+	require.Equal(t, 2, agg.Len())
+	require.Len(t, storage.Snapshot(), 2)
+
+	// a family's state is written back and read back whole
+	gauge, ok := storage.Get("gauge")
+	require.True(t, ok)
+	state, err := gauge.MarshalBinary()
+	require.NoError(t, err)
+	gathered := func() string {
+		families, err := agg.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "gauge" {
+				return family.String()
+			}
+		}
+		return ""
+	}
+	before := gathered()
+	require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+	require.NotEqual(t, before, gathered())
+	require.NoError(t, gauge.UnmarshalBinary(state))
+	require.Equal(t, before, gathered())
+	counter, _ = storage.Get("counter")
+	require.Error(t, counter.UnmarshalBinary(state), "another family's state")
+}
+
+func TestDiskStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(dir, 1)
+	require.NoError(t, err)
+	ttl := time.Minute
+	agg := NewAggregate(SetStorage(storage), SetTTLMetricTime(&ttl))
+	memory := NewAggregate()
+	render := func(agg *Aggregate) string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	spilled := func() int {
+		cold := 0
+		storage.Range(func(_ string, family *Family) bool {
+			if family.current.Load() == nil {
+				cold++
+			}
+			return true
+		})
+		return cold
+	}
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+		require.NoError(t, memory.parseAndMerge(strings.NewReader(in1), testLabels))
+		// but the family pushed to last, every family is rendered from disk
+		require.Equal(t, 2, spilled())
+		require.Equal(t, render(memory), render(agg))
+	}
+	// spilled families don't count towards the memory budget, and renders
+	// leave the hot family be
+	require.Less(t, agg.memoryBytes.Load(), memory.memoryBytes.Load())
+	require.Equal(t, 2, spilled())
+
+	// a spilled family that can't be read back fails renders and merges
+	// rather than losing its series
+	gauge, ok := storage.Get("gauge")
+	require.True(t, ok)
+	require.Nil(t, gauge.current.Load())
+	spillFile := gauge.spillPath
+	require.NoError(t, os.Rename(spillFile, spillFile+".moved"))
+	_, err = agg.Gather()
+	require.ErrorIs(t, err, ErrSpillRead)
+	w := httptest.NewRecorder()
+	agg.ServeRenderJSON(w, httptest.NewRequest("GET", "/api/v1/metrics", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.ErrorIs(t, agg.parseAndMerge(strings.NewReader(in1), testLabels), ErrSpillRead)
+	require.NoError(t, os.Rename(spillFile+".moved", spillFile))
+	require.Equal(t, render(memory), render(agg), "the failed push merged nothing")
+
+	counter, ok := storage.Get("counter")
+	require.True(t, ok)
+	counter.lastUpdate = time.Now().Add(-2 * ttl)
+	agg.expireFamilies(time.Now())
+	require.Equal(t, 2, agg.Len())
+	_, ok = storage.Get("counter")
+	require.False(t, ok)
+
+	// a gateway taking over leaves the spilled families of this one alone
+	rendered := render(agg)
+	next, err := NewDiskStorage(dir, 1)
+	require.NoError(t, err)
+	require.Equal(t, rendered, render(agg))
+
+	agg.Close()
+	files, err := filepath.Glob(filepath.Join(dir, runPrefix+"*", "*"+spillSuffix))
+	require.NoError(t, err)
+	require.Empty(t, files)
+	require.NoError(t, next.(io.Closer).Close())
+	runs, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, runs)
+}
+
+func TestDiskStorageRenders(t *testing.T) {
+	series := `
+# TYPE series gauge
+series{a="1"} 1
+series{a="2"} 2
+`
+	for name, opts := range map[string][]Option{
+		"cached":       nil,
+		"streamed":     {SetStreamingRender(1, 0)},
+		"truncated":    {SetMaxRenderSeries(1, SeriesLimitTruncate)},
+		"gauge spread": {SetGaugeSpread(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			storage, err := NewDiskStorage(t.TempDir(), 1)
+			require.NoError(t, err)
+			agg := NewAggregate(append(opts, SetStorage(storage))...)
+			defer agg.Close()
+			memory := NewAggregate(opts...)
+			render := func(agg *Aggregate) string {
+				w := httptest.NewRecorder()
+				agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+				require.Equal(t, http.StatusOK, w.Code)
+				return w.Body.String()
+			}
+			for _, in := range []string{series, in1, in2} {
+				require.NoError(t, agg.parseAndMerge(strings.NewReader(in), testLabels))
+				require.NoError(t, memory.parseAndMerge(strings.NewReader(in), testLabels))
+			}
+			// spilled families are read back one at a time, with their
+			// gauge spread
+			rendered := render(agg)
+			require.Equal(t, render(memory), rendered)
+
+			// a render goes on with the instant it took, the merges and
+			// spills meanwhile replacing the spill files it reads
+			in, err := agg.instantOf(nil)
+			require.NoError(t, err)
+			require.True(t, in.spilled())
+			require.NoError(t, agg.parseAndMerge(strings.NewReader(in1), testLabels))
+			buf := new(bytes.Buffer)
+			opts := agg.opts()
+			fe := newFamilyEncoder(buf, expfmt.FmtText, opts.encoderOptions(expfmt.FmtText)...)
+			_, err = agg.eachRendered(in, opts, nil, fe.encode)
+			in.close()
+			require.NoError(t, err)
+			require.Equal(t, rendered, buf.String())
+			require.NotEqual(t, rendered, render(agg))
+		})
+	}
+}
+
+func TestContentionMetrics(t *testing.T) {
+	sampleCount := func(o prometheus.Observer) uint64 {
+		m := &dto.Metric{}
+		require.NoError(t, o.(prometheus.Metric).Write(m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	parses, merges := sampleCount(parseStage), sampleCount(mergeStage)
+	shardWaits, familyWaits := sampleCount(shardLockWait), sampleCount(familyLockWait)
+
+	agg := NewAggregate()
+	g := errgroup.Group{}
+	for i := 0; i < 8; i++ {
+		g.Go(func() error {
+			return agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 1\n"), nil)
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	require.Equal(t, parses+8, sampleCount(parseStage))
+	require.Equal(t, merges+8, sampleCount(mergeStage))
+	// the family is created once, then merged into by the other pushes
+	require.GreaterOrEqual(t, sampleCount(shardLockWait), shardWaits+1)
+	require.GreaterOrEqual(t, sampleCount(familyLockWait), familyWaits+7)
+}
+
+func TestFreezeFamily(t *testing.T) {
+	ttl := time.Hour
+	agg := NewAggregate(SetTTLMetricTime(&ttl))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 1\n# TYPE deploys counter\ndeploys 1\n"), nil))
+	serve := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeFreeze(w, httptest.NewRequest(method, "/api/v1/admin/freeze"+query, nil))
+		return w
+	}
+
+	require.Equal(t, http.StatusNotFound, serve("POST", "?name=missing").Code)
+	w := serve("POST", "?name=builds&reason=INC-42")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Families []frozenFamily `json:"families"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Families, 1)
+	require.Equal(t, "INC-42", list.Families[0].Reason)
+
+	// the rest of the push is still merged
+	req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader("# TYPE builds counter\nbuilds 1\n# TYPE deploys counter\ndeploys 1\n"))
+	req.SetPathValue("labels", "/job/ci")
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Contains(t, w.Body.String(), "family builds is frozen, its series were not merged")
+	builds, _ := agg.families.Get("builds")
+	require.Equal(t, 1.0, builds.head().toDTO().Metric[0].GetCounter().GetValue())
+	require.Equal(t, 1.0, testutil.ToFloat64(FrozenFamilyPushes.WithLabelValues("builds")))
+
+	age := func() {
+		for _, f := range agg.snapshot() {
+			f.family.lock.Lock()
+			f.family.lastUpdate = time.Now().Add(-2 * ttl)
+			f.family.lock.Unlock()
+		}
+	}
+	age()
+	agg.expireFamilies(time.Now())
+	_, ok := agg.families.Get("builds")
+	require.True(t, ok)
+	_, ok = agg.families.Get("deploys")
+	require.False(t, ok)
+
+	require.Equal(t, http.StatusOK, serve("DELETE", "?name=builds").Code)
+	require.Equal(t, http.StatusNotFound, serve("DELETE", "?name=builds").Code)
+	age()
+	agg.expireFamilies(time.Now())
+	require.Zero(t, agg.Len())
+}
+
+func TestWatchFamily(t *testing.T) {
+	agg := NewAggregate()
+	serve := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		agg.ServeWatch(w, httptest.NewRequest(method, "/api/v1/admin/watch"+query, nil))
+		return w
+	}
+	push := func(body string) {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(body))
+		req.SetPathValue("labels", "/job/ci")
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	require.Equal(t, http.StatusBadRequest, serve("POST", "?name=queue_depth&duration=2h").Code)
+	// families are watched before they exist
+	require.Equal(t, http.StatusOK, serve("POST", "?name=queue_depth&duration=1m").Code)
+	push("# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 5\n# TYPE builds counter\nbuilds 1\n")
+	push("# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 0\n")
+
+	var list struct {
+		Watches []familyWatch `json:"watches"`
+	}
+	require.NoError(t, json.Unmarshal(serve("GET", "").Body.Bytes(), &list))
+	require.Len(t, list.Watches, 1)
+	events := list.Watches[0].Events
+	require.Len(t, events, 2)
+	require.Equal(t, "ci", events[0].Job)
+	require.Equal(t, map[string]string{"job": "ci", "queue": "a"}, events[0].Labels)
+	require.Nil(t, events[0].Before)
+	require.Equal(t, 5.0, events[0].After)
+	require.Equal(t, 5.0, *events[1].Before)
+	require.Equal(t, 0.0, events[1].Pushed)
+	require.Equal(t, 5.0, events[1].After)
+
+	require.Equal(t, http.StatusOK, serve("DELETE", "?name=queue_depth").Code)
+	require.Equal(t, http.StatusNotFound, serve("DELETE", "?name=queue_depth").Code)
+	require.False(t, agg.watches.watching("queue_depth", time.Now()))
+
+	// watches end on their own
+	agg.watches.start("builds", time.Now().Add(-time.Second))
+	require.False(t, agg.watches.watching("builds", time.Now()))
+	require.Zero(t, agg.watches.active.Load())
+
+	// and redact what the push log does
+	agg = NewAggregate(SetPushLog(0, 0, []string{"queue", "job"}))
+	require.Equal(t, http.StatusOK, serve("POST", "?name=queue_depth").Code)
+	push("# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 5\n")
+	require.NoError(t, json.Unmarshal(serve("GET", "").Body.Bytes(), &list))
+	events = list.Watches[0].Events
+	require.Equal(t, redactedValue, events[0].Job)
+	require.Equal(t, map[string]string{"job": redactedValue, "queue": redactedValue}, events[0].Labels)
+}
+
+func TestDeleteSeriesTombstones(t *testing.T) {
+	agg := NewAggregate(SetTombstoneTTL(time.Hour))
+	push := func(job, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/job/"+job, strings.NewReader(body))
+		req.SetPathValue("labels", "/job/"+job)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		return w
+	}
+	remove := func(labels, query string) int {
+		req := httptest.NewRequest("DELETE", "/api/v1/admin/series"+labels+query, nil)
+		req.SetPathValue("labels", labels)
+		w := httptest.NewRecorder()
+		agg.ServeSeries(w, req)
+		return w.Code
+	}
+	push("bad", "# TYPE garbage counter\ngarbage{id=\"1\"} 1\ngarbage{id=\"2\"} 1\n# TYPE builds counter\nbuilds 1\n")
+	push("good", "# TYPE builds counter\nbuilds 1\n")
+
+	require.Equal(t, http.StatusBadRequest, remove("", ""))
+	require.Equal(t, http.StatusBadRequest, remove("", "?name=garbage&dry_run=maybe"))
+
+	// a dry run only previews the deletion
+	req := httptest.NewRequest("DELETE", "/api/v1/admin/series/job/bad?dry_run=true", nil)
+	req.SetPathValue("labels", "/job/bad")
+	w := httptest.NewRecorder()
+	agg.ServeSeries(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var preview struct {
+		Deleted int            `json:"deleted"`
+		Sample  []seriesSample `json:"sample"`
+		DryRun  bool           `json:"dry_run"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preview))
+	require.Equal(t, 3, preview.Deleted)
+	require.True(t, preview.DryRun)
+	require.Equal(t, seriesSample{Family: "builds", Labels: map[string]string{"job": "bad"}}, preview.Sample[0])
+	require.Len(t, preview.Sample, 3)
+	garbage, _ := agg.families.Get("garbage")
+	require.Len(t, garbage.head().series, 2)
+	require.Empty(t, agg.tombstones.list(time.Now()))
+
+	require.Equal(t, http.StatusNotFound, remove("/job/missing", ""))
+	require.Equal(t, http.StatusOK, remove("", "?name=garbage"))
+	require.Equal(t, http.StatusOK, remove("/job/bad", "?name=builds"))
+	_, ok := agg.families.Get("garbage")
+	require.False(t, ok)
+
+	// the exact label sets deleted are dropped, others are merged
+	w = push("bad", "# TYPE garbage counter\ngarbage{id=\"1\"} 1\ngarbage{id=\"3\"} 1\n# TYPE builds counter\nbuilds 1\n")
+	require.Contains(t, w.Body.String(), "1 series of family garbage were deleted and are tombstoned, they were not merged")
+	require.Contains(t, w.Body.String(), "1 series of family builds were deleted and are tombstoned")
+	require.Equal(t, 1.0, testutil.ToFloat64(TombstonedSeries.WithLabelValues("garbage")))
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, `# TYPE builds counter
+builds{job="good"} 1
+# TYPE garbage counter
+garbage{id="3",job="bad"} 1
+`, buf.String())
+
+	w = httptest.NewRecorder()
+	agg.ServeTombstones(w, httptest.NewRequest("GET", "/api/v1/admin/tombstones", nil))
+	var list struct {
+		Tombstones []tombstone `json:"tombstones"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Tombstones, 3)
+	require.Equal(t, "builds", list.Tombstones[0].Family)
+	require.Equal(t, map[string]string{"id": "1", "job": "bad"}, list.Tombstones[1].Labels)
+
+	w = httptest.NewRecorder()
+	agg.ServeTombstones(w, httptest.NewRequest("DELETE", "/api/v1/admin/tombstones?name=builds", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Tombstones, 2)
+	push("bad", "# TYPE builds counter\nbuilds 1\n")
+	builds, _ := agg.families.Get("builds")
+	require.Len(t, builds.head().series, 2)
+
+	// expired tombstones are dropped without anyone listing them
+	var stones tombstones
+	now := time.Now()
+	stones.add("garbage", []labelSet{makeLabelSet(nil)}, now.Add(-time.Second))
+	stones.add("builds", []labelSet{makeLabelSet(nil)}, now.Add(time.Hour))
+	require.NotContains(t, stones.families, "garbage")
+	stones.add("garbage", []labelSet{makeLabelSet(nil)}, now.Add(time.Second))
+	_, ok = stones.buried("garbage", now.Add(2*time.Second))
+	require.False(t, ok)
+	require.NotContains(t, stones.families, "garbage")
+}
+
+func TestGaugeSpread(t *testing.T) {
+	agg := NewAggregate(SetGaugeSpread(true))
+	for _, value := range []string{"3", "5", "1"} {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} "+value+"\n# TYPE builds counter\nbuilds 1\n"), nil))
+	}
+	// pushed families win over companions
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE queue_depth_max counter\nqueue_depth_max 100\n"), nil))
+
+	buf := new(bytes.Buffer)
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Equal(t, `# TYPE builds counter
+builds 3
+# TYPE queue_depth gauge
+queue_depth{queue="a"} 9
+# HELP queue_depth_contributors Number of pushes merged into queue_depth
+# TYPE queue_depth_contributors gauge
+queue_depth_contributors{queue="a"} 3
+# TYPE queue_depth_max counter
+queue_depth_max 100
+# HELP queue_depth_min Smallest value merged into queue_depth
+# TYPE queue_depth_min gauge
+queue_depth_min{queue="a"} 1
+`, buf.String())
+
+	// other strategies keep their own value
+	agg = NewAggregate(SetGaugeSpread(true), SetMergeStrategy(dto.MetricType_GAUGE, LastStrategy))
+	for _, value := range []string{"3", "5", "1"} {
+		require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE queue_depth gauge\nqueue_depth "+value+"\n"), nil))
+	}
+	buf.Reset()
+	agg.encodeAllMetrics(buf, expfmt.FmtText)
+	require.Contains(t, buf.String(), "queue_depth 1\n")
+	require.Contains(t, buf.String(), "queue_depth_max 5\n")
+	require.Contains(t, buf.String(), "queue_depth_contributors 3\n")
+}
+
+func TestScrapeTTL(t *testing.T) {
+	agg := NewAggregate(SetScrapeTTL(2))
+	scrape := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, req)
+		return w
+	}
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 1\n"), nil))
+
+	// however long it has been, a family is scraped twice before it expires
+	require.Contains(t, scrape("").Body.String(), "builds 1")
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE deploys counter\ndeploys 1\n"), nil))
+	w := scrape("")
+	require.Contains(t, w.Body.String(), "builds 1")
+	require.Contains(t, w.Body.String(), "deploys 1")
+	w = scrape("")
+	require.NotContains(t, w.Body.String(), "builds")
+	require.Contains(t, w.Body.String(), "deploys 1")
+
+	// renders answered with 304 are scrapes too, and a push starts the count over
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE deploys counter\ndeploys 1\n"), nil))
+	w = scrape("")
+	require.Contains(t, w.Body.String(), "deploys 2")
+	require.Equal(t, http.StatusNotModified, scrape(w.Header().Get("ETag")).Code)
+	require.Empty(t, scrape("").Body.String())
+
+	// with a metric TTL, both must have gone by
+	ttl := time.Hour
+	agg = NewAggregate(SetScrapeTTL(1), SetTTLMetricTime(&ttl))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 1\n"), nil))
+	scrape("")
+	require.Contains(t, scrape("").Body.String(), "builds 1")
+	for _, f := range agg.snapshot() {
+		f.family.lock.Lock()
+		f.family.lastUpdate = time.Now().Add(-2 * ttl)
+		f.family.lock.Unlock()
+	}
+	require.Empty(t, scrape("").Body.String())
+
+	// truncated renders don't count as scrapes of the families left out
+	agg = NewAggregate(SetScrapeTTL(1), SetMaxRenderSeries(1, SeriesLimitTruncate))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds{branch=\"a\"} 1\nbuilds{branch=\"b\"} 1\n"), nil))
+	scrape("")
+	scrape("")
+	require.Equal(t, 1, agg.Len())
+}
+
+func TestPushErrorFormat(t *testing.T) {
+	push := func(agg *Aggregate, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(body))
+		req.SetPathValue("labels", "/job/ci")
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) pushErrorBody {
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var body pushErrorBody
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body
+	}
+
+	// plain text unless JSON is accepted
+	agg := NewAggregate()
+	w := push(agg, "# TYPE builds counter\nbuilds 1\nbuilds{\n", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+
+	w = push(agg, "# TYPE builds counter\nbuilds 1\nbuilds abc\n", http.Header{"Accept": {"application/json"}, "X-Request-Id": {"req-1"}})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	body := decode(w)
+	require.Equal(t, "parse_error", body.Code)
+	require.Equal(t, 3, body.Line)
+	require.Equal(t, "req-1", body.RequestID)
+	require.Equal(t, "req-1", w.Header().Get("X-Request-Id"))
+
+	// the family at fault is named
+	agg = NewAggregate(SetErrorFormat(ErrorFormatJSON))
+	require.NoError(t, agg.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds 1\n"), nil))
+	w = push(agg, "# TYPE builds gauge\nbuilds 1\n", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	body = decode(w)
+	require.Equal(t, "invalid_push", body.Code)
+	require.Equal(t, "builds", body.Family)
+	require.Contains(t, body.Message, "cannot merge metric 'builds'")
+	require.NotEmpty(t, body.RequestID)
+	require.Equal(t, body.RequestID, w.Header().Get("X-Request-Id"))
+
+	// as are rejections before the body is read
+	agg.ServeMaintenance(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/admin/maintenance?enabled=true", nil))
+	w = push(agg, "# TYPE builds counter\nbuilds 1\n", nil)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "maintenance", decode(w).Code)
+	Maintenance.Set(0)
+}
+
+func TestHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	subs := []SubAggregate{{Label: "env", Value: "prod"}}
+	old := NewAggregate(SetAsyncIngest(1, 10), SetPersistence(path, time.Hour, nil), SetSubAggregates(subs))
+	for _, labels := range []string{"/job/ci", "/env/prod/job/ci"} {
+		req := httptest.NewRequest("POST", "/metrics"+labels, strings.NewReader("# TYPE builds counter\nbuilds 3\n"))
+		req.SetPathValue("labels", labels)
+		w := httptest.NewRecorder()
+		old.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	// the queued push is merged before the handoff
+	var state bytes.Buffer
+	require.NoError(t, old.Handoff(&state))
+	// and the final snapshot written, for the next process to fall back on
+	fallback := NewAggregate(SetPersistence(path, time.Hour, nil))
+	require.NoError(t, fallback.Restore())
+	require.Equal(t, 1, fallback.Len())
+	family, ok := old.families.Get("builds")
+	require.True(t, ok)
+
+	next := NewAggregate(SetSubAggregates(subs))
+	defer next.Close()
+	require.NoError(t, next.RestoreHandoff(state.Bytes()))
+	render := func(path string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetPathValue("labels", strings.TrimPrefix(path, "/metrics"))
+		w := httptest.NewRecorder()
+		next.ServeRender(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	require.Equal(t, "# TYPE builds counter\nbuilds{job=\"ci\"} 3\n", render("/metrics"))
+	require.Equal(t, "# TYPE builds counter\nbuilds{env=\"prod\",job=\"ci\"} 3\n", render("/metrics/env/prod"))
+	handedOff, ok := next.families.Get("builds")
+	require.True(t, ok)
+	require.True(t, family.lastUpdate.Equal(handedOff.lastUpdate), "the TTL goes on")
+
+	require.Error(t, next.RestoreHandoff([]byte("garbage")))
+
+	// with snapshot keys, the handed off series are encrypted too
+	keysPath := filepath.Join(t.TempDir(), "keys.yaml")
+	require.NoError(t, os.WriteFile(keysPath, []byte("default_key: "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0o600))
+	keys, err := LoadSnapshotKeys(keysPath)
+	require.NoError(t, err)
+	encrypted := NewAggregate(SetPersistence(path, time.Hour, keys))
+	require.NoError(t, encrypted.parseAndMerge(strings.NewReader("# TYPE builds counter\nbuilds{secret=\"s3cr3t\"} 3\n"), nil))
+	state.Reset()
+	require.NoError(t, encrypted.Handoff(&state))
+	require.NotContains(t, state.String(), "s3cr3t")
+	plain := NewAggregate()
+	defer plain.Close()
+	require.Error(t, plain.RestoreHandoff(state.Bytes()), "encrypted, and no keys given")
+	decrypted := NewAggregate(SetPersistence(path, time.Hour, keys))
+	defer decrypted.Close()
+	require.NoError(t, decrypted.RestoreHandoff(state.Bytes()))
+	require.Equal(t, 1, decrypted.Len())
+}
+
+func TestLabelAllowlists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlists.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("label_allowlists:\n  ci: [job, pipeline]\n"), 0o600))
+	allowlists, err := LoadLabelAllowlists(path)
+	require.NoError(t, err)
+	agg := NewAggregate(SetLabelAllowlists(allowlists))
+	push := func(user, labels string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/metrics"+labels, strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+		req.SetPathValue("labels", labels)
+		if user != "" {
+			req = req.WithContext(WithAuthUser(req.Context(), user))
+		}
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		return w
+	}
+
+	require.Equal(t, http.StatusAccepted, push("ci", "/job/build/pipeline/main").Code)
+	w := push("ci", "/job/build/branch/main/commit/abc")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), `user "ci" may only set job, pipeline, not branch, commit`)
+	// users without an allowlist may set any label, unverified pushes none
+	require.Equal(t, http.StatusAccepted, push("admin", "/job/build/branch/main").Code)
+	require.Equal(t, http.StatusForbidden, push("", "/job/build/branch/main").Code)
+	require.Equal(t, http.StatusAccepted, push("", "").Code)
+	req := httptest.NewRequest("POST", "/metrics/job/build/branch/main", strings.NewReader("# TYPE builds counter\nbuilds 1\n"))
+	req.SetPathValue("labels", "/job/build/branch/main")
+	req.SetBasicAuth("admin", "unchecked")
+	w = httptest.NewRecorder()
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code, "an unchecked basic auth header is no verified user")
+
+	require.NoError(t, os.WriteFile(path, []byte("label_allowlists:\n  ci: [job, \"bad-name\"]\n"), 0o600))
+	_, err = LoadLabelAllowlists(path)
+	require.Error(t, err)
+}
+
+func TestChecksum(t *testing.T) {
+	checksum := func(agg *Aggregate) map[string]any {
+		req := httptest.NewRequest("GET", "/api/v1/checksum?families=true", nil)
+		w := httptest.NewRecorder()
+		agg.ServeChecksum(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body
+	}
+	push := func(agg *Aggregate, body string) {
+		req := httptest.NewRequest("POST", "/metrics/job/ci", strings.NewReader(body))
+		req.SetPathValue("labels", "/job/ci")
+		w := httptest.NewRecorder()
+		agg.ServeInsert(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	// the same series in another order and with another help agree
+	a, b := NewAggregate(), NewAggregate()
+	push(a, "# TYPE builds counter\nbuilds{os=\"linux\"} 1\nbuilds{os=\"mac\"} 2\n# TYPE queue gauge\nqueue 3\n")
+	push(b, "# TYPE queue gauge\nqueue 3\n# HELP builds Builds.\n# TYPE builds counter\nbuilds{os=\"mac\"} 2\nbuilds{os=\"linux\"} 1\n")
+	sumA, sumB := checksum(a), checksum(b)
+	require.Equal(t, sumA["checksum"], sumB["checksum"])
+	require.Equal(t, float64(2), sumA["families"])
+	require.Equal(t, float64(3), sumA["series"])
+
+	generation := sumB["generation"]
+	push(b, "# TYPE queue gauge\nqueue 1\n")
+	sumB = checksum(b)
+	require.NotEqual(t, sumA["checksum"], sumB["checksum"])
+	familiesA, familiesB := sumA["family_checksums"].(map[string]any), sumB["family_checksums"].(map[string]any)
+	require.Equal(t, familiesA["builds"], familiesB["builds"])
+	require.NotEqual(t, familiesA["queue"], familiesB["queue"])
+	require.Greater(t, sumB["generation"], generation)
+
+	// a family created again is hashed again, at the same version
+	c := NewAggregate()
+	push(c, "# TYPE queue gauge\nqueue 3\n")
+	sumC := checksum(c)
+	require.True(t, c.removeFamily("queue"))
+	push(c, "# TYPE queue gauge\nqueue 4\n")
+	require.NotEqual(t, sumC["checksum"], checksum(c)["checksum"])
+}
+
+func TestSelftest(t *testing.T) {
+	for _, openMetrics := range []bool{false, true} {
+		agg := NewAggregate(SetOpenMetrics(openMetrics), SetRenderTimestamps(TimestampsAggregation), AddIgnoredLabels("instance"))
+		families := testutil.ToFloat64(TotalFamiliesGauge)
+		req := httptest.NewRequest("GET", "/api/v1/selftest?accept="+url.QueryEscape("application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5"), nil)
+		w := httptest.NewRecorder()
+		agg.ServeSelftest(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var report struct {
+			OK      bool             `json:"ok"`
+			Formats []selftestResult `json:"formats"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		require.True(t, report.OK)
+		require.Len(t, report.Formats, 8)
+		for _, result := range report.Formats {
+			require.True(t, result.OK, "%s: %s", result.Format, result.Error)
+		}
+		require.Equal(t, !openMetrics, report.Formats[3].Skipped != "")
+		// the aggregate itself is left alone, and so are its self-metrics
+		require.Zero(t, agg.families.Len())
+		require.Equal(t, families, testutil.ToFloat64(TotalFamiliesGauge))
+		require.Zero(t, testutil.ToFloat64(MetricCountByFamily.WithLabelValues("selftest_temperature")))
+	}
+
+	require.EqualError(t, compareSamples(map[string]float64{`selftest_a{x="1"}`: 1, "selftest_b": 2}, map[string]float64{`selftest_a{x="1"}`: 3, "selftest_c": 2}),
+		`selftest_a{x="1"} is 3 instead of 1; selftest_b is missing; selftest_c wasn't pushed`)
+}
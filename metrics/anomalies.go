@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// anomalyWebhookQueue is how many notifications may wait for the webhook,
+// more are dropped rather than slowing pushes down
+const anomalyWebhookQueue = 64
+
+// anomalyWarmup is how many pushes of a job its baseline learns from before
+// pushes are checked against it
+const anomalyWarmup = 5
+
+// anomalyWeight is the weight of a push in the rolling series baseline of
+// its job once warmed up, a lasting change becoming the new baseline within
+// a few dozen pushes
+const anomalyWeight = 0.1
+
+// anomalyBaselineIdle is how long a job goes without pushing before its
+// baseline is forgotten, the job learning a new one if it comes back
+const anomalyBaselineIdle = 24 * time.Hour
+
+// SetPushAnomalies learns a rolling baseline of the pushes of each job and
+// tenant, their series count and the label names of their series, and flags
+// the pushes that deviate from it: more than factor times as many series as
+// usual, or label names the job never pushed, the marks of a producer
+// regression about to blow up cardinality. Each anomaly is counted in
+// PushAnomalies, logged, added to the warnings of the push acknowledgement
+// and, with webhookURL, posted there as JSON. The push is merged all the
+// same. 0 disables it.
+func SetPushAnomalies(factor float64, webhookURL string) Option {
+	return func(a *Aggregate) {
+		a.options.anomalyFactor = factor
+		a.options.anomalyWebhook = webhookURL
+	}
+}
+
+type pushAnomaly struct {
+	Job    string `json:"job"`
+	Tenant string `json:"tenant,omitempty"`
+	Source string `json:"source"`
+	// Anomalies are "series" and "label_names"
+	Anomalies      []string `json:"anomalies"`
+	Series         int      `json:"series"`
+	BaselineSeries float64  `json:"baseline_series"`
+	Factor         float64  `json:"factor"`
+	NewLabelNames  []string `json:"new_label_names,omitempty"`
+}
+
+type jobKey struct {
+	job, tenant string
+}
+
+type pushBaseline struct {
+	lastPush   time.Time
+	pushes     int
+	series     float64
+	labelNames map[string]struct{}
+}
+
+type anomalyGuard struct {
+	factor float64
+
+	lock      sync.Mutex
+	baselines map[jobKey]*pushBaseline
+	// swept is when the idle baselines were last forgotten
+	swept time.Time
+
+	webhook *webhook
+}
+
+func newAnomalyGuard(factor float64, webhookURL string) *anomalyGuard {
+	return &anomalyGuard{factor: factor, baselines: map[jobKey]*pushBaseline{}, webhook: newWebhook(webhookURL, "a push anomaly", anomalyWebhookQueue, AnomalyNotifications)}
+}
+
+// check compares a push of series series with labelNames to the baseline
+// of its job, then learns from it, returning nil when it is as usual
+func (g *anomalyGuard) check(key producerKey, series int, labelNames map[string]struct{}, now time.Time) *pushAnomaly {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if now.Sub(g.swept) > anomalyBaselineIdle/24 {
+		g.swept = now
+		for job, baseline := range g.baselines {
+			if now.Sub(baseline.lastPush) > anomalyBaselineIdle {
+				delete(g.baselines, job)
+			}
+		}
+	}
+
+	baseline, ok := g.baselines[jobKey{key.job, key.tenant}]
+	if !ok {
+		baseline = &pushBaseline{labelNames: map[string]struct{}{}}
+		g.baselines[jobKey{key.job, key.tenant}] = baseline
+	}
+
+	anomaly := &pushAnomaly{Job: key.job, Tenant: key.tenant, Source: key.source, Series: series, BaselineSeries: baseline.series, Factor: g.factor}
+	if baseline.pushes >= anomalyWarmup {
+		if float64(series) > max(baseline.series, 1)*g.factor {
+			anomaly.Anomalies = append(anomaly.Anomalies, "series")
+		}
+		for name := range labelNames {
+			if _, ok := baseline.labelNames[name]; !ok {
+				anomaly.NewLabelNames = append(anomaly.NewLabelNames, name)
+			}
+		}
+		if len(anomaly.NewLabelNames) > 0 {
+			sort.Strings(anomaly.NewLabelNames)
+			anomaly.Anomalies = append(anomaly.Anomalies, "label_names")
+		}
+	}
+
+	// the mean of the first pushes, then a moving average
+	baseline.series += (float64(series) - baseline.series) * max(1/float64(baseline.pushes+1), anomalyWeight)
+	baseline.pushes++
+	baseline.lastPush = now
+	for name := range labelNames {
+		baseline.labelNames[name] = struct{}{}
+	}
+
+	if len(anomaly.Anomalies) == 0 {
+		return nil
+	}
+	return anomaly
+}
+
+// warnings describes the anomaly to the producer
+func (p *pushAnomaly) warnings() []string {
+	var warnings []string
+	for _, kind := range p.Anomalies {
+		switch kind {
+		case "series":
+			warnings = append(warnings, fmt.Sprintf("the push has %d series, more than %g times the usual %.0f of job %q", p.Series, p.Factor, p.BaselineSeries, p.Job))
+		case "label_names":
+			warnings = append(warnings, fmt.Sprintf("job %q never pushed the label names %s before", p.Job, strings.Join(p.NewLabelNames, ", ")))
+		}
+	}
+	return warnings
+}
+
+// close sends the notifications still waiting
+func (g *anomalyGuard) close() {
+	g.webhook.close()
+}
+
+// trackPushShape makes ack record the label names of the push, for
+// checkPushShape
+func (a *Aggregate) trackPushShape(ack *pushAck) {
+	if a.anomalyGuard != nil {
+		ack.labelNames = map[string]struct{}{}
+	}
+}
+
+// checkPushShape checks a producer's merged push against the baseline of
+// its job
+func (a *Aggregate) checkPushShape(key producerKey, ack *pushAck) {
+	if a.anomalyGuard == nil {
+		return
+	}
+	anomaly := a.anomalyGuard.check(key, ack.series, ack.labelNames, time.Now())
+	if anomaly == nil {
+		return
+	}
+
+	warnings := anomaly.warnings()
+	for i, kind := range anomaly.Anomalies {
+		PushAnomalies.WithLabelValues(key.job, kind).Inc()
+		log.Printf("Push anomaly from %s: %s\n", key.source, warnings[i])
+	}
+	ack.warnings = append(ack.warnings, warnings...)
+	a.anomalyGuard.webhook.send(*anomaly)
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+)
+
+type authUserKey struct{}
+
+// WithAuthUser returns ctx carrying the auth user a request was verified as,
+// for the routers to set once their auth middleware checked its credentials
+func WithAuthUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, authUserKey{}, user)
+}
+
+// AuthUser returns the auth user the request was verified as, "" when its
+// credentials, if any, were not checked. Unlike r.BasicAuth it can't be set
+// by a client of a route without auth.
+func AuthUser(r *http.Request) string {
+	user, _ := r.Context().Value(authUserKey{}).(string)
+	return user
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Bootstrap seeds the aggregate with the families stored by the gateway at
+// base, e.g. the one a blue/green deployment is replacing, so dashboards
+// don't see its counters restart from zero. They are read from its admin
+// export, so render filters, limits and synthetic families don't end up in
+// the seeded state, the credentials of base authenticating the request.
+// Families the aggregate has already, restored from its own snapshot, are
+// kept as they are. It returns how many families were seeded.
+func (a *Aggregate) Bootstrap(base string) (int, error) {
+	if a.replica != nil {
+		return 0, ErrReadOnlyReplica
+	}
+
+	export, err := url.JoinPath(base, "/api/v1/admin/export")
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodGet, export, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	client := &http.Client{Timeout: replicaSyncTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	families, err := decodeRender(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	seeded, opts := 0, a.opts()
+	for name, family := range families {
+		if !metricsSorted(family.Metric) {
+			sort.Sort(byLabel(family.Metric))
+		}
+		if a.setFamilyOrGetExistingFamily(name, compactFamilyFromDTO(family), opts) == nil {
+			seeded++
+		}
+	}
+	a.generation.Add(1)
+	a.enforceMemoryBudget()
+	return seeded, nil
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// checksums caches the checksum of every family by the version of the
+// family it was computed from, so a checksum only hashes the families
+// merged into since the previous one
+type checksums struct {
+	lock     sync.Mutex
+	families map[string]familyChecksum
+}
+
+type familyChecksum struct {
+	incarnation uint64
+	version     uint64
+	sum         uint64
+	series      int
+}
+
+// checksums returns the checksum of every family, sorted by name
+func (a *Aggregate) checksums() ([]namedChecksum, error) {
+	a.expireFamilies(time.Now())
+	a.checksumCache.lock.Lock()
+	defer a.checksumCache.lock.Unlock()
+
+	cached := a.checksumCache.families
+	type changedFamily struct {
+		instantFamily
+		checksum familyChecksum
+	}
+	var changed []changedFamily
+	sums := make([]namedChecksum, 0, a.families.Len())
+	err := a.atInstant(func(name string, family *Family) error {
+		checksum := familyChecksum{incarnation: family.incarnation, version: family.version.Load()}
+		if previous, ok := cached[name]; ok && previous.incarnation == checksum.incarnation && previous.version == checksum.version {
+			sums = append(sums, namedChecksum{name, previous})
+			return nil
+		}
+		// only the families that changed are read, and hashed once merges
+		// may go on, one at a time
+		f, err := atInstantFamily(name, family)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, changedFamily{f, checksum})
+		return nil
+	})
+	defer func() {
+		for i := range changed {
+			changed[i].close()
+		}
+	}()
+	if err != nil {
+		// recomputed next time
+		return nil, err
+	}
+	for i := range changed {
+		f := &changed[i]
+		state, err := f.load()
+		if err != nil {
+			return nil, err
+		}
+		f.checksum.sum, f.checksum.series = hashFamily(state), len(state.series)
+		sums = append(sums, namedChecksum{f.name, f.checksum})
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].name < sums[j].name })
+
+	a.checksumCache.families = make(map[string]familyChecksum, len(sums))
+	for _, f := range sums {
+		a.checksumCache.families[f.name] = f.familyChecksum
+	}
+	return sums, nil
+}
+
+type namedChecksum struct {
+	name string
+	familyChecksum
+}
+
+// hashFamily hashes the type and the series of a family, their labels and
+// values, not their help, created timestamps, timestamps or exemplars, which
+// aggregates that agree on their values may differ on
+func hashFamily(family *compactFamily) uint64 {
+	h := fnv.New64a()
+	var buf []byte
+	putFloat := func(f float64) {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(f))
+	}
+	buf = binary.AppendUvarint(buf, uint64(family.ty))
+	for i := range family.series {
+		s := &family.series[i]
+		key := s.labels.key()
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		putFloat(s.value)
+		if family.ty == dto.MetricType_HISTOGRAM || family.ty == dto.MetricType_SUMMARY {
+			buf = binary.AppendUvarint(buf, s.count)
+		}
+		for _, b := range s.buckets() {
+			putFloat(b.upperBound)
+			buf = binary.AppendUvarint(buf, b.count)
+		}
+		if s.extra != nil {
+			for _, q := range s.extra.quantiles {
+				putFloat(q.quantile)
+				putFloat(q.value)
+			}
+		}
+		h.Write(buf)
+		buf = buf[:0]
+	}
+	h.Write(buf)
+	return h.Sum64()
+}
+
+// ServeChecksum answers with a checksum of the aggregate's families, their
+// series and values, which aggregates holding the same series agree on,
+// e.g. a replica and its primary or two gateways fed the same pushes, so
+// reconciliation jobs can tell them apart without comparing renders. Only
+// the families merged into since the previous checksum are hashed again.
+// The generation, which changes with every merge and expiry, is local to
+// the process. With ?families=true, the checksum of each family is listed
+// too, to find those that diverge.
+func (a *Aggregate) ServeChecksum(w http.ResponseWriter, r *http.Request) {
+	byFamily := false
+	if value := r.URL.Query().Get("families"); value != "" {
+		var err error
+		if byFamily, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "families must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	generation := a.generation.Load()
+	h := fnv.New64a()
+	series := 0
+	perFamily := map[string]string{}
+	sums, err := a.checksums()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, f := range sums {
+		var buf []byte
+		buf = binary.AppendUvarint(buf, uint64(len(f.name)))
+		buf = append(buf, f.name...)
+		buf = binary.LittleEndian.AppendUint64(buf, f.sum)
+		h.Write(buf)
+		series += f.series
+		if byFamily {
+			perFamily[f.name] = formatChecksum(f.sum)
+		}
+	}
+
+	body := map[string]any{
+		"checksum":   formatChecksum(h.Sum64()),
+		"generation": generation,
+		"families":   len(sums),
+		"series":     series,
+	}
+	if byFamily {
+		body["family_checksums"] = perFamily
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func formatChecksum(sum uint64) string {
+	return fmt.Sprintf("%016x", sum)
+}
@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// compactFamily is the state a family is held in between pushes. Series are
+// plain values rather than dto's tree of pointer-boxed proto messages, and
+// label sets live in a shared symbol table, which takes large aggregates
+// down to a fraction of the memory. Families go back to dto only to render.
+type compactFamily struct {
+	name   string
+	help   *string
+	unit   *string
+	ty     dto.MetricType
+	series []compactSeries
+	// stampMs, when set, is when the family was last merged into in unix
+	// milliseconds, rendered as the timestamp of series without their own
+	stampMs int64
+}
+
+type compactSeries struct {
+	labels labelSet
+	// value is the counter, gauge or untyped value, or the histogram or summary sum
+	value float64
+	count uint64
+	// created is the created timestamp in unix nanoseconds, 0 when there is none
+	created int64
+	extra   *seriesExtra
+}
+
+// seriesExtra holds what only some series carry, so plain samples don't pay for it
+type seriesExtra struct {
+	buckets     []compactBucket
+	native      *compactNative
+	quantiles   []compactQuantile
+	exemplar    *dto.Exemplar
+	timestampMs *int64
+	// spread is tracked for gauges with SetGaugeSpread
+	spread *gaugeSpread
+}
+
+type compactBucket struct {
+	upperBound float64
+	count      uint64
+	exemplar   *dto.Exemplar
+}
+
+type compactQuantile struct {
+	quantile, value float64
+}
+
+func (s *compactSeries) buckets() []compactBucket {
+	if s.extra == nil {
+		return nil
+	}
+	return s.extra.buckets
+}
+
+func (s *compactSeries) native() *compactNative {
+	if s.extra == nil {
+		return nil
+	}
+	return s.extra.native
+}
+
+func (s *compactSeries) exemplar() *dto.Exemplar {
+	if s.extra == nil {
+		return nil
+	}
+	return s.extra.exemplar
+}
+
+func compactFamilyFromDTO(family *dto.MetricFamily) *compactFamily {
+	return &compactFamily{
+		name:   family.GetName(),
+		help:   family.Help,
+		unit:   family.Unit,
+		ty:     family.GetType(),
+		series: compactSeriesFromDTO(family.GetType(), family.Metric),
+	}
+}
+
+// compactSeriesFromDTO converts label-sorted metrics, keeping their order
+func compactSeriesFromDTO(ty dto.MetricType, metrics []*dto.Metric) []compactSeries {
+	series := make([]compactSeries, len(metrics))
+	for i, m := range metrics {
+		s := &series[i]
+		s.labels = makeLabelSet(m.Label)
+
+		var extra seriesExtra
+		switch ty {
+		case dto.MetricType_COUNTER:
+			s.value = m.Counter.GetValue()
+			s.created = createdNanos(m.Counter.GetCreatedTimestamp())
+			extra.exemplar = m.Counter.GetExemplar()
+		case dto.MetricType_GAUGE:
+			s.value = m.Gauge.GetValue()
+		case dto.MetricType_UNTYPED:
+			s.value = m.Untyped.GetValue()
+		case dto.MetricType_HISTOGRAM:
+			s.value = m.Histogram.GetSampleSum()
+			s.count = m.Histogram.GetSampleCount()
+			s.created = createdNanos(m.Histogram.GetCreatedTimestamp())
+			extra.buckets = make([]compactBucket, len(m.Histogram.GetBucket()))
+			for j, b := range m.Histogram.GetBucket() {
+				extra.buckets[j] = compactBucket{upperBound: b.GetUpperBound(), count: b.GetCumulativeCount(), exemplar: b.Exemplar}
+			}
+			extra.native = compactNativeFromDTO(m.Histogram)
+		case dto.MetricType_SUMMARY:
+			s.value = m.Summary.GetSampleSum()
+			s.count = m.Summary.GetSampleCount()
+			s.created = createdNanos(m.Summary.GetCreatedTimestamp())
+			if len(m.Summary.GetQuantile()) > 0 {
+				extra.quantiles = make([]compactQuantile, len(m.Summary.Quantile))
+				for j, q := range m.Summary.Quantile {
+					extra.quantiles[j] = compactQuantile{quantile: q.GetQuantile(), value: q.GetValue()}
+				}
+			}
+		}
+		extra.timestampMs = m.TimestampMs
+
+		if extra.buckets != nil || extra.native != nil || extra.quantiles != nil || extra.exemplar != nil || extra.timestampMs != nil {
+			s.extra = &extra
+		}
+	}
+	return series
+}
+
+func createdNanos(ts *timestamppb.Timestamp) int64 {
+	if ts == nil {
+		return 0
+	}
+	return ts.AsTime().UnixNano()
+}
+
+// toDTO builds the dto form of the family for encoding. Values point into
+// the compact state, so the result must be treated as read-only.
+func (cf *compactFamily) toDTO() *dto.MetricFamily {
+	family := &dto.MetricFamily{
+		Name:   &cf.name,
+		Help:   cf.help,
+		Unit:   cf.unit,
+		Type:   &cf.ty,
+		Metric: make([]*dto.Metric, len(cf.series)),
+	}
+
+	metrics := make([]dto.Metric, len(cf.series))
+	for i := range cf.series {
+		s := &cf.series[i]
+		m := &metrics[i]
+		m.Label = s.labels.pairs()
+
+		var created *timestamppb.Timestamp
+		if s.created != 0 {
+			created = timestamppb.New(time.Unix(0, s.created))
+		}
+
+		switch cf.ty {
+		case dto.MetricType_COUNTER:
+			m.Counter = &dto.Counter{Value: &s.value, CreatedTimestamp: created, Exemplar: s.exemplar()}
+		case dto.MetricType_GAUGE:
+			m.Gauge = &dto.Gauge{Value: &s.value}
+		case dto.MetricType_UNTYPED:
+			m.Untyped = &dto.Untyped{Value: &s.value}
+		case dto.MetricType_HISTOGRAM:
+			m.Histogram = &dto.Histogram{SampleSum: &s.value, SampleCount: &s.count, CreatedTimestamp: created}
+			buckets := s.buckets()
+			dtoBuckets := make([]dto.Bucket, len(buckets))
+			m.Histogram.Bucket = make([]*dto.Bucket, len(buckets))
+			for j := range buckets {
+				b := &buckets[j]
+				dtoBuckets[j] = dto.Bucket{UpperBound: &b.upperBound, CumulativeCount: &b.count, Exemplar: b.exemplar}
+				m.Histogram.Bucket[j] = &dtoBuckets[j]
+			}
+			if s.extra != nil && s.extra.native != nil {
+				s.extra.native.toDTO(m.Histogram)
+			}
+		case dto.MetricType_SUMMARY:
+			m.Summary = &dto.Summary{SampleSum: &s.value, SampleCount: &s.count, CreatedTimestamp: created}
+			if s.extra != nil && len(s.extra.quantiles) > 0 {
+				quantiles := make([]dto.Quantile, len(s.extra.quantiles))
+				m.Summary.Quantile = make([]*dto.Quantile, len(quantiles))
+				for j := range s.extra.quantiles {
+					q := &s.extra.quantiles[j]
+					quantiles[j] = dto.Quantile{Quantile: &q.quantile, Value: &q.value}
+					m.Summary.Quantile[j] = &quantiles[j]
+				}
+			}
+		}
+		if s.extra != nil && s.extra.timestampMs != nil {
+			m.TimestampMs = s.extra.timestampMs
+		} else if cf.stampMs != 0 {
+			m.TimestampMs = &cf.stampMs
+		}
+
+		family.Metric[i] = m
+	}
+	return family
+}
@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrNoGroupLabels = errors.New("the completed group must be given as label pairs, e.g. /api/v1/complete/job/<name>")
+
+// completedGroup is a group of series (those carrying all of its labels)
+// whose pusher reported it won't push again
+type completedGroup struct {
+	labels []labelPair
+	// pinned groups are kept past the metric TTL until they were scraped
+	pinned bool
+	// seq orders completions against the scrapes that started after them
+	seq uint64
+}
+
+// completions tracks completed groups until a scrape has served them, so a
+// batch job finishing right after a scrape still gets its last push scraped
+// once before the group is dropped
+type completions struct {
+	lock   sync.Mutex
+	seq    uint64
+	groups map[string]completedGroup
+}
+
+// groupKey identifies a group by its labels whatever their order, a
+// separator no label holds keeping names and values apart
+func groupKey(labels []labelPair) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.name + "\xff" + l.value
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\xfe")
+}
+
+func (c *completions) complete(labels []labelPair, pinned bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.groups == nil {
+		c.groups = map[string]completedGroup{}
+	}
+	c.seq++
+	c.groups[groupKey(labels)] = completedGroup{labels: labels, pinned: pinned, seq: c.seq}
+	CompletedGroups.Set(float64(len(c.groups)))
+}
+
+// reopen forgets the completion of a group pushed to again
+func (c *completions) reopen(labels []labelPair) {
+	if len(labels) == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := groupKey(labels)
+	if _, ok := c.groups[key]; ok {
+		delete(c.groups, key)
+		CompletedGroups.Set(float64(len(c.groups)))
+	}
+}
+
+// current returns the sequence number of the latest completion, a scrape
+// starting now serves every group completed up to it
+func (c *completions) current() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.seq
+}
+
+// served removes and returns the groups completed up to seq
+func (c *completions) served(seq uint64) []completedGroup {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var groups []completedGroup
+	for key, group := range c.groups {
+		if group.seq <= seq {
+			groups = append(groups, group)
+			delete(c.groups, key)
+		}
+	}
+	if len(groups) > 0 {
+		CompletedGroups.Set(float64(len(c.groups)))
+	}
+	return groups
+}
+
+// pinned returns the pinned groups, nil if there are none
+func (c *completions) pinned() []completedGroup {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var groups []completedGroup
+	for _, group := range c.groups {
+		if group.pinned {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// inGroup reports whether the series carries every label of the group
+func (s *compactSeries) inGroup(group []labelPair) bool {
+	pairs := s.labels.pairs()
+	for _, l := range group {
+		found := false
+		for _, p := range pairs {
+			if p.GetName() == l.name {
+				found = p.GetValue() == l.value
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (cf *compactFamily) hasSeriesInGroups(groups []completedGroup) bool {
+	for i := range cf.series {
+		for _, group := range groups {
+			if cf.series[i].inGroup(group.labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServeComplete marks the group given by the label path, e.g. job/<name>, as
+// complete: it is dropped once the next scrape has served it. With ?pin=true
+// the group is also kept past the metric TTL until then.
+func (a *Aggregate) ServeComplete(w http.ResponseWriter, r *http.Request) {
+	if a.replica != nil {
+		a.pushError(w, r, http.StatusForbidden, ErrReadOnlyReplica)
+		return
+	}
+	if a.rejectMaintenance(w, r) {
+		return
+	}
+
+	labels, _, err := parseLabelsInPath(r.PathValue("labels"))
+	if err == nil && len(labels) == 0 {
+		err = ErrNoGroupLabels
+	}
+	pinned := false
+	if pin := r.URL.Query().Get("pin"); err == nil && pin != "" {
+		pinned, err = strconv.ParseBool(pin)
+	}
+	tenant := ""
+	if err == nil {
+		tenant, err = a.requestTenant(r)
+	}
+	if err != nil {
+		log.Println(err)
+		a.pushError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if a.proxyUnowned(w, r, tenant) {
+		return
+	}
+
+	a.completions.complete(labels, pinned)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// dropServedGroups removes the series of the groups completed before a
+// scrape that was just served successfully
+func (a *Aggregate) dropServedGroups(seq uint64) {
+	groups := a.completions.served(seq)
+	if len(groups) == 0 {
+		return
+	}
+
+	inGroups := func(s *compactSeries) bool {
+		for _, group := range groups {
+			if s.inGroup(group.labels) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, f := range a.snapshot() {
+		sizeDelta, remaining, err := f.family.removeSeries(inGroups)
+		if err != nil {
+			log.Printf("Could not drop the completed groups from %s: %s\n", f.name, err.Error())
+			continue
+		}
+		a.addMemoryBytes(sizeDelta)
+		if remaining == 0 {
+			a.removeFamilyIfEmpty(f.name)
+		}
+	}
+	a.generation.Add(1)
+}
+
+// removeSeries drops the series matching drop, returning by how many bytes
+// the family's estimated size changed and how many series are left
+func (mf *Family) removeSeries(drop func(*compactSeries) bool) (int64, int, error) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+
+	current, err := mf.load()
+	if err != nil {
+		return 0, 0, err
+	}
+	kept := make([]compactSeries, 0, len(current.series))
+	for i := range current.series {
+		if !drop(&current.series[i]) {
+			kept = append(kept, current.series[i])
+		}
+	}
+	if len(kept) == len(current.series) {
+		return 0, len(kept), nil
+	}
+
+	// Never mutate the published family, renders may be encoding it right now
+	family := *current
+	family.series = kept
+	mf.publish(&family)
+	mf.metricCount.Set(float64(len(kept)))
+
+	newSize := estimateFamilyBytes(&family)
+	sizeDelta := newSize - mf.sizeBytes
+	mf.sizeBytes = newSize
+	return sizeDelta, len(kept), nil
+}
+
+// removeFamilyIfEmpty drops a family left without series, unless a push
+// added some back meanwhile
+func (a *Aggregate) removeFamilyIfEmpty(name string) {
+	family, ok := a.families.Delete(name, func(family *Family) bool {
+		current, err := family.load()
+		return err == nil && len(current.series) == 0
+	})
+	if ok {
+		a.familyDeleted(name, family)
+	}
+}
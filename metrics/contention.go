@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	shardLockWait  = LockWaitSeconds.WithLabelValues("shard")
+	familyLockWait = LockWaitSeconds.WithLabelValues("family")
+
+	parseStage = PushStageSeconds.WithLabelValues("parse")
+	mergeStage = PushStageSeconds.WithLabelValues("merge")
+)
+
+// lockObserved acquires lock, observing how long it waited. Only write locks
+// taken by merges are observed, those are what pushes contend on, while the
+// read locks of renders are cheap and would drown them out.
+func lockObserved(lock sync.Locker, wait prometheus.Observer) {
+	start := time.Now()
+	lock.Lock()
+	wait.Observe(time.Since(start).Seconds())
+}
+
+// pushTimings adds up the time a push spends in each stage, across the
+// chunks it is parsed and merged in. Time spent waiting for the body isn't
+// part of either, so a slow client doesn't look like parse CPU.
+type pushTimings struct {
+	parse, merge time.Duration
+}
+
+// observe records the push's stages, nil timings recording nothing
+func (t *pushTimings) observe() {
+	if t == nil {
+		return
+	}
+	parseStage.Observe(t.parse.Seconds())
+	mergeStage.Observe(t.merge.Seconds())
+}
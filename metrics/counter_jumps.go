@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"log"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterJumpWebhookQueue is how many notifications may wait for the
+// webhook, more are dropped rather than slowing renders down
+const counterJumpWebhookQueue = 16
+
+// SetCounterJumpGuard flags aggregated counters growing more than factor
+// times between two renders of /metrics, the mark of a push counted twice or
+// replayed: each jump is counted in CounterJumps, logged and, with
+// webhookURL, posted there as JSON. Counters coming from 0 aren't checked,
+// and neither are tenant or sharded renders. 0 disables it.
+func SetCounterJumpGuard(factor float64, webhookURL string) Option {
+	return func(a *Aggregate) {
+		a.options.counterJumpFactor = factor
+		a.options.counterJumpWebhook = webhookURL
+	}
+}
+
+type counterJump struct {
+	Family   string            `json:"family"`
+	Labels   map[string]string `json:"labels"`
+	Previous float64           `json:"previous"`
+	Current  float64           `json:"current"`
+}
+
+type counterJumpsMessage struct {
+	Factor float64       `json:"factor"`
+	Jumps  []counterJump `json:"jumps"`
+}
+
+type counterGuard struct {
+	factor float64
+
+	lock sync.Mutex
+	// generation is that of the last render checked
+	generation uint64
+	// last holds the counter values of that render, per family and series
+	last map[string]map[labelSet]float64
+
+	webhook *webhook
+}
+
+func newCounterGuard(factor float64, webhookURL string) *counterGuard {
+	return &counterGuard{factor: factor, webhook: newWebhook(webhookURL, "counter jumps", counterJumpWebhookQueue, CounterJumpNotifications)}
+}
+
+// check compares the counters of a render of generation to those of the
+// previous render, renders of generations already checked aside
+func (g *counterGuard) check(generation uint64, families []*compactFamily) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.checkedLocked(generation) {
+		return
+	}
+
+	var jumps []counterJump
+	current := make(map[string]map[labelSet]float64, len(g.last))
+	for _, family := range families {
+		if family.ty != dto.MetricType_COUNTER {
+			continue
+		}
+		previous := g.last[family.name]
+		values := make(map[labelSet]float64, len(family.series))
+		for _, s := range family.series {
+			values[s.labels] = s.value
+			if before, ok := previous[s.labels]; ok && before > 0 && s.value > before*g.factor {
+				jumps = append(jumps, counterJump{Family: family.name, Labels: labelMap(s.labels), Previous: before, Current: s.value})
+			}
+		}
+		current[family.name] = values
+	}
+	g.generation, g.last = generation, current
+
+	for _, jump := range jumps {
+		CounterJumps.WithLabelValues(jump.Family).Inc()
+		log.Printf("Counter %s%v jumped from %g to %g between renders\n", jump.Family, jump.Labels, jump.Previous, jump.Current)
+	}
+	if len(jumps) > 0 {
+		g.webhook.send(counterJumpsMessage{Factor: g.factor, Jumps: jumps})
+	}
+}
+
+// checked reports whether a render of generation was checked already
+func (g *counterGuard) checked(generation uint64) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.checkedLocked(generation)
+}
+
+func (g *counterGuard) checkedLocked(generation uint64) bool {
+	return g.last != nil && generation <= g.generation
+}
+
+// close sends the notifications still waiting
+func (g *counterGuard) close() {
+	g.webhook.close()
+}
+
+func labelMap(labels labelSet) map[string]string {
+	pairs := labels.pairs()
+	m := make(map[string]string, len(pairs))
+	for _, l := range pairs {
+		m[l.GetName()] = l.GetValue()
+	}
+	return m
+}
+
+// guardCounters checks a render of generation with opts for counter jumps,
+// on the families as rendered
+func (a *Aggregate) guardCounters(generation uint64, opts *aggregateOptions) {
+	if a.counterGuard == nil || a.counterGuard.checked(generation) {
+		return
+	}
+	in, err := a.instantOf(nil)
+	if err != nil {
+		// left for the next render to check
+		return
+	}
+	defer in.close()
+	var counters []*compactFamily
+	_, err = a.eachRendered(in, opts, nil, func(family *compactFamily) error {
+		if family.ty == dto.MetricType_COUNTER {
+			counters = append(counters, family)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	a.counterGuard.check(generation, counters)
+}
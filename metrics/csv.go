@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+var csvHeader = []string{"name", "labels", "value", "timestamp"}
+
+// ServeRenderCSV exports the aggregate as CSV, one row per sample: histograms
+// and summaries are flattened into their _bucket, _sum, _count and quantile
+// series as in the text format. Repeated ?name parameters select families.
+// Samples without a pushed timestamp are stamped with the export time.
+func (a *Aggregate) ServeRenderCSV(w http.ResponseWriter, r *http.Request) {
+	families, err := a.selectedFamilies(r)
+	if err != nil {
+		http.Error(w, err.Error(), selectionStatus(err))
+		return
+	}
+	now := time.Now()
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.TimeFromUnixNano(now.UnixNano())}, families...)
+	if err != nil {
+		// the families of unsupported types are left out of the export
+		log.Printf("Could not export all samples as CSV: %s\n", err.Error())
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="metrics.csv"`)
+	out := csv.NewWriter(w)
+	_ = out.Write(csvHeader)
+	for _, s := range samples {
+		_ = out.Write([]string{
+			string(s.Metric[model.MetricNameLabel]),
+			csvLabels(s.Metric),
+			formatFloat(float64(s.Value)),
+			s.Timestamp.Time().UTC().Format(time.RFC3339Nano),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("An error has occurred while writing the response:\n\n%s\n", err.Error())
+	}
+}
+
+// csvLabels flattens the labels but the name into k="v" pairs, sorted by name
+func csvLabels(metric model.Metric) string {
+	labels := model.LabelSet(metric.Clone())
+	delete(labels, model.MetricNameLabel)
+	return strings.TrimSuffix(strings.TrimPrefix(labels.String(), "{"), "}")
+}
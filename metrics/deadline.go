@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	ErrPushDeadline = errors.New("push not read and merged within the push deadline")
+	ErrPushCanceled = errors.New("push canceled by the client")
+)
+
+// SetPushDeadline bounds reading, parsing and merging a push to d. Pushes
+// are all or nothing, parsed in full before any of their families are
+// merged, so one hitting the deadline, 408, leaves the aggregate as it was,
+// like one whose client disconnects mid-upload. 0 disables it.
+func SetPushDeadline(d time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.pushDeadline = d
+	}
+}
+
+// withPushDeadline bounds the request to the push deadline: its context
+// expires with it, and so does reading the body where the connection
+// supports read deadlines, so a stalled upload doesn't hold a reader
+func withPushDeadline(w http.ResponseWriter, r *http.Request, d time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	deadline, _ := ctx.Deadline()
+	// writers not unwrapping to the connection's leave only the context,
+	// checked between reads
+	_ = http.NewResponseController(w).SetReadDeadline(deadline)
+
+	r = r.WithContext(ctx)
+	r.Body = &contextBody{ctx: ctx, ReadCloser: r.Body}
+	return r, cancel
+}
+
+// contextBody fails reads once its context is done, and turns the errors of
+// reads past the read deadline into ErrPushDeadline
+type contextBody struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (b *contextBody) Read(p []byte) (int, error) {
+	if err := pushAborted(b.ctx); err != nil {
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		if aborted := pushAborted(b.ctx); aborted != nil {
+			return n, aborted
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, fmt.Errorf("%w: %s", ErrPushDeadline, err.Error())
+		}
+	}
+	return n, err
+}
+
+// pushAborted returns why a push's context is done, nil while it isn't
+func pushAborted(ctx context.Context) error {
+	switch err := ctx.Err(); {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrPushDeadline
+	default:
+		return ErrPushCanceled
+	}
+}
+
+// abortReason is the IngestRejected reason of a push aborted by its
+// context, "" for other errors
+func abortReason(err error) string {
+	switch {
+	case errors.Is(err, ErrPushDeadline):
+		return "deadline"
+	case errors.Is(err, ErrPushCanceled):
+		return "canceled"
+	}
+	return ""
+}
+
+// stagedFamily is a normalized family waiting for its push to be committed
+type stagedFamily struct {
+	name   string
+	family *compactFamily
+}
+
+// stageFamily stages a normalized family, which is not used afterwards
+func stageFamily(name string, family *dto.MetricFamily) stagedFamily {
+	return stagedFamily{name: name, family: compactFamilyFromDTO(family)}
+}
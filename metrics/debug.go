@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ServeDebugParse answers a push body with the families as they would be
+// merged, after label formatting, ignored labels, ingest hooks and rollup
+// rules, without merging them. It reads the label path from the "labels" path value and
+// honours the headers and parameters a push does.
+func (a *Aggregate) ServeDebugParse(w http.ResponseWriter, r *http.Request) {
+	labelParts, _, err := parseLabelsInPath(r.PathValue("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	honor, err := a.pushHonorLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenant, err := a.requestTenant(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labelParts = a.pushLabels(r, labelParts, honor, tenant)
+
+	ack := newPushAck(a.opts())
+	var families []*dto.MetricFamily
+	err = parseFamilies(r.Body, nil, func(inFamilies map[string]*dto.MetricFamily) error {
+		for name, family := range inFamilies {
+			keep, err := a.normalizeFamily(name, family, labelParts, ack)
+			if err != nil {
+				return err
+			}
+			if keep {
+				families = append(families, family)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), insertErrorStatus(err))
+		return
+	}
+
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	data := make([]jsonFamily, 0, len(families))
+	for _, family := range families {
+		data = append(data, familyToJSON(family))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":   "success",
+		"data":     data,
+		"warnings": ack.body().Warnings,
+	})
+}
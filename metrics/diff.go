@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxSnapshots bounds the snapshots kept for diffing, the oldest is dropped first
+const maxSnapshots = 8
+
+const defaultSnapshotName = "latest"
+
+var ErrUnknownSnapshot = errors.New("unknown snapshot")
+
+// stateSnapshot is the aggregate's state at some point. Published families
+// are never mutated, so keeping their pointers is all a snapshot costs.
+type stateSnapshot struct {
+	name     string
+	takenAt  time.Time
+	families map[string]*compactFamily
+}
+
+type snapshots struct {
+	lock sync.Mutex
+	// byAge holds the snapshots oldest first
+	byAge []*stateSnapshot
+}
+
+func (s *snapshots) put(snapshot *stateSnapshot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.byAge = deleteSnapshot(s.byAge, snapshot.name)
+	if len(s.byAge) >= maxSnapshots {
+		s.byAge = s.byAge[1:]
+	}
+	s.byAge = append(s.byAge, snapshot)
+}
+
+func (s *snapshots) get(name string) *stateSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, snapshot := range s.byAge {
+		if snapshot.name == name {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+func deleteSnapshot(byAge []*stateSnapshot, name string) []*stateSnapshot {
+	kept := byAge[:0]
+	for _, snapshot := range byAge {
+		if snapshot.name != name {
+			kept = append(kept, snapshot)
+		}
+	}
+	return kept
+}
+
+func (a *Aggregate) takeSnapshot(name string) (*stateSnapshot, error) {
+	snapshot := &stateSnapshot{name: name, takenAt: time.Now(), families: map[string]*compactFamily{}}
+	opts := a.opts()
+	for _, f := range a.snapshot() {
+		current, err := f.family.load()
+		if err != nil {
+			return nil, err
+		}
+		snapshot.families[f.name] = opts.collapseIgnored(current)
+	}
+	return snapshot, nil
+}
+
+// ServeSnapshot stores the current state under ?name (default "latest"),
+// for a later diff against it
+func (a *Aggregate) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = defaultSnapshotName
+	}
+
+	snapshot, err := a.takeSnapshot(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.snapshots.put(snapshot)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"name":     snapshot.name,
+		"taken_at": snapshot.takenAt,
+		"families": len(snapshot.families),
+	})
+}
+
+// ServeDiff reports in JSON how the current state differs from the snapshot
+// named by ?snapshot (default "latest"): families and series added and
+// removed, and the series whose value changed
+func (a *Aggregate) ServeDiff(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("snapshot")
+	if name == "" {
+		name = defaultSnapshotName
+	}
+
+	before := a.snapshots.get(name)
+	if before == nil {
+		err := fmt.Errorf("%w %q, take one with POST /api/v1/admin/snapshot?name=%s", ErrUnknownSnapshot, name, name)
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	after, err := a.takeSnapshot("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, diffSnapshots(before, after))
+}
+
+type stateDiff struct {
+	Snapshot        string       `json:"snapshot"`
+	TakenAt         time.Time    `json:"taken_at"`
+	AddedFamilies   []string     `json:"added_families"`
+	RemovedFamilies []string     `json:"removed_families"`
+	AddedSeries     []seriesDiff `json:"added_series"`
+	RemovedSeries   []seriesDiff `json:"removed_series"`
+	ChangedSeries   []seriesDiff `json:"changed_series"`
+}
+
+type seriesDiff struct {
+	Family string            `json:"family"`
+	Labels map[string]string `json:"labels"`
+	Before *seriesValue      `json:"before,omitempty"`
+	After  *seriesValue      `json:"after,omitempty"`
+	Delta  *seriesValue      `json:"delta,omitempty"`
+}
+
+// seriesValue is a counter, gauge or untyped value, or a histogram or summary
+// count and sum
+type seriesValue struct {
+	Value *float64 `json:"value,omitempty"`
+	Count *float64 `json:"count,omitempty"`
+	Sum   *float64 `json:"sum,omitempty"`
+}
+
+func newSeriesValue(ty dto.MetricType, value, count float64) *seriesValue {
+	if ty == dto.MetricType_HISTOGRAM || ty == dto.MetricType_SUMMARY {
+		return &seriesValue{Count: &count, Sum: &value}
+	}
+	return &seriesValue{Value: &value}
+}
+
+func diffSnapshots(before, after *stateSnapshot) stateDiff {
+	diff := stateDiff{
+		Snapshot:        before.name,
+		TakenAt:         before.takenAt,
+		AddedFamilies:   []string{},
+		RemovedFamilies: []string{},
+		AddedSeries:     []seriesDiff{},
+		RemovedSeries:   []seriesDiff{},
+		ChangedSeries:   []seriesDiff{},
+	}
+
+	for name, family := range after.families {
+		previous, ok := before.families[name]
+		switch {
+		case !ok:
+			diff.AddedFamilies = append(diff.AddedFamilies, name)
+		case previous.ty != family.ty:
+			// a family recreated with another type has nothing to compare
+			diff.RemovedFamilies = append(diff.RemovedFamilies, name)
+			diff.AddedFamilies = append(diff.AddedFamilies, name)
+		case previous != family:
+			diffSeries(&diff, previous, family)
+		}
+	}
+	for name := range before.families {
+		if _, ok := after.families[name]; !ok {
+			diff.RemovedFamilies = append(diff.RemovedFamilies, name)
+		}
+	}
+
+	sort.Strings(diff.AddedFamilies)
+	sort.Strings(diff.RemovedFamilies)
+	for _, series := range [][]seriesDiff{diff.AddedSeries, diff.RemovedSeries, diff.ChangedSeries} {
+		sort.SliceStable(series, func(i, j int) bool { return series[i].Family < series[j].Family })
+	}
+	return diff
+}
+
+// diffSeries walks both families' series, which are sorted by labels
+func diffSeries(diff *stateDiff, before, after *compactFamily) {
+	ty := after.ty
+	describe := func(s *compactSeries) seriesDiff {
+		labels := map[string]string{}
+		for _, l := range s.labels.pairs() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		return seriesDiff{Family: after.name, Labels: labels}
+	}
+
+	i, j := 0, 0
+	for i < len(before.series) || j < len(after.series) {
+		switch {
+		case j == len(after.series) || (i < len(before.series) && before.series[i].labels.less(after.series[j].labels)):
+			s := &before.series[i]
+			d := describe(s)
+			d.Before = newSeriesValue(ty, s.value, float64(s.count))
+			diff.RemovedSeries = append(diff.RemovedSeries, d)
+			i++
+		case i == len(before.series) || after.series[j].labels.less(before.series[i].labels):
+			s := &after.series[j]
+			d := describe(s)
+			d.After = newSeriesValue(ty, s.value, float64(s.count))
+			diff.AddedSeries = append(diff.AddedSeries, d)
+			j++
+		default:
+			b, s := &before.series[i], &after.series[j]
+			if b.value != s.value || b.count != s.count {
+				d := describe(s)
+				d.Before = newSeriesValue(ty, b.value, float64(b.count))
+				d.After = newSeriesValue(ty, s.value, float64(s.count))
+				d.Delta = newSeriesValue(ty, s.value-b.value, float64(s.count)-float64(b.count))
+				diff.ChangedSeries = append(diff.ChangedSeries, d)
+			}
+			i++
+			j++
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("An error has occurred while writing the response:\n\n%s\n", err.Error())
+	}
+}
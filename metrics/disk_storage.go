@@ -0,0 +1,411 @@
+package metrics
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// spillSuffix ends the name of every file a disk storage spills a family to
+const spillSuffix = ".family"
+
+// runPrefix starts the name of the directory each disk storage spills to
+const runPrefix = "run-"
+
+// ErrSpillRead fails the merges and renders of a spilled family which can't
+// be read back from disk, rather than have them go on without its series
+var ErrSpillRead = errors.New("could not read a spilled family back")
+
+// diskStorage keeps the families merged into most recently in memory, up
+// to hotBytes of estimated size, and spills the series of the others to a
+// file each in dir, which is what takes memory in large aggregates. Cold
+// families are read back from disk by renders, without being cached, and
+// made hot again by the next merge into them.
+//
+// It spills to plain files rather than an embedded key-value store such as
+// BadgerDB or Bolt: one file per family is all a family's lifecycle needs,
+// written whole and read back whole, without another dependency.
+type diskStorage struct {
+	*familyShards
+	// dir is the directory of this run, in the one the storage was given
+	dir      string
+	hotBytes int64
+	// runLock holds the lock telling later runs dir is in use
+	runLock *os.File
+	// spilled reports by how many bytes spills lowered the estimated size
+	// of the aggregate
+	spilled func(delta int64)
+
+	lock sync.Mutex
+	// recent orders the families merged into most recently first
+	recent   list.List
+	elements map[string]*list.Element
+	// hot is the estimated size of the families in recent, as of the last
+	// merge into each
+	hot int64
+}
+
+// hotFamily is a family in memory, with its estimated size when it was
+// last merged into
+type hotFamily struct {
+	namedFamily
+	sizeBytes int64
+}
+
+// NewDiskStorage returns a Storage keeping the families merged into most
+// recently in memory, as long as they are estimated at most hotBytes,
+// spilling the others to dir, for aggregates larger than RAM on a single
+// node. The family merged into last stays in memory whatever its size.
+// Spilled families no longer count towards the memory budget.
+//
+// Each run spills to a directory of its own in dir, and those of previous
+// runs no process holds anymore are removed: the aggregate is restored from
+// its persistence snapshot, not from them, and a gateway taking over from
+// another one through a handoff leaves those of the one still serving
+// alone.
+func NewDiskStorage(dir string, hotBytes int64) (Storage, error) {
+	if hotBytes <= 0 {
+		return nil, fmt.Errorf("invalid hot bytes %d, must be positive", hotBytes)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := removeStaleRuns(dir); err != nil {
+		return nil, err
+	}
+	runDir, err := os.MkdirTemp(dir, runPrefix)
+	if err != nil {
+		return nil, err
+	}
+	runLock, err := lockRun(runDir, false)
+	if err != nil {
+		os.RemoveAll(runDir)
+		return nil, err
+	}
+	return &diskStorage{
+		familyShards: newFamilyShards(),
+		dir:          runDir,
+		hotBytes:     hotBytes,
+		runLock:      runLock,
+		spilled:      func(int64) {},
+		elements:     map[string]*list.Element{},
+	}, nil
+}
+
+// GetOrCreate counts the creation as a merge into the family, renders only
+// calling Get
+func (s *diskStorage) GetOrCreate(name string, create func() *Family) (*Family, bool) {
+	family, ok := s.familyShards.GetOrCreate(name, func() *Family {
+		family := create()
+		family.spillPath = s.path(name)
+		return family
+	})
+	if !ok {
+		s.merged(name, family)
+	}
+	return family, ok
+}
+
+func (s *diskStorage) Delete(name string, drop func(*Family) bool) (*Family, bool) {
+	family, ok := s.familyShards.Delete(name, drop)
+	if !ok {
+		return nil, false
+	}
+	s.lock.Lock()
+	if element, ok := s.elements[name]; ok {
+		s.hot -= s.recent.Remove(element).(hotFamily).sizeBytes
+		delete(s.elements, name)
+	}
+	s.lock.Unlock()
+	if err := os.Remove(family.spillPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Could not remove the spilled family %s: %s\n", name, err.Error())
+	}
+	return family, true
+}
+
+// Close removes the spilled families
+func (s *diskStorage) Close() error {
+	defer s.runLock.Close()
+	return os.RemoveAll(s.dir)
+}
+
+func (s *diskStorage) path(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+spillSuffix)
+}
+
+// accountSpills has spills report by how many bytes they lowered the
+// estimated size of the families
+func (s *diskStorage) accountSpills(spilled func(delta int64)) {
+	s.spilled = spilled
+}
+
+// merged moves a family to the front of the hot ones, spilling those
+// merged into least recently past hotBytes
+func (s *diskStorage) merged(name string, family *Family) {
+	family.lock.RLock()
+	sizeBytes := family.sizeBytes
+	family.lock.RUnlock()
+
+	var spill []namedFamily
+	s.lock.Lock()
+	hot := hotFamily{namedFamily{name, family}, sizeBytes}
+	if element, ok := s.elements[name]; ok {
+		s.hot += sizeBytes - element.Value.(hotFamily).sizeBytes
+		element.Value = hot
+		s.recent.MoveToFront(element)
+	} else {
+		s.hot += sizeBytes
+		s.elements[name] = s.recent.PushFront(hot)
+	}
+	for s.hot > s.hotBytes && s.recent.Len() > 1 {
+		evicted := s.recent.Remove(s.recent.Back()).(hotFamily)
+		delete(s.elements, evicted.name)
+		s.hot -= evicted.sizeBytes
+		spill = append(spill, evicted.namedFamily)
+	}
+	s.lock.Unlock()
+
+	for _, f := range spill {
+		freed, err := f.family.spill()
+		if err != nil {
+			SpillErrors.Inc()
+			log.Printf("Could not spill family %s to disk: %s\n", f.name, err.Error())
+			continue
+		}
+		s.spilled(-freed)
+	}
+}
+
+// lockRun takes the lock of a run directory, failing with
+// syscall.EWOULDBLOCK when a running process holds it and existing is set
+func lockRun(runDir string, existing bool) (*os.File, error) {
+	flags := os.O_RDWR
+	if !existing {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(filepath.Join(runDir, "lock"), flags, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// removeStaleRuns removes the run directories in dir whose processes are
+// gone
+func removeStaleRuns(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), runPrefix) {
+			continue
+		}
+		runDir := filepath.Join(dir, entry.Name())
+		runLock, err := lockRun(runDir, true)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			continue
+		}
+		// a run without its lock died creating it
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		err = os.RemoveAll(runDir)
+		if runLock != nil {
+			runLock.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spill writes the series of the family to its spill file and drops them
+// from memory, renders reading them back from there until it is merged
+// into again. It returns by how many bytes the family's estimated size
+// dropped.
+func (mf *Family) spill() (int64, error) {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	current := mf.current.Load()
+	if current == nil {
+		return 0, nil
+	}
+
+	content, err := encodeSpill(current)
+	if err != nil {
+		return 0, err
+	}
+	// renders may be reading the previous spill, replace it at once
+	tmp := mf.spillPath + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, mf.spillPath); err != nil {
+		return 0, err
+	}
+
+	cold := *current
+	cold.series = nil
+	mf.cold.Store(&cold)
+	mf.current.Store(nil)
+	FamilySpills.Inc()
+
+	// merges read the series back, adding them to the size again
+	sizeBytes := estimateFamilyBytes(&cold)
+	freed := mf.sizeBytes - sizeBytes
+	mf.sizeBytes = sizeBytes
+	return freed, nil
+}
+
+// head returns the latest published state, without its series while the
+// family is spilled
+func (mf *Family) head() *compactFamily {
+	if current := mf.current.Load(); current != nil {
+		return current
+	}
+	return mf.cold.Load()
+}
+
+// unspill reads the state of a cold family back from its spill file
+func (mf *Family) unspill() (*compactFamily, error) {
+	spill, err := mf.openSpill()
+	if err != nil {
+		return nil, err
+	}
+	defer spill.Close()
+	return mf.readSpill(spill)
+}
+
+// openSpill opens the spill file of a cold family. Spills replace the file
+// rather than write into it, so what is read from it is the state spilled
+// when it was opened, whatever merges and spills come after.
+func (mf *Family) openSpill() (*os.File, error) {
+	spill, err := os.Open(mf.spillPath)
+	if err != nil {
+		return nil, mf.unspillError(mf.cold.Load(), err)
+	}
+	return spill, nil
+}
+
+// readSpill reads the state of a cold family back from its opened spill
+// file, from the start whatever was read from it before
+func (mf *Family) readSpill(spill *os.File) (*compactFamily, error) {
+	content, err := io.ReadAll(io.NewSectionReader(spill, 0, math.MaxInt64))
+	if err != nil {
+		return nil, mf.unspillError(mf.cold.Load(), err)
+	}
+	compact, err := decodeSpill(content)
+	if err != nil {
+		return nil, mf.unspillError(mf.cold.Load(), err)
+	}
+	return compact, nil
+}
+
+// encodeState encodes a family state as its stamp followed by its protobuf
+// encoding
+func encodeState(state *compactFamily) ([]byte, error) {
+	body, err := proto.Marshal(state.toDTO())
+	if err != nil {
+		return nil, err
+	}
+	content := binary.AppendVarint(nil, state.stampMs)
+	return append(content, body...), nil
+}
+
+func decodeState(content []byte) (*compactFamily, error) {
+	stampMs, n := binary.Varint(content)
+	if n <= 0 {
+		return nil, errors.New("invalid stamp")
+	}
+	family := &dto.MetricFamily{}
+	if err := proto.Unmarshal(content[n:], family); err != nil {
+		return nil, err
+	}
+	compact := compactFamilyFromDTO(family)
+	compact.stampMs = stampMs
+	return compact, nil
+}
+
+// encodeSpill encodes a family state for its spill file: the length of its
+// encodeState encoding, that encoding, then the gauge spread of the series
+// tracking theirs, which dto has no room for
+func encodeSpill(state *compactFamily) ([]byte, error) {
+	encoded, err := encodeState(state)
+	if err != nil {
+		return nil, err
+	}
+	content := binary.AppendUvarint(nil, uint64(len(encoded)))
+	content = append(content, encoded...)
+	for i := range state.series {
+		spread := state.series[i].spread()
+		if spread == nil {
+			continue
+		}
+		content = binary.AppendUvarint(content, uint64(i))
+		content = binary.LittleEndian.AppendUint64(content, math.Float64bits(spread.min))
+		content = binary.LittleEndian.AppendUint64(content, math.Float64bits(spread.max))
+		content = binary.AppendUvarint(content, spread.contributors)
+	}
+	return content, nil
+}
+
+func decodeSpill(content []byte) (*compactFamily, error) {
+	size, n := binary.Uvarint(content)
+	if n <= 0 || size > uint64(len(content)-n) {
+		return nil, errors.New("invalid length")
+	}
+	content = content[n:]
+	compact, err := decodeState(content[:size])
+	if err != nil {
+		return nil, err
+	}
+
+	for content = content[size:]; len(content) > 0; {
+		i, n := binary.Uvarint(content)
+		if n <= 0 || i >= uint64(len(compact.series)) || len(content)-n < 16 {
+			return nil, errors.New("invalid gauge spread")
+		}
+		content = content[n:]
+		spread := &gaugeSpread{
+			min: math.Float64frombits(binary.LittleEndian.Uint64(content)),
+			max: math.Float64frombits(binary.LittleEndian.Uint64(content[8:])),
+		}
+		content = content[16:]
+		if spread.contributors, n = binary.Uvarint(content); n <= 0 {
+			return nil, errors.New("invalid gauge spread")
+		}
+		content = content[n:]
+		s := &compact.series[i]
+		if s.extra == nil {
+			s.extra = &seriesExtra{}
+		}
+		s.extra.spread = spread
+	}
+	return compact, nil
+}
+
+func (mf *Family) unspillError(cold *compactFamily, err error) error {
+	SpillErrors.Inc()
+	return fmt.Errorf("%w, %s: %w", ErrSpillRead, cold.name, err)
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// DuplicateSeriesReject rejects pushes repeating a series with 400
+	DuplicateSeriesReject = "reject"
+	// DuplicateSeriesMerge merges the repeats with the type's merge strategy
+	DuplicateSeriesMerge = "merge"
+)
+
+// SetDuplicateSeries sets what a push holding the same series more than
+// once gets, including series left with the same labels by the ignored
+// labels: DuplicateSeriesReject (the default) or DuplicateSeriesMerge,
+// which merges them in the order of the push as pushes to the series would
+// be, warning in the acknowledgement and counting them.
+func SetDuplicateSeries(mode string) Option {
+	return func(a *Aggregate) {
+		a.options.duplicateSeries = mode
+	}
+}
+
+// mergeDuplicates merges the series of a pushed family sharing their labels
+func (ao *aggregateOptions) mergeDuplicates(family *dto.MetricFamily, ack *pushAck) {
+	if merged := collapseSeriesWith(family, ao.mergeStrategy(family.GetType())); merged > 0 {
+		DuplicateSeries.WithLabelValues(family.GetName()).Add(float64(merged))
+		ack.warnings = append(ack.warnings, fmt.Sprintf("%d duplicate series of %s were merged", merged, family.GetName()))
+	}
+}
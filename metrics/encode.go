@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"log"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// parallelEncodeThreshold is the family count from which renders are split
+// across cores, below it the goroutine handoff costs more than it saves
+const parallelEncodeThreshold = 1024
+
+// familyEncoder encodes families in a content type, skipping the escaping
+// pass (which copies the whole family) for families that don't need it.
+// Each family is encoded into a scratch buffer first, so one that fails to
+// encode is left out whole rather than cut off half-way.
+type familyEncoder struct {
+	w           io.Writer
+	scratch     bytes.Buffer
+	enc, rawEnc expfmt.Encoder
+	// nativeSchema converts classic histograms to native ones of this schema
+	nativeSchema *int32
+}
+
+// encoderOption configures a familyEncoder
+type encoderOption func(fe *familyEncoder)
+
+func newFamilyEncoder(w io.Writer, contentType expfmt.Format, opts ...encoderOption) *familyEncoder {
+	fe := &familyEncoder{w: w}
+	for _, opt := range opts {
+		opt(fe)
+	}
+	if contentType.FormatType() == expfmt.TypeProtoDelim {
+		fe.enc = &protoDelimEncoder{w: &fe.scratch, escaping: contentType.ToEscapingScheme()}
+		fe.rawEnc = &protoDelimEncoder{w: &fe.scratch, escaping: model.NoEscaping}
+		return fe
+	}
+	var options []expfmt.EncoderOption
+	if contentType.FormatType() == expfmt.TypeOpenMetrics {
+		options = append(options, expfmt.WithCreatedLines(), expfmt.WithUnit())
+	}
+	fe.enc = expfmt.NewEncoder(&fe.scratch, contentType, options...)
+	fe.rawEnc = expfmt.NewEncoder(&fe.scratch, contentType.WithEscapingScheme(model.NoEscaping), options...)
+	return fe
+}
+
+// encode writes the family to w, or skips it when it can't be encoded. Only
+// errors writing to w are returned.
+func (fe *familyEncoder) encode(compact *compactFamily) error {
+	family := compact.toDTO()
+	if fe.nativeSchema != nil && family.GetType() == dto.MetricType_HISTOGRAM {
+		toNativeHistograms(family, *fe.nativeSchema)
+	}
+	enc := fe.enc
+	if !familyNeedsEscaping(family) {
+		enc = fe.rawEnc
+	}
+
+	fe.scratch.Reset()
+	if !encodeMetric(family, enc) {
+		return nil
+	}
+	_, err := fe.w.Write(fe.scratch.Bytes())
+	return err
+}
+
+// encodeFamilies encodes families in order, stopping at the first write failure
+func encodeFamilies(w io.Writer, contentType expfmt.Format, families []*compactFamily, opts ...encoderOption) bool {
+	fe := newFamilyEncoder(w, contentType, opts...)
+	for _, family := range families {
+		if err := fe.encode(family); err != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// encodeFamiliesParallel splits families into contiguous ranges encoded
+// concurrently into their own buffers, which are streamed to w in order as
+// soon as each one (and all the ones before it) is done
+func encodeFamiliesParallel(w io.Writer, contentType expfmt.Format, families []*compactFamily, workers int, opts ...encoderOption) {
+	type part struct {
+		buf  bytes.Buffer
+		ok   bool
+		done chan struct{}
+	}
+
+	chunkSize := (len(families) + workers - 1) / workers
+	parts := make([]*part, 0, workers)
+	for start := 0; start < len(families); start += chunkSize {
+		end := min(start+chunkSize, len(families))
+		p := &part{done: make(chan struct{})}
+		parts = append(parts, p)
+
+		go func(chunk []*compactFamily) {
+			defer close(p.done)
+			p.ok = encodeFamilies(&p.buf, contentType, chunk, opts...)
+		}(families[start:end])
+	}
+
+	failed := false
+	for _, p := range parts {
+		<-p.done
+		if failed {
+			continue
+		}
+		if _, err := w.Write(p.buf.Bytes()); err != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+			failed = true
+		}
+		failed = failed || !p.ok
+	}
+}
+
+// protoDelimEncoder writes length-delimited protobuf like expfmt does for
+// FmtProtoDelim, but marshals every family into the same scratch buffer
+// instead of allocating a fresh one per family.
+type protoDelimEncoder struct {
+	w   io.Writer
+	buf []byte
+	// escaping is how names outside the legacy character set are escaped
+	escaping model.EscapingScheme
+}
+
+func (e *protoDelimEncoder) Encode(family *dto.MetricFamily) error {
+	if e.escaping != model.NoEscaping {
+		family = model.EscapeMetricFamily(family, e.escaping)
+	}
+	size := proto.Size(family)
+	e.buf = protowire.AppendVarint(e.buf[:0], uint64(size))
+
+	var err error
+	e.buf, err = proto.MarshalOptions{UseCachedSize: true}.MarshalAppend(e.buf, family)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(e.buf)
+	return err
+}
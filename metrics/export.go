@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// ServeExport streams the aggregate's families as stored, length-delimited
+// MetricFamily protobufs sorted by name, for tooling that would rather not
+// parse a render: no render filters, limits or synthetic families apply,
+// and names are never escaped. ?name, repeatable, only exports those
+// families. Like streamed renders, an export failing mid-way aborts the
+// connection rather than end a truncated response normally.
+func (a *Aggregate) ServeExport(w http.ResponseWriter, r *http.Request) {
+	if a.serveSubAggregateAdmin(w, r, (*Aggregate).ServeExport) {
+		return
+	}
+	a.expireFamilies(time.Now())
+	var keep func(name string) bool
+	if names := r.URL.Query()["name"]; len(names) > 0 {
+		keep = func(name string) bool { return slices.Contains(names, name) }
+	}
+	families, err := a.pointInTimeOf(keep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	w.Header().Set("Vary", "Accept-Encoding")
+	var out io.Writer = w
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(gz)
+		gz.Reset(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	for _, family := range families {
+		if _, err := protodelim.MarshalTo(out, family.toDTO()); err != nil {
+			log.Printf("An error has occurred while exporting metrics:\n\n%s\n", err.Error())
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// familyMetrics are the self-metrics an aggregate keeps on its families
+type familyMetrics struct {
+	total       prometheus.Gauge
+	byType      *prometheus.GaugeVec
+	byFamily    *prometheus.GaugeVec
+	restoredAge *prometheus.GaugeVec
+	memoryBytes prometheus.Gauge
+}
+
+// registeredFamilyMetrics are those of the main aggregate, the ones
+// PromRegistry exposes
+var registeredFamilyMetrics = &familyMetrics{
+	total:       TotalFamiliesGauge,
+	byType:      MetricCountByType,
+	byFamily:    MetricCountByFamily,
+	restoredAge: RestoredFamilyAge,
+	memoryBytes: EstimatedMemoryBytes,
+}
+
+// newUnregisteredFamilyMetrics returns family metrics no registry exposes,
+// for the aggregates next to the main one, whose families would otherwise
+// add to and remove from those of the main aggregate
+func newUnregisteredFamilyMetrics() *familyMetrics {
+	return &familyMetrics{
+		total:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "total_families"}),
+		byType:      prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "metrics_by_type"}, []string{"metric_type"}),
+		byFamily:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "metrics_by_family"}, []string{"family"}),
+		restoredAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "restored_family_age_seconds"}, []string{"family"}),
+		memoryBytes: prometheus.NewGauge(prometheus.GaugeOpts{Name: "estimated_memory_bytes"}),
+	}
+}
+
+// withUnregisteredMetrics keeps the aggregate's family metrics out of the
+// registered ones
+func withUnregisteredMetrics() Option {
+	return func(a *Aggregate) {
+		a.options.unregisteredMetrics = true
+	}
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// FlushPush flushes by pushing the text render to another gateway
+	FlushPush = "push"
+	// FlushRemoteWrite flushes as a Prometheus remote write request
+	FlushRemoteWrite = "remote_write"
+)
+
+// Flush sends everything the aggregate holds to url in one request, either
+// pushed to another gateway or as a remote write request. It is meant for
+// gateways that only live as long as the sandbox they buffer pushes for, and
+// must hand their state over before it is frozen or torn down.
+func (a *Aggregate) Flush(ctx context.Context, url, format string) error {
+	var (
+		body    bytes.Buffer
+		headers = http.Header{}
+	)
+	switch format {
+	case FlushPush:
+		if err := a.encodeAllMetrics(&body, expfmt.NewFormat(expfmt.TypeTextPlain)); err != nil {
+			return err
+		}
+		headers.Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	case FlushRemoteWrite:
+		nowMs := time.Now().UnixMilli()
+		var request []byte
+		families, err := a.pointInTime()
+		if err != nil {
+			return err
+		}
+		for _, family := range families {
+			request = appendRemoteWriteFamily(request, family.toDTO(), nowMs)
+		}
+		body.Write(snappy.Encode(nil, request))
+		headers.Set("Content-Encoding", "snappy")
+		headers.Set("Content-Type", "application/x-protobuf")
+		headers.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	default:
+		return fmt.Errorf("unknown flush format %q, expected %q or %q", format, FlushPush, FlushRemoteWrite)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header = headers
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
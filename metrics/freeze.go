@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// frozenFamilies are the families kept as they were when frozen, e.g. as
+// evidence during an incident, while their producers keep pushing: merges
+// into them are skipped and they don't expire
+type frozenFamilies struct {
+	lock     sync.RWMutex
+	families map[string]frozenFamily
+}
+
+type frozenFamily struct {
+	Family   string    `json:"family"`
+	FrozenAt time.Time `json:"frozen_at"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+func (f *frozenFamilies) has(name string) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	_, ok := f.families[name]
+	return ok
+}
+
+func (f *frozenFamilies) freeze(name, reason string, now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.families == nil {
+		f.families = map[string]frozenFamily{}
+	}
+	if _, ok := f.families[name]; !ok {
+		f.families[name] = frozenFamily{Family: name, FrozenAt: now, Reason: reason}
+	}
+}
+
+// thaw reports whether the family was frozen
+func (f *frozenFamilies) thaw(name string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, ok := f.families[name]
+	delete(f.families, name)
+	return ok
+}
+
+// list returns the frozen families sorted by name
+func (f *frozenFamilies) list() []frozenFamily {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	families := make([]frozenFamily, 0, len(f.families))
+	for _, family := range f.families {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].Family < families[j].Family })
+	return families
+}
+
+// skipFrozen reports whether the pushed family is frozen, warning the push
+// its series were not merged
+func (a *Aggregate) skipFrozen(name string, ack *pushAck) bool {
+	if !a.frozen.has(name) {
+		return false
+	}
+	FrozenFamilyPushes.WithLabelValues(name).Inc()
+	ack.warnings = append(ack.warnings, fmt.Sprintf("family %s is frozen, its series were not merged", name))
+	return true
+}
+
+// ServeFreeze lists the frozen families. A POST with ?name freezes that
+// family, with an optional ?reason, until a DELETE with ?name thaws it. A
+// family thawed after its TTL went by expires on the next scrape.
+func (a *Aggregate) ServeFreeze(w http.ResponseWriter, r *http.Request) {
+	if a.serveSubAggregateAdmin(w, r, (*Aggregate).ServeFreeze) {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodPost:
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if _, ok := a.families.Get(name); !ok {
+			http.Error(w, fmt.Sprintf("no family %s", name), http.StatusNotFound)
+			return
+		}
+		a.frozen.freeze(name, r.URL.Query().Get("reason"), time.Now())
+	case http.MethodDelete:
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if !a.frozen.thaw(name) {
+			http.Error(w, fmt.Sprintf("family %s is not frozen", name), http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"families": a.frozen.list()})
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Suffixes of the companion families of gauges
+const (
+	GaugeMinSuffix          = "_min"
+	GaugeMaxSuffix          = "_max"
+	GaugeContributorsSuffix = "_contributors"
+)
+
+// SetGaugeSpread tracks the smallest and largest value merged into each
+// gauge series and how many pushes contributed to it, rendered as
+// companion <name>_min, <name>_max and <name>_contributors gauges, so
+// dashboards see the spread across pushers behind the merged value. Pushed
+// families of those names take precedence, and gauges whose ignored labels
+// are merged over at render have no companions.
+func SetGaugeSpread(enabled bool) Option {
+	return func(a *Aggregate) {
+		a.options.gaugeSpread = enabled
+	}
+}
+
+// gaugeSpread is the spread of the values merged into a gauge series
+type gaugeSpread struct {
+	min, max     float64
+	contributors uint64
+}
+
+func (s *compactSeries) spread() *gaugeSpread {
+	if s.extra == nil {
+		return nil
+	}
+	return s.extra.spread
+}
+
+// trackSpread starts tracking the spread of pushed gauge series
+func trackSpread(series []compactSeries) {
+	for i := range series {
+		s := &series[i]
+		if s.extra == nil {
+			s.extra = &seriesExtra{}
+		}
+		s.extra.spread = &gaugeSpread{min: s.value, max: s.value, contributors: 1}
+	}
+}
+
+// withSpread merges the spreads of a and b into merged, once either of
+// them is tracked, a series without one counting as a single contribution
+func withSpread(merged compactSeries, a, b *compactSeries) compactSeries {
+	sa, sb := a.spread(), b.spread()
+	if sa == nil && sb == nil {
+		return merged
+	}
+	if sa == nil {
+		sa = &gaugeSpread{min: a.value, max: a.value, contributors: 1}
+	}
+	if sb == nil {
+		sb = &gaugeSpread{min: b.value, max: b.value, contributors: 1}
+	}
+	if merged.extra == nil {
+		merged.extra = &seriesExtra{}
+	}
+	merged.extra.spread = &gaugeSpread{
+		min:          min(sa.min, sb.min),
+		max:          max(sa.max, sb.max),
+		contributors: sa.contributors + sb.contributors,
+	}
+	return merged
+}
+
+// spreadFamilies returns the min, max and contributors families of a gauge,
+// none when none of its series tracks its spread
+func spreadFamilies(family *compactFamily) []*compactFamily {
+	companion := func(suffix, help string) *compactFamily {
+		return &compactFamily{name: family.name + suffix, help: proto.String(help + family.name), ty: dto.MetricType_GAUGE, stampMs: family.stampMs}
+	}
+	mins := companion(GaugeMinSuffix, "Smallest value merged into ")
+	maxes := companion(GaugeMaxSuffix, "Largest value merged into ")
+	contributors := companion(GaugeContributorsSuffix, "Number of pushes merged into ")
+	for _, s := range family.series {
+		spread := s.spread()
+		if spread == nil {
+			continue
+		}
+		var extra *seriesExtra
+		if s.extra.timestampMs != nil {
+			extra = &seriesExtra{timestampMs: s.extra.timestampMs}
+		}
+		mins.series = append(mins.series, compactSeries{labels: s.labels, value: spread.min, extra: extra})
+		maxes.series = append(maxes.series, compactSeries{labels: s.labels, value: spread.max, extra: extra})
+		contributors.series = append(contributors.series, compactSeries{labels: s.labels, value: float64(spread.contributors), extra: extra})
+	}
+	if len(mins.series) == 0 {
+		return nil
+	}
+	return []*compactFamily{mins, maxes, contributors}
+}
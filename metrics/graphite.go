@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// graphiteReplacer strips the characters Graphite does not accept in tags
+var graphiteReplacer = strings.NewReplacer(";", "_", "~", "_", "!", "_", "^", "_", "=", "_", " ", "_", "\n", "_")
+
+// WriteGraphite writes every aggregated sample in the Graphite plaintext
+// protocol, as tagged series named prefix + the sample name. Samples without
+// a pushed timestamp are stamped with now, NaN and infinities are left out.
+func (a *Aggregate) WriteGraphite(w io.Writer, prefix string, now time.Time) error {
+	a.expireFamilies(now)
+	families, _ := a.Gather()
+	return writeGraphite(w, families, prefix, now)
+}
+
+// ServeRenderGraphite renders the aggregate in Graphite plaintext, the
+// families selected by repeated ?name parameters, with an optional ?prefix
+func (a *Aggregate) ServeRenderGraphite(w http.ResponseWriter, r *http.Request) {
+	families, err := a.selectedFamilies(r)
+	if err != nil {
+		http.Error(w, err.Error(), selectionStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := writeGraphite(w, families, r.URL.Query().Get("prefix"), time.Now()); err != nil {
+		log.Printf("An error has occurred while writing the response:\n\n%s\n", err.Error())
+	}
+}
+
+func writeGraphite(w io.Writer, families []*dto.MetricFamily, prefix string, now time.Time) error {
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{Timestamp: model.TimeFromUnixNano(now.UnixNano())}, families...)
+	if err != nil {
+		log.Printf("Could not convert all samples to Graphite: %s\n", err.Error())
+	}
+
+	buf := bufio.NewWriter(w)
+	for _, s := range samples {
+		value := float64(s.Value)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		buf.WriteString(graphitePath(prefix, s.Metric))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(s.Timestamp.Unix(), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+// graphitePath is name;tag=value;... with sorted tags, empty values are
+// dropped as Graphite does not store them
+func graphitePath(prefix string, metric model.Metric) string {
+	names := make([]string, 0, len(metric))
+	for name, value := range metric {
+		if name != model.MetricNameLabel && value != "" {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(graphiteReplacer.Replace(string(metric[model.MetricNameLabel])))
+	for _, name := range names {
+		b.WriteByte(';')
+		b.WriteString(graphiteReplacer.Replace(name))
+		b.WriteByte('=')
+		b.WriteString(graphiteReplacer.Replace(string(metric[model.LabelName(name)])))
+	}
+	return b.String()
+}
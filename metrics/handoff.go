@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// handoffMagic starts the state a gateway hands off to the process
+// replacing it, its last byte is the format version
+const handoffMagic = "PAGHAND\x01"
+
+// handoffShadow names the shadow's state in a handoff, sub-aggregates
+// being named label=value and the main aggregate ""
+const handoffShadow = "shadow"
+
+// Handoff closes the aggregate like Close, first writing its state, and
+// that of its shadow and sub-aggregates, to w for the process replacing
+// this one to RestoreHandoff. The pushes queued for the ingest workers are
+// merged first, and the final snapshot is written before w is done with,
+// for the new process to restore instead should the handed off state be
+// unreadable. The series of each tenant are encrypted with the snapshot
+// keys, if any, like in snapshots. Nothing may push to the aggregate
+// anymore.
+func (a *Aggregate) Handoff(w io.Writer) error {
+	aggregates := a.handoffAggregates()
+	keys := a.opts().persistKeys
+	// the main aggregate first, its workers feed the shadow
+	a.drainForHandoff()
+	for _, agg := range aggregates {
+		agg.drainForHandoff()
+	}
+
+	content := []byte(handoffMagic)
+	for name, agg := range aggregates {
+		snapshot, err := encodeSnapshot(agg, keys)
+		if err != nil {
+			a.Close()
+			return fmt.Errorf("encoding the state of %q: %w", name, err)
+		}
+		content = binary.AppendUvarint(content, uint64(len(name)))
+		content = append(content, name...)
+		content = binary.AppendUvarint(content, uint64(len(snapshot)))
+		content = append(content, snapshot...)
+	}
+	_, err := w.Write(content)
+	a.Close()
+	return err
+}
+
+// RestoreHandoff replaces the aggregate's state, and that of its shadow and
+// sub-aggregates, with what the process it replaces handed off. Families
+// keep their last push, whatever the restore TTL: the handoff only paused
+// pushes. The state of a shadow or sub-aggregate no longer configured is
+// dropped. Encrypted series are decrypted with the snapshot keys.
+func (a *Aggregate) RestoreHandoff(content []byte) error {
+	if !bytes.HasPrefix(content, []byte(handoffMagic)) {
+		return errors.New("not a handoff, or one of an unknown version")
+	}
+	aggregates := a.handoffAggregates()
+	keys := a.opts().persistKeys
+	r := bytes.NewReader(content[len(handoffMagic):])
+	for r.Len() > 0 {
+		name, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		snapshot, err := readSnapshotField(r)
+		if err != nil {
+			return err
+		}
+		families, pushed, err := readSnapshot(snapshot, keys)
+		if err != nil {
+			return fmt.Errorf("reading the state of %q: %w", name, err)
+		}
+		agg, ok := aggregates[string(name)]
+		if !ok {
+			log.Printf("Dropping the %d families handed off for %q, it isn't configured anymore\n", len(families), name)
+			continue
+		}
+		agg.replaceAll(families)
+		for name, pushedAt := range pushed {
+			if family, ok := agg.families.Get(name); ok {
+				family.lock.Lock()
+				family.lastUpdate = pushedAt
+				family.lock.Unlock()
+			}
+		}
+	}
+	return nil
+}
+
+// drainForHandoff merges the pushes queued for the ingest workers
+func (a *Aggregate) drainForHandoff() {
+	if a.ingestQueue != nil {
+		a.ingestQueue.close()
+	}
+}
+
+// handoffAggregates returns the aggregate, its shadow and its
+// sub-aggregates by their name in a handoff
+func (a *Aggregate) handoffAggregates() map[string]*Aggregate {
+	aggregates := map[string]*Aggregate{"": a}
+	if a.shadow != nil {
+		aggregates[handoffShadow] = a.shadow
+	}
+	for _, sub := range a.subAggregates {
+		aggregates[sub.label+"="+sub.value] = sub.agg
+	}
+	return aggregates
+}
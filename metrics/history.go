@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// SetHistory keeps the last size states of the aggregate in memory, one taken
+// every interval, so a scraper that missed a window can still read what it
+// would have seen. 0 disables the history.
+func SetHistory(size int, interval time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.historySize = size
+		a.options.historyInterval = interval
+	}
+}
+
+type history struct {
+	size int
+
+	lock sync.Mutex
+	// byAge holds the snapshots oldest first
+	byAge []*stateSnapshot
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHistory(a *Aggregate, size int, interval time.Duration) *history {
+	h := &history{size: size, stop: make(chan struct{})}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if snapshot, err := a.takeSnapshot(""); err != nil {
+					log.Printf("Could not record the aggregate's history: %s\n", err.Error())
+				} else {
+					h.record(snapshot)
+				}
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+
+	return h
+}
+
+func (h *history) close() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+func (h *history) record(snapshot *stateSnapshot) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.byAge) >= h.size {
+		h.byAge = h.byAge[1:]
+	}
+	h.byAge = append(h.byAge, snapshot)
+}
+
+// at returns the newest snapshot taken at or before ts, nil if there is none
+func (h *history) at(ts time.Time) *stateSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := len(h.byAge) - 1; i >= 0; i-- {
+		if !h.byAge[i].takenAt.After(ts) {
+			return h.byAge[i]
+		}
+	}
+	return nil
+}
+
+func (h *history) timestamps() []time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	out := make([]time.Time, len(h.byAge))
+	for i, snapshot := range h.byAge {
+		out[i] = snapshot.takenAt
+	}
+	return out
+}
+
+// ServeHistory renders the state retained for ?ts (unix seconds or RFC 3339),
+// the newest one taken at or before it, in the format the client negotiates.
+// Without ts it lists in JSON when the retained states were taken.
+func (a *Aggregate) ServeHistory(w http.ResponseWriter, r *http.Request) {
+	if a.history == nil {
+		http.Error(w, "history is disabled, see --historySize", http.StatusNotFound)
+		return
+	}
+
+	param := r.URL.Query().Get("ts")
+	if param == "" {
+		writeJSON(w, http.StatusOK, map[string]any{"snapshots": a.history.timestamps()})
+		return
+	}
+	ts, err := parseTimestamp(param)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot := a.history.at(ts)
+	if snapshot == nil {
+		http.Error(w, fmt.Sprintf("no state retained at %s", ts.UTC().Format(time.RFC3339)), http.StatusNotFound)
+		return
+	}
+
+	families := make([]*compactFamily, 0, len(snapshot.families))
+	for _, family := range snapshot.families {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	contentType := a.negotiateFormat(r.Header)
+	w.Header().Set("Content-Type", string(contentType))
+	w.Header().Set("Last-Modified", snapshot.takenAt.UTC().Format(http.TimeFormat))
+	if encodeFamilies(w, contentType, families, a.opts().encoderOptions(contentType)...) && contentType.FormatType() == expfmt.TypeOpenMetrics {
+		if _, err := expfmt.FinalizeOpenMetrics(w); err != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+		}
+	}
+}
+
+// parseTimestamp accepts the timestamps the Prometheus HTTP API does
+func parseTimestamp(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a unix or RFC 3339 timestamp", s)
+}
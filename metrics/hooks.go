@@ -0,0 +1,11 @@
+package metrics
+
+import "github.com/zapier/prom-aggregation-gateway/hook"
+
+// SetIngestHooks runs hooks, in order, over every pushed series once its
+// labels are formatted, before the schema and rollup rules see it
+func SetIngestHooks(hooks []*hook.Hook) Option {
+	return func(a *Aggregate) {
+		a.options.ingestHooks = hooks
+	}
+}
@@ -0,0 +1,210 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader names a push, its retries carry the same key
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+var ErrPushInProgress = errors.New("a push with the same Idempotency-Key is being merged, retry later")
+
+// Outcomes of claiming the key of a push
+const (
+	keyClaimed = iota
+	keyDuplicate
+	keyInProgress
+)
+
+// SetIdempotencyWindow skips pushes repeating the Idempotency-Key of a push
+// to the same label path merged within window, so client retries of a push
+// that did go through don't count it twice. A retry arriving while the push
+// is still being merged is answered 409, to retry once it is merged or
+// failed. 0 ignores the header.
+func SetIdempotencyWindow(window time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.idempotencyWindow = window
+	}
+}
+
+type idempotencyKeys struct {
+	window time.Duration
+
+	lock      sync.Mutex
+	seen      map[string]*keyedPush
+	lastSweep time.Time
+	// producers counts the keyed pushes and duplicates of each producer
+	// that pushed with a key within the window
+	producers map[producerKey]*duplicateStats
+}
+
+type keyedPush struct {
+	// at is when the push was merged, or claimed while merging
+	at      time.Time
+	merging bool
+}
+
+type duplicateStats struct {
+	Job           string     `json:"job"`
+	Tenant        string     `json:"tenant,omitempty"`
+	Source        string     `json:"source"`
+	KeyedPushes   uint64     `json:"keyed_pushes"`
+	Duplicates    uint64     `json:"duplicates"`
+	LastDuplicate *time.Time `json:"last_duplicate,omitempty"`
+
+	lastPush time.Time
+}
+
+func newIdempotencyKeys(window time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{
+		window:    window,
+		seen:      map[string]*keyedPush{},
+		lastSweep: time.Now(),
+		producers: map[producerKey]*duplicateStats{},
+	}
+}
+
+// claim records the key of a producer's push as merging, unless a push
+// with it was merged within the window, keyDuplicate, or is being merged,
+// keyInProgress
+func (k *idempotencyKeys) claim(key string, producer producerKey, now time.Time) int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	defer func() { IdempotencyKeys.Set(float64(len(k.seen))) }()
+
+	// expired keys, and producers, are dropped at most once a window, not
+	// on every push
+	if now.Sub(k.lastSweep) >= k.window {
+		for seenKey, seen := range k.seen {
+			if !seen.merging && now.Sub(seen.at) >= k.window {
+				delete(k.seen, seenKey)
+			}
+		}
+		for key, stats := range k.producers {
+			if now.Sub(stats.lastPush) >= k.window {
+				delete(k.producers, key)
+			}
+		}
+		k.lastSweep = now
+	}
+
+	stats, ok := k.producers[producer]
+	if !ok {
+		stats = &duplicateStats{Job: producer.job, Tenant: producer.tenant, Source: producer.source}
+		k.producers[producer] = stats
+	}
+	stats.lastPush = now
+	if seen, ok := k.seen[key]; ok {
+		if seen.merging {
+			return keyInProgress
+		}
+		if now.Sub(seen.at) < k.window {
+			stats.KeyedPushes++
+			stats.Duplicates++
+			stats.LastDuplicate = &now
+			return keyDuplicate
+		}
+	}
+	stats.KeyedPushes++
+	k.seen[key] = &keyedPush{at: now, merging: true}
+	return keyClaimed
+}
+
+// merged marks the key of a push merged, its retries within the window from
+// now being duplicates
+func (k *idempotencyKeys) merged(key string, now time.Time) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if seen, ok := k.seen[key]; ok {
+		seen.at, seen.merging = now, false
+	}
+}
+
+// release forgets a key whose push failed, so a retry is merged
+func (k *idempotencyKeys) release(key string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.seen, key)
+	IdempotencyKeys.Set(float64(len(k.seen)))
+}
+
+// duplicates returns the stats of the producers that pushed with a key
+// within about the window, those with the most duplicates first, and how many keys are remembered
+func (k *idempotencyKeys) duplicates() ([]duplicateStats, int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	producers := make([]duplicateStats, 0, len(k.producers))
+	for _, stats := range k.producers {
+		producers = append(producers, *stats)
+	}
+	sort.Slice(producers, func(i, j int) bool {
+		if producers[i].Duplicates != producers[j].Duplicates {
+			return producers[i].Duplicates > producers[j].Duplicates
+		}
+		if producers[i].Job != producers[j].Job {
+			return producers[i].Job < producers[j].Job
+		}
+		if producers[i].Tenant != producers[j].Tenant {
+			return producers[i].Tenant < producers[j].Tenant
+		}
+		return producers[i].Source < producers[j].Source
+	})
+	return producers, len(k.seen)
+}
+
+// claimIdempotencyKey returns the push's key scoped to its tenant and label
+// path, empty when it has none, and the outcome of claiming it
+func (a *Aggregate) claimIdempotencyKey(r *http.Request, producer producerKey) (string, int) {
+	if a.idempotencyKeys == nil {
+		return "", keyClaimed
+	}
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return "", keyClaimed
+	}
+	key = producer.tenant + "\x00" + r.PathValue("labels") + "\x00" + key
+	switch claimed := a.idempotencyKeys.claim(key, producer, time.Now()); claimed {
+	case keyDuplicate:
+		DuplicatePushes.WithLabelValues(producer.job).Inc()
+		if producer.tenant != "" {
+			TenantDuplicatePushes.WithLabelValues(producer.tenant).Inc()
+		}
+		return "", claimed
+	case keyInProgress:
+		return "", claimed
+	}
+	return key, keyClaimed
+}
+
+// settleIdempotencyKey marks the claimed key of a push merged, or releases
+// it for a retry when the push failed, merging nothing
+func (a *Aggregate) settleIdempotencyKey(key string, err error) {
+	if key == "" {
+		return
+	}
+	if err != nil {
+		a.idempotencyKeys.release(key)
+		return
+	}
+	a.idempotencyKeys.merged(key, time.Now())
+}
+
+// ServeDuplicates lists, per producer, how many pushes carried an
+// Idempotency-Key and how many of them repeated a key already merged, most
+// duplicates first, to find the clients retrying pushes that went through
+func (a *Aggregate) ServeDuplicates(w http.ResponseWriter, r *http.Request) {
+	if a.idempotencyKeys == nil {
+		http.Error(w, "idempotency keys are ignored, see --idempotencyWindow", http.StatusNotFound)
+		return
+	}
+	producers, keys := a.idempotencyKeys.duplicates()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"window":    a.idempotencyKeys.window.String(),
+		"keys":      keys,
+		"producers": producers,
+	})
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrIngestQueueFull = errors.New("ingest queue is full, retry later")
+	ErrIngestSaturated = errors.New("too many pushes in flight, retry later")
+	ErrIngestClosed    = errors.New("the gateway is shutting down, retry later")
+)
+
+// retryAfterSeconds is sent with every push rejected because of backpressure
+const retryAfterSeconds = "1"
+
+type ingestJob struct {
+	body         []byte
+	labels       []labelPair
+	shadowLabels []labelPair
+	// shadowed feeds the push to the shadow aggregate too
+	shadowed bool
+	jobName  string
+	producer producerKey
+	// receipt is the scrape receipt of the push, if it asked for one
+	receipt *scrapeReceipt
+	// idempotencyKey is the claimed key of the push, settled once merged
+	idempotencyKey string
+}
+
+// ingestQueue decouples pushes from merging: handlers enqueue the raw body and
+// a fixed pool of workers parses and merges it in the background.
+type ingestQueue struct {
+	jobs chan ingestJob
+	wg   sync.WaitGroup
+	// lock keeps pushes from being sent to jobs once it is closed
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newIngestQueue(a *Aggregate, workers, size int) *ingestQueue {
+	q := &ingestQueue{jobs: make(chan ingestJob, size)}
+
+	q.wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				IngestQueueDepth.Dec()
+				ack := newPushAck(a.opts())
+				ack.producer = job.producer
+				a.trackPushShape(ack)
+				err := a.parseAndMergeAck(context.Background(), bytes.NewReader(job.body), job.labels, ack)
+				a.noteOutcome(job.producer, err)
+				a.noteNewFamilies(job.producer, ack)
+				a.noteMerged(job.receipt, err)
+				a.settleIdempotencyKey(job.idempotencyKey, err)
+				if err != nil {
+					log.Printf("async ingest of push for job %q failed: %v", job.jobName, err)
+					AsyncIngestErrors.WithLabelValues(job.jobName).Inc()
+					continue
+				}
+				MetricPushes.WithLabelValues(job.jobName).Inc()
+				a.notePush(job.jobName, job.producer.tenant)
+				a.noteUsage(job.producer, len(job.body), ack)
+				a.checkPushShape(job.producer, ack)
+				ack.observe(job.jobName, len(job.body))
+				if job.shadowed {
+					a.feedShadow(job.body, job.shadowLabels)
+				}
+			}
+		}()
+	}
+
+	return q
+}
+
+// enqueue hands a push to the workers without ever blocking the caller,
+// refusing it once the queue is closed
+func (q *ingestQueue) enqueue(job ingestJob) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return ErrIngestClosed
+	}
+	select {
+	case q.jobs <- job:
+		IngestQueueDepth.Inc()
+		return nil
+	default:
+		return ErrIngestQueueFull
+	}
+}
+
+// close stops accepting pushes and waits for the queued ones to be merged.
+// It may be called again, a handoff draining the queue before Close.
+func (q *ingestQueue) close() {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.lock.Unlock()
+	q.wg.Wait()
+}
+
+// ingestLimiter bounds how many pushes are parsed and merged at once
+type ingestLimiter chan struct{}
+
+func newIngestLimiter(limit int) ingestLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return make(ingestLimiter, limit)
+}
+
+// tryAcquire takes a slot without waiting, a nil limiter never refuses
+func (l ingestLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		IngestInFlight.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+func (l ingestLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l
+	IngestInFlight.Dec()
+}
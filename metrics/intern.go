@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"strings"
+	"unique"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// intern returns the canonical copy of s, so label names and values shared by
+// many series and pushes (job, env, region, ...) are only held in memory once.
+// Canonical copies are garbage collected once no series references them.
+func intern(s string) string {
+	return unique.Make(s).Value()
+}
+
+func internLabels(labels []*dto.LabelPair) {
+	for _, l := range labels {
+		if l.Name != nil {
+			*l.Name = intern(*l.Name)
+		}
+		if l.Value != nil {
+			*l.Value = intern(*l.Value)
+		}
+	}
+}
+
+// labelSet is a series' sorted label pairs interned in a process-wide symbol
+// table: series with the same labels (across families and pushes) share one
+// copy, compare by pointer, and the copy is garbage collected once no series
+// references it anymore. The names and values in it are interned too, so
+// label sets sharing some of them (job, instance, le, ...) hold them once.
+type labelSet struct {
+	handle unique.Handle[labelChunk]
+}
+
+// labelChunkPairs is how many label pairs a chunk of a label set holds
+const labelChunkPairs = 4
+
+// labelChunk holds the first label pairs of a set, next holding the chunk
+// of those following them once they fill it
+type labelChunk struct {
+	pairs [labelChunkPairs]internedPair
+	n     uint8
+	next  unique.Handle[labelChunk]
+}
+
+type internedPair struct {
+	name, value unique.Handle[string]
+}
+
+const (
+	labelSep = '\x00'
+	labelEsc = '\x01'
+)
+
+func makeLabelSet(labels []*dto.LabelPair) labelSet {
+	return labelSet{makeLabelChunk(labels)}
+}
+
+func makeLabelChunk(labels []*dto.LabelPair) unique.Handle[labelChunk] {
+	var chunk labelChunk
+	for i, l := range labels {
+		if i == labelChunkPairs {
+			chunk.next = makeLabelChunk(labels[i:])
+			break
+		}
+		chunk.pairs[i] = internedPair{unique.Make(l.GetName()), unique.Make(l.GetValue())}
+		chunk.n++
+	}
+	return unique.Make(chunk)
+}
+
+// each calls visit with the label pairs of the set, in order
+func (ls labelSet) each(visit func(name, value string)) {
+	for handle := ls.handle; ; {
+		chunk := handle.Value()
+		for _, p := range chunk.pairs[:chunk.n] {
+			visit(p.name.Value(), p.value.Value())
+		}
+		if chunk.next == (unique.Handle[labelChunk]{}) {
+			return
+		}
+		handle = chunk.next
+	}
+}
+
+// key returns the label pairs of the set as every name and value followed
+// by labelSep, with labelSep and labelEsc escaped inside them, which keeps
+// keys in the same order as labelsLessThan
+func (ls labelSet) key() string {
+	var b strings.Builder
+	ls.each(func(name, value string) {
+		writeLabelPart(&b, name)
+		writeLabelPart(&b, value)
+	})
+	return b.String()
+}
+
+// keyLen is the length of key, without building it
+func (ls labelSet) keyLen() int {
+	n := 0
+	ls.each(func(name, value string) {
+		n += len(name) + len(value) + 2
+		n += strings.Count(name, string(labelSep)) + strings.Count(name, string(labelEsc))
+		n += strings.Count(value, string(labelSep)) + strings.Count(value, string(labelEsc))
+	})
+	return n
+}
+
+func writeLabelPart(b *strings.Builder, s string) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case labelSep:
+			b.WriteString("\x01\x01")
+		case labelEsc:
+			b.WriteString("\x01\x02")
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	b.WriteByte(labelSep)
+}
+
+// less orders label sets as labelsLessThan: pair by pair, name then value,
+// a set being less than those it is the start of
+func (ls labelSet) less(other labelSet) bool {
+	a, b := ls.handle, other.handle
+	for a != b {
+		ca, cb := a.Value(), b.Value()
+		for i := 0; i < int(ca.n) && i < int(cb.n); i++ {
+			pa, pb := ca.pairs[i], cb.pairs[i]
+			if pa.name != pb.name {
+				return pa.name.Value() < pb.name.Value()
+			}
+			if pa.value != pb.value {
+				return pa.value.Value() < pb.value.Value()
+			}
+		}
+		if ca.n != cb.n {
+			return ca.n < cb.n
+		}
+		none := unique.Handle[labelChunk]{}
+		if ca.next == none || cb.next == none {
+			return ca.next == none && cb.next != none
+		}
+		a, b = ca.next, cb.next
+	}
+	return false
+}
+
+// pairs decodes the label set for rendering. Names and values point to their
+// interned copies instead of being copied.
+func (ls labelSet) pairs() []*dto.LabelPair {
+	parts := make([]string, 0, 2*labelChunkPairs)
+	ls.each(func(name, value string) {
+		parts = append(parts, name, value)
+	})
+	n := len(parts) / 2
+	if n == 0 {
+		return nil
+	}
+
+	pairs := make([]dto.LabelPair, n)
+	labels := make([]*dto.LabelPair, n)
+	for i := range pairs {
+		pairs[i] = dto.LabelPair{Name: &parts[2*i], Value: &parts[2*i+1]}
+		labels[i] = &pairs[i]
+	}
+	return labels
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inventoryWebhookQueue is how many notifications may wait for the
+// webhook, more are dropped rather than slowing pushes down
+const inventoryWebhookQueue = 64
+
+// SetFamilyInventory records when each family was first merged and by which
+// producer, its job, tenant and host, so unexpected additions to the metric
+// surface are visible on /api/v1/admin/inventory. With webhookURL, each push
+// creating families also posts them there as JSON. Families stay in the
+// inventory once expired, a family seen again isn't new.
+func SetFamilyInventory(enabled bool, webhookURL string) Option {
+	return func(a *Aggregate) {
+		a.options.inventory = enabled
+		a.options.inventoryWebhook = webhookURL
+	}
+}
+
+type inventoryEntry struct {
+	Family    string    `json:"family"`
+	FirstSeen time.Time `json:"first_seen"`
+	Job       string    `json:"job"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Source    string    `json:"source"`
+}
+
+type newFamiliesMessage struct {
+	Families []inventoryEntry `json:"families"`
+}
+
+type inventory struct {
+	lock     sync.Mutex
+	families map[string]*inventoryEntry
+
+	webhook *webhook
+}
+
+func newInventory(webhookURL string) *inventory {
+	return &inventory{families: map[string]*inventoryEntry{}, webhook: newWebhook(webhookURL, "new families", inventoryWebhookQueue, InventoryNotifications)}
+}
+
+// record adds the families a producer created, those already in the
+// inventory aside
+func (inv *inventory) record(key producerKey, names []string, now time.Time) {
+	var added []inventoryEntry
+	inv.lock.Lock()
+	for _, name := range names {
+		if _, ok := inv.families[name]; ok {
+			continue
+		}
+		entry := &inventoryEntry{Family: name, FirstSeen: now, Job: key.job, Tenant: key.tenant, Source: key.source}
+		inv.families[name] = entry
+		added = append(added, *entry)
+	}
+	inv.lock.Unlock()
+
+	if len(added) == 0 {
+		return
+	}
+	NewFamilies.WithLabelValues(key.job).Add(float64(len(added)))
+	sort.Slice(added, func(i, j int) bool { return added[i].Family < added[j].Family })
+	inv.webhook.send(newFamiliesMessage{Families: added})
+}
+
+// list returns the families first seen since since, newest first, those
+// of job only when it isn't empty
+func (inv *inventory) list(job string, since time.Time) []inventoryEntry {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	entries := []inventoryEntry{}
+	for _, entry := range inv.families {
+		if (job != "" && entry.Job != job) || entry.FirstSeen.Before(since) {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].FirstSeen.Equal(entries[j].FirstSeen) {
+			return entries[i].FirstSeen.After(entries[j].FirstSeen)
+		}
+		return entries[i].Family < entries[j].Family
+	})
+	return entries
+}
+
+// close sends the notifications still waiting
+func (inv *inventory) close() {
+	inv.webhook.close()
+}
+
+// noteNewFamilies records the families a producer's push created
+func (a *Aggregate) noteNewFamilies(key producerKey, ack *pushAck) {
+	if a.inventory != nil && len(ack.created) > 0 {
+		a.inventory.record(key, ack.created, time.Now())
+	}
+}
+
+// ServeInventory lists when each family was first seen and by whom, newest
+// first, ?job only listing those of a job and ?since, a duration, those
+// first seen within it
+func (a *Aggregate) ServeInventory(w http.ResponseWriter, r *http.Request) {
+	if a.inventory == nil {
+		http.Error(w, "the family inventory is disabled, see --familyInventory", http.StatusNotFound)
+		return
+	}
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			http.Error(w, "since must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-window)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"families": a.inventory.list(r.URL.Query().Get("job"), since)})
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help,omitempty"`
+	Type    string       `json:"type"`
+	Unit    string       `json:"unit,omitempty"`
+	Metrics []jsonSeries `json:"metrics"`
+}
+
+// jsonSeries carries values as strings, as the Prometheus HTTP API does, so
+// NaN and infinities survive
+type jsonSeries struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value,omitempty"`
+	Count     string            `json:"count,omitempty"`
+	Sum       string            `json:"sum,omitempty"`
+	Buckets   map[string]string `json:"buckets,omitempty"`
+	Quantiles map[string]string `json:"quantiles,omitempty"`
+}
+
+// ServeRenderJSON renders the aggregate as JSON, in a shape close to the
+// Prometheus HTTP API, for consumers that do not speak the exposition
+// formats. Repeated ?name parameters restrict it to those families.
+func (a *Aggregate) ServeRenderJSON(w http.ResponseWriter, r *http.Request) {
+	families, err := a.selectedFamilies(r)
+	if err != nil {
+		errorType := "bad_data"
+		if selectionStatus(err) == http.StatusInternalServerError {
+			errorType = "internal"
+		}
+		writeJSON(w, selectionStatus(err), map[string]string{
+			"status":    "error",
+			"errorType": errorType,
+			"error":     err.Error(),
+		})
+		return
+	}
+	data := make([]jsonFamily, 0, len(families))
+	for _, family := range families {
+		data = append(data, familyToJSON(family))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+// selectedFamilies returns the families named by the ?name parameters, or
+// every family, sorted by name, only the series of the render's tenant
+// when it has one. Expired families are dropped first, as for /metrics.
+func (a *Aggregate) selectedFamilies(r *http.Request) ([]*dto.MetricFamily, error) {
+	a.expireFamilies(time.Now())
+	tenant, err := a.renderTenant(r)
+	if err != nil {
+		return nil, err
+	}
+	names := r.URL.Query()["name"]
+	if len(names) == 0 {
+		return a.gatherTenant(tenant)
+	}
+
+	sort.Strings(names)
+	opts := a.opts()
+	families := make([]*dto.MetricFamily, 0, len(names))
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		mf, ok := a.families.Get(name)
+		if !ok {
+			continue
+		}
+		current, err := mf.load()
+		if err != nil {
+			return nil, err
+		}
+		family := opts.overrideMetadata(opts.collapseIgnored(current))
+		if tenant != "" {
+			if family = tenantFamily(family, opts.tenantLabel, tenant); family == nil {
+				continue
+			}
+		}
+		families = append(families, family.toDTO())
+	}
+	return families, nil
+}
+
+// selectionStatus is the status of a request selectedFamilies failed
+func selectionStatus(err error) int {
+	if errors.Is(err, ErrSpillRead) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+func familyToJSON(family *dto.MetricFamily) jsonFamily {
+	out := jsonFamily{
+		Name:    family.GetName(),
+		Help:    family.GetHelp(),
+		Type:    strings.ToLower(family.GetType().String()),
+		Unit:    family.GetUnit(),
+		Metrics: make([]jsonSeries, 0, len(family.Metric)),
+	}
+	for _, m := range family.Metric {
+		series := jsonSeries{Labels: make(map[string]string, len(m.Label))}
+		for _, l := range m.Label {
+			series.Labels[l.GetName()] = l.GetValue()
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			series.Value = formatFloat(m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			series.Value = formatFloat(m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			series.Value = formatFloat(m.GetUntyped().GetValue())
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			h := m.GetHistogram()
+			series.Count = formatFloat(float64(h.GetSampleCount()))
+			series.Sum = formatFloat(h.GetSampleSum())
+			series.Buckets = make(map[string]string, len(h.Bucket))
+			for _, b := range h.Bucket {
+				series.Buckets[formatFloat(b.GetUpperBound())] = formatFloat(float64(b.GetCumulativeCount()))
+			}
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			series.Count = formatFloat(float64(s.GetSampleCount()))
+			series.Sum = formatFloat(s.GetSampleSum())
+			series.Quantiles = make(map[string]string, len(s.Quantile))
+			for _, q := range s.Quantile {
+				series.Quantiles[formatFloat(q.GetQuantile())] = formatFloat(q.GetValue())
+			}
+		}
+		out.Metrics = append(out.Metrics, series)
+	}
+	return out
+}
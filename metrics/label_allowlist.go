@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrLabelNotAllowed = errors.New("grouping label not allowed")
+
+// SetLabelAllowlists restricts the grouping labels the label path of a push
+// may set to the allowlist of its verified auth user, e.g. job and pipeline
+// for the user of CI tokens, to keep the label space governed. Pushes of
+// users without an allowlist may set any label, those not verified as any
+// user none.
+func SetLabelAllowlists(allowlists map[string][]string) Option {
+	return func(a *Aggregate) {
+		a.options.labelAllowlists = allowlists
+	}
+}
+
+type labelAllowlistsFile struct {
+	LabelAllowlists map[string][]string `yaml:"label_allowlists"`
+}
+
+// LoadLabelAllowlists reads the label_allowlists of a YAML file, the
+// grouping labels each auth user may set
+func LoadLabelAllowlists(path string) (map[string][]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := labelAllowlistsFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing label allowlists %s: %w", path, err)
+	}
+	for user, labels := range file.LabelAllowlists {
+		for _, label := range labels {
+			if labelNameSafe(label) != label {
+				return nil, fmt.Errorf("invalid label allowlist of user %q in %s: invalid label name %q", user, path, label)
+			}
+		}
+	}
+	return file.LabelAllowlists, nil
+}
+
+// checkLabelAllowlist rejects a label path setting grouping labels the
+// allowlist of the push's user lacks. The user is the one the auth
+// middleware verified, never the unchecked basic auth header, so a push
+// without verified credentials may set no grouping label at all.
+func (a *Aggregate) checkLabelAllowlist(r *http.Request, labels []labelPair) error {
+	allowlists := a.opts().labelAllowlists
+	if len(allowlists) == 0 || len(labels) == 0 {
+		return nil
+	}
+	user := AuthUser(r)
+	if user == "" {
+		return fmt.Errorf("%w: label allowlists are enforced, pushes must authenticate to set grouping labels", ErrLabelNotAllowed)
+	}
+	allowed, ok := allowlists[user]
+	if !ok {
+		return nil
+	}
+
+	var denied []string
+	for _, l := range labels {
+		if !slices.Contains(allowed, l.name) && !slices.Contains(denied, l.name) {
+			denied = append(denied, l.name)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: user %q may only set %s, not %s", ErrLabelNotAllowed, user, strings.Join(allowed, ", "), strings.Join(denied, ", "))
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrTooManyLabelValues = errors.New("too many distinct values for a grouping label")
+
+// SetMaxLabelValues rejects pushes whose label path gives one of the labels
+// of limits a new value once it already has that many distinct values, to
+// stop misconfigured clients putting e.g. a UUID into job. Values are
+// forgotten once they haven't been pushed for the metric TTL, if any.
+func SetMaxLabelValues(limits map[string]int) Option {
+	return func(a *Aggregate) {
+		a.options.maxLabelValues = limits
+	}
+}
+
+type labelValues struct {
+	limits map[string]int
+
+	lock sync.Mutex
+	// seen holds when each value of the limited labels was last pushed
+	seen map[string]map[string]time.Time
+}
+
+func newLabelValues(limits map[string]int) *labelValues {
+	v := &labelValues{limits: limits, seen: make(map[string]map[string]time.Time, len(limits))}
+	for name := range limits {
+		v.seen[name] = map[string]time.Time{}
+	}
+	return v
+}
+
+// admit records the limited values of a label path, or rejects it without
+// recording any when one of them is new and its label is at its limit.
+// Values not pushed within ttl, when positive, are forgotten.
+func (v *labelValues) admit(labels []labelPair, now time.Time, ttl time.Duration) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, l := range labels {
+		limit, ok := v.limits[l.name]
+		if !ok {
+			continue
+		}
+		values := v.seen[l.name]
+		if _, known := values[l.value]; known || len(values) < limit {
+			continue
+		}
+		if ttl > 0 {
+			for value, seenAt := range values {
+				if now.Sub(seenAt) > ttl {
+					delete(values, value)
+				}
+			}
+		}
+		if len(values) >= limit {
+			return fmt.Errorf("%w: %s already has %d values, the limit", ErrTooManyLabelValues, l.name, len(values))
+		}
+	}
+
+	for _, l := range labels {
+		if values, ok := v.seen[l.name]; ok {
+			values[l.value] = now
+		}
+	}
+	return nil
+}
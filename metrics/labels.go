@@ -2,7 +2,9 @@ package metrics
 
 import (
 	"fmt"
+	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
 	dto "github.com/prometheus/client_model/go"
@@ -12,37 +14,116 @@ func strPtr(s string) *string {
 	return &s
 }
 
+// exportedLabelPrefix renames series labels overridden by path labels, as
+// Prometheus does for target labels scraped with honor_labels: false
+const exportedLabelPrefix = "exported_"
+
+// SetHonorLabels sets what happens to series labels that a push's path sets
+// too, unless the push says otherwise with ?honor_labels: true keeps the
+// series' label, false overrides it (keeping it as exported_<name>), nil
+// rejects the push.
+func SetHonorLabels(honor *bool) Option {
+	return func(a *Aggregate) {
+		a.options.honorLabels = honor
+	}
+}
+
+// pushHonorLabels returns the push's ?honor_labels, or the configured default
+func (a *Aggregate) pushHonorLabels(r *http.Request) (*bool, error) {
+	value := r.URL.Query().Get("honor_labels")
+	if value == "" {
+		return a.opts().honorLabels, nil
+	}
+	honor, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid honor_labels %q: %w", value, err)
+	}
+	return &honor, nil
+}
+
+// withHonorLabels marks how the path labels treat series labels of the same name
+func withHonorLabels(labels []labelPair, honor *bool) []labelPair {
+	if honor == nil {
+		return labels
+	}
+	for i := range labels {
+		labels[i].ifAbsent = *honor
+		labels[i].override = !*honor
+	}
+	return labels
+}
+
 func addLabels(m *dto.Metric, labels []labelPair) error {
-	set := make(map[string]struct{}, len(m.Label))
-	for _, l := range m.Label {
-		set[l.GetName()] = struct{}{}
+	if len(labels) == 0 {
+		return nil
 	}
-	for _, label := range labels {
-		if _, duplicate := set[label.name]; duplicate {
-			return fmt.Errorf("duplicate label %s", label.name)
+
+	// Path labels are few, so a linear scan is cheaper than building a set per metric
+	existing := len(m.Label)
+	pairs := make([]dto.LabelPair, len(labels))
+	for i, label := range labels {
+		var present *dto.LabelPair
+		for _, l := range m.Label[:existing] {
+			if l.GetName() == label.name {
+				present = l
+				break
+			}
+		}
+		if present != nil {
+			switch {
+			case label.ifAbsent:
+				continue
+			case label.override:
+				present.Name = strPtr(exportedName(m.Label, label.name))
+			default:
+				return fmt.Errorf("duplicate label %s", label.name)
+			}
 		}
-		pair := dto.LabelPair{Name: strPtr(label.name), Value: strPtr(label.value)}
-		m.Label = append(m.Label, &pair)
+
+		pairs[i] = dto.LabelPair{Name: strPtr(label.name), Value: strPtr(label.value)}
+		m.Label = append(m.Label, &pairs[i])
 	}
 
 	return nil
 }
 
-func (a *Aggregate) formatLabels(m *dto.Metric, labels []labelPair) error {
+// exportedName prefixes name until it doesn't clash with any label
+func exportedName(labels []*dto.LabelPair, name string) string {
+	for {
+		name = exportedLabelPrefix + name
+		clash := false
+		for _, l := range labels {
+			if l.GetName() == name {
+				clash = true
+				break
+			}
+		}
+		if !clash {
+			return name
+		}
+	}
+}
+
+func (ao *aggregateOptions) formatLabels(m *dto.Metric, labels []labelPair) error {
 	if err := addLabels(m, labels); err != nil {
 		return err
 	}
-	sort.Sort(byName(m.Label))
+	if !labelsSorted(m.Label) {
+		sort.Sort(byName(m.Label))
+	}
 
-	if len(a.options.ignoredLabels) > 0 {
-		var newLabelList []*dto.LabelPair
+	if ao.dropsIgnoredLabels() {
+		// Filter in place, the parsed metric is owned by this push
+		newLabelList := m.Label[:0]
 		for _, l := range m.Label {
-			if !a.options.ignoredLabels.labelInIgnoredList(l) {
+			if !ao.ignoredLabels.labelInIgnoredList(l) {
 				newLabelList = append(newLabelList, l)
 			}
 		}
 		m.Label = newLabelList
 	}
+
+	internLabels(m.Label)
 	return nil
 }
 
@@ -2,14 +2,16 @@ package metrics
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"unsafe"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
 var TestLabels = []labelPair{
-	{"job", "test"},
+	{name: "job", value: "test"},
 }
 
 func TestFormatLabels(t *testing.T) {
@@ -24,7 +26,7 @@ func TestFormatLabels(t *testing.T) {
 			{},
 		},
 	}
-	err := a.formatLabels(m, []labelPair{{"job", "test"}, {"thing3", "value3"}})
+	err := a.opts().formatLabels(m, []labelPair{{name: "job", value: "test"}, {name: "thing3", value: "value3"}})
 
 	assert.Equal(t, err, nil)
 	assert.Equal(t, &dto.LabelPair{Name: strPtr("job"), Value: strPtr("test")}, m.Label[0])
@@ -33,7 +35,7 @@ func TestFormatLabels(t *testing.T) {
 	assert.Equal(t, &dto.LabelPair{Name: strPtr("thing3"), Value: strPtr("value3")}, m.Label[3])
 	assert.Len(t, m.Label, 4)
 
-	err = a.formatLabels(m, []labelPair{{"job", "test"}, {"thing3", "value3"}})
+	err = a.opts().formatLabels(m, []labelPair{{name: "job", value: "test"}, {name: "thing3", value: "value3"}})
 
 	if assert.Error(t, err) {
 		assert.Equal(t, err, fmt.Errorf("duplicate label job"))
@@ -95,8 +97,110 @@ func BenchmarkFormatLabels(b *testing.B) {
 		a := NewAggregate(AddIgnoredLabels(v.ignoredLabels...))
 		b.Run(fmt.Sprintf("metric_type_%s", v.inputName), func(b *testing.B) {
 			for n := 0; n < b.N; n++ {
-				a.formatLabels(v.m, TestLabels)
+				a.opts().formatLabels(v.m, TestLabels)
 			}
 		})
 	}
 }
+
+func TestFormatLabelsInterns(t *testing.T) {
+	a := NewAggregate()
+
+	value1 := strings.Repeat("x", 16)
+	value2 := strings.Repeat("x", 16)
+	m1 := &dto.Metric{Label: []*dto.LabelPair{{Name: strPtr("env"), Value: &value1}}}
+	m2 := &dto.Metric{Label: []*dto.LabelPair{{Name: strPtr("env"), Value: &value2}}}
+
+	assert.NoError(t, a.opts().formatLabels(m1, nil))
+	assert.NoError(t, a.opts().formatLabels(m2, nil))
+	assert.Equal(t, unsafe.StringData(m1.Label[0].GetValue()), unsafe.StringData(m2.Label[0].GetValue()))
+}
+
+func TestLabelSetInterned(t *testing.T) {
+	value1 := strings.Repeat("x", 16)
+	value2 := strings.Clone(value1)
+	ls1 := makeLabelSet([]*dto.LabelPair{{Name: strPtr("env"), Value: &value1}})
+	ls2 := makeLabelSet([]*dto.LabelPair{{Name: strPtr("env"), Value: &value2}})
+
+	assert.Equal(t, ls1, ls2)
+	assert.Equal(t, unsafe.StringData(ls1.pairs()[0].GetValue()), unsafe.StringData(ls2.pairs()[0].GetValue()))
+
+	// other label sets share the names and values they have in common
+	value3 := strings.Clone(value1)
+	ls3 := makeLabelSet([]*dto.LabelPair{{Name: strPtr("env"), Value: &value3}, {Name: strPtr("job"), Value: strPtr("test")}})
+	assert.NotEqual(t, ls1, ls3)
+	assert.Equal(t, unsafe.StringData(ls1.pairs()[0].GetName()), unsafe.StringData(ls3.pairs()[0].GetName()))
+	assert.Equal(t, unsafe.StringData(ls1.pairs()[0].GetValue()), unsafe.StringData(ls3.pairs()[0].GetValue()))
+}
+
+func TestLabelSetRoundTrip(t *testing.T) {
+	pairs := func(kv ...string) []*dto.LabelPair {
+		labels := make([]*dto.LabelPair, 0, len(kv)/2)
+		for i := 0; i < len(kv); i += 2 {
+			labels = append(labels, &dto.LabelPair{Name: strPtr(kv[i]), Value: strPtr(kv[i+1])})
+		}
+		return labels
+	}
+
+	sets := [][]*dto.LabelPair{
+		pairs(),
+		pairs("a", ""),
+		pairs("a", "\x00"),
+		pairs("a", "\x00\x01"),
+		pairs("a", "\x01"),
+		pairs("a", "1"),
+		pairs("a", "1", "b", "2"),
+		pairs("a", "1", "b", "2", "c", "3", "d", "4"),
+		pairs("a", "1", "b", "2", "c", "3", "d", "4", "e", "5"),
+		pairs("a", "1", "b", "2", "c", "3", "d", "4", "e", "5", "f", "6"),
+		pairs("a", "1", "b", "2", "c", "3", "d", "4", "e", "6"),
+		pairs("a", "2"),
+		pairs("ab", "1"),
+	}
+	for i, labels := range sets {
+		ls := makeLabelSet(labels)
+		assert.Equal(t, labels, append([]*dto.LabelPair{}, ls.pairs()...))
+		assert.Len(t, ls.key(), ls.keyLen())
+
+		// label set order must match labelsLessThan, the order series are merged in
+		for _, other := range sets {
+			assert.Equal(t, labelsLessThan(labels, other), ls.less(makeLabelSet(other)), "%v < %v", sets[i], other)
+		}
+	}
+}
+
+func TestLabelsSorted(t *testing.T) {
+	pairs := func(names ...string) []*dto.LabelPair {
+		labels := make([]*dto.LabelPair, len(names))
+		for i, n := range names {
+			labels[i] = &dto.LabelPair{Name: strPtr(n), Value: strPtr("v")}
+		}
+		return labels
+	}
+
+	for _, c := range []struct {
+		name   string
+		labels []*dto.LabelPair
+		sorted bool
+	}{
+		{"empty", pairs(), true},
+		{"single", pairs("a"), true},
+		{"sorted", pairs("a", "b", "c"), true},
+		{"unsorted", pairs("b", "a", "c"), false},
+		{"unsorted_tail", pairs("a", "c", "b"), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.sorted, labelsSorted(c.labels))
+		})
+	}
+
+	series := func(values ...string) []*dto.Metric {
+		metrics := make([]*dto.Metric, len(values))
+		for i, v := range values {
+			metrics[i] = &dto.Metric{Label: []*dto.LabelPair{{Name: strPtr("l"), Value: strPtr(v)}}}
+		}
+		return metrics
+	}
+	assert.True(t, metricsSorted(series("a", "b", "c")))
+	assert.False(t, metricsSorted(series("a", "c", "b")))
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMaintenance = errors.New("the gateway is in maintenance, retry later")
+
+// defaultMaintenanceRetryAfter is sent when maintenance is entered without
+// a retry_after
+const defaultMaintenanceRetryAfter = 30 * time.Second
+
+type maintenance struct {
+	enabled atomic.Bool
+	// retryAfter is sent as the Retry-After, in seconds
+	retryAfter atomic.Int64
+}
+
+// rejectMaintenance answers a push with 503 while in maintenance, and
+// reports whether it did
+func (a *Aggregate) rejectMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	if !a.maintenance.enabled.Load() {
+		return false
+	}
+	IngestRejected.WithLabelValues("maintenance").Inc()
+	w.Header().Set("Retry-After", strconv.FormatInt(a.maintenance.retryAfter.Load(), 10))
+	a.pushError(w, r, http.StatusServiceUnavailable, ErrMaintenance)
+	return true
+}
+
+// ServeMaintenance reports in JSON whether the gateway is in maintenance. A
+// POST with ?enabled=true (and an optional ?retry_after in seconds) starts
+// rejecting pushes with 503, scrapes are still served, and ?enabled=false
+// stops.
+func (a *Aggregate) ServeMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		retryAfter := defaultMaintenanceRetryAfter
+		if s := r.URL.Query().Get("retry_after"); s != "" {
+			seconds, err := strconv.Atoi(s)
+			if err != nil || seconds < 0 {
+				http.Error(w, "retry_after must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		a.maintenance.retryAfter.Store(int64(retryAfter.Seconds()))
+		a.maintenance.enabled.Store(enabled)
+		if enabled {
+			Maintenance.Set(1)
+		} else {
+			Maintenance.Set(0)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": a.maintenance.enabled.Load()})
+}
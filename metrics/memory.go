@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// Rough per-object costs of the compact state, including pointers and
+// headers. They don't need to be exact, only proportional to what the family
+// holds. Label sets are shared between series, but counted for each of them.
+const (
+	familyOverheadBytes   = 96
+	seriesOverheadBytes   = 48
+	extraOverheadBytes    = 64
+	labelSetOverheadBytes = 16
+	bucketOverheadBytes   = 24
+)
+
+// evictionTargetRatio is how far under the budget eviction goes, so that we
+// don't evict again on the very next push
+const evictionTargetRatio = 0.9
+
+// SetMemoryBudget evicts the least recently pushed families whenever the
+// approximate memory held by the aggregate goes over budgetBytes
+func SetMemoryBudget(budgetBytes int64) Option {
+	return func(a *Aggregate) {
+		a.options.memoryBudget = budgetBytes
+	}
+}
+
+func estimateFamilyBytes(family *compactFamily) int64 {
+	size := int64(familyOverheadBytes + len(family.name))
+	for i := range family.series {
+		s := &family.series[i]
+		size += int64(seriesOverheadBytes + labelSetOverheadBytes + s.labels.keyLen())
+		if s.extra != nil {
+			size += int64(extraOverheadBytes + (len(s.extra.buckets)+len(s.extra.quantiles))*bucketOverheadBytes)
+			if native := s.extra.native; native != nil {
+				size += int64(extraOverheadBytes + (len(native.positive)+len(native.negative))*bucketOverheadBytes)
+			}
+		}
+	}
+	return size
+}
+
+func (a *Aggregate) addMemoryBytes(delta int64) {
+	a.familyMetrics.memoryBytes.Set(float64(a.memoryBytes.Add(delta)))
+}
+
+// enforceMemoryBudget evicts least recently pushed families until the
+// aggregate is comfortably back under its memory budget
+func (a *Aggregate) enforceMemoryBudget() {
+	budget := a.opts().memoryBudget
+	if budget <= 0 || a.memoryBytes.Load() <= budget {
+		return
+	}
+
+	type candidate struct {
+		name       string
+		lastUpdate time.Time
+	}
+	families := a.snapshot()
+	candidates := make([]candidate, 0, len(families))
+	for _, f := range families {
+		f.family.lock.RLock()
+		candidates = append(candidates, candidate{f.name, f.family.lastUpdate})
+		f.family.lock.RUnlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUpdate.Before(candidates[j].lastUpdate) })
+
+	target := int64(float64(budget) * evictionTargetRatio)
+	for _, c := range candidates {
+		if a.memoryBytes.Load() <= target {
+			break
+		}
+		if a.removeFamily(c.name) {
+			EvictedFamilies.Inc()
+		}
+	}
+}
+
+// removeFamily drops a family by name, reporting whether it was present
+func (a *Aggregate) removeFamily(name string) bool {
+	family, ok := a.families.Delete(name, nil)
+	if ok {
+		a.familyDeleted(name, family)
+	}
+	return ok
+}
+
+// familyDeleted accounts for a family deleted from the storage
+func (a *Aggregate) familyDeleted(name string, family *Family) {
+	a.familyMetrics.byFamily.DeleteLabelValues(name)
+	if family.restored.Load() {
+		a.familyMetrics.restoredAge.DeleteLabelValues(name)
+	}
+	a.familyMetrics.total.Dec()
+	a.familyMetrics.byType.WithLabelValues(family.head().ty.String()).Dec()
+
+	family.lock.RLock()
+	a.addMemoryBytes(-family.sizeBytes)
+	family.lock.RUnlock()
+
+	a.generation.Add(1)
+}
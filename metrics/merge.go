@@ -2,6 +2,8 @@ package metrics
 
 import (
 	"fmt"
+	"slices"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
@@ -35,6 +37,27 @@ func (a byName) Len() int           { return len(a) }
 func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byName) Less(i, j int) bool { return a[i].GetName() < a[j].GetName() }
 
+// Well-behaved clients already emit labels and series in order, these checks
+// let ingest skip sort.Sort (and its interface boxing) for them.
+
+func labelsSorted(labels []*dto.LabelPair) bool {
+	for i := 1; i < len(labels); i++ {
+		if labels[i].GetName() < labels[i-1].GetName() {
+			return false
+		}
+	}
+	return true
+}
+
+func metricsSorted(metrics []*dto.Metric) bool {
+	for i := 1; i < len(metrics); i++ {
+		if labelsLessThan(metrics[i].Label, metrics[i-1].Label) {
+			return false
+		}
+	}
+	return true
+}
+
 func uint64ptr(a uint64) *uint64 {
 	return &a
 }
@@ -43,132 +66,220 @@ func float64ptr(a float64) *float64 {
 	return &a
 }
 
-func mergeBuckets(a, b []*dto.Bucket) []*dto.Bucket {
-	output := []*dto.Bucket{}
+func mergeBuckets(a, b []compactBucket) []compactBucket {
+	output := make([]compactBucket, 0, max(len(a), len(b)))
 	i, j := 0, 0
 	for i < len(a) && j < len(b) {
-		if *a[i].UpperBound < *b[j].UpperBound {
+		if a[i].upperBound < b[j].upperBound {
 			output = append(output, a[i])
 			i++
-		} else if *a[i].UpperBound > *b[j].UpperBound {
+		} else if a[i].upperBound > b[j].upperBound {
 			output = append(output, b[j])
 			j++
 		} else {
-			output = append(output, &dto.Bucket{
-				CumulativeCount: uint64ptr(*a[i].CumulativeCount + *b[j].CumulativeCount),
-				UpperBound:      a[i].UpperBound,
+			output = append(output, compactBucket{
+				upperBound: a[i].upperBound,
+				count:      a[i].count + b[j].count,
+				exemplar:   latestExemplar(a[i].exemplar, b[j].exemplar),
 			})
 			i++
 			j++
 		}
 	}
-	for ; i < len(a); i++ {
-		output = append(output, a[i])
-	}
-	for ; j < len(b); j++ {
-		output = append(output, b[j])
-	}
+	output = append(output, a[i:]...)
+	output = append(output, b[j:]...)
 	return output
 }
 
-func mergeMetric(ty dto.MetricType, a, b *dto.Metric) *dto.Metric {
+// mergeSeries merges b into a with strategy, nil merging with the built-in
+// sum. timestamps keeps the latest timestamp of the two.
+func mergeSeries(ty dto.MetricType, a, b *compactSeries, strategy MergeStrategy, timestamps bool) (compactSeries, bool) {
+	if strategy != nil {
+		if ty == dto.MetricType_GAUGE_HISTOGRAM {
+			return compactSeries{}, false
+		}
+		merged := mergeWithStrategy(ty, a, b, strategy)
+		if ty == dto.MetricType_GAUGE {
+			merged = withSpread(merged, a, b)
+		}
+		return withLatestTimestamp(merged, a, b, timestamps), true
+	}
+
+	merged := compactSeries{labels: a.labels, value: a.value + b.value}
+
 	switch ty {
 	case dto.MetricType_COUNTER:
-		return &dto.Metric{
-			Label: a.Label,
-			Counter: &dto.Counter{
-				Value: float64ptr(*a.Counter.Value + *b.Counter.Value),
-			},
+		merged.created = a.created
+		if exemplar := latestExemplar(a.exemplar(), b.exemplar()); exemplar != nil {
+			merged.extra = &seriesExtra{exemplar: exemplar}
 		}
 
 	case dto.MetricType_GAUGE:
 		// No very meaningful way for us to merge gauges.  We'll sum them
 		// and clear out any gauges on scrape, as a best approximation, but
 		// this relies on client pushing with the same interval as we scrape.
-		return &dto.Metric{
-			Label: a.Label,
-			Gauge: &dto.Gauge{
-				Value: float64ptr(*a.Gauge.Value + *b.Gauge.Value),
-			},
-		}
+		merged = withSpread(merged, a, b)
 
 	case dto.MetricType_HISTOGRAM:
-		return &dto.Metric{
-			Label: a.Label,
-			Histogram: &dto.Histogram{
-				SampleCount: uint64ptr(*a.Histogram.SampleCount + *b.Histogram.SampleCount),
-				SampleSum:   float64ptr(*a.Histogram.SampleSum + *b.Histogram.SampleSum),
-				Bucket:      mergeBuckets(a.Histogram.Bucket, b.Histogram.Bucket),
-			},
-		}
+		merged.count = a.count + b.count
+		merged.created = a.created
+		merged.extra = &seriesExtra{buckets: mergeBuckets(a.buckets(), b.buckets()), native: mergeNative(a.native(), b.native())}
 
 	case dto.MetricType_UNTYPED:
-		return &dto.Metric{
-			Label: a.Label,
-			Untyped: &dto.Untyped{
-				Value: float64ptr(*a.Untyped.Value + *b.Untyped.Value),
-			},
-		}
 
 	case dto.MetricType_SUMMARY:
 		// Treat Summary as a pair of counters, ignoring quantiles (which not all clients support anyway)
-		return &dto.Metric{
-			Label: a.Label,
-			Summary: &dto.Summary{
-				SampleCount: uint64ptr(*a.Summary.SampleCount + *b.Summary.SampleCount),
-				SampleSum:   float64ptr(*a.Summary.SampleSum + *b.Summary.SampleSum),
-			},
-		}
+		merged.count = a.count + b.count
+		merged.created = a.created
+
+	default:
+		return compactSeries{}, false
 	}
 
-	return nil
+	return withLatestTimestamp(merged, a, b, timestamps), true
 }
 
-func (mf *metricFamily) mergeFamily(b *dto.MetricFamily) error {
-	if *mf.Type != *b.Type {
-		return fmt.Errorf("cannot merge metric '%s': type %s != %s",
-			*mf.Name, mf.Type.String(), b.Type.String())
+func withLatestTimestamp(merged compactSeries, a, b *compactSeries, timestamps bool) compactSeries {
+	if !timestamps {
+		return merged
+	}
+	if ts := latestTimestamp(a, b); ts != nil {
+		if merged.extra == nil {
+			merged.extra = &seriesExtra{}
+		}
+		merged.extra.timestampMs = ts
 	}
+	return merged
+}
 
-	newMetric := []*dto.Metric{}
+// mergeSeriesLists merges two label-sorted series lists into a new sorted list
+func mergeSeriesLists(ty dto.MetricType, a, b []compactSeries, strategy MergeStrategy, timestamps bool) []compactSeries {
+	newSeries := make([]compactSeries, 0, len(a)+len(b))
 
 	i, j := 0, 0
-	mf.lock.Lock()
-	defer mf.lock.Unlock()
-	for i < len(mf.Metric) && j < len(b.Metric) {
-		if labelsLessThan(mf.Metric[i].Label, b.Metric[j].Label) {
-			newMetric = append(newMetric, mf.Metric[i])
+	for i < len(a) && j < len(b) {
+		if a[i].labels.less(b[j].labels) {
+			newSeries = append(newSeries, a[i])
 			i++
-		} else if labelsLessThan(b.Metric[j].Label, mf.Metric[i].Label) {
-			newMetric = append(newMetric, b.Metric[j])
+		} else if b[j].labels.less(a[i].labels) {
+			newSeries = append(newSeries, b[j])
 			j++
 		} else {
-			merged := mergeMetric(*mf.Type, mf.Metric[i], b.Metric[j])
-			if merged != nil {
-				newMetric = append(newMetric, merged)
+			if merged, ok := mergeSeries(ty, &a[i], &b[j], strategy, timestamps); ok {
+				newSeries = append(newSeries, merged)
 			}
 			i++
 			j++
 		}
 	}
 
-	for ; i < len(mf.Metric); i++ {
-		newMetric = append(newMetric, mf.Metric[i])
+	newSeries = append(newSeries, a[i:]...)
+	newSeries = append(newSeries, b[j:]...)
+	return newSeries
+}
+
+// mergeFamily merges b into the family with strategy, nil for the built-in
+// sum, and returns by how many bytes its estimated size changed. spread
+// tracks the spread of b's series, for gauges. latestHelp replaces the HELP
+// of the family with b's, when it has one. timestamps keeps the latest
+// timestamp of merged series, only worth it when renders show them.
+//
+// Concurrent pushes to the same family are coalesced: each one queues its
+// metrics, and whoever gets the family lock first merges everything queued in
+// a single pass over the (possibly large) existing family. By the time a push
+// gets the lock itself its metrics are guaranteed to have been merged.
+func (mf *Family) mergeFamily(b *compactFamily, strategy MergeStrategy, spread, latestHelp, timestamps bool) (int64, error) {
+	// The type never changes once a family exists, so it's safe to check unlocked
+	current := mf.head()
+	if current.ty != b.ty {
+		return 0, fmt.Errorf("cannot merge metric '%s': type %s != %s",
+			current.name, current.ty.String(), b.ty.String())
 	}
-	for ; j < len(b.Metric); j++ {
-		newMetric = append(newMetric, b.Metric[j])
+	ty := current.ty
+	series := b.series
+	if spread && ty == dto.MetricType_GAUGE {
+		trackSpread(series)
 	}
 
-	mf.Metric = newMetric
-	return nil
+	mf.pendingLock.Lock()
+	mf.pending = append(mf.pending, series)
+	if latestHelp && b.help != nil {
+		mf.pendingHelp = b.help
+	}
+	mf.pendingLock.Unlock()
+
+	lockObserved(&mf.lock, familyLockWait)
+	defer mf.lock.Unlock()
+
+	ours := func(queued []compactSeries) bool { return sameSeries(queued, series) }
+	mf.pendingLock.Lock()
+	queued := slices.ContainsFunc(mf.pending, ours)
+	mf.pendingLock.Unlock()
+	if !queued {
+		// an earlier lock holder already merged our metrics
+		CoalescedPushes.Inc()
+		return 0, nil
+	}
+
+	current, err := mf.load()
+	if err != nil {
+		// the other queued pushes fail likewise once they get the lock
+		mf.pendingLock.Lock()
+		mf.pending = slices.DeleteFunc(mf.pending, ours)
+		mf.pendingLock.Unlock()
+		return 0, err
+	}
+
+	mf.pendingLock.Lock()
+	batch := mf.pending
+	help := mf.pendingHelp
+	mf.pending, mf.pendingHelp = nil, nil
+	mf.pendingLock.Unlock()
+
+	incoming := batch[0]
+	for _, series := range batch[1:] {
+		incoming = mergeSeriesLists(ty, incoming, series, strategy, timestamps)
+	}
+
+	if help == nil {
+		help = current.help
+	}
+	// Never mutate the published family, renders may be encoding it right now
+	merged := &compactFamily{
+		name:   current.name,
+		help:   help,
+		unit:   current.unit,
+		ty:     ty,
+		series: mergeSeriesLists(ty, current.series, incoming, strategy, timestamps),
+	}
+	now := time.Now()
+	if current.stampMs != 0 {
+		merged.stampMs = now.UnixMilli()
+	}
+	mf.publish(merged)
+	mf.lastUpdate = now
+	mf.metricCount.Set(float64(len(merged.series)))
+
+	newSize := estimateFamilyBytes(merged)
+	sizeDelta := newSize - mf.sizeBytes
+	mf.sizeBytes = newSize
+	return sizeDelta, nil
+}
+
+// sameSeries reports whether a and b are the same series list, not just
+// equal ones
+func sameSeries(a, b []compactSeries) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
 func validateFamily(f *dto.MetricFamily) error {
 	// Map of fingerprints we've seen before in this family
 	fingerprints := make(map[model.Fingerprint]struct{}, len(f.Metric))
+	// Reused for every metric, only the fingerprint outlives an iteration
+	lSet := model.LabelSet{}
 	for _, m := range f.Metric {
 		// Turn protobuf LabelSet into Prometheus model LabelSet
-		lSet := make(model.LabelSet, len(m.Label)+1)
+		clear(lSet)
 		for _, p := range m.Label {
 			lSet[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
 		}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+type metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// metadataTypes are the type names of the Prometheus metadata API
+var metadataTypes = map[dto.MetricType]string{
+	dto.MetricType_COUNTER:         "counter",
+	dto.MetricType_GAUGE:           "gauge",
+	dto.MetricType_SUMMARY:         "summary",
+	dto.MetricType_UNTYPED:         "unknown",
+	dto.MetricType_HISTOGRAM:       "histogram",
+	dto.MetricType_GAUGE_HISTOGRAM: "gaugehistogram",
+}
+
+// ServeMetadata answers like the Prometheus /api/v1/metadata endpoint with
+// the HELP, TYPE and unit of the aggregated families, so metadata lookups
+// work through an agent forwarding to the gateway. It takes the same metric
+// and limit parameters.
+func (a *Aggregate) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	limit := -1
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"status":    "error",
+				"errorType": "bad_data",
+				"error":     "limit must be a number",
+			})
+			return
+		}
+	}
+
+	data := map[string][]metadata{}
+	metric := r.URL.Query().Get("metric")
+	opts := a.opts()
+	for _, f := range a.snapshot() {
+		if limit >= 0 && len(data) >= limit {
+			break
+		}
+		if metric != "" && f.name != metric {
+			continue
+		}
+		family := opts.overrideMetadata(f.family.head())
+		entry := metadata{Type: metadataTypes[family.ty]}
+		if family.help != nil {
+			entry.Help = *family.help
+		}
+		if family.unit != nil {
+			entry.Unit = *family.unit
+		}
+		data[f.name] = []metadata{entry}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": "success",
+		"data":   data,
+	})
+}
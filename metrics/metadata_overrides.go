@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+// HELP conflict policies, what a family's HELP is when pushes disagree
+const (
+	HelpConflictsFirst  = "first"
+	HelpConflictsLatest = "latest"
+)
+
+// MetadataOverride sets the HELP, TYPE or unit the families it matches are
+// rendered with, whatever their pushers sent
+type MetadataOverride struct {
+	// Match is an anchored regular expression on the family name
+	Match string  `yaml:"match"`
+	Help  *string `yaml:"help"`
+	Unit  *string `yaml:"unit"`
+	// Type is counter, gauge or untyped, it only applies to families pushed
+	// as one of those, which are merged as that type
+	Type string `yaml:"type"`
+
+	re *regexp.Regexp
+	ty *dto.MetricType
+}
+
+// MetadataOverrides is a metadata override file
+type MetadataOverrides struct {
+	// HelpConflicts is first (the default) to keep the HELP of the push
+	// creating a family, latest to take that of each push sending one
+	HelpConflicts string             `yaml:"help_conflicts"`
+	Overrides     []MetadataOverride `yaml:"overrides"`
+}
+
+// maxMetadataMatches bounds how many family names the overrides matching
+// them are cached for, the cache starting over past it
+const maxMetadataMatches = 1 << 16
+
+// metadataMatches caches the overrides matching each family name, so
+// renders don't run the regular expression of every override on every
+// family
+type metadataMatches struct {
+	lock   sync.RWMutex
+	byName map[string][]int
+}
+
+// overridableTypes are the types an override may set, those sharing how
+// series are held
+var overridableTypes = map[string]dto.MetricType{
+	"counter": dto.MetricType_COUNTER,
+	"gauge":   dto.MetricType_GAUGE,
+	"untyped": dto.MetricType_UNTYPED,
+	"unknown": dto.MetricType_UNTYPED,
+}
+
+// LoadMetadataOverrides reads a metadata override file
+func LoadMetadataOverrides(path string) (*MetadataOverrides, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &MetadataOverrides{}
+	if err := yaml.Unmarshal(content, file); err != nil {
+		return nil, fmt.Errorf("parsing metadata overrides %s: %w", path, err)
+	}
+	switch file.HelpConflicts {
+	case "", HelpConflictsFirst, HelpConflictsLatest:
+	default:
+		return nil, fmt.Errorf("invalid help_conflicts %q in %s, must be %s or %s", file.HelpConflicts, path, HelpConflictsFirst, HelpConflictsLatest)
+	}
+	for i := range file.Overrides {
+		if err := file.Overrides[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid metadata override %d in %s: %w", i+1, path, err)
+		}
+	}
+	return file, nil
+}
+
+func (o *MetadataOverride) compile() error {
+	if o.Match == "" {
+		return fmt.Errorf("match is missing")
+	}
+	re, err := regexp.Compile("^(?:" + o.Match + ")$")
+	if err != nil {
+		return err
+	}
+	o.re = re
+	if o.Type != "" {
+		ty, ok := overridableTypes[o.Type]
+		if !ok {
+			return fmt.Errorf("invalid type %q, must be counter, gauge or untyped", o.Type)
+		}
+		o.ty = &ty
+	}
+	return nil
+}
+
+// SetMetadataOverrides renders the families with the HELP, TYPE and unit of
+// the overrides matching them, in order, a later override winning over an
+// earlier one, so scrapers get consistent documentation whichever producer
+// created a family. The TYPE also applies to pushes, so producers moving to
+// the advertised type keep merging into the same family. Invalid overrides
+// are logged and left out. nil disables it.
+func SetMetadataOverrides(overrides *MetadataOverrides) Option {
+	return func(a *Aggregate) {
+		a.options.metadataOverrides = nil
+		a.options.metadataMatches = nil
+		a.options.latestHelp = false
+		if overrides == nil {
+			return
+		}
+		a.options.metadataMatches = &metadataMatches{}
+		a.options.latestHelp = overrides.HelpConflicts == HelpConflictsLatest
+		for _, override := range overrides.Overrides {
+			if override.re == nil {
+				if err := override.compile(); err != nil {
+					log.Printf("Ignoring metadata override %q: %s\n", override.Match, err.Error())
+					continue
+				}
+			}
+			a.options.metadataOverrides = append(a.options.metadataOverrides, override)
+		}
+	}
+}
+
+// matchingOverrides returns the indexes of the overrides matching a family
+// name, in order
+func (ao *aggregateOptions) matchingOverrides(name string) []int {
+	cache := ao.metadataMatches
+	if cache != nil {
+		cache.lock.RLock()
+		matching, ok := cache.byName[name]
+		cache.lock.RUnlock()
+		if ok {
+			return matching
+		}
+	}
+
+	var matching []int
+	for i := range ao.metadataOverrides {
+		if ao.metadataOverrides[i].re.MatchString(name) {
+			matching = append(matching, i)
+		}
+	}
+	if cache != nil {
+		cache.lock.Lock()
+		if cache.byName == nil || len(cache.byName) >= maxMetadataMatches {
+			cache.byName = map[string][]int{}
+		}
+		cache.byName[name] = matching
+		cache.lock.Unlock()
+	}
+	return matching
+}
+
+// overrideType sets a pushed family to the TYPE of the overrides matching
+// it, moving the values of its series over
+func (ao *aggregateOptions) overrideType(family *dto.MetricFamily) {
+	if !isScalarType(family.GetType()) {
+		return
+	}
+	var ty *dto.MetricType
+	for _, i := range ao.matchingOverrides(family.GetName()) {
+		if override := &ao.metadataOverrides[i]; override.ty != nil {
+			ty = override.ty
+		}
+	}
+	if ty == nil || *ty == family.GetType() {
+		return
+	}
+
+	for _, m := range family.Metric {
+		var value float64
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			value = m.Counter.GetValue()
+		case dto.MetricType_GAUGE:
+			value = m.Gauge.GetValue()
+		default:
+			value = m.Untyped.GetValue()
+		}
+		m.Counter, m.Gauge, m.Untyped = nil, nil, nil
+		switch *ty {
+		case dto.MetricType_COUNTER:
+			m.Counter = &dto.Counter{Value: &value}
+		case dto.MetricType_GAUGE:
+			m.Gauge = &dto.Gauge{Value: &value}
+		default:
+			m.Untyped = &dto.Untyped{Value: &value}
+		}
+	}
+	overridden := *ty
+	family.Type = &overridden
+}
+
+// overrideMetadata returns the family as rendered, with the metadata of the
+// overrides matching it
+func (ao *aggregateOptions) overrideMetadata(family *compactFamily) *compactFamily {
+	overridden := family
+	for _, i := range ao.matchingOverrides(family.name) {
+		override := &ao.metadataOverrides[i]
+		if overridden == family {
+			// never mutate the published family
+			copied := *family
+			overridden = &copied
+		}
+		if override.Help != nil {
+			overridden.help = override.Help
+		}
+		if override.Unit != nil {
+			overridden.unit = override.Unit
+		}
+		if override.ty != nil && isScalarType(family.ty) {
+			overridden.ty = *override.ty
+		}
+	}
+	return overridden
+}
+
+func isScalarType(ty dto.MetricType) bool {
+	return ty == dto.MetricType_COUNTER || ty == dto.MetricType_GAUGE || ty == dto.MetricType_UNTYPED
+}
@@ -11,6 +11,53 @@ func init() {
 		TotalFamiliesGauge,
 		MetricCountByFamily,
 		MetricPushes,
+		AsyncIngestErrors,
+		IngestQueueDepth,
+		IngestInFlight,
+		IngestRejected,
+		EstimatedMemoryBytes,
+		EvictedFamilies,
+		CoalescedPushes,
+		LoadShedding,
+		RenderAborts,
+		RenderEncodeErrors,
+		ReplicaSyncs,
+		ReplicaLastSync,
+		CompletedGroups,
+		DuplicatePushes,
+		Maintenance,
+		ProxiedPushes,
+		SchemaViolations,
+		ShadowPushes,
+		WASMFilterErrors,
+		IngestedBytes,
+		IngestedSamples,
+		QuarantinedProducers,
+		PushFamilies,
+		PushSeries,
+		PushBodyBytes,
+		SnapshotWrites,
+		NewFamilies,
+		InventoryNotifications,
+		DuplicateSeries,
+		LockWaitSeconds,
+		PushStageSeconds,
+		FrozenFamilyPushes,
+		CounterJumps,
+		CounterJumpNotifications,
+		PushAnomalies,
+		AnomalyNotifications,
+		ScrapedReceipts,
+		ReceiptNotifications,
+		TombstonedSeries,
+		QueuedRequests,
+		RequestQueueSeconds,
+		ShedRequests,
+		TenantDuplicatePushes,
+		IdempotencyKeys,
+		FamilySpills,
+		SpillErrors,
+		RestoredFamilyAge,
 	)
 }
 
@@ -54,3 +101,485 @@ var MetricPushes = prometheus.NewCounterVec(
 		"push_job",
 	},
 )
+
+var AsyncIngestErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "async_ingest_errors",
+		Help:      "Total number of queued pushes that failed to parse or merge, per job",
+	},
+	[]string{
+		"push_job",
+	},
+)
+
+var IngestQueueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_queue_depth",
+		Help:      "Number of pushes waiting for an async ingest worker",
+	},
+)
+
+var IngestInFlight = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_in_flight",
+		Help:      "Number of pushes currently being parsed and merged",
+	},
+)
+
+var IngestRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingest_rejected",
+		Help:      "Total number of pushes rejected because of backpressure, per reason",
+	},
+	[]string{
+		"reason",
+	},
+)
+
+var EstimatedMemoryBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "estimated_memory_bytes",
+		Help:      "Approximate memory held by the aggregated metric families",
+	},
+)
+
+var EvictedFamilies = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "evicted_families",
+		Help:      "Total number of metric families evicted to stay within the memory budget",
+	},
+)
+
+var CoalescedPushes = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "coalesced_pushes",
+		Help:      "Total number of family pushes merged as part of another push's merge pass",
+	},
+)
+
+var LoadShedding = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "load_shedding",
+		Help:      "Whether pushes creating new metric families are rejected because of memory pressure",
+	},
+)
+
+var RenderAborts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "render_aborts",
+		Help:      "Total number of streamed renders aborted mid-response, per reason",
+	},
+	[]string{
+		"reason",
+	},
+)
+
+var RenderEncodeErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "render_encode_errors",
+		Help:      "Total number of metric families left out of a render because they failed to encode",
+	},
+)
+
+var ReplicaSyncs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "replica_syncs",
+		Help:      "Total number of snapshot pulls from the primary, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var ReplicaLastSync = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "replica_last_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful snapshot pull from the primary",
+	},
+)
+
+var CompletedGroups = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "completed_groups",
+		Help:      "Number of groups marked complete that are waiting for a scrape before being dropped",
+	},
+)
+
+var DuplicatePushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "duplicate_pushes",
+		Help:      "Total number of pushes skipped because their Idempotency-Key was already merged, per job",
+	},
+	[]string{
+		"push_job",
+	},
+)
+
+var Maintenance = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "maintenance",
+		Help:      "Whether the gateway is in maintenance, rejecting pushes",
+	},
+)
+
+var ProxiedPushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "proxied_pushes",
+		Help:      "Total number of pushes this gateway doesn't own proxied to the upstream gateway, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var SchemaViolations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "schema_violations",
+		Help:      "Total number of metrics schema violations found in pushes, per family of the schema (empty for the others) and enforcement",
+	},
+	[]string{
+		"family",
+		"enforcement",
+	},
+)
+
+var ShadowPushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "shadow_pushes",
+		Help:      "Total number of merged pushes fed to the shadow aggregate, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var WASMFilterErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "wasm_filter_errors",
+		Help:      "Total number of families a WASM filter failed on, per stage",
+	},
+	[]string{
+		"stage",
+	},
+)
+
+var IngestedBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingested_bytes",
+		Help:      "Total number of push body bytes merged, per job and tenant",
+	},
+	[]string{
+		"job",
+		"tenant",
+	},
+)
+
+var IngestedSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "ingested_samples",
+		Help:      "Total number of samples merged, per job and tenant",
+	},
+	[]string{
+		"job",
+		"tenant",
+	},
+)
+
+var QuarantinedProducers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "quarantined_producers",
+		Help:      "Number of producers whose pushes are rejected after repeated invalid pushes",
+	},
+)
+
+var PushFamilies = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "push_families",
+		Help:      "Number of metric families of merged pushes, per job",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	},
+	[]string{
+		"job",
+	},
+)
+
+var PushSeries = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "push_series",
+		Help:      "Number of series of merged pushes, per job",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+	},
+	[]string{
+		"job",
+	},
+)
+
+var PushBodyBytes = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "push_body_bytes",
+		Help:      "Body size of merged pushes in bytes, per job",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	},
+	[]string{
+		"job",
+	},
+)
+
+var SnapshotWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "snapshot_writes",
+		Help:      "Total number of writes of the persisted snapshot, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var NewFamilies = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "new_families",
+		Help:      "Total number of families first seen in the inventory, per job creating them",
+	},
+	[]string{
+		"job",
+	},
+)
+
+var InventoryNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "inventory_notifications",
+		Help:      "Total number of new family notifications to the webhook, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var DuplicateSeries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "duplicate_series",
+		Help:      "Total number of series repeated within a push and merged, per family",
+	},
+	[]string{
+		"family",
+	},
+)
+
+var LockWaitSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "lock_wait_seconds",
+		Help:      "Time merges waited for the write lock of a family shard or of a family, per lock",
+		Buckets:   prometheus.ExponentialBuckets(1e-7, 4, 12),
+	},
+	[]string{
+		"lock",
+	},
+)
+
+var PushStageSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "push_stage_seconds",
+		Help:      "Time pushes spent parsing their body and merging it, per stage",
+		Buckets:   prometheus.ExponentialBuckets(1e-5, 4, 10),
+	},
+	[]string{
+		"stage",
+	},
+)
+
+var FrozenFamilyPushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "frozen_family_pushes",
+		Help:      "Total number of pushes to a frozen family whose series were not merged, per family",
+	},
+	[]string{
+		"family",
+	},
+)
+
+var CounterJumps = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "counter_jumps",
+		Help:      "Total number of aggregated counter series that grew more than the jump factor between renders, per family",
+	},
+	[]string{
+		"family",
+	},
+)
+
+var CounterJumpNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "counter_jump_notifications",
+		Help:      "Total number of counter jump notifications to the webhook, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var PushAnomalies = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "push_anomalies",
+		Help:      "Total number of pushes deviating from the baseline of their job, per job and kind of anomaly",
+	},
+	[]string{
+		"job",
+		"kind",
+	},
+)
+
+var AnomalyNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "push_anomaly_notifications",
+		Help:      "Total number of push anomaly notifications to the webhook, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var ScrapedReceipts = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "scraped_receipts",
+		Help:      "Total number of scrape receipts of pushes served to a scraper",
+	},
+)
+
+var ReceiptNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "receipt_notifications",
+		Help:      "Total number of scrape receipt notifications to the webhook, per result",
+	},
+	[]string{
+		"result",
+	},
+)
+
+var TombstonedSeries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "tombstoned_series",
+		Help:      "Total number of pushed series dropped for matching the tombstone of a deleted series, per family",
+	},
+	[]string{
+		"family",
+	},
+)
+
+var QueuedRequests = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "queued_requests",
+		Help:      "Number of API requests waiting for the concurrency limit, per priority class",
+	},
+	[]string{
+		"class",
+	},
+)
+
+var RequestQueueSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "request_queue_seconds",
+		Help:      "Time API requests waited for the concurrency limit, per priority class",
+		Buckets:   prometheus.ExponentialBuckets(1e-4, 4, 10),
+	},
+	[]string{
+		"class",
+	},
+)
+
+var ShedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "shed_requests",
+		Help:      "Total number of API requests answered 503 after waiting out the request queue timeout, per priority class",
+	},
+	[]string{
+		"class",
+	},
+)
+
+var TenantDuplicatePushes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "tenant_duplicate_pushes",
+		Help:      "Total number of pushes skipped because their Idempotency-Key was already merged, per X-Scope-OrgID tenant",
+	},
+	[]string{
+		"tenant",
+	},
+)
+
+var IdempotencyKeys = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "idempotency_keys",
+		Help:      "Number of Idempotency-Keys of merged pushes remembered within the idempotency window",
+	},
+)
+
+var FamilySpills = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "family_spills",
+		Help:      "Total number of metric families whose series were spilled to disk by the disk storage",
+	},
+)
+
+var SpillErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "spill_errors",
+		Help:      "Total number of metric families the disk storage could not spill to disk or read back",
+	},
+)
+
+var RestoredFamilyAge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "restored_family_age_seconds",
+		Help:      "How long before the restore each family restored from the snapshot was last pushed to, until it is pushed to again",
+	},
+	[]string{
+		"family",
+	},
+)
@@ -0,0 +1,262 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Native histogram schemas range from -4, buckets growing 65536-fold, to
+// 8, buckets growing by 2^(1/256)
+const (
+	MinNativeHistogramSchema = -4
+	MaxNativeHistogramSchema = 8
+)
+
+// SetNativeHistograms renders classic histograms as native histograms of
+// the given schema to scrapers negotiating protobuf, the only format
+// carrying them, so a histogram is stored downstream as one series instead
+// of one per bucket. Each classic bucket's observations are counted in the
+// native bucket holding its upper bound, the resolution is that of the
+// coarser of the two bucketings.
+func SetNativeHistograms(enabled bool, schema int32) Option {
+	return func(a *Aggregate) {
+		a.options.nativeSchema = nil
+		if enabled {
+			a.options.nativeSchema = &schema
+		}
+	}
+}
+
+// encoderOptions returns how families are encoded in contentType
+func (ao *aggregateOptions) encoderOptions(contentType expfmt.Format) []encoderOption {
+	if ao.nativeSchema == nil || contentType.FormatType() != expfmt.TypeProtoDelim {
+		return nil
+	}
+	schema := *ao.nativeSchema
+	return []encoderOption{func(fe *familyEncoder) { fe.nativeSchema = &schema }}
+}
+
+// toNativeHistograms replaces the classic histograms of a family freshly
+// built by toDTO with native ones, leaving the compact state alone.
+// Histograms pushed as native ones keep their own buckets, and those native
+// buckets can't place the observations of stay classic.
+func toNativeHistograms(family *dto.MetricFamily, schema int32) {
+	for _, m := range family.Metric {
+		if m.Histogram != nil && m.Histogram.Schema == nil {
+			if native := nativeHistogram(m.Histogram, schema); native != nil {
+				m.Histogram = native
+			}
+		}
+	}
+}
+
+// nativeHistogram returns the native form of a classic histogram, nil when
+// some of its observations are above its highest finite bound and that
+// bound isn't positive, only +Inf for one, as no native bucket holds just
+// what is above it
+func nativeHistogram(classic *dto.Histogram, schema int32) *dto.Histogram {
+	native := &dto.Histogram{
+		SampleCount:      classic.SampleCount,
+		SampleSum:        classic.SampleSum,
+		CreatedTimestamp: classic.CreatedTimestamp,
+		Schema:           &schema,
+		ZeroThreshold:    new(float64),
+		ZeroCount:        new(uint64),
+	}
+
+	positive, negative := map[int32]uint64{}, map[int32]uint64{}
+	var finite uint64
+	total := classic.GetSampleCount()
+	highest := math.Inf(-1)
+	for _, b := range classic.Bucket {
+		if b.Exemplar != nil {
+			native.Exemplars = append(native.Exemplars, b.Exemplar)
+		}
+		if math.IsInf(b.GetUpperBound(), 1) {
+			total = max(total, b.GetCumulativeCount())
+			continue
+		}
+		// cumulative counts only ever grow, a shrinking one adds nothing
+		count := b.GetCumulativeCount() - min(finite, b.GetCumulativeCount())
+		finite = max(finite, b.GetCumulativeCount())
+		highest = b.GetUpperBound()
+		addObservations(native, positive, negative, highest, count, schema)
+	}
+
+	// observations above the highest finite bound go one bucket above it
+	if total > finite {
+		if highest <= 0 {
+			return nil
+		}
+		positive[nativeBucketKey(highest, schema)+1] += total - finite
+	}
+
+	native.PositiveSpan, native.PositiveDelta = nativeBuckets(positive)
+	native.NegativeSpan, native.NegativeDelta = nativeBuckets(negative)
+	if len(native.PositiveSpan) == 0 && len(native.NegativeSpan) == 0 && *native.ZeroCount == 0 {
+		// an empty span marks the histogram native when it has no observations
+		native.PositiveSpan = []*dto.BucketSpan{{Offset: new(int32), Length: new(uint32)}}
+	}
+	return native
+}
+
+func addObservations(native *dto.Histogram, positive, negative map[int32]uint64, upperBound float64, count uint64, schema int32) {
+	if count == 0 {
+		return
+	}
+	switch {
+	case upperBound > 0:
+		positive[nativeBucketKey(upperBound, schema)] += count
+	case upperBound < 0:
+		negative[nativeBucketKey(-upperBound, schema)] += count
+	default:
+		*native.ZeroCount += count
+	}
+}
+
+// nativeBucketKey returns the index of the native bucket holding v, bucket
+// i spanning (base^(i-1), base^i] with base 2^(2^-schema)
+func nativeBucketKey(v float64, schema int32) int32 {
+	return int32(math.Ceil(math.Log2(v) * math.Exp2(float64(schema))))
+}
+
+// nativeBuckets encodes bucket counts as spans of consecutive buckets and
+// the deltas between successive counts
+func nativeBuckets(counts map[int32]uint64) ([]*dto.BucketSpan, []int64) {
+	if len(counts) == 0 {
+		return nil, nil
+	}
+	keys := make([]int32, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var spans []*dto.BucketSpan
+	deltas := make([]int64, 0, len(keys))
+	var last int32
+	var previous int64
+	for i, key := range keys {
+		if i == 0 || key != last+1 {
+			offset := key
+			if i > 0 {
+				offset = key - last - 1
+			}
+			spans = append(spans, &dto.BucketSpan{Offset: &offset, Length: new(uint32)})
+		}
+		*spans[len(spans)-1].Length++
+		count := int64(counts[key])
+		deltas = append(deltas, count-previous)
+		previous, last = count, key
+	}
+	return spans, deltas
+}
+
+// compactNative is the native part of a histogram pushed as one, its
+// bucket counts keyed by index. Float histograms aren't kept.
+type compactNative struct {
+	schema        int32
+	zeroThreshold float64
+	zeroCount     uint64
+	positive      map[int32]uint64
+	negative      map[int32]uint64
+}
+
+// compactNativeFromDTO returns the native part of a pushed histogram, nil
+// when it has none
+func compactNativeFromDTO(h *dto.Histogram) *compactNative {
+	if h.Schema == nil || h.SampleCountFloat != nil {
+		return nil
+	}
+	return &compactNative{
+		schema:        h.GetSchema(),
+		zeroThreshold: h.GetZeroThreshold(),
+		zeroCount:     h.GetZeroCount(),
+		positive:      nativeCounts(h.PositiveSpan, h.PositiveDelta),
+		negative:      nativeCounts(h.NegativeSpan, h.NegativeDelta),
+	}
+}
+
+// nativeCounts decodes spans and deltas into bucket counts, the reverse of
+// nativeBuckets
+func nativeCounts(spans []*dto.BucketSpan, deltas []int64) map[int32]uint64 {
+	counts := map[int32]uint64{}
+	var key int32
+	var count int64
+	for i, span := range spans {
+		if i == 0 {
+			key = span.GetOffset()
+		} else {
+			key += span.GetOffset() + 1
+		}
+		for j := uint32(0); j < span.GetLength() && len(deltas) > 0; j++ {
+			if j > 0 {
+				key++
+			}
+			count += deltas[0]
+			deltas = deltas[1:]
+			if count > 0 {
+				counts[key] = uint64(count)
+			}
+		}
+	}
+	return counts
+}
+
+// mergeNative adds the native parts of two histograms up at the coarser of
+// their schemas and the wider of their zero buckets. A histogram pushed
+// without one merges into the other's as it is.
+func mergeNative(a, b *compactNative) *compactNative {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := &compactNative{
+		schema:        min(a.schema, b.schema),
+		zeroThreshold: max(a.zeroThreshold, b.zeroThreshold),
+		zeroCount:     a.zeroCount + b.zeroCount,
+		positive:      map[int32]uint64{},
+		negative:      map[int32]uint64{},
+	}
+	for _, n := range []*compactNative{a, b} {
+		merged.zeroCount += n.reduce(n.positive, merged.positive, merged.schema, merged.zeroThreshold)
+		merged.zeroCount += n.reduce(n.negative, merged.negative, merged.schema, merged.zeroThreshold)
+	}
+	return merged
+}
+
+// reduce adds the bucket counts of n to into at a schema no finer than
+// n's, returning the count of those falling into the zero bucket of
+// threshold
+func (n *compactNative) reduce(counts, into map[int32]uint64, schema int32, threshold float64) uint64 {
+	var zero uint64
+	shift := n.schema - schema
+	for key, count := range counts {
+		// bucket i at a schema s is bucket ((i-1) >> d) + 1 at s-d
+		key = ((key - 1) >> shift) + 1
+		if math.Exp2(float64(key)*math.Exp2(-float64(schema))) <= threshold {
+			zero += count
+			continue
+		}
+		into[key] += count
+	}
+	return zero
+}
+
+// toDTO sets the native part on a histogram built from the compact state
+func (n *compactNative) toDTO(h *dto.Histogram) {
+	h.Schema = &n.schema
+	h.ZeroThreshold = &n.zeroThreshold
+	h.ZeroCount = &n.zeroCount
+	h.PositiveSpan, h.PositiveDelta = nativeBuckets(n.positive)
+	h.NegativeSpan, h.NegativeDelta = nativeBuckets(n.negative)
+	if len(h.PositiveSpan) == 0 && len(h.NegativeSpan) == 0 && n.zeroCount == 0 {
+		// an empty span marks the histogram native when it has no observations
+		h.PositiveSpan = []*dto.BucketSpan{{Offset: new(int32), Length: new(uint32)}}
+	}
+}
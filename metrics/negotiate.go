@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// acceptedFormat is an entry of an Accept header
+type acceptedFormat struct {
+	mediaType string
+	params    map[string]string
+	q         float64
+}
+
+// parseAccept returns the entries of an Accept header by preference, those
+// that can't be parsed or are refused with q=0 left out
+func parseAccept(accept string) []acceptedFormat {
+	var formats []acceptedFormat
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		formats = append(formats, acceptedFormat{mediaType: mediaType, params: params, q: q})
+	}
+	sort.SliceStable(formats, func(i, j int) bool { return formats[i].q > formats[j].q })
+	return formats
+}
+
+// escaping returns the escaping scheme the entry asks for. Scrapers
+// predating UTF-8 names don't ask for one and get names escaped with
+// underscores, like those asking for a scheme this version doesn't know.
+func (f acceptedFormat) escaping() model.EscapingScheme {
+	if scheme, err := model.ToEscapingScheme(f.params[model.EscapingKey]); err == nil {
+		return scheme
+	}
+	return model.NameEscapingScheme
+}
+
+// negotiateFormat picks the format of a render, the first entry of the
+// Accept header the aggregate renders, with the escaping scheme of that
+// entry. Unlike expfmt.Negotiate, the escaping asked for with one format
+// doesn't carry over to another, so a scraper accepting UTF-8 names in
+// OpenMetrics only still gets escaped names in the text format it falls
+// back to when OpenMetrics is disabled, and old and new Prometheus versions
+// scraping the same gateway each get names they accept.
+func (a *Aggregate) negotiateFormat(header http.Header) expfmt.Format {
+	for _, accepted := range parseAccept(header.Get("Accept")) {
+		if format, ok := a.offeredFormat(accepted); ok {
+			return format.WithEscapingScheme(accepted.escaping())
+		}
+	}
+	return expfmt.NewFormat(expfmt.TypeTextPlain).WithEscapingScheme(model.NameEscapingScheme)
+}
+
+// offeredFormat returns the format the aggregate renders for an Accept
+// entry, if any
+func (a *Aggregate) offeredFormat(accepted acceptedFormat) (expfmt.Format, bool) {
+	version := accepted.params["version"]
+	switch accepted.mediaType {
+	case expfmt.ProtoType:
+		if accepted.params["proto"] != expfmt.ProtoProtocol {
+			return "", false
+		}
+		switch accepted.params["encoding"] {
+		case "delimited":
+			return expfmt.NewFormat(expfmt.TypeProtoDelim), true
+		case "text":
+			return expfmt.NewFormat(expfmt.TypeProtoText), true
+		case "compact-text":
+			return expfmt.NewFormat(expfmt.TypeProtoCompact), true
+		}
+	case "text/plain":
+		// 1.0.0 only differs from 0.0.4 by allowing UTF-8 names, which the
+		// escaping scheme of the entry decides
+		if version == "" || version == expfmt.TextVersion || version == "1.0.0" {
+			return expfmt.NewFormat(expfmt.TypeTextPlain), true
+		}
+	case expfmt.OpenMetricsType:
+		if !a.opts().openMetrics {
+			return "", false
+		}
+		switch version {
+		case expfmt.OpenMetricsVersion_1_0_0:
+			return expfmt.FmtOpenMetrics_1_0_0, true
+		case "", expfmt.OpenMetricsVersion_0_0_1:
+			return expfmt.FmtOpenMetrics_0_0_1, true
+		}
+	case "*/*", "text/*":
+		return expfmt.NewFormat(expfmt.TypeTextPlain), true
+	}
+	return "", false
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SetOpenMetrics renders OpenMetrics 1.0 to scrapers that ask for it.
+// Off by default since OpenMetrics exposes counters not named *_total as
+// unknown, which changes their type for scrapers that already negotiate it.
+func SetOpenMetrics(enabled bool) Option {
+	return func(a *Aggregate) {
+		a.options.openMetrics = enabled
+	}
+}
+
+// stampCreated records when the aggregate first saw each cumulative series,
+// rendered as the OpenMetrics _created line. Series already carrying a
+// created timestamp from the client keep it.
+func stampCreated(family *dto.MetricFamily, now time.Time) {
+	created := timestamppb.New(now)
+	for _, m := range family.Metric {
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			if m.Counter != nil && m.Counter.CreatedTimestamp == nil {
+				m.Counter.CreatedTimestamp = created
+			}
+		case dto.MetricType_HISTOGRAM:
+			if m.Histogram != nil && m.Histogram.CreatedTimestamp == nil {
+				m.Histogram.CreatedTimestamp = created
+			}
+		case dto.MetricType_SUMMARY:
+			if m.Summary != nil && m.Summary.CreatedTimestamp == nil {
+				m.Summary.CreatedTimestamp = created
+			}
+		default:
+			return
+		}
+	}
+}
+
+// latestExemplar keeps the newest exemplar of two merged series
+func latestExemplar(a, b *dto.Exemplar) *dto.Exemplar {
+	if b != nil {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// opts returns the options currently in effect
+func (a *Aggregate) opts() *aggregateOptions {
+	return a.current.Load()
+}
+
+// metricTTL returns the metric TTL currently in effect, 0 when families
+// don't expire
+func (a *Aggregate) metricTTL() time.Duration {
+	if ttl := a.opts().metricTTLDuration; ttl != nil {
+		return *ttl
+	}
+	return 0
+}
+
+// UpdateOptions applies opts over the options of a running aggregate,
+// swapping them at once, so each push or render sees either the old
+// options or the new ones. Only options read per push or render take
+// effect, those the aggregate started workers or built state from, like
+// async ingest, replication, the push log or the shadow, stay as they were.
+func (a *Aggregate) UpdateOptions(opts ...Option) {
+	a.updateLock.Lock()
+	defer a.updateLock.Unlock()
+
+	scratch := &Aggregate{options: *a.opts()}
+	for _, opt := range opts {
+		opt(scratch)
+	}
+	scratch.options.formatOptions()
+	a.current.Store(&scratch.options)
+	// renders may depend on the options, don't serve them from the cache
+	a.generation.Add(1)
+}
+
+type runtimeOptions struct {
+	MetricTTL     string   `json:"metric_ttl"`
+	IgnoredLabels []string `json:"ignored_labels"`
+}
+
+// ServeOptions returns the options that can be changed at runtime, POST
+// changes those given as parameters: metric_ttl, a duration with 0
+// disabling expiry, and ignored_labels, comma separated with an empty
+// value ignoring none
+func (a *Aggregate) ServeOptions(w http.ResponseWriter, r *http.Request) {
+	if a.serveSubAggregateAdmin(w, r, (*Aggregate).ServeOptions) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var opts []Option
+		query := r.URL.Query()
+		if query.Has("metric_ttl") {
+			ttl, err := time.ParseDuration(query.Get("metric_ttl"))
+			if err != nil || ttl < 0 {
+				http.Error(w, "metric_ttl must be a non-negative duration", http.StatusBadRequest)
+				return
+			}
+			opts = append(opts, SetTTLMetricTime(&ttl))
+		}
+		if query.Has("ignored_labels") {
+			var labels []string
+			for _, label := range strings.Split(query.Get("ignored_labels"), ",") {
+				if label = strings.TrimSpace(label); label != "" {
+					labels = append(labels, label)
+				}
+			}
+			opts = append(opts, AddIgnoredLabels(labels...))
+		}
+		a.UpdateOptions(opts...)
+	}
+
+	current := a.opts()
+	writeJSON(w, http.StatusOK, runtimeOptions{
+		MetricTTL:     a.metricTTL().String(),
+		IgnoredLabels: append([]string{}, current.ignoredLabels...),
+	})
+}
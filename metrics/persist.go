@@ -0,0 +1,447 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"gopkg.in/yaml.v3"
+)
+
+// snapshotMagic starts every snapshot file, its last byte is the format
+// version. Version 2 precedes each family with its last push.
+const snapshotMagic = "PAGSNAP\x02"
+
+// snapshotMagicV1 starts the snapshots written without last pushes
+const snapshotMagicV1 = "PAGSNAP\x01"
+
+const (
+	// RestoreResetTTL starts the TTL of restored families at the restore,
+	// as if they had just been pushed
+	RestoreResetTTL = "reset"
+	// RestoreHonorTTL keeps the last push of restored families, those pushed
+	// to longer than the TTL ago expiring before they are rendered
+	RestoreHonorTTL = "honor"
+)
+
+const (
+	sectionPlain     byte = 0
+	sectionEncrypted byte = 1
+)
+
+// SetPersistence writes the aggregate to path every interval and once more
+// on Close, so a restarted gateway can Restore it instead of starting
+// empty. With keys, the series of each tenant are encrypted with the
+// tenant's key, or the default one, so a leaked snapshot or backup doesn't
+// leak the metrics. "" disables persistence.
+func SetPersistence(path string, interval time.Duration, keys *SnapshotKeys) Option {
+	return func(a *Aggregate) {
+		a.options.persistPath = path
+		a.options.persistInterval = interval
+		a.options.persistKeys = keys
+	}
+}
+
+// SetRestoreTTL sets how restoring a snapshot treats the TTL of its
+// families, RestoreResetTTL or RestoreHonorTTL. The age of each family's
+// last push as of the restore is exported either way.
+func SetRestoreTTL(mode string) Option {
+	return func(a *Aggregate) {
+		a.options.restoreTTL = mode
+	}
+}
+
+// SnapshotKeys are the AES-256 keys snapshots are encrypted with
+type SnapshotKeys struct {
+	// DefaultKey encrypts the series of tenants without their own key, and
+	// those of no tenant
+	DefaultKey string `yaml:"default_key"`
+	// TenantKeys are the keys of tenants by X-Scope-OrgID
+	TenantKeys map[string]string `yaml:"tenant_keys"`
+
+	aeads map[string]cipher.AEAD
+	// fallback is the AEAD of DefaultKey
+	fallback cipher.AEAD
+}
+
+// LoadSnapshotKeys reads a YAML file of base64 encoded 32 byte keys, as a
+// secrets manager or KMS agent would render it
+func LoadSnapshotKeys(path string) (*SnapshotKeys, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &SnapshotKeys{}
+	if err := yaml.Unmarshal(content, keys); err != nil {
+		return nil, fmt.Errorf("parsing snapshot keys %s: %w", path, err)
+	}
+	if err := keys.compile(); err != nil {
+		return nil, fmt.Errorf("invalid snapshot keys %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+func (k *SnapshotKeys) compile() error {
+	if k.DefaultKey == "" {
+		return errors.New("default_key is required")
+	}
+	var err error
+	if k.fallback, err = newSnapshotAEAD(k.DefaultKey); err != nil {
+		return fmt.Errorf("default_key: %w", err)
+	}
+	k.aeads = make(map[string]cipher.AEAD, len(k.TenantKeys))
+	for tenant, key := range k.TenantKeys {
+		if k.aeads[tenant], err = newSnapshotAEAD(key); err != nil {
+			return fmt.Errorf("key of tenant %q: %w", tenant, err)
+		}
+	}
+	return nil
+}
+
+func newSnapshotAEAD(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("not base64: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aead returns the AEAD encrypting the tenant's series
+func (k *SnapshotKeys) aead(tenant string) cipher.AEAD {
+	if aead, ok := k.aeads[tenant]; ok {
+		return aead
+	}
+	return k.fallback
+}
+
+type persister struct {
+	path string
+	keys *SnapshotKeys
+
+	// lock serializes writes of the snapshot
+	lock sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newPersister(a *Aggregate, path string, interval time.Duration, keys *SnapshotKeys) *persister {
+	p := &persister{path: path, keys: keys, stop: make(chan struct{})}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.persist(a)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// close stops the periodic writes and writes the final snapshot, also
+// after a handoff: it is what the next process restores should it fail to
+// restore the handed off state
+func (p *persister) close(a *Aggregate) {
+	close(p.stop)
+	p.wg.Wait()
+	p.persist(a)
+}
+
+func (p *persister) persist(a *Aggregate) {
+	if err := p.write(a); err != nil {
+		SnapshotWrites.WithLabelValues("error").Inc()
+		log.Printf("Could not persist the aggregate to %s: %s\n", p.path, err.Error())
+		return
+	}
+	SnapshotWrites.WithLabelValues("ok").Inc()
+}
+
+// write replaces the snapshot file with the aggregate's current state,
+// through a temporary file so a crash mid-write keeps the previous one
+func (p *persister) write(a *Aggregate) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	content, err := encodeSnapshot(a, p.keys)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// encodeSnapshot returns the aggregate's current state in the snapshot
+// format, the series of each tenant encrypted with keys if any
+func encodeSnapshot(a *Aggregate, keys *SnapshotKeys) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	sections, err := a.tenantSections()
+	if err != nil {
+		return nil, err
+	}
+	pushed := a.lastPushes()
+	tenants := make([]string, 0, len(sections))
+	for tenant := range sections {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	for _, tenant := range tenants {
+		var payload bytes.Buffer
+		for _, family := range sections[tenant] {
+			pushedAt, ok := pushed[family.GetName()]
+			if !ok {
+				// deleted since
+				pushedAt = time.Now()
+			}
+			payload.Write(binary.AppendVarint(nil, pushedAt.UnixNano()))
+			if _, err := protodelim.MarshalTo(&payload, family); err != nil {
+				return nil, err
+			}
+		}
+		mode, content := sectionPlain, payload.Bytes()
+		if keys != nil {
+			aead := keys.aead(tenant)
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			mode, content = sectionEncrypted, aead.Seal(nonce, nonce, content, []byte(tenant))
+		}
+		buf.Write(binary.AppendUvarint(nil, uint64(len(tenant))))
+		buf.WriteString(tenant)
+		buf.WriteByte(mode)
+		buf.Write(binary.AppendUvarint(nil, uint64(len(content))))
+		buf.Write(content)
+	}
+	return buf.Bytes(), nil
+}
+
+// tenantSections splits the families by the tenant of their series, every
+// family under "" when tenants are not enabled
+func (a *Aggregate) tenantSections() (map[string][]*dto.MetricFamily, error) {
+	families, err := a.pointInTime()
+	if err != nil {
+		return nil, err
+	}
+	label := a.opts().tenantLabel
+	sections := map[string][]*dto.MetricFamily{}
+	for _, f := range families {
+		family := f.toDTO()
+		if label == "" {
+			sections[""] = append(sections[""], family)
+			continue
+		}
+		byTenant := map[string]*dto.MetricFamily{}
+		for _, m := range family.Metric {
+			tenant := ""
+			for _, l := range m.Label {
+				if l.GetName() == label {
+					tenant = l.GetValue()
+					break
+				}
+			}
+			split, ok := byTenant[tenant]
+			if !ok {
+				split = &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Unit: family.Unit}
+				byTenant[tenant] = split
+				sections[tenant] = append(sections[tenant], split)
+			}
+			split.Metric = append(split.Metric, m)
+		}
+	}
+	return sections, nil
+}
+
+// lastPushes returns when each family was last pushed to
+func (a *Aggregate) lastPushes() map[string]time.Time {
+	pushed := map[string]time.Time{}
+	for _, f := range a.snapshot() {
+		f.family.lock.RLock()
+		pushed[f.name] = f.family.lastUpdate
+		f.family.lock.RUnlock()
+	}
+	return pushed
+}
+
+// Restore replaces the aggregate's state with its persisted snapshot, if
+// there is one. It fails on snapshots it can't read or decrypt rather than
+// start empty and overwrite them. Restored families keep their last push
+// with RestoreHonorTTL.
+func (a *Aggregate) Restore() error {
+	for _, sub := range a.subAggregates {
+		if err := sub.agg.Restore(); err != nil {
+			return err
+		}
+	}
+	path := a.opts().persistPath
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	families, pushed, err := readSnapshot(content, a.opts().persistKeys)
+	if err != nil {
+		return fmt.Errorf("restoring %s: %w", path, err)
+	}
+	a.replaceAll(families)
+
+	now := time.Now()
+	honor := a.opts().restoreTTL == RestoreHonorTTL
+	for name, pushedAt := range pushed {
+		family, ok := a.families.Get(name)
+		if !ok {
+			continue
+		}
+		if honor {
+			family.lock.Lock()
+			family.lastUpdate = pushedAt
+			family.lock.Unlock()
+		}
+		family.restored.Store(true)
+		a.familyMetrics.restoredAge.WithLabelValues(name).Set(now.Sub(pushedAt).Seconds())
+	}
+	if honor && pushed == nil {
+		log.Printf("The snapshot %s has no last pushes, the TTL of its families starts now\n", path)
+	}
+	return nil
+}
+
+// readSnapshot returns the families of a snapshot, and when each was last
+// pushed to unless the snapshot predates that
+func readSnapshot(content []byte, keys *SnapshotKeys) (map[string]*dto.MetricFamily, map[string]time.Time, error) {
+	var pushed map[string]time.Time
+	switch {
+	case bytes.HasPrefix(content, []byte(snapshotMagic)):
+		pushed = map[string]time.Time{}
+	case bytes.HasPrefix(content, []byte(snapshotMagicV1)):
+	default:
+		return nil, nil, errors.New("not a snapshot, or one of an unknown version")
+	}
+	r := bytes.NewReader(content[len(snapshotMagic):])
+
+	families := map[string]*dto.MetricFamily{}
+	for r.Len() > 0 {
+		tenant, err := readSnapshotField(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		mode, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, errors.New("truncated snapshot")
+		}
+		payload, err := readSnapshotField(r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch mode {
+		case sectionPlain:
+		case sectionEncrypted:
+			if keys == nil {
+				return nil, nil, fmt.Errorf("the series of tenant %q are encrypted, and no keys were given", tenant)
+			}
+			aead := keys.aead(string(tenant))
+			if len(payload) < aead.NonceSize() {
+				return nil, nil, errors.New("truncated snapshot")
+			}
+			nonce, sealed := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+			if payload, err = aead.Open(nil, nonce, sealed, tenant); err != nil {
+				return nil, nil, fmt.Errorf("could not decrypt the series of tenant %q, with a wrong key?", tenant)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown section mode %d", mode)
+		}
+
+		pr := bufio.NewReader(bytes.NewReader(payload))
+		for {
+			var pushedAt time.Time
+			if pushed != nil {
+				nanos, err := binary.ReadVarint(pr)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, nil, errors.New("truncated snapshot")
+				}
+				pushedAt = time.Unix(0, nanos)
+			}
+			family := &dto.MetricFamily{}
+			if err := protodelim.UnmarshalFrom(pr, family); err == io.EOF && pushed == nil {
+				break
+			} else if err != nil {
+				return nil, nil, err
+			}
+			if existing, ok := families[family.GetName()]; ok {
+				existing.Metric = append(existing.Metric, family.Metric...)
+			} else {
+				families[family.GetName()] = family
+			}
+			if pushed != nil && pushedAt.After(pushed[family.GetName()]) {
+				pushed[family.GetName()] = pushedAt
+			}
+		}
+	}
+	return families, pushed, nil
+}
+
+func readSnapshotField(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errors.New("truncated snapshot")
+	}
+	field := make([]byte, n)
+	_, _ = r.Read(field)
+	return field, nil
+}
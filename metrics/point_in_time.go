@@ -0,0 +1,213 @@
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// commit merges families normalized together, every family of a push, under
+// a single hold of the commit lock, so a point-in-time view has all of them
+// or none
+func (a *Aggregate) commit(staged []stagedFamily, ack *pushAck) error {
+	if len(staged) == 0 {
+		return nil
+	}
+	a.commits.RLock()
+	defer a.commits.RUnlock()
+	staged, err := a.checkCommit(staged)
+	if err != nil {
+		return err
+	}
+
+	var created []createdFamily
+	for _, f := range staged {
+		before := len(ack.created)
+		if err := a.saveNormalized(f.name, f.family, ack); err != nil {
+			a.rollbackCreated(created)
+			ack.created = ack.created[:len(ack.created)-len(created)]
+			return &familyError{family: f.name, err: err}
+		}
+		if len(ack.created) > before {
+			if family, ok := a.families.Get(f.name); ok {
+				created = append(created, createdFamily{name: f.name, family: family, generation: family.mergedGen.Load()})
+			}
+		}
+	}
+	return nil
+}
+
+// checkCommit fails a commit before any of it is merged when a family
+// wouldn't merge: pushed with another type than the family it merges into,
+// spilled and unreadable, or created under memory pressure. It returns the families in the order
+// to merge them, those to create first, so a push racing to create one of
+// them with another type only leaves created families to roll back.
+func (a *Aggregate) checkCommit(staged []stagedFamily) ([]stagedFamily, error) {
+	shedding := a.shedding()
+	ordered := make([]stagedFamily, 0, len(staged))
+	var existing []stagedFamily
+	for _, f := range staged {
+		family, ok := a.families.Get(f.name)
+		if !ok {
+			if shedding {
+				return nil, &familyError{family: f.name, err: ErrMemoryPressure}
+			}
+			ordered = append(ordered, f)
+			continue
+		}
+		if current := family.head(); current.ty != f.family.ty {
+			return nil, &familyError{family: f.name, err: fmt.Errorf("cannot merge metric '%s': type %s != %s",
+				current.name, current.ty.String(), f.family.ty.String())}
+		}
+		if family.current.Load() == nil {
+			if _, err := family.load(); err != nil {
+				return nil, &familyError{family: f.name, err: err}
+			}
+		}
+		existing = append(existing, f)
+	}
+	return append(ordered, existing...), nil
+}
+
+type createdFamily struct {
+	name       string
+	family     *Family
+	generation uint64
+}
+
+// rollbackCreated deletes the families a failed commit created, unless
+// another push merged into them since
+func (a *Aggregate) rollbackCreated(created []createdFamily) {
+	for _, c := range created {
+		family, ok := a.families.Delete(c.name, func(family *Family) bool {
+			return family == c.family && family.mergedGen.Load() == c.generation
+		})
+		if ok {
+			a.familyDeleted(c.name, family)
+		}
+	}
+}
+
+// pointInTime returns the state of every family as of the same instant,
+// sorted by name: no merge is in progress while it is read, so a render
+// doesn't show a family with merges another family lacks, nor part of a
+// push, each push being committed at once. It fails when a spilled family
+// can't be read back, rather than have the render leave it out.
+func (a *Aggregate) pointInTime() ([]*compactFamily, error) {
+	return a.pointInTimeOf(nil)
+}
+
+// pointInTimeOf is pointInTime of the families keep accepts, nil keeping
+// every family. Those left out aren't even read back when spilled.
+func (a *Aggregate) pointInTimeOf(keep func(name string) bool) ([]*compactFamily, error) {
+	in, err := a.instantOf(keep)
+	if err != nil {
+		return nil, err
+	}
+	defer in.close()
+	families := make([]*compactFamily, len(in))
+	for i := range in {
+		if families[i], err = in[i].load(); err != nil {
+			return nil, err
+		}
+	}
+	return families, nil
+}
+
+// instantFamily is a family as of an instant: its state when it was in
+// memory, else its spill file, opened then
+type instantFamily struct {
+	name   string
+	family *Family
+	state  *compactFamily
+	spill  *os.File
+}
+
+// atInstantFamily is the family as of now, to be taken while no merge is in
+// progress
+func atInstantFamily(name string, family *Family) (instantFamily, error) {
+	if current := family.current.Load(); current != nil {
+		return instantFamily{name: name, family: family, state: current}, nil
+	}
+	spill, err := family.openSpill()
+	if err != nil {
+		return instantFamily{}, err
+	}
+	return instantFamily{name: name, family: family, spill: spill}, nil
+}
+
+// load returns the state of the family, reading it back when it was
+// spilled, anew on each load
+func (f *instantFamily) load() (*compactFamily, error) {
+	if f.spill == nil {
+		return f.state, nil
+	}
+	return f.family.readSpill(f.spill)
+}
+
+// close closes the spill file of the family
+func (f *instantFamily) close() {
+	if f.spill != nil {
+		f.spill.Close()
+	}
+}
+
+// instant is the state of families as of the same instant, sorted by name.
+// Spilled families are only read back as they are loaded, one at a time,
+// so going through an instant never holds more of them in memory than the
+// one being loaded, nor blocks merges on disk reads.
+type instant []instantFamily
+
+// instantOf returns the instant of the families keep accepts, nil keeping
+// every family. It must be closed.
+func (a *Aggregate) instantOf(keep func(name string) bool) (instant, error) {
+	in := make(instant, 0, a.families.Len())
+	err := a.atInstant(func(name string, family *Family) error {
+		if keep != nil && !keep(name) {
+			return nil
+		}
+		f, err := atInstantFamily(name, family)
+		if err != nil {
+			return err
+		}
+		in = append(in, f)
+		return nil
+	})
+	if err != nil {
+		in.close()
+		return nil, err
+	}
+
+	sort.Slice(in, func(i, j int) bool { return in[i].name < in[j].name })
+	return in, nil
+}
+
+// spilled reports whether any of the families is read back from disk
+func (in instant) spilled() bool {
+	for i := range in {
+		if in[i].spill != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// close closes the spill files of the instant
+func (in instant) close() {
+	for i := range in {
+		in[i].close()
+	}
+}
+
+// atInstant calls visit with every family, in no particular order, while no
+// merge is in progress, stopping at the first error visit returns
+func (a *Aggregate) atInstant(visit func(name string, family *Family) error) error {
+	var err error
+	a.commits.Lock()
+	defer a.commits.Unlock()
+	a.families.Range(func(name string, family *Family) bool {
+		err = visit(name, family)
+		return err == nil
+	})
+	return err
+}
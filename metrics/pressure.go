@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"errors"
+	runtimemetrics "runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMemoryPressure = errors.New("under memory pressure, only pushes to existing metric families are accepted, retry later")
+
+// heapSampleInterval is how often the heap is checked against the load
+// shedding threshold. Reading runtime/metrics doesn't stop the world, so
+// this is cheap.
+const heapSampleInterval = time.Second
+
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// SetLoadShedding rejects pushes creating new families with 503 while the
+// heap holds more than heapBytes of live and not yet swept objects. Pushes
+// to existing families and scrapes keep being served, so the gateway sheds
+// growth instead of getting OOM-killed and losing all state.
+func SetLoadShedding(heapBytes int64) Option {
+	return func(a *Aggregate) {
+		a.options.shedHeapBytes = heapBytes
+	}
+}
+
+// memoryMonitor periodically samples the heap and flags when to shed load
+type memoryMonitor struct {
+	threshold uint64
+	shedding  atomic.Bool
+	sample    []runtimemetrics.Sample
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newMemoryMonitor(threshold int64) *memoryMonitor {
+	m := &memoryMonitor{
+		threshold: uint64(threshold),
+		sample:    []runtimemetrics.Sample{{Name: heapObjectsMetric}},
+		stop:      make(chan struct{}),
+	}
+	m.check()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(heapSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.check()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+func (m *memoryMonitor) check() {
+	runtimemetrics.Read(m.sample)
+	heap := m.sample[0].Value.Uint64()
+
+	shedding := heap > m.threshold
+	if m.shedding.Swap(shedding) != shedding {
+		if shedding {
+			LoadShedding.Set(1)
+		} else {
+			LoadShedding.Set(0)
+		}
+	}
+}
+
+func (m *memoryMonitor) close() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// shedding reports whether pushes creating new families must be rejected
+func (a *Aggregate) shedding() bool {
+	return a.memoryMonitor != nil && a.memoryMonitor.shedding.Load()
+}
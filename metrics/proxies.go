@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// RealIPForwardedFor takes the client from X-Forwarded-For, the last
+	// address not of a trusted proxy
+	RealIPForwardedFor = "X-Forwarded-For"
+	// RealIPHeader takes the client from X-Real-IP
+	RealIPHeader = "X-Real-IP"
+)
+
+// SetTrustedProxies believes the client address header of requests coming
+// from proxies, RealIPForwardedFor or RealIPHeader, so the producers of
+// usage accounting, the quarantine and the inventory, the push log and the
+// sidecar's local pushes see the pushing host rather than the ingress.
+// Requests from other addresses are taken as coming from their peer, the
+// header ignored.
+func SetTrustedProxies(proxies []netip.Prefix, header string) Option {
+	return func(a *Aggregate) {
+		a.options.trustedProxies = proxies
+		a.options.realIPHeader = header
+	}
+}
+
+// ParseTrustedProxies parses CIDRs and single addresses of trusted proxies
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	proxies := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, must be a CIDR or an address", value)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// clientAddr returns the address of the request's client, its peer unless
+// that is a trusted proxy giving the client in the real IP header
+func (a *Aggregate) clientAddr(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	opts := a.opts()
+	if len(opts.trustedProxies) == 0 || !opts.trustedProxy(peer) {
+		return peer
+	}
+
+	switch opts.realIPHeader {
+	case RealIPHeader:
+		if value := strings.TrimSpace(r.Header.Get(RealIPHeader)); value != "" {
+			if addr, err := netip.ParseAddr(value); err == nil {
+				return addr.Unmap().String()
+			}
+		}
+	default:
+		// proxies append their peer, so the first address from the right
+		// that isn't a trusted proxy is the client, anything left of it may
+		// be forged
+		hops := strings.Split(strings.Join(r.Header.Values(RealIPForwardedFor), ","), ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap().String()
+			if !opts.trustedProxy(client) {
+				break
+			}
+		}
+		if client != "" {
+			return client
+		}
+	}
+	return peer
+}
+
+// requestScheme returns the scheme the client sent the request with, that
+// of the X-Forwarded-Proto header of a trusted proxy when it gives http or
+// https
+func (a *Aggregate) requestScheme(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if opts := a.opts(); len(opts.trustedProxies) > 0 && opts.trustedProxy(peer) {
+		// the first proxy's, the client's side of the chain
+		forwarded, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		switch scheme := strings.ToLower(strings.TrimSpace(forwarded)); scheme {
+		case "http", "https":
+			return scheme
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (ao *aggregateOptions) trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range ao.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
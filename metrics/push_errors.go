@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// ErrorFormatText answers failed pushes in plain text, unless they
+	// accept application/json
+	ErrorFormatText = "text"
+	// ErrorFormatJSON always answers failed pushes in JSON
+	ErrorFormatJSON = "json"
+)
+
+// requestIDHeader carries the ID of a push, a client's own or one made up
+// for its error
+const requestIDHeader = "X-Request-Id"
+
+// SetErrorFormat picks how failed pushes are answered, ErrorFormatText or
+// ErrorFormatJSON. JSON errors carry a stable code, the message, the family
+// or line at fault when known and the request ID, so client tooling can
+// handle failures without matching messages.
+func SetErrorFormat(format string) Option {
+	return func(a *Aggregate) {
+		a.options.errorFormat = format
+	}
+}
+
+type pushErrorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Family    string `json:"family,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// familyError is an error merging a family of a push
+type familyError struct {
+	family string
+	err    error
+}
+
+func (e *familyError) Error() string { return e.err.Error() }
+
+func (e *familyError) Unwrap() error { return e.err }
+
+var (
+	// ErrBadEncoding is the error of a push whose body can't be decoded
+	// as its Content-Encoding says
+	ErrBadEncoding = errors.New("invalid Content-Encoding")
+	// ErrOverloaded is the error of a request the gateway shed
+	ErrOverloaded = errors.New("the gateway is overloaded")
+)
+
+// PushError answers a push the routers refused before it reached
+// ServeInsert, like a failed push, so its error comes out in the same
+// format whichever layer refused it
+func (a *Aggregate) PushError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	a.pushError(w, r, status, err)
+}
+
+// pushError answers a failed push with err and status, as http.Error would
+// unless the push gets JSON errors
+func (a *Aggregate) pushError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if a.opts().errorFormat != ErrorFormatJSON && !wantsAck(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	body := pushErrorBody{Code: errorCode(status, err), Message: err.Error(), RequestID: r.Header.Get(requestIDHeader)}
+	var famErr *familyError
+	if errors.As(err, &famErr) {
+		body.Family = famErr.family
+	}
+	var parseErr expfmt.ParseError
+	if errors.As(err, &parseErr) {
+		body.Line = parseErr.Line
+	}
+	if body.RequestID == "" {
+		id := make([]byte, 8)
+		_, _ = rand.Read(id)
+		body.RequestID = hex.EncodeToString(id)
+	}
+	w.Header().Set(requestIDHeader, body.RequestID)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, body)
+}
+
+// errorCode is the stable code of a push error
+func errorCode(status int, err error) string {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return "too_large"
+	case errors.Is(err, ErrReadOnlyReplica):
+		return "read_only_replica"
+	case errors.Is(err, ErrMaintenance):
+		return "maintenance"
+	case errors.Is(err, ErrQuarantined):
+		return "quarantined"
+	case errors.Is(err, ErrIngestQueueFull):
+		return "queue_full"
+	case errors.Is(err, ErrIngestClosed):
+		return "shutting_down"
+	case errors.Is(err, ErrIngestSaturated):
+		return "saturated"
+	case errors.Is(err, ErrMemoryPressure):
+		return "memory_pressure"
+	case errors.Is(err, ErrPushDeadline):
+		return "deadline"
+	case errors.Is(err, ErrPushCanceled):
+		return "canceled"
+	case errors.Is(err, ErrFilterFailed):
+		return "filter_failed"
+	case errors.Is(err, ErrTooManyLabelValues):
+		return "too_many_label_values"
+	case errors.Is(err, ErrSchemaViolation):
+		return "schema_violation"
+	case errors.Is(err, ErrOddNumberOfLabelParts):
+		return "odd_label_parts"
+	case errors.Is(err, ErrBadEncoding):
+		return "bad_encoding"
+	case errors.Is(err, ErrOverloaded):
+		return "overloaded"
+	}
+	var parseErr expfmt.ParseError
+	if errors.As(err, &parseErr) {
+		return "parse_error"
+	}
+	if status == http.StatusBadRequest {
+		return "invalid_push"
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+const redactedValue = "<redacted>"
+
+// maxLoggedError bounds the error response kept with a failed push
+const maxLoggedError = 512
+
+// SetPushLog keeps the last entries push bodies, holding up to maxBytes of
+// them, for tracing a surprising aggregate value back to the pushes behind
+// it. With redactLabels, bodies are parsed and kept as the families parsed,
+// their values of redactLabels redacted, what can't be parsed being left
+// out. Family watches redact them too. 0 entries keeps none.
+func SetPushLog(entries int, maxBytes int64, redactLabels []string) Option {
+	return func(a *Aggregate) {
+		a.options.pushLogEntries = entries
+		a.options.pushLogBytes = maxBytes
+		a.options.redactLabels = redactLabels
+	}
+}
+
+type loggedPush struct {
+	ReceivedAt  time.Time `json:"received_at"`
+	LabelPath   string    `json:"label_path"`
+	Source      string    `json:"source"`
+	ContentType string    `json:"content_type,omitempty"`
+	Status      int       `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Body        string    `json:"body"`
+	// Truncated bodies were cut at the log's size, or where they stopped
+	// parsing when redacted
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type pushLog struct {
+	entries  int
+	maxBytes int64
+	redact   map[string]struct{}
+
+	lock sync.Mutex
+	// byAge holds the pushes oldest first
+	byAge []*loggedPush
+	bytes int64
+}
+
+func newPushLog(entries int, maxBytes int64, redactLabels []string) *pushLog {
+	l := &pushLog{entries: entries, maxBytes: maxBytes, redact: map[string]struct{}{}}
+	for _, name := range redactLabels {
+		l.redact[name] = struct{}{}
+	}
+	return l
+}
+
+func (l *pushLog) add(push *loggedPush) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	size := int64(len(push.Body))
+	for len(l.byAge) > 0 && (len(l.byAge) >= l.entries || (l.maxBytes > 0 && l.bytes+size > l.maxBytes)) {
+		l.bytes -= int64(len(l.byAge[0].Body))
+		l.byAge = l.byAge[1:]
+	}
+	l.byAge = append(l.byAge, push)
+	l.bytes += size
+}
+
+func (l *pushLog) list() []*loggedPush {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*loggedPush(nil), l.byAge...)
+}
+
+// redactPath redacts the values of the redacted labels in a label path
+func (l *pushLog) redactPath(path string) string {
+	if len(l.redact) == 0 {
+		return path
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i+1 < len(parts); i += 2 {
+		if _, ok := l.redact[parts[i]]; ok {
+			parts[i+1] = redactedValue
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// redactBody returns the families of a captured body with the values of
+// the redacted labels redacted, as text of up to the log's size, and
+// whether some of the body was left out
+func (l *pushLog) redactBody(body string, truncated bool) (string, bool) {
+	if len(l.redact) == 0 {
+		return body, truncated
+	}
+	// a truncated body stops parsing at the cut, the families before it
+	// are kept
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(strings.NewReader(body))
+	truncated = truncated || err != nil
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out, buf bytes.Buffer
+	for _, name := range names {
+		family := families[name]
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if _, ok := l.redact[label.GetName()]; ok {
+					label.Value = proto.String(redactedValue)
+				}
+			}
+		}
+		buf.Reset()
+		if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+			// e.g. the series the cut ended in
+			truncated = true
+			continue
+		}
+		out.Write(buf.Bytes())
+	}
+	if l.maxBytes > 0 && int64(out.Len()) > l.maxBytes {
+		out.Truncate(int(l.maxBytes))
+		truncated = true
+	}
+	return out.String(), truncated
+}
+
+// capture tees the push's body and response status into the log, logging
+// the push from source when the returned func is called
+func (l *pushLog) capture(w http.ResponseWriter, r *http.Request, source string) (http.ResponseWriter, func()) {
+	body := &capturedBody{ReadCloser: r.Body, limit: l.maxBytes}
+	r.Body = body
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	receivedAt := time.Now()
+
+	return recorder, func() {
+		push := &loggedPush{
+			ReceivedAt:  receivedAt,
+			LabelPath:   l.redactPath(r.PathValue("labels")),
+			Source:      source,
+			ContentType: r.Header.Get("Content-Type"),
+			Status:      recorder.status,
+			Error:       strings.TrimSpace(recorder.errorBody.String()),
+		}
+		push.Body, push.Truncated = l.redactBody(body.buf.String(), body.truncated)
+		l.add(push)
+	}
+}
+
+// capturedBody keeps up to limit bytes of what is read from the body
+type capturedBody struct {
+	io.ReadCloser
+	limit     int64
+	buf       strings.Builder
+	truncated bool
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	kept := p[:n]
+	if b.limit > 0 {
+		if room := b.limit - int64(b.buf.Len()); int64(len(kept)) > room {
+			kept = kept[:max(room, 0)]
+			b.truncated = true
+		}
+	}
+	b.buf.Write(kept)
+	return n, err
+}
+
+// statusRecorder remembers the response status, and the start of the body of
+// error responses
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	errorBody strings.Builder
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status >= http.StatusBadRequest && s.errorBody.Len() < maxLoggedError {
+		s.errorBody.Write(p[:min(len(p), maxLoggedError-s.errorBody.Len())])
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// ServePushLog lists the logged pushes, oldest first, the last ?limit ones
+// when given
+func (a *Aggregate) ServePushLog(w http.ResponseWriter, r *http.Request) {
+	if a.pushLog == nil {
+		http.Error(w, "the push log is disabled, see --pushLogSize", http.StatusNotFound)
+		return
+	}
+	pushes := a.pushLog.list()
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		if limit < len(pushes) {
+			pushes = pushes[len(pushes)-limit:]
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"pushes": pushes})
+}
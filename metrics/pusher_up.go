@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// PusherUpMetric is the name of the synthetic liveness family
+const PusherUpMetric = "aggregation_gateway_pusher_up"
+
+const pusherUpHelp = "Whether the job pushed within the metric TTL, 0 for one TTL after it stopped"
+
+// SetPusherUp renders a PusherUpMetric gauge per job pushing to the
+// gateway, 1 while its last push is within the metric TTL and 0 for one
+// more TTL once it isn't, the push equivalent of a scrape's up. Jobs
+// pushing for a tenant get one per tenant, with the tenant label, so
+// tenant renders show theirs.
+func SetPusherUp(enabled bool) Option {
+	return func(a *Aggregate) {
+		a.options.pusherUp = enabled
+	}
+}
+
+// pushers tracks when each job last pushed, per tenant
+type pushers struct {
+	lock sync.Mutex
+	jobs map[pusherKey]*pusher
+}
+
+type pusherKey struct {
+	job, tenant string
+}
+
+type pusher struct {
+	lastPush time.Time
+	up       bool
+}
+
+func newPushers() *pushers {
+	return &pushers{jobs: map[pusherKey]*pusher{}}
+}
+
+func (p *pushers) seen(key pusherKey, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if state, ok := p.jobs[key]; ok {
+		state.lastPush, state.up = now, true
+		return
+	}
+	p.jobs[key] = &pusher{lastPush: now, up: true}
+}
+
+// expire marks the jobs that stopped pushing within ttl down and forgets
+// those down for a whole ttl, reporting whether any of them changed
+func (p *pushers) expire(now time.Time, ttl time.Duration) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	changed := false
+	for key, state := range p.jobs {
+		idle := now.Sub(state.lastPush)
+		switch {
+		case idle > 2*ttl:
+			delete(p.jobs, key)
+			changed = true
+		case idle > ttl && state.up:
+			state.up = false
+			changed = true
+		}
+	}
+	return changed
+}
+
+// family returns the liveness family, the tenant of a job in tenantLabel,
+// nil when no job pushed
+func (p *pushers) family(tenantLabel string) *compactFamily {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.jobs) == 0 {
+		return nil
+	}
+	family := &dto.MetricFamily{
+		Name: proto.String(PusherUpMetric),
+		Help: proto.String(pusherUpHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for key, state := range p.jobs {
+		value := 0.0
+		if state.up {
+			value = 1
+		}
+		labels := []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(key.job)}}
+		if key.tenant != "" && tenantLabel != "" {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(tenantLabel), Value: proto.String(key.tenant)})
+			sort.Sort(byName(labels))
+		}
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: labels,
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		})
+	}
+	sort.Sort(byLabel(family.Metric))
+	return compactFamilyFromDTO(family)
+}
+
+// notePush records a merged push for the liveness of the job, of tenant
+// when it has one
+func (a *Aggregate) notePush(job, tenant string) {
+	if a.pushers != nil && job != "" {
+		a.pushers.seen(pusherKey{job: job, tenant: tenant}, time.Now())
+	}
+}
+
+// renderFamilies returns the families a full render with opts encodes,
+// sorted by name, with the liveness family
+func (a *Aggregate) renderFamilies(opts *aggregateOptions) ([]*compactFamily, error) {
+	in, err := a.instantOf(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer in.close()
+	var families []*compactFamily
+	err = a.eachRenderFamily(in, opts, nil, func(family *compactFamily) error {
+		families = append(families, family)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// eachRenderFamily calls visit with the families of in as a full render
+// with opts encodes them, sorted by name, with their gauge spread
+// companions and the liveness family, unless keep leaves it out. Spilled
+// families are read back as they come, none of them held past visit.
+func (a *Aggregate) eachRenderFamily(in instant, opts *aggregateOptions, keep func(name string) bool, visit func(*compactFamily) error) error {
+	// synthetic families wait for the pushed ones sorting before them, and
+	// are left out for those of the same name
+	var synthetic []*compactFamily
+	if keep == nil || keep(PusherUpMetric) {
+		synthetic = a.withPusherUp(nil, opts, "")
+	}
+	for i := range in {
+		current, err := in[i].load()
+		if err != nil {
+			return err
+		}
+		family := opts.overrideMetadata(opts.collapseIgnored(current))
+		if opts.gaugeSpread && family.ty == dto.MetricType_GAUGE {
+			for _, companion := range spreadFamilies(family) {
+				synthetic = insertFamily(synthetic, companion)
+			}
+		}
+		for len(synthetic) > 0 && synthetic[0].name <= family.name {
+			if synthetic[0].name < family.name {
+				if err := visit(synthetic[0]); err != nil {
+					return err
+				}
+			}
+			synthetic = synthetic[1:]
+		}
+		if err := visit(family); err != nil {
+			return err
+		}
+	}
+	for _, family := range synthetic {
+		if err := visit(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withPusherUp adds the liveness family to families sorted by name, the
+// series of tenant only when it isn't ""
+func (a *Aggregate) withPusherUp(families []*compactFamily, opts *aggregateOptions, tenant string) []*compactFamily {
+	if a.pushers == nil {
+		return families
+	}
+	up := a.pushers.family(opts.tenantLabel)
+	if up != nil && tenant != "" {
+		up = tenantFamily(up, opts.tenantLabel, tenant)
+	}
+	if up == nil {
+		return families
+	}
+	return insertFamily(families, up)
+}
+
+// insertFamily adds a synthetic family to families sorted by name, unless
+// a pushed family took its name
+func insertFamily(families []*compactFamily, family *compactFamily) []*compactFamily {
+	i := sort.Search(len(families), func(i int) bool { return families[i].name >= family.name })
+	if i < len(families) && families[i].name == family.name {
+		return families
+	}
+	families = append(families, nil)
+	copy(families[i+1:], families[i:])
+	families[i] = family
+	return families
+}
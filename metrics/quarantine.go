@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrQuarantined = errors.New("quarantined")
+
+// SetQuarantine rejects pushes from a producer, its job, tenant and host,
+// with 429 for duration once failures of its pushes in a row were rejected
+// as invalid, so a broken client retrying in a tight loop stops costing
+// parse CPU. 0 failures disables the quarantine.
+func SetQuarantine(failures int, duration time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.quarantineFailures = failures
+		a.options.quarantineDuration = duration
+	}
+}
+
+type quarantinedProducer struct {
+	Job       string    `json:"job"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Source    string    `json:"source"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	Until     time.Time `json:"until"`
+}
+
+// quarantine counts the invalid pushes of each producer since its last
+// valid one
+type quarantine struct {
+	failures int
+	duration time.Duration
+
+	lock      sync.Mutex
+	producers map[producerKey]*producerFailures
+	// pruned is when producers last had those it no longer needs dropped
+	pruned time.Time
+}
+
+type producerFailures struct {
+	count     int
+	last      time.Time
+	lastError string
+	// until is when the quarantine ends, zero while there is none
+	until time.Time
+}
+
+func newQuarantine(failures int, duration time.Duration) *quarantine {
+	return &quarantine{failures: failures, duration: duration, producers: map[producerKey]*producerFailures{}}
+}
+
+// check returns until when the producer is quarantined, zero when it isn't
+func (q *quarantine) check(key producerKey, now time.Time) time.Time {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	p, ok := q.producers[key]
+	if !ok || p.until.IsZero() {
+		return time.Time{}
+	}
+	if !now.Before(p.until) {
+		delete(q.producers, key)
+		q.updateGauge()
+		return time.Time{}
+	}
+	return p.until
+}
+
+// record notes the outcome of a producer's push, only pushes rejected as
+// invalid count as failures, not those the gateway couldn't take
+func (q *quarantine) record(key producerKey, err error, now time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err == nil {
+		if _, ok := q.producers[key]; ok {
+			delete(q.producers, key)
+			q.updateGauge()
+		}
+		return
+	}
+	if !invalidPush(err) {
+		return
+	}
+	if now.Sub(q.pruned) >= q.duration {
+		q.prune(now)
+	}
+
+	p, ok := q.producers[key]
+	// failures a whole quarantine apart aren't a tight loop
+	if !ok || now.Sub(p.last) > q.duration {
+		p = &producerFailures{}
+		q.producers[key] = p
+	}
+	p.count++
+	p.last = now
+	p.lastError = err.Error()
+	if p.count >= q.failures && p.until.IsZero() {
+		p.until = now.Add(q.duration)
+		q.updateGauge()
+	}
+}
+
+// prune drops the producers whose quarantine ended, or whose failures are a
+// whole quarantine old, those that never push again included, the lock
+// being held
+func (q *quarantine) prune(now time.Time) {
+	for key, p := range q.producers {
+		if (p.until.IsZero() && now.Sub(p.last) > q.duration) || (!p.until.IsZero() && !now.Before(p.until)) {
+			delete(q.producers, key)
+		}
+	}
+	q.pruned = now
+	q.updateGauge()
+}
+
+func invalidPush(err error) bool {
+	status := insertErrorStatus(err)
+	return status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge
+}
+
+// updateGauge must be called with the lock held
+func (q *quarantine) updateGauge() {
+	n := 0
+	for _, p := range q.producers {
+		if !p.until.IsZero() {
+			n++
+		}
+	}
+	QuarantinedProducers.Set(float64(n))
+}
+
+func (q *quarantine) list(now time.Time) []quarantinedProducer {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.prune(now)
+
+	producers := []quarantinedProducer{}
+	for key, p := range q.producers {
+		if p.until.IsZero() {
+			continue
+		}
+		producers = append(producers, quarantinedProducer{
+			Job:       key.job,
+			Tenant:    key.tenant,
+			Source:    key.source,
+			Failures:  p.count,
+			LastError: p.lastError,
+			Until:     p.until,
+		})
+	}
+	sort.Slice(producers, func(i, j int) bool { return producers[i].Until.Before(producers[j].Until) })
+	return producers
+}
+
+// release lifts the quarantine of the producers matching job and source,
+// every producer for empty ones, returning how many were released
+func (q *quarantine) release(job, source string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	released := 0
+	for key, p := range q.producers {
+		if (job != "" && key.job != job) || (source != "" && key.source != source) {
+			continue
+		}
+		if !p.until.IsZero() {
+			released++
+		}
+		delete(q.producers, key)
+	}
+	q.updateGauge()
+	return released
+}
+
+// rejectQuarantined reports whether the push was rejected because its
+// producer is quarantined
+func (a *Aggregate) rejectQuarantined(w http.ResponseWriter, r *http.Request, key producerKey) bool {
+	if a.quarantine == nil {
+		return false
+	}
+	now := time.Now()
+	until := a.quarantine.check(key, now)
+	if until.IsZero() {
+		return false
+	}
+
+	IngestRejected.WithLabelValues("quarantine").Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(now).Seconds())+1))
+	a.pushError(w, r, http.StatusTooManyRequests, fmt.Errorf("job %q from %s is %w until %s after %d invalid pushes in a row, fix the pushes and retry after it",
+		key.job, key.source, ErrQuarantined, until.UTC().Format(time.RFC3339), a.quarantine.failures))
+	return true
+}
+
+// noteOutcome records whether a producer's push was merged for the quarantine
+func (a *Aggregate) noteOutcome(key producerKey, err error) {
+	if a.quarantine != nil {
+		a.quarantine.record(key, err, time.Now())
+	}
+}
+
+// ServeQuarantine lists the quarantined producers, DELETE releases those
+// matching the job and source parameters, every one without them
+func (a *Aggregate) ServeQuarantine(w http.ResponseWriter, r *http.Request) {
+	if a.quarantine == nil {
+		http.Error(w, "the quarantine is disabled, see --quarantineFailures", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		released := a.quarantine.release(r.URL.Query().Get("job"), r.URL.Query().Get("source"))
+		writeJSON(w, http.StatusOK, map[string]int{"released": released})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"producers": a.quarantine.list(time.Now())})
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type readFamily struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Help   string `json:"help,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+	Series int    `json:"series"`
+}
+
+// readSeries is a line of the series stream, a series of the JSON render
+// with its family
+type readSeries struct {
+	Family string `json:"family"`
+	Type   string `json:"type"`
+	jsonSeries
+}
+
+// readFamilies returns the families of the read API as /metrics renders
+// them, render filters, series limits, gauge spread and synthetic families
+// included, those named by ?name when given, sorted by name. Families not
+// named aren't read at all.
+func (a *Aggregate) readFamilies(r *http.Request) ([]*compactFamily, error) {
+	a.expireFamilies(time.Now())
+	var keep func(name string) bool
+	if names := r.URL.Query()["name"]; len(names) > 0 {
+		keep = func(name string) bool { return slices.Contains(names, name) }
+	}
+	in, err := a.instantOf(keep)
+	if err != nil {
+		return nil, err
+	}
+	defer in.close()
+	var families []*compactFamily
+	_, err = a.eachRendered(in, a.opts(), keep, func(family *compactFamily) error {
+		// not the gauge spread companions of the named families
+		if keep == nil || keep(family.name) {
+			families = append(families, family)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// ServeReadFamilies lists the families of the aggregate, their type, help,
+// unit and series count, sorted by name, for sidecar readers to find what
+// to stream. Repeated ?name parameters restrict it to those families.
+func (a *Aggregate) ServeReadFamilies(w http.ResponseWriter, r *http.Request) {
+	families, err := a.readFamilies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := make([]readFamily, 0, len(families))
+	for _, family := range families {
+		list = append(list, readFamily{
+			Name:   family.name,
+			Type:   strings.ToLower(family.ty.String()),
+			Help:   stringOrEmpty(family.help),
+			Unit:   stringOrEmpty(family.unit),
+			Series: len(family.series),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"families": list})
+}
+
+// ServeReadSeries streams the series of the aggregate as newline delimited
+// JSON, one series of the JSON render per line with its family and type,
+// family by family in name order, flushing after each family so readers
+// consume large aggregates as they come rather than parsing an exposition.
+// Repeated ?name parameters restrict it to those families and repeated
+// ?match=<label>=<value> ones to the series carrying all of those labels.
+func (a *Aggregate) ServeReadSeries(w http.ResponseWriter, r *http.Request) {
+	var matchers []labelPair
+	for _, match := range r.URL.Query()["match"] {
+		name, value, ok := strings.Cut(match, "=")
+		if !ok || name == "" {
+			http.Error(w, fmt.Sprintf("invalid match %q, must be <label>=<value>", match), http.StatusBadRequest)
+			return
+		}
+		matchers = append(matchers, labelPair{name: name, value: value})
+	}
+
+	families, err := a.readFamilies(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for _, family := range families {
+		rendered := familyToJSON(family.toDTO())
+		for _, series := range rendered.Metrics {
+			if !seriesMatches(series.Labels, matchers) {
+				continue
+			}
+			if err := enc.Encode(readSeries{Family: rendered.Name, Type: rendered.Type, jsonSeries: series}); err != nil {
+				log.Printf("An error has occurred while streaming series:\n\n%s\n", err.Error())
+				return
+			}
+		}
+		_ = rc.Flush()
+	}
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// seriesMatches reports whether labels carry every label of matchers
+func seriesMatches(labels map[string]string, matchers []labelPair) bool {
+	for _, m := range matchers {
+		if value, ok := labels[m.name]; !ok || value != m.value {
+			return false
+		}
+	}
+	return true
+}
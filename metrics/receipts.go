@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrReceiptsDisabled = errors.New("scrape receipts are disabled, see --scrapeReceipts")
+
+// receiptWebhookQueue is how many notifications may wait for the webhook,
+// more are dropped rather than slowing scrapes down
+const receiptWebhookQueue = 256
+
+// maxReceiptWait bounds how long a receipt request waits for the scrape
+const maxReceiptWait = 5 * time.Minute
+
+// Receipt statuses, queued until an asynchronous push is merged, then
+// pending until a scrape served it
+const (
+	ReceiptQueued  = "queued"
+	ReceiptPending = "pending"
+	ReceiptScraped = "scraped"
+	ReceiptFailed  = "failed"
+)
+
+// SetScrapeReceipts lets pushes ask for a receipt with ?receipt=true, which
+// tells once what they merged was served to a scraper: a render of
+// /metrics of a generation at least that of the push. Clients poll it on
+// /api/v1/receipt or, with webhookURL, get it posted there as JSON, giving
+// batch jobs exiting after their final push a delivery guarantee. Tenant
+// and sharded renders don't count. Receipts are held in memory, for
+// retention after their push. 0 disables them.
+func SetScrapeReceipts(retention time.Duration, webhookURL string) Option {
+	return func(a *Aggregate) {
+		a.options.receiptRetention = retention
+		a.options.receiptWebhook = webhookURL
+	}
+}
+
+type scrapeReceipt struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Job       string     `json:"job"`
+	PushedAt  time.Time  `json:"pushed_at"`
+	ScrapedAt *time.Time `json:"scraped_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+
+	// generation is that of the aggregate once the push was merged
+	generation uint64
+	// done is closed once the receipt is scraped or failed
+	done chan struct{}
+}
+
+type receipts struct {
+	retention time.Duration
+
+	lock sync.Mutex
+	byID map[string]*scrapeReceipt
+	// pending holds the merged receipts waiting for a scrape
+	pending map[string]*scrapeReceipt
+
+	webhook *webhook
+}
+
+func newReceipts(retention time.Duration, webhookURL string) *receipts {
+	return &receipts{
+		retention: retention,
+		byID:      map[string]*scrapeReceipt{},
+		pending:   map[string]*scrapeReceipt{},
+		webhook:   newWebhook(webhookURL, "a scrape receipt", receiptWebhookQueue, ReceiptNotifications),
+	}
+}
+
+// issue returns a new receipt for a push of job, queued until merged
+func (rs *receipts) issue(job string, now time.Time) *scrapeReceipt {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	receipt := &scrapeReceipt{ID: hex.EncodeToString(id), Status: ReceiptQueued, Job: job, PushedAt: now, done: make(chan struct{})}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.prune(now)
+	rs.byID[receipt.ID] = receipt
+	return receipt
+}
+
+// prune forgets the receipts pushed more than the retention ago
+func (rs *receipts) prune(now time.Time) {
+	for id, receipt := range rs.byID {
+		if now.Sub(receipt.PushedAt) > rs.retention {
+			delete(rs.byID, id)
+			delete(rs.pending, id)
+		}
+	}
+}
+
+// merged marks the push of a receipt merged, the aggregate being at
+// generation
+func (rs *receipts) merged(receipt *scrapeReceipt, generation uint64) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if _, ok := rs.byID[receipt.ID]; !ok {
+		return
+	}
+	receipt.Status, receipt.generation = ReceiptPending, generation
+	rs.pending[receipt.ID] = receipt
+}
+
+// failed marks the push of a receipt failed, it won't be scraped
+func (rs *receipts) failed(receipt *scrapeReceipt, err error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	receipt.Status, receipt.Error = ReceiptFailed, err.Error()
+	close(receipt.done)
+	rs.webhook.send(*receipt)
+}
+
+// served marks the receipts a render of generation served scraped
+func (rs *receipts) served(generation uint64, now time.Time) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for id, receipt := range rs.pending {
+		if receipt.generation > generation {
+			continue
+		}
+		delete(rs.pending, id)
+		receipt.Status, receipt.ScrapedAt = ReceiptScraped, &now
+		close(receipt.done)
+		ScrapedReceipts.Inc()
+		rs.webhook.send(*receipt)
+	}
+}
+
+// get returns a copy of a receipt, and a channel closed once it is settled
+func (rs *receipts) get(id string) (scrapeReceipt, <-chan struct{}, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	receipt, ok := rs.byID[id]
+	if !ok {
+		return scrapeReceipt{}, nil, false
+	}
+	return *receipt, receipt.done, true
+}
+
+// close sends the notifications still waiting
+func (rs *receipts) close() {
+	rs.webhook.close()
+}
+
+// wantsReceipt reports whether a push asks for a scrape receipt with
+// ?receipt=true
+func (a *Aggregate) wantsReceipt(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("receipt")
+	if value == "" {
+		return false, nil
+	}
+	want, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid receipt %q: %w", value, err)
+	}
+	if want && a.receipts == nil {
+		return false, ErrReceiptsDisabled
+	}
+	return want, nil
+}
+
+// issueReceipt returns the receipt of a push of job when it asks for one,
+// nil otherwise, naming it in the Scrape-Receipt response header
+func (a *Aggregate) issueReceipt(w http.ResponseWriter, want bool, job string) *scrapeReceipt {
+	if !want {
+		return nil
+	}
+	receipt := a.receipts.issue(job, time.Now())
+	w.Header().Set("Scrape-Receipt", receipt.ID)
+	return receipt
+}
+
+// noteMerged records the outcome of the merge of a push with a receipt
+func (a *Aggregate) noteMerged(receipt *scrapeReceipt, err error) {
+	if receipt == nil {
+		return
+	}
+	if err != nil {
+		a.receipts.failed(receipt, err)
+		return
+	}
+	a.receipts.merged(receipt, a.generation.Load())
+}
+
+// receiptID is the ID of a receipt, "" for none
+func receiptID(receipt *scrapeReceipt) string {
+	if receipt == nil {
+		return ""
+	}
+	return receipt.ID
+}
+
+// ServeReceipt answers with the receipt ?id of a push, and its status:
+// queued, pending, scraped or failed. With ?wait, a duration, it waits up
+// to that long for the receipt to be scraped or failed first.
+func (a *Aggregate) ServeReceipt(w http.ResponseWriter, r *http.Request) {
+	if a.receipts == nil {
+		http.Error(w, ErrReceiptsDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			http.Error(w, "wait must be a duration", http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, maxReceiptWait)
+	}
+
+	id := r.URL.Query().Get("id")
+	owner := a
+	receipt, done, ok := a.receipts.get(id)
+	for _, sub := range a.subAggregates {
+		if ok {
+			break
+		}
+		owner = sub.agg
+		receipt, done, ok = sub.agg.receipts.get(id)
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown receipt %q, it may have been pushed more than the retention ago", id), http.StatusNotFound)
+		return
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		select {
+		case <-done:
+			if settled, _, ok := owner.receipts.get(id); ok {
+				receipt = settled
+			}
+		case <-ctx.Done():
+		}
+	}
+	writeJSON(w, http.StatusOK, receipt)
+}
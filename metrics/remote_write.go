@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteLabel is a label of a flattened remote write series
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// appendRemoteWriteFamily appends the family as prometheus.WriteRequest
+// timeseries (field 1), flattening histograms and summaries the way
+// Prometheus stores classic ones: _bucket, _sum, _count and quantile series.
+func appendRemoteWriteFamily(buf []byte, family *dto.MetricFamily, timestampMs int64) []byte {
+	name := family.GetName()
+	for _, m := range family.Metric {
+		sample := func(suffix string, value float64, extra ...remoteWriteLabel) {
+			buf = appendTimeSeries(buf, name+suffix, m.Label, extra, value, timestampMs)
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sample("", m.Counter.GetValue())
+		case dto.MetricType_GAUGE:
+			sample("", m.Gauge.GetValue())
+		case dto.MetricType_UNTYPED:
+			sample("", m.Untyped.GetValue())
+		case dto.MetricType_SUMMARY:
+			for _, q := range m.Summary.GetQuantile() {
+				sample("", q.GetValue(), remoteWriteLabel{model.QuantileLabel, formatFloat(q.GetQuantile())})
+			}
+			sample("_sum", m.Summary.GetSampleSum())
+			sample("_count", float64(m.Summary.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			infSeen := false
+			for _, b := range m.Histogram.GetBucket() {
+				infSeen = infSeen || math.IsInf(b.GetUpperBound(), 1)
+				sample("_bucket", float64(b.GetCumulativeCount()), remoteWriteLabel{model.BucketLabel, formatFloat(b.GetUpperBound())})
+			}
+			if !infSeen {
+				sample("_bucket", float64(m.Histogram.GetSampleCount()), remoteWriteLabel{model.BucketLabel, "+Inf"})
+			}
+			sample("_sum", m.Histogram.GetSampleSum())
+			sample("_count", float64(m.Histogram.GetSampleCount()))
+		}
+	}
+	return buf
+}
+
+// appendTimeSeries appends one prometheus.TimeSeries with a single sample
+func appendTimeSeries(buf []byte, name string, metricLabels []*dto.LabelPair, extra []remoteWriteLabel, value float64, timestampMs int64) []byte {
+	labels := make([]remoteWriteLabel, 0, len(metricLabels)+len(extra)+1)
+	labels = append(labels, remoteWriteLabel{model.MetricNameLabel, name})
+	for _, l := range metricLabels {
+		labels = append(labels, remoteWriteLabel{l.GetName(), l.GetValue()})
+	}
+	labels = append(labels, extra...)
+	// remote write receivers expect labels sorted by name
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	var series []byte
+	for _, l := range labels {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, l.name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, l.value)
+
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestampMs))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, series)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
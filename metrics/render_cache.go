@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// renderCache keeps the fully encoded exposition per content type, tagged
+// with the aggregate generation it was encoded from.
+type renderCache struct {
+	lock    sync.Mutex
+	entries map[expfmt.Format]renderCacheEntry
+}
+
+type renderCacheEntry struct {
+	generation uint64
+	body       []byte
+	etag       string
+	// complete is whether the render served every family, see renderView
+	complete bool
+}
+
+func (rc *renderCache) get(contentType expfmt.Format, generation uint64) (renderCacheEntry, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	entry, ok := rc.entries[contentType]
+	if !ok || entry.generation != generation {
+		return renderCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (rc *renderCache) set(contentType expfmt.Format, entry renderCacheEntry) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if rc.entries == nil {
+		rc.entries = map[expfmt.Format]renderCacheEntry{}
+	}
+	rc.entries[contentType] = entry
+}
+
+func (rc *renderCache) lastSize(contentType expfmt.Format) int {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	return len(rc.entries[contentType].body)
+}
+
+// computeETag hashes the encoded body, so identical state yields the same
+// ETag even across restarts and replicas
+func computeETag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// gzipETag is the ETag of the gzipped encoding of the body tagged etag, a
+// strong ETag naming one representation, not the content
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
+
+// render returns the encoded aggregate, only re-encoding when a merge or
+// expiry happened since the last render of the same content type.
+func (a *Aggregate) render(contentType expfmt.Format, opts *aggregateOptions) (renderCacheEntry, error) {
+	a.expireFamilies(time.Now())
+
+	// Read the generation before encoding, a merge racing with the encode
+	// then simply invalidates the entry we're about to store.
+	generation := a.generation.Load()
+	if entry, ok := a.renderCache.get(contentType, generation); ok {
+		return entry, nil
+	}
+
+	// Size the buffer after the previous render to avoid regrowing it family by family
+	buf := bytes.NewBuffer(make([]byte, 0, a.renderCache.lastSize(contentType)))
+	complete, err := a.encodeRender(buf, contentType, opts)
+	if err != nil {
+		return renderCacheEntry{}, err
+	}
+	entry := renderCacheEntry{
+		generation: generation,
+		body:       buf.Bytes(),
+		etag:       computeETag(buf.Bytes()),
+		complete:   complete,
+	}
+	a.renderCache.set(contentType, entry)
+
+	return entry, nil
+}
+
+// etagMatches reports whether an If-None-Match header value matches the ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// SetIgnoreLabelsAtRender keeps the ignored labels on the merged series and
+// only merges the series differing by them at render, so the contributions
+// of each pod or instance stay inspectable on /api/v1/admin/raw. It costs
+// the memory of every series, and a merge per render.
+func SetIgnoreLabelsAtRender(enabled bool) Option {
+	return func(a *Aggregate) {
+		a.options.ignoreAtRender = enabled
+	}
+}
+
+// dropsIgnoredLabels reports whether ignored labels are dropped from pushes
+// before they are merged
+func (ao *aggregateOptions) dropsIgnoredLabels() bool {
+	return len(ao.ignoredLabels) > 0 && !ao.ignoreAtRender
+}
+
+// collapseIgnored returns the family as rendered, its series merged over the
+// ignored labels when they are only ignored at render
+func (ao *aggregateOptions) collapseIgnored(family *compactFamily) *compactFamily {
+	if !ao.ignoreAtRender || len(ao.ignoredLabels) == 0 {
+		return family
+	}
+
+	rendered := family.toDTO()
+	stripped := false
+	for _, m := range rendered.Metric {
+		kept := make([]*dto.LabelPair, 0, len(m.Label))
+		for _, l := range m.Label {
+			if !ao.ignoredLabels.labelInIgnoredList(l) {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) < len(m.Label) {
+			m.Label = kept
+			stripped = true
+		}
+	}
+	if !stripped {
+		return family
+	}
+
+	collapseSeriesWith(rendered, ao.mergeStrategy(family.ty))
+	collapsed := compactFamilyFromDTO(rendered)
+	collapsed.stampMs = family.stampMs
+	return collapsed
+}
+
+// ServeRawRender renders the families as merged, before the ignored labels
+// are merged over at render and without render filters or limits, those
+// matching ?name only when given
+func (a *Aggregate) ServeRawRender(w http.ResponseWriter, r *http.Request) {
+	if a.serveSubAggregateAdmin(w, r, (*Aggregate).ServeRawRender) {
+		return
+	}
+	a.expireFamilies(time.Now())
+	contentType := a.negotiateFormat(r.Header)
+
+	snapshot, err := a.pointInTime()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	var families []*compactFamily
+	for _, family := range snapshot {
+		if name == "" || family.name == name {
+			families = append(families, family)
+		}
+	}
+	serveFamilies(w, r, contentType, families, a.opts())
+}
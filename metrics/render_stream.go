@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// SetStreamingRender streams renders to the scraper, flushing every
+// flushEvery families, instead of encoding the whole aggregate in memory
+// for the render cache first. Streamed renders carry no ETag. timeout bounds
+// how long a single scrape may take, 0 leaves it unbounded.
+func SetStreamingRender(flushEvery int, timeout time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.renderFlushEvery = flushEvery
+		a.options.renderTimeout = timeout
+	}
+}
+
+// streamRender encodes families straight into the response. Once the
+// response has started the status can't change anymore, so a scrape that
+// times out or fails mid-way aborts the connection rather than end the
+// response normally and have the scraper ingest a truncated aggregate. It
+// reports whether the whole render was written and complete, see
+// eachRendered. Families read back from disk are encoded as they are read,
+// none of them held past its encoding. opts.renderFlushEvery must be
+// positive.
+func (a *Aggregate) streamRender(w http.ResponseWriter, r *http.Request, contentType expfmt.Format, opts *aggregateOptions) bool {
+	a.expireFamilies(time.Now())
+
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	if timeout := opts.renderTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := rc.SetWriteDeadline(time.Now().Add(timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Could not set the render write deadline: %s\n", err.Error())
+		}
+	}
+
+	in, err := a.instantOf(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	defer in.close()
+
+	w.Header().Set("Content-Type", string(contentType))
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	var out io.Writer = w
+	flush, finish := rc.Flush, rc.Flush
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		defer gzipWriterPool.Put(gz)
+		gz.Reset(w)
+		finish = func() error {
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		out = gz
+		flush = func() error {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+	}
+
+	fe := newFamilyEncoder(out, contentType, opts.encoderOptions(contentType)...)
+	encoded := 0
+	complete, err := a.eachRendered(in, opts, nil, func(family *compactFamily) error {
+		if err := fe.encode(family); err != nil {
+			RenderAborts.WithLabelValues("write").Inc()
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		if encoded++; encoded%opts.renderFlushEvery != 0 {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			reason := "canceled"
+			if errors.Is(err, context.DeadlineExceeded) {
+				reason = "timeout"
+			}
+			RenderAborts.WithLabelValues(reason).Inc()
+			log.Printf("Aborting render after %d families: %s\n", encoded, err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		if err := flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			RenderAborts.WithLabelValues("write").Inc()
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	})
+	if err != nil {
+		// a spilled family couldn't be read back: fail the render while
+		// nothing was written yet, else abort it
+		if encoded == 0 {
+			w.Header().Del("Content-Encoding")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		RenderAborts.WithLabelValues("read").Inc()
+		log.Printf("Aborting render after %d families: %s\n", encoded, err.Error())
+		panic(http.ErrAbortHandler)
+	}
+
+	if contentType.FormatType() == expfmt.TypeOpenMetrics {
+		if _, err := expfmt.FinalizeOpenMetrics(out); err != nil {
+			log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+			return false
+		}
+	}
+	if err := finish(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("An error has occurred while writing metrics:\n\n%s\n", err.Error())
+		return false
+	}
+	return complete
+}
@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+var ErrReadOnlyReplica = errors.New("this gateway is a read-only replica, push to the primary instead")
+
+// replicaSyncTimeout bounds a single snapshot pull from the primary
+const replicaSyncTimeout = 30 * time.Second
+
+// SetReplicaOf turns the aggregate into a read-only replica mirroring the
+// gateway rendering at primaryURL, pulling a fresh snapshot every interval.
+// Scrapers can then be spread over replicas without competing with the
+// primary's ingestion. Renders the primary reports as unchanged (by ETag)
+// are not transferred again.
+func SetReplicaOf(primaryURL string, interval time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.replicaOf = primaryURL
+		a.options.replicaInterval = interval
+	}
+}
+
+type replica struct {
+	primaryURL string
+	client     *http.Client
+
+	// lock serializes syncs and guards etag
+	lock sync.Mutex
+	etag string
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReplica(a *Aggregate, primaryURL string, interval time.Duration) *replica {
+	r := &replica{
+		primaryURL: primaryURL,
+		client:     &http.Client{Timeout: replicaSyncTimeout},
+		stop:       make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := r.sync(a); err != nil {
+				log.Printf("Could not sync from primary %s: %s\n", primaryURL, err.Error())
+			}
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// sync pulls the primary's current render and replaces the aggregate with it
+func (r *replica) sync(a *Aggregate) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, r.primaryURL, nil)
+	if err != nil {
+		ReplicaSyncs.WithLabelValues("error").Inc()
+		return err
+	}
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeProtoDelim).WithEscapingScheme(model.NoEscaping)))
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		ReplicaSyncs.WithLabelValues("error").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		ReplicaSyncs.WithLabelValues("not_modified").Inc()
+		ReplicaLastSync.SetToCurrentTime()
+		return nil
+	case http.StatusOK:
+	default:
+		ReplicaSyncs.WithLabelValues("error").Inc()
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	families, err := decodeRender(resp)
+	if err != nil {
+		ReplicaSyncs.WithLabelValues("error").Inc()
+		return err
+	}
+
+	a.replaceAll(families)
+	r.etag = resp.Header.Get("ETag")
+	ReplicaSyncs.WithLabelValues("ok").Inc()
+	ReplicaLastSync.SetToCurrentTime()
+	return nil
+}
+
+// decodeRender decodes the families of a gateway's render, in whatever
+// format it was answered with
+func decodeRender(resp *http.Response) (map[string]*dto.MetricFamily, error) {
+	families := map[string]*dto.MetricFamily{}
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		family := &dto.MetricFamily{}
+		if err := dec.Decode(family); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families[family.GetName()] = family
+	}
+}
+
+func (r *replica) close() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// replaceAll swaps the state of the aggregate for families, dropping the
+// families that aren't part of it anymore
+func (a *Aggregate) replaceAll(families map[string]*dto.MetricFamily) {
+	a.commits.RLock()
+	defer a.commits.RUnlock()
+	for _, f := range a.snapshot() {
+		if _, ok := families[f.name]; !ok {
+			a.removeFamily(f.name)
+		}
+	}
+
+	opts := a.opts()
+	for name, family := range families {
+		if !metricsSorted(family.Metric) {
+			sort.Sort(byLabel(family.Metric))
+		}
+		compact := compactFamilyFromDTO(family)
+		if existingFamily := a.setFamilyOrGetExistingFamily(name, compact, opts); existingFamily != nil {
+			a.addMemoryBytes(existingFamily.replace(compact, a.familyMetrics.byType))
+			a.familyMerged(name, existingFamily)
+		}
+	}
+
+	a.generation.Add(1)
+}
+
+// replace swaps the family's state for compact, which it takes over, and
+// returns by how many bytes its estimated size changed
+func (mf *Family) replace(compact *compactFamily, byType *prometheus.GaugeVec) int64 {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+
+	if previous := mf.head(); previous.ty != compact.ty {
+		byType.WithLabelValues(previous.ty.String()).Dec()
+		byType.WithLabelValues(compact.ty.String()).Inc()
+	}
+	mf.publish(compact)
+	mf.lastUpdate = time.Now()
+	mf.metricCount.Set(float64(len(compact.series)))
+
+	newSize := estimateFamilyBytes(compact)
+	sizeDelta := newSize - mf.sizeBytes
+	mf.sizeBytes = newSize
+	return sizeDelta
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+// RollupRule collapses the families it matches at ingest, before they are
+// merged, to keep high-cardinality histograms from growing the aggregate
+type RollupRule struct {
+	// Match is an anchored regular expression on the family name
+	Match string `yaml:"match"`
+	// DropLabels are removed from every series, series left with the same
+	// labels are merged, e.g. per-endpoint histograms into a per-service one
+	DropLabels []string `yaml:"drop_labels"`
+	// MaxBucket drops histogram buckets with a higher upper bound, +Inf is kept
+	MaxBucket *float64 `yaml:"max_bucket"`
+	// Buckets, if set, are the only histogram upper bounds kept, +Inf aside
+	Buckets []float64 `yaml:"buckets"`
+
+	re *regexp.Regexp
+}
+
+type rollupFile struct {
+	RollupRules []RollupRule `yaml:"rollup_rules"`
+}
+
+// LoadRollupRules reads the rollup_rules list of a YAML file
+func LoadRollupRules(path string) ([]RollupRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := rollupFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing rollup rules %s: %w", path, err)
+	}
+	for i := range file.RollupRules {
+		if err := file.RollupRules[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid rollup rule %d in %s: %w", i+1, path, err)
+		}
+	}
+	return file.RollupRules, nil
+}
+
+func (r *RollupRule) compile() error {
+	if r.Match == "" {
+		return fmt.Errorf("match is missing")
+	}
+	re, err := regexp.Compile("^(?:" + r.Match + ")$")
+	if err != nil {
+		return err
+	}
+	r.re = re
+	sort.Float64s(r.Buckets)
+	return nil
+}
+
+// SetRollupRules applies rules to the pushed families they match, in order.
+// Invalid rules are logged and left out.
+func SetRollupRules(rules []RollupRule) Option {
+	return func(a *Aggregate) {
+		a.options.rollupRules = nil
+		for _, rule := range rules {
+			if rule.re == nil {
+				if err := rule.compile(); err != nil {
+					log.Printf("Ignoring rollup rule %q: %s\n", rule.Match, err.Error())
+					continue
+				}
+			}
+			a.options.rollupRules = append(a.options.rollupRules, rule)
+		}
+	}
+}
+
+// rollup applies the matching rules to a family with sorted labels
+func (ao *aggregateOptions) rollup(family *dto.MetricFamily) {
+	for i := range ao.rollupRules {
+		rule := &ao.rollupRules[i]
+		if !rule.re.MatchString(family.GetName()) {
+			continue
+		}
+
+		if family.GetType() == dto.MetricType_HISTOGRAM && (rule.MaxBucket != nil || rule.Buckets != nil) {
+			for _, m := range family.Metric {
+				if m.Histogram == nil {
+					continue
+				}
+				m.Histogram.Bucket = slices.DeleteFunc(m.Histogram.Bucket, func(b *dto.Bucket) bool {
+					return !rule.keepsBucket(b.GetUpperBound())
+				})
+			}
+		}
+		if len(rule.DropLabels) > 0 {
+			for _, m := range family.Metric {
+				m.Label = slices.DeleteFunc(m.Label, func(l *dto.LabelPair) bool {
+					return slices.Contains(rule.DropLabels, l.GetName())
+				})
+			}
+			collapseSeries(family)
+		}
+	}
+}
+
+func (r *RollupRule) keepsBucket(upperBound float64) bool {
+	if math.IsInf(upperBound, 1) {
+		return true
+	}
+	if r.MaxBucket != nil && upperBound > *r.MaxBucket {
+		return false
+	}
+	if r.Buckets != nil {
+		_, found := slices.BinarySearch(r.Buckets, upperBound)
+		return found
+	}
+	return true
+}
+
+// collapseSeries merges the series of a family left with the same labels,
+// the way pushes to the same series are merged
+func collapseSeries(family *dto.MetricFamily) {
+	collapseSeriesWith(family, nil)
+}
+
+// collapseSeriesWith is collapseSeries with a merge strategy, nil for the
+// built-in sum, returning how many series were merged into others. Series
+// with the same labels are merged in the order they came in.
+func collapseSeriesWith(family *dto.MetricFamily, strategy MergeStrategy) int {
+	if !metricsSorted(family.Metric) {
+		sort.Stable(byLabel(family.Metric))
+	}
+	series := compactSeriesFromDTO(family.GetType(), family.Metric)
+
+	collapsed := series[:0]
+	for _, s := range series {
+		if n := len(collapsed); n > 0 && collapsed[n-1].labels == s.labels {
+			if merged, ok := mergeSeries(family.GetType(), &collapsed[n-1], &s, strategy, true); ok {
+				collapsed[n-1] = merged
+			}
+			continue
+		}
+		collapsed = append(collapsed, s)
+	}
+	merged := len(family.Metric) - len(collapsed)
+	if merged == 0 {
+		return 0
+	}
+
+	compact := &compactFamily{name: family.GetName(), ty: family.GetType(), series: collapsed}
+	family.Metric = compact.toDTO().Metric
+	return merged
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrSchemaViolation = errors.New("push violates the metrics schema")
+
+const (
+	// SchemaReject rejects pushes violating the schema with 400
+	SchemaReject = "reject"
+	// SchemaWarn merges them, counting and reporting the violations
+	SchemaWarn = "warn"
+)
+
+// Schema is the metrics contract pushes are held to
+type Schema struct {
+	// Enforcement is SchemaReject (the default) or SchemaWarn
+	Enforcement string `yaml:"enforcement"`
+	// Strict also holds families missing from Families as violations
+	Strict   bool           `yaml:"strict"`
+	Families []FamilySchema `yaml:"families"`
+
+	byName map[string]*FamilySchema
+}
+
+type FamilySchema struct {
+	Name string `yaml:"name"`
+	// Type is counter, gauge, histogram, summary or untyped, any when empty
+	Type string `yaml:"type"`
+	// Unit is checked against pushes giving one, in OpenMetrics or protobuf
+	Unit string `yaml:"unit"`
+	// Labels are the only labels the series may have, path labels included,
+	// any when empty
+	Labels []string `yaml:"labels"`
+}
+
+// LoadSchema reads a metrics schema YAML file
+func LoadSchema(path string) (*Schema, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{}
+	if err := yaml.Unmarshal(content, schema); err != nil {
+		return nil, fmt.Errorf("parsing metrics schema %s: %w", path, err)
+	}
+	if err := schema.compile(); err != nil {
+		return nil, fmt.Errorf("invalid metrics schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+func (s *Schema) compile() error {
+	switch s.Enforcement {
+	case "":
+		s.Enforcement = SchemaReject
+	case SchemaReject, SchemaWarn:
+	default:
+		return fmt.Errorf("unknown enforcement %q, must be %q or %q", s.Enforcement, SchemaReject, SchemaWarn)
+	}
+
+	s.byName = make(map[string]*FamilySchema, len(s.Families))
+	for i := range s.Families {
+		f := &s.Families[i]
+		if f.Name == "" {
+			return fmt.Errorf("family %d has no name", i+1)
+		}
+		if _, ok := s.byName[f.Name]; ok {
+			return fmt.Errorf("family %s is listed twice", f.Name)
+		}
+		if f.Type != "" {
+			if _, ok := dto.MetricType_value[strings.ToUpper(f.Type)]; !ok {
+				return fmt.Errorf("family %s has unknown type %q", f.Name, f.Type)
+			}
+		}
+		s.byName[f.Name] = f
+	}
+	return nil
+}
+
+// SetSchema holds pushes to schema, nil accepts anything. An invalid schema
+// is logged and ignored.
+func SetSchema(schema *Schema) Option {
+	return func(a *Aggregate) {
+		if schema != nil && schema.byName == nil {
+			if err := schema.compile(); err != nil {
+				log.Printf("Ignoring metrics schema: %s\n", err.Error())
+				schema = nil
+			}
+		}
+		a.options.schema = schema
+	}
+}
+
+// violations lists how a family with formatted labels breaks the schema
+func (s *Schema) violations(family *dto.MetricFamily) []string {
+	expected, ok := s.byName[family.GetName()]
+	if !ok {
+		if s.Strict {
+			return []string{fmt.Sprintf("family %s is not in the schema", family.GetName())}
+		}
+		return nil
+	}
+
+	var violations []string
+	if expected.Type != "" && !strings.EqualFold(expected.Type, family.GetType().String()) {
+		violations = append(violations, fmt.Sprintf("family %s is a %s, the schema expects a %s",
+			family.GetName(), strings.ToLower(family.GetType().String()), expected.Type))
+	}
+	if expected.Unit != "" && family.GetUnit() != "" && family.GetUnit() != expected.Unit {
+		violations = append(violations, fmt.Sprintf("family %s has unit %s, the schema expects %s", family.GetName(), family.GetUnit(), expected.Unit))
+	}
+	if len(expected.Labels) > 0 {
+		reported := map[string]struct{}{}
+		for _, m := range family.Metric {
+			for _, l := range m.Label {
+				name := l.GetName()
+				if _, done := reported[name]; done || slices.Contains(expected.Labels, name) {
+					continue
+				}
+				reported[name] = struct{}{}
+				violations = append(violations, fmt.Sprintf("family %s has label %s, which the schema doesn't allow", family.GetName(), name))
+			}
+		}
+	}
+	return violations
+}
+
+// enforceSchema returns the error rejecting the family, or records its
+// violations as warnings of the push
+func (ao *aggregateOptions) enforceSchema(family *dto.MetricFamily, ack *pushAck) error {
+	violations := ao.schema.violations(family)
+	if len(violations) == 0 {
+		return nil
+	}
+	// families missing from the schema are counted together, pushers
+	// making up names would otherwise grow the family label unbounded
+	counted := ""
+	if _, listed := ao.schema.byName[family.GetName()]; listed {
+		counted = family.GetName()
+	}
+	SchemaViolations.WithLabelValues(counted, ao.schema.Enforcement).Add(float64(len(violations)))
+	if ao.schema.Enforcement == SchemaReject {
+		return fmt.Errorf("%w: %s", ErrSchemaViolation, strings.Join(violations, "; "))
+	}
+	ack.warnings = append(ack.warnings, violations...)
+	return nil
+}
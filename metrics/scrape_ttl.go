@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SetScrapeTTL expires families once scrapes renders of /metrics were
+// served since their last push, so a scraper sees the final push of every
+// family however late it scrapes. With a metric TTL too, a family expires
+// once both went by. Tenant and sharded renders don't count, nor do renders
+// not written in full or missing series, filtered out or over the series
+// limit, see renderView. 0 disables it.
+func SetScrapeTTL(scrapes int) Option {
+	return func(a *Aggregate) {
+		a.options.scrapeTTL = scrapes
+	}
+}
+
+// scrapeClock remembers the aggregate generations the latest renders were
+// served from. A family last merged at generation g is part of every render
+// of a generation of at least g, so it was scraped n times once n served
+// renders are that recent.
+type scrapeClock struct {
+	lock sync.Mutex
+	// served holds the largest generations served, ascending
+	served []uint64
+}
+
+// serve records a render of generation, keeping the n largest
+func (c *scrapeClock) serve(generation uint64, n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := sort.Search(len(c.served), func(i int) bool { return c.served[i] > generation })
+	c.served = append(c.served, 0)
+	copy(c.served[i+1:], c.served[i:])
+	c.served[i] = generation
+	if len(c.served) > n {
+		c.served = c.served[len(c.served)-n:]
+	}
+}
+
+// horizon returns the generation up to which families were scraped n
+// times, false while fewer than n renders were served
+func (c *scrapeClock) horizon(n int) (uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.served) < n {
+		return 0, false
+	}
+	return c.served[len(c.served)-n], true
+}
+
+// noteScraped records a render of generation with opts served to a scraper
+func (a *Aggregate) noteScraped(generation uint64, opts *aggregateOptions) {
+	if n := opts.scrapeTTL; n > 0 {
+		a.scrapeClock.serve(generation, n)
+	}
+	a.guardCounters(generation, opts)
+	if a.receipts != nil {
+		a.receipts.served(generation, time.Now())
+	}
+}
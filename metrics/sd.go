@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// sdLabelPrefix starts the meta labels of the targets of ServeSD, which
+// Prometheus drops after relabeling
+const sdLabelPrefix = "__meta_aggregation_gateway_"
+
+// sdTargetGroup is a target group of the Prometheus HTTP service discovery
+// format
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ServeSD lists the render endpoints of the gateway in the Prometheus HTTP
+// service discovery format: /metrics, those of the shadow and the
+// sub-aggregates and, with tenants, one per tenant with series, selected by
+// ?tenant since scrapers can't set a header per target. With ?shards=N and
+// sharded renders, each endpoint but the tenant ones is split into N
+// shards instead. Targets are the host the request was sent to, ?target
+// overriding it, with the scheme it was sent with, that a trusted proxy
+// forwarded or ?scheme.
+func (a *Aggregate) ServeSD(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		target = r.Host
+	}
+	scheme := r.URL.Query().Get("scheme")
+	switch scheme {
+	case "":
+		scheme = a.requestScheme(r)
+	case "http", "https":
+	default:
+		http.Error(w, fmt.Sprintf("invalid scheme %q, must be http or https", scheme), http.StatusBadRequest)
+		return
+	}
+	shards := 0
+	if value := r.URL.Query().Get("shards"); value != "" {
+		var err error
+		if shards, err = strconv.Atoi(value); err != nil || shards < 1 {
+			http.Error(w, fmt.Sprintf("invalid shards %q, must be a positive number", value), http.StatusBadRequest)
+			return
+		}
+		if a.opts().renderSeriesMode != SeriesLimitSplit {
+			http.Error(w, "sharded renders are disabled, see --maxRenderSeriesMode", http.StatusBadRequest)
+			return
+		}
+	}
+
+	groups := []sdTargetGroup{}
+	group := func(path string, labels map[string]string) {
+		labels["__metrics_path__"] = path
+		if scheme == "https" {
+			labels["__scheme__"] = scheme
+		}
+		groups = append(groups, sdTargetGroup{Targets: []string{target}, Labels: labels})
+	}
+	var failed error
+	endpoint := func(path, kind string, agg *Aggregate, labels map[string]string) {
+		if shards == 0 {
+			group(path, labels)
+		}
+		for shard := 0; shard < shards; shard++ {
+			sharded := map[string]string{sdLabelPrefix + "shard": strconv.Itoa(shard), "__param_shards": strconv.Itoa(shards), "__param_shard": strconv.Itoa(shard)}
+			for name, value := range labels {
+				sharded[name] = value
+			}
+			group(path, sharded)
+		}
+		if agg == nil {
+			return
+		}
+		tenants, err := agg.tenants()
+		if err != nil {
+			failed = err
+			return
+		}
+		for _, tenant := range tenants {
+			tenantLabels := map[string]string{sdLabelPrefix + "tenant": tenant, "__param_tenant": tenant}
+			for name, value := range labels {
+				tenantLabels[name] = value
+			}
+			tenantLabels[sdLabelPrefix+"endpoint"] = kind + "_tenant"
+			group(path, tenantLabels)
+		}
+	}
+
+	endpoint("/metrics", "main", a, map[string]string{sdLabelPrefix + "endpoint": "main"})
+	if a.shadow != nil {
+		endpoint("/api/v1/shadow/metrics", "shadow", nil, map[string]string{sdLabelPrefix + "endpoint": "shadow"})
+	}
+	for _, sub := range a.subAggregates {
+		endpoint("/metrics/"+url.PathEscape(sub.label)+"/"+url.PathEscape(sub.value), "sub_aggregate", sub.agg, map[string]string{
+			sdLabelPrefix + "endpoint":      "sub_aggregate",
+			sdLabelPrefix + "sub_aggregate": sub.label + "=" + sub.value,
+		})
+	}
+	if failed != nil {
+		http.Error(w, failed.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// tenants returns the sorted values of the tenant label among the series,
+// none when tenants are not enabled
+func (a *Aggregate) tenants() ([]string, error) {
+	label := a.opts().tenantLabel
+	if label == "" {
+		return nil, nil
+	}
+	families, err := a.pointInTime()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, family := range families {
+		for _, s := range family.series {
+			for _, l := range s.labels.pairs() {
+				if l.GetName() == label && tenantIDPattern.MatchString(l.GetValue()) {
+					seen[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	tenants := make([]string, 0, len(seen))
+	for tenant := range seen {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
@@ -0,0 +1,471 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// selftestPrefix starts the name of every synthetic family of the self-test
+const selftestPrefix = "selftest_"
+
+// selftestPush is pushed to two groups by the self-test, with label values
+// that need escaping in every format
+const selftestPush = `# HELP selftest_requests_total Requests of the self-test.
+# TYPE selftest_requests_total counter
+selftest_requests_total{code="200",path="/a \"quoted\" \\ path\nwith a newline"} 42
+selftest_requests_total{code="500",path="/b"} 0.5
+# TYPE selftest_temperature gauge
+selftest_temperature{unit="°C"} -12.25
+# TYPE selftest_latency_seconds histogram
+selftest_latency_seconds_bucket{le="0.1"} 3
+selftest_latency_seconds_bucket{le="1"} 5
+selftest_latency_seconds_bucket{le="+Inf"} 6
+selftest_latency_seconds_sum 2.5
+selftest_latency_seconds_count 6
+# TYPE selftest_size_bytes summary
+selftest_size_bytes{quantile="0.5"} 128
+selftest_size_bytes{quantile="0.99"} 4096
+selftest_size_bytes_sum 8192
+selftest_size_bytes_count 10
+`
+
+// selftestGroups are the label paths the self-test pushes to
+var selftestGroups = []string{"/job/selftest/instance/a", "/job/selftest/instance/b"}
+
+type selftestResult struct {
+	Format      string `json:"format"`
+	ContentType string `json:"content_type,omitempty"`
+	OK          bool   `json:"ok"`
+	Skipped     string `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// selftestFormats are the exposition formats of /metrics the self-test
+// renders, by Accept and Accept-Encoding
+var selftestFormats = []struct {
+	name, accept, encoding string
+}{
+	{name: "text", accept: "text/plain;version=0.0.4"},
+	{name: "text+gzip", accept: "text/plain;version=0.0.4", encoding: "gzip"},
+	{name: "protobuf", accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"},
+	{name: "openmetrics", accept: "application/openmetrics-text;version=1.0.0"},
+}
+
+// newSelftestAggregate returns an empty aggregate with the render options of
+// a, the rules, filters and limits that change families left out, and self
+// metrics of its own
+func (a *Aggregate) newSelftestAggregate() *Aggregate {
+	current := a.opts()
+	return NewAggregate(withUnregisteredMetrics(), func(s *Aggregate) {
+		s.options.openMetrics = current.openMetrics
+		s.options.renderTimestamps = current.renderTimestamps
+		s.options.renderFlushEvery = current.renderFlushEvery
+		s.options.renderTimeout = current.renderTimeout
+		s.options.nativeSchema = current.nativeSchema
+		s.options.mergeStrategies = current.mergeStrategies
+		s.options.duplicateSeries = current.duplicateSeries
+	})
+}
+
+// ServeSelftest pushes synthetic families of every type to an empty
+// aggregate with the render options of this one, renders them in every
+// format of /metrics (text, gzipped text, protobuf and OpenMetrics when
+// enabled), JSON, CSV and Graphite, and decodes each render back, reporting
+// the formats whose samples don't match what was pushed. ?accept also
+// renders with that Accept header, e.g. the one of a scraper. It answers
+// 500 when a format failed.
+func (a *Aggregate) ServeSelftest(w http.ResponseWriter, r *http.Request) {
+	selftest := a.newSelftestAggregate()
+	defer selftest.Close()
+
+	want := map[string]float64{}
+	for _, group := range selftestGroups {
+		labels, _, _ := parseLabelsInPath(group)
+		if err := selftest.parseAndMerge(strings.NewReader(selftestPush), labels); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"ok": false, "error": fmt.Sprintf("merging the push: %s", err.Error())})
+			return
+		}
+		group, err := selftestSamples(selftestPush, labels)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"ok": false, "error": fmt.Sprintf("parsing the push: %s", err.Error())})
+			return
+		}
+		for key, value := range group {
+			want[key] = value
+		}
+	}
+
+	results := []selftestResult{}
+	for _, format := range selftestFormats {
+		if format.name == "openmetrics" && !selftest.opts().openMetrics {
+			results = append(results, selftestResult{Format: format.name, OK: true, Skipped: "OpenMetrics is disabled, see --openMetrics"})
+			continue
+		}
+		results = append(results, selftest.checkExposition(format.name, format.accept, format.encoding, want))
+	}
+	if accept := r.URL.Query().Get("accept"); accept != "" {
+		results = append(results, selftest.checkExposition("accept", accept, "", want))
+	}
+	results = append(results,
+		selftest.checkRender("json", selftest.ServeRenderJSON, want, decodeJSONSamples),
+		selftest.checkRender("csv", selftest.ServeRenderCSV, want, decodeCSVSamples),
+		selftest.checkRender("graphite", selftest.ServeRenderGraphite, graphiteSamples(want), decodeGraphiteSamples),
+	)
+
+	ok := true
+	for _, result := range results {
+		ok = ok && result.OK
+	}
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]any{"ok": ok, "formats": results})
+}
+
+// checkExposition renders /metrics with the Accept and Accept-Encoding
+// headers and compares its samples with want
+func (a *Aggregate) checkExposition(name, accept, encoding string, want map[string]float64) selftestResult {
+	return a.checkRender(name, func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept", accept)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		a.ServeRender(w, r)
+	}, want, func(header http.Header, body []byte) (map[string]float64, error) {
+		if encoding != "" && header.Get("Content-Encoding") != encoding {
+			return nil, fmt.Errorf("asked for %s, the render is not encoded with it", encoding)
+		}
+		return decodeExpositionSamples(header, body)
+	})
+}
+
+// checkRender serves a render with handler and compares what decode makes
+// of it with want
+func (a *Aggregate) checkRender(name string, handler http.HandlerFunc, want map[string]float64, decode func(http.Header, []byte) (map[string]float64, error)) selftestResult {
+	r, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		return selftestResult{Format: name, Error: err.Error()}
+	}
+	w := &selftestRecorder{header: http.Header{}, status: http.StatusOK}
+	handler(w, r)
+	result := selftestResult{Format: name, ContentType: w.header.Get("Content-Type")}
+	if w.status != http.StatusOK {
+		result.Error = fmt.Sprintf("unexpected status %d: %s", w.status, strings.TrimSpace(w.body.String()))
+		return result
+	}
+	got, err := decode(w.header, w.body.Bytes())
+	if err == nil {
+		err = compareSamples(want, got)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OK = true
+	return result
+}
+
+// selftestRecorder keeps the response of a render of the self-test
+type selftestRecorder struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (s *selftestRecorder) Header() http.Header {
+	return s.header
+}
+
+func (s *selftestRecorder) WriteHeader(status int) {
+	if !s.wrote {
+		s.status, s.wrote = status, true
+	}
+}
+
+func (s *selftestRecorder) Write(p []byte) (int, error) {
+	s.wrote = true
+	return s.body.Write(p)
+}
+
+// Flush lets streamed renders flush, the body being kept anyway
+func (s *selftestRecorder) Flush() {}
+
+// compareSamples reports the first few synthetic samples missing from got,
+// with another value or that weren't pushed
+func compareSamples(want, got map[string]float64) error {
+	var problems []string
+	for key, value := range want {
+		if gotValue, ok := got[key]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is missing", key))
+		} else if gotValue != value {
+			problems = append(problems, fmt.Sprintf("%s is %g instead of %g", key, gotValue, value))
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok && strings.HasPrefix(key, selftestPrefix) {
+			problems = append(problems, fmt.Sprintf("%s wasn't pushed", key))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	if len(problems) > 5 {
+		problems = append(problems[:5], fmt.Sprintf("and %d more", len(problems)-5))
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// selftestSamples are the samples of a push in the text format with the
+// labels of its label path
+func selftestSamples(text string, labels []labelPair) (map[string]float64, error) {
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		for _, m := range family.Metric {
+			for _, l := range labels {
+				m.Label = append(m.Label, &dto.LabelPair{Name: &l.name, Value: &l.value})
+			}
+		}
+		list = append(list, family)
+	}
+	return familySamples(list)
+}
+
+// familySamples flattens families into their samples, by metric
+func familySamples(families []*dto.MetricFamily) (map[string]float64, error) {
+	samples, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{}, families...)
+	if err != nil {
+		return nil, err
+	}
+	flat := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		// OpenMetrics renders le="1" as le="1.0"
+		for _, name := range []model.LabelName{model.BucketLabel, model.QuantileLabel} {
+			if value, ok := s.Metric[name]; ok {
+				if f, err := strconv.ParseFloat(string(value), 64); err == nil {
+					s.Metric[name] = model.LabelValue(formatFloat(f))
+				}
+			}
+		}
+		flat[s.Metric.String()] = float64(s.Value)
+	}
+	return flat, nil
+}
+
+// decodeExpositionSamples decodes a render of /metrics in the format of its
+// Content-Type
+func decodeExpositionSamples(header http.Header, body []byte) (map[string]float64, error) {
+	if header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+
+	// expfmt only decodes the text and protobuf formats
+	if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType == expfmt.OpenMetricsType {
+		return decodeOpenMetricsSamples(body)
+	}
+	dec := expfmt.NewDecoder(bytes.NewReader(body), expfmt.ResponseFormat(header))
+	var families []*dto.MetricFamily
+	for {
+		family := &dto.MetricFamily{}
+		if err := dec.Decode(family); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		families = append(families, family)
+	}
+	return familySamples(families)
+}
+
+// decodeOpenMetricsSamples reads the samples of an OpenMetrics render back,
+// leaving its _created samples, timestamps and exemplars out
+func decodeOpenMetricsSamples(body []byte) (map[string]float64, error) {
+	if !bytes.HasSuffix(body, []byte("# EOF\n")) {
+		return nil, errors.New("the render doesn't end with # EOF")
+	}
+	var text strings.Builder
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, rest := splitSeries(line)
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("sample without a value: %s", line)
+		}
+		if name, _, _ := strings.Cut(series, "{"); strings.HasSuffix(name, "_created") {
+			continue
+		}
+		text.WriteString(series + " " + fields[0] + "\n")
+	}
+	return untypedSamples(text.String())
+}
+
+// splitSeries splits a sample line after its name and labels
+func splitSeries(line string) (string, string) {
+	quoted, escaped := false, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = quoted
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '}'):
+			if c == '}' {
+				i++
+			}
+			return line[:i], line[i:]
+		}
+	}
+	return line, ""
+}
+
+// untypedSamples parses sample lines of the text format without TYPE
+func untypedSamples(text string) (map[string]float64, error) {
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		list = append(list, family)
+	}
+	return familySamples(list)
+}
+
+// decodeJSONSamples flattens a JSON render like the text format would
+func decodeJSONSamples(_ http.Header, body []byte) (map[string]float64, error) {
+	var render struct {
+		Data []jsonFamily `json:"data"`
+	}
+	if err := json.Unmarshal(body, &render); err != nil {
+		return nil, err
+	}
+	flat := map[string]float64{}
+	var err error
+	add := func(name string, labels map[string]string, extra, extraValue, value string) {
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+		for l, v := range labels {
+			metric[model.LabelName(l)] = model.LabelValue(v)
+		}
+		if extra != "" {
+			metric[model.LabelName(extra)] = model.LabelValue(extraValue)
+		}
+		parsed, parseErr := strconv.ParseFloat(value, 64)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("invalid value %q of %s", value, metric)
+		}
+		flat[metric.String()] = parsed
+	}
+	for _, family := range render.Data {
+		for _, s := range family.Metrics {
+			switch family.Type {
+			case "histogram", "summary":
+				add(family.Name+"_sum", s.Labels, "", "", s.Sum)
+				add(family.Name+"_count", s.Labels, "", "", s.Count)
+				for le, value := range s.Buckets {
+					add(family.Name+"_bucket", s.Labels, model.BucketLabel, le, value)
+				}
+				for quantile, value := range s.Quantiles {
+					add(family.Name, s.Labels, model.QuantileLabel, quantile, value)
+				}
+			default:
+				add(family.Name, s.Labels, "", "", s.Value)
+			}
+		}
+	}
+	return flat, err
+}
+
+// decodeCSVSamples reads the rows of a CSV render back as sample lines
+func decodeCSVSamples(_ http.Header, body []byte) (map[string]float64, error) {
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("the render has no header")
+	}
+	var text strings.Builder
+	for _, row := range rows[1:] {
+		if len(row) != len(csvHeader) {
+			return nil, fmt.Errorf("row of %d columns instead of %d", len(row), len(csvHeader))
+		}
+		text.WriteString(row[0] + "{" + row[1] + "} " + row[2] + "\n")
+	}
+	return untypedSamples(text.String())
+}
+
+// graphiteSamples are the Graphite paths of samples
+func graphiteSamples(samples map[string]float64) map[string]float64 {
+	paths := make(map[string]float64, len(samples))
+	for key, value := range samples {
+		metric, err := parseMetric(key)
+		if err != nil {
+			continue
+		}
+		paths[graphitePath("", metric)] = value
+	}
+	return paths
+}
+
+// parseMetric parses a metric back from its String()
+func parseMetric(key string) (model.Metric, error) {
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(strings.NewReader(key + " 0\n"))
+	if err != nil {
+		return nil, err
+	}
+	for name, family := range families {
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+		for _, l := range family.Metric[0].Label {
+			metric[model.LabelName(l.GetName())] = model.LabelValue(l.GetValue())
+		}
+		return metric, nil
+	}
+	return nil, errors.New("no metric")
+}
+
+// decodeGraphiteSamples reads the lines of a Graphite render back, by path
+func decodeGraphiteSamples(_ http.Header, body []byte) (map[string]float64, error) {
+	samples := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of line %q", line)
+		}
+		samples[fields[0]] = value
+	}
+	return samples, nil
+}
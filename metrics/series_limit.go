@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// SeriesLimitTruncate renders the first series of an oversized family
+	SeriesLimitTruncate = "truncate"
+	// SeriesLimitSplit additionally lets scrapers split renders in shards
+	SeriesLimitSplit = "split"
+)
+
+// TruncatedSeriesMetric is the name of the family warning of truncated renders
+const TruncatedSeriesMetric = "aggregation_gateway_truncated_series"
+
+const truncatedSeriesHelp = "Series of the family left out of the render, over the maximum series per family"
+
+// SetMaxRenderSeries caps the series rendered per family at limit, so one
+// runaway family can't push scrapers over their sample limit. Families
+// over it are truncated to their first series in label order, with a
+// TruncatedSeriesMetric series counting those left out. In the
+// SeriesLimitSplit mode scrapers may also ask for one of several shards of
+// the render with ?shard=<i>&shards=<n>, each holding the series whose
+// labels hash to it, the limit then applying per shard. 0 renders every
+// series.
+func SetMaxRenderSeries(limit int, mode string) Option {
+	return func(a *Aggregate) {
+		a.options.maxRenderSeries = limit
+		a.options.renderSeriesMode = mode
+	}
+}
+
+// requestShard returns the render shard asked for, 0 shards when the
+// render isn't sharded
+func (a *Aggregate) requestShard(r *http.Request) (int, int, error) {
+	query := r.URL.Query()
+	if !query.Has("shards") && !query.Has("shard") {
+		return 0, 0, nil
+	}
+	if a.opts().renderSeriesMode != SeriesLimitSplit {
+		return 0, 0, fmt.Errorf("sharded renders are disabled, see --maxRenderSeriesMode")
+	}
+	shards, err := strconv.Atoi(query.Get("shards"))
+	if err != nil || shards < 1 {
+		return 0, 0, fmt.Errorf("invalid shards %q, must be a positive number", query.Get("shards"))
+	}
+	shard, err := strconv.Atoi(query.Get("shard"))
+	if err != nil || shard < 0 || shard >= shards {
+		return 0, 0, fmt.Errorf("invalid shard %q, must be between 0 and %d", query.Get("shard"), shards-1)
+	}
+	return shard, shards, nil
+}
+
+// serveShardRender renders the series of one shard only, bypassing the
+// render cache
+func (a *Aggregate) serveShardRender(w http.ResponseWriter, r *http.Request, shard, shards int) {
+	a.expireFamilies(time.Now())
+	contentType := a.negotiateFormat(r.Header)
+	opts := a.opts()
+	rendered, err := a.renderFamilies(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var families []*compactFamily
+	for _, family := range opts.filterRenderAll(rendered) {
+		if family = shardFamily(family, shard, shards); family != nil {
+			families = append(families, family)
+		}
+	}
+	serveFamilies(w, r, contentType, opts.limitRenderSeries(families), opts)
+}
+
+// shardFamily is the family restricted to the series hashing to shard,
+// nil when it has none
+func shardFamily(family *compactFamily, shard, shards int) *compactFamily {
+	var series []compactSeries
+	for _, s := range family.series {
+		h := fnv.New32a()
+		h.Write([]byte(s.labels.key()))
+		if int(h.Sum32()%uint32(shards)) == shard {
+			series = append(series, s)
+		}
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	sharded := *family
+	sharded.series = series
+	return &sharded
+}
+
+// limitRenderSeries truncates the families over the maximum series, adding
+// the family counting what was left out
+func (ao *aggregateOptions) limitRenderSeries(families []*compactFamily) []*compactFamily {
+	limit := ao.maxRenderSeries
+	if limit <= 0 {
+		return families
+	}
+
+	var warning *dto.MetricFamily
+	for i, family := range families {
+		if len(family.series) <= limit {
+			continue
+		}
+		if warning == nil {
+			warning = &dto.MetricFamily{
+				Name: proto.String(TruncatedSeriesMetric),
+				Help: proto.String(truncatedSeriesHelp),
+				Type: dto.MetricType_GAUGE.Enum(),
+			}
+		}
+		warning.Metric = append(warning.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("family"), Value: proto.String(family.name)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(len(family.series) - limit))},
+		})
+
+		truncated := *family
+		truncated.series = family.series[:limit]
+		families[i] = &truncated
+	}
+	if warning == nil {
+		return families
+	}
+	// families are sorted by name, so are the warning's series
+	return insertFamily(families, compactFamilyFromDTO(warning))
+}
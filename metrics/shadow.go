@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+)
+
+// SetShadow feeds every push to a second, shadow aggregate built with the
+// same options overridden by opts, rendered on its own path, so a change of
+// options can be validated against production traffic before switching to
+// it. The shadow doesn't replicate, proxy, log pushes or keep history. No
+// opts runs no shadow, it would only mirror the primary.
+func SetShadow(opts ...Option) Option {
+	return func(a *Aggregate) {
+		a.options.shadowOptions = opts
+	}
+}
+
+func newShadow(primaryOpts, shadowOpts []Option) *Aggregate {
+	opts := append(append([]Option{}, primaryOpts...), shadowOpts...)
+	opts = append(opts, withUnregisteredMetrics(), func(s *Aggregate) {
+		s.options.shadowOptions = nil
+		s.options.subAggregates = nil
+		// the primary alone talks to other gateways and handles retries,
+		// the shadow merges what the primary does
+		s.options.replicaOf = ""
+		s.options.upstreamURL = ""
+		s.options.idempotencyWindow = 0
+		s.options.maxLabelValues = nil
+		s.options.pushLogEntries = 0
+		s.options.historySize = 0
+		s.options.asyncWorkers = 0
+		s.options.receiptRetention = 0
+	})
+	return NewAggregate(opts...)
+}
+
+// shadowLabels returns the labels the shadow adds to a push's series, which
+// its own options may make differ from the primary's. A push they can't be
+// worked out for is not fed to the shadow, it is counted as an error.
+func (a *Aggregate) shadowLabels(r *http.Request, pathLabels []labelPair, tenant string) ([]labelPair, bool) {
+	honor, err := a.shadow.pushHonorLabels(r)
+	if err != nil {
+		log.Printf("Could not merge push into the shadow aggregate: %s\n", err.Error())
+		ShadowPushes.WithLabelValues("error").Inc()
+		return nil, false
+	}
+	return a.shadow.pushLabels(r, pathLabels, honor, tenant), true
+}
+
+// feedShadow merges a push the primary merged into the shadow too
+func (a *Aggregate) feedShadow(body []byte, labels []labelPair) {
+	if err := a.shadow.parseAndMerge(bytes.NewReader(body), labels); err != nil {
+		log.Printf("Could not merge push into the shadow aggregate: %s\n", err.Error())
+		ShadowPushes.WithLabelValues("error").Inc()
+		return
+	}
+	ShadowPushes.WithLabelValues("ok").Inc()
+}
+
+// ServeShadowRender renders the shadow aggregate as ServeRender does the
+// primary
+func (a *Aggregate) ServeShadowRender(w http.ResponseWriter, r *http.Request) {
+	if a.shadow == nil {
+		http.Error(w, "no shadow aggregate is configured", http.StatusNotFound)
+		return
+	}
+	a.shadow.ServeRender(w, r)
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// familyShardCount is the number of independently locked partitions of the
+// family map. Pushes to families in different shards never contend on a lock.
+const familyShardCount = 64
+
+type familyShard struct {
+	lock     sync.RWMutex
+	families map[string]*Family
+}
+
+// familyShards is the default Storage, the families in memory
+type familyShards [familyShardCount]*familyShard
+
+func newFamilyShards() *familyShards {
+	var shards familyShards
+	for i := range shards {
+		shards[i] = &familyShard{families: map[string]*Family{}}
+	}
+	return &shards
+}
+
+// shardFor picks the shard owning a family name using an inlined 32-bit FNV-1a hash
+func (s *familyShards) shardFor(familyName string) *familyShard {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	hash := uint32(offset32)
+	for i := 0; i < len(familyName); i++ {
+		hash ^= uint32(familyName[i])
+		hash *= prime32
+	}
+	return s[hash%familyShardCount]
+}
+
+func (s *familyShards) Get(familyName string) (*Family, bool) {
+	shard := s.shardFor(familyName)
+	shard.lock.RLock()
+	family, ok := shard.families[familyName]
+	shard.lock.RUnlock()
+	return family, ok
+}
+
+func (s *familyShards) GetOrCreate(familyName string, create func() *Family) (*Family, bool) {
+	shard := s.shardFor(familyName)
+	lockObserved(&shard.lock, shardLockWait)
+	defer shard.lock.Unlock()
+	if family, ok := shard.families[familyName]; ok {
+		return family, true
+	}
+	family := create()
+	shard.families[familyName] = family
+	return family, false
+}
+
+func (s *familyShards) Delete(familyName string, drop func(*Family) bool) (*Family, bool) {
+	shard := s.shardFor(familyName)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	family, ok := shard.families[familyName]
+	if !ok || (drop != nil && !drop(family)) {
+		return nil, false
+	}
+	delete(shard.families, familyName)
+	return family, true
+}
+
+// Range only locks each shard while it is being copied
+func (s *familyShards) Range(fn func(name string, family *Family) bool) {
+	var families []namedFamily
+	for _, shard := range s {
+		families = families[:0]
+		shard.lock.RLock()
+		for name, family := range shard.families {
+			families = append(families, namedFamily{name, family})
+		}
+		shard.lock.RUnlock()
+
+		for _, f := range families {
+			if !fn(f.name, f.family) {
+				return
+			}
+		}
+	}
+}
+
+// Snapshot holds every shard's lock while it copies them
+func (s *familyShards) Snapshot() map[string]*Family {
+	for _, shard := range s {
+		shard.lock.RLock()
+	}
+	families := make(map[string]*Family)
+	for _, shard := range s {
+		for name, family := range shard.families {
+			families[name] = family
+		}
+		shard.lock.RUnlock()
+	}
+	return families
+}
+
+func (s *familyShards) Len() int {
+	count := 0
+	for _, shard := range s {
+		shard.lock.RLock()
+		count += len(shard.families)
+		shard.lock.RUnlock()
+	}
+	return count
+}
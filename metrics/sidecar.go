@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"net/http"
+	"net/netip"
+	"sort"
+)
+
+// SetLocalPushLabels attaches labels to every push received over loopback,
+// which in a sidecar are the pushes of the pod's own containers. A label the
+// push already sets, in its path or its series, is left as pushed.
+func SetLocalPushLabels(labels map[string]string) Option {
+	return func(a *Aggregate) {
+		a.options.localPushLabels = make([]labelPair, 0, len(labels))
+		for name, value := range labels {
+			a.options.localPushLabels = append(a.options.localPushLabels, labelPair{name: name, value: value, ifAbsent: true})
+		}
+		sort.Slice(a.options.localPushLabels, func(i, j int) bool {
+			return a.options.localPushLabels[i].name < a.options.localPushLabels[j].name
+		})
+	}
+}
+
+// withLocalPushLabels adds the local push labels the path doesn't set already
+func (a *Aggregate) withLocalPushLabels(r *http.Request, labels []labelPair) []labelPair {
+	local := a.opts().localPushLabels
+	if len(local) == 0 || !isLoopback(a.clientAddr(r)) {
+		return labels
+	}
+
+	for _, extra := range local {
+		set := false
+		for _, l := range labels {
+			if l.name == extra.name {
+				set = true
+				break
+			}
+		}
+		if !set {
+			labels = append(labels, extra)
+		}
+	}
+	return labels
+}
+
+func isLoopback(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
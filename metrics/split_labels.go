@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// SplitIntoSeries turns a series into one per item of the label's value,
+	// each with the label set to that item
+	SplitIntoSeries = "series"
+	// SplitIntoLabels replaces the label with one label per item, named its
+	// prefix and the item and set to "true"
+	SplitIntoLabels = "labels"
+)
+
+// SplitRule splits a delimited label value of the families it matches at
+// ingest, e.g. tags="a,b,c", for producers that can't push proper label sets
+type SplitRule struct {
+	// Match is an anchored regular expression on the family name, every
+	// family when empty
+	Match string `yaml:"match"`
+	// Label is the label whose value is split
+	Label string `yaml:"label"`
+	// Separator delimits the items of the value, "," by default
+	Separator string `yaml:"separator"`
+	// Into is SplitIntoSeries, the default, or SplitIntoLabels
+	Into string `yaml:"into"`
+	// Prefix starts the names of the labels SplitIntoLabels adds, the label
+	// and an underscore by default
+	Prefix string `yaml:"prefix"`
+
+	re *regexp.Regexp
+}
+
+type splitFile struct {
+	SplitRules []SplitRule `yaml:"split_rules"`
+}
+
+// LoadSplitRules reads the split_rules list of a YAML file
+func LoadSplitRules(path string) ([]SplitRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := splitFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing split rules %s: %w", path, err)
+	}
+	for i := range file.SplitRules {
+		if err := file.SplitRules[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid split rule %d in %s: %w", i+1, path, err)
+		}
+	}
+	return file.SplitRules, nil
+}
+
+func (r *SplitRule) compile() error {
+	if r.Label == "" {
+		return fmt.Errorf("label is missing")
+	}
+	switch r.Into {
+	case "":
+		r.Into = SplitIntoSeries
+	case SplitIntoSeries, SplitIntoLabels:
+	default:
+		return fmt.Errorf("unknown into %q, must be %q or %q", r.Into, SplitIntoSeries, SplitIntoLabels)
+	}
+	if r.Separator == "" {
+		r.Separator = ","
+	}
+	if r.Prefix == "" {
+		r.Prefix = r.Label + "_"
+	}
+	re, err := regexp.Compile("^(?:" + r.Match + ")$")
+	if err != nil {
+		return err
+	}
+	r.re = re
+	return nil
+}
+
+// SetSplitRules applies rules to the pushed families they match, in order,
+// before ingest hooks and rollup rules. Invalid rules are logged and left out.
+func SetSplitRules(rules []SplitRule) Option {
+	return func(a *Aggregate) {
+		a.options.splitRules = nil
+		for _, rule := range rules {
+			if rule.re == nil {
+				if err := rule.compile(); err != nil {
+					log.Printf("Ignoring split rule for label %q: %s\n", rule.Label, err.Error())
+					continue
+				}
+			}
+			a.options.splitRules = append(a.options.splitRules, rule)
+		}
+	}
+}
+
+// splitLabels applies the matching rules to a family with sorted labels,
+// merging the series left with the same labels
+func (ao *aggregateOptions) splitLabels(family *dto.MetricFamily) {
+	var split bool
+	for i := range ao.splitRules {
+		rule := &ao.splitRules[i]
+		if !rule.re.MatchString(family.GetName()) {
+			continue
+		}
+
+		metrics := make([]*dto.Metric, 0, len(family.Metric))
+		for _, m := range family.Metric {
+			series, ok := rule.split(m)
+			if !ok {
+				metrics = append(metrics, m)
+				continue
+			}
+			metrics = append(metrics, series...)
+			split = true
+		}
+		family.Metric = metrics
+	}
+	if split {
+		collapseSeries(family)
+	}
+}
+
+// split returns the series m is split into, false when it doesn't have the
+// rule's label
+func (r *SplitRule) split(m *dto.Metric) ([]*dto.Metric, bool) {
+	at := slices.IndexFunc(m.Label, func(l *dto.LabelPair) bool { return l.GetName() == r.Label })
+	if at < 0 {
+		return nil, false
+	}
+
+	var items []string
+	for _, item := range strings.Split(m.Label[at].GetValue(), r.Separator) {
+		if item = strings.TrimSpace(item); item != "" && !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+
+	if r.Into == SplitIntoLabels {
+		labels := slices.Delete(slices.Clone(m.Label), at, at+1)
+		for _, item := range items {
+			name := r.Prefix + labelNameSafe(item)
+			// labels the producer pushed itself win
+			if !slices.ContainsFunc(labels, func(l *dto.LabelPair) bool { return l.GetName() == name }) {
+				labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String("true")})
+			}
+		}
+		sort.Sort(byName(labels))
+		m.Label = labels
+		return []*dto.Metric{m}, true
+	}
+
+	if len(items) == 0 {
+		// an empty label is no label at all
+		m.Label = slices.Delete(m.Label, at, at+1)
+		return []*dto.Metric{m}, true
+	}
+	series := make([]*dto.Metric, 0, len(items))
+	for _, item := range items {
+		s := proto.Clone(m).(*dto.Metric)
+		s.Label[at].Value = proto.String(item)
+		series = append(series, s)
+	}
+	return series, true
+}
+
+// labelNameSafe replaces the characters of s a legacy label name can't have
+// with underscores
+func labelNameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
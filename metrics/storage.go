@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Storage keeps an aggregate's families between pushes, the default keeping
+// them in a sharded in-memory map. Merges, renders and expiry only reach the
+// families through it, so another backend (e.g. one that spills to Redis,
+// BadgerDB or object storage, writing back each family's state) can be
+// plugged in with SetStorage without touching them.
+//
+// A Family is stored as handed over: merges lock it and publish new states
+// into it, and the storage needn't look inside it, but for writing its
+// state back with MarshalBinary and reading it into it again with
+// UnmarshalBinary. Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the family stored under name
+	Get(name string) (*Family, bool)
+	// GetOrCreate returns the family stored under name and true, or, when
+	// there is none, stores the family create returns there and returns it
+	// and false. The check and the store are atomic.
+	GetOrCreate(name string, create func() *Family) (*Family, bool)
+	// Delete removes the family stored under name if drop, called atomically
+	// with the removal, reports true for it, or always when drop is nil. It
+	// returns the family removed.
+	Delete(name string, drop func(*Family) bool) (*Family, bool)
+	// Range calls fn with every family stored, in any order, until it
+	// returns false. fn may call the storage, and families may be stored or
+	// deleted meanwhile.
+	Range(fn func(name string, family *Family) bool)
+	// Snapshot returns every family stored as of a single instant, no
+	// family being stored or deleted while it is taken
+	Snapshot() map[string]*Family
+	// Len returns how many families are stored
+	Len() int
+}
+
+// SetStorage keeps the aggregate's families in storage instead of memory.
+// It must be empty.
+func SetStorage(storage Storage) Option {
+	return func(a *Aggregate) {
+		a.families = storage
+	}
+}
+
+// hotStorage is a Storage keeping the families merged into most recently
+// in memory
+type hotStorage interface {
+	// merged records a merge into the family
+	merged(name string, family *Family)
+	// accountSpills has the storage report by how many bytes moving
+	// families out of memory changed their estimated size
+	accountSpills(func(delta int64))
+}
+
+// familyMerged tells the storage about a merge into the family, if it
+// keeps track
+func (a *Aggregate) familyMerged(name string, family *Family) {
+	if hot, ok := a.families.(hotStorage); ok {
+		hot.merged(name, family)
+	}
+}
+
+type namedFamily struct {
+	name   string
+	family *Family
+}
+
+// snapshot returns every family currently stored, sorted by name
+func (a *Aggregate) snapshot() []namedFamily {
+	stored := a.families.Snapshot()
+	families := make([]namedFamily, 0, len(stored))
+	for name, family := range stored {
+		families = append(families, namedFamily{name, family})
+	}
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	return families
+}
+
+// MarshalBinary encodes the family's current state, for a storage writing
+// it back
+func (mf *Family) MarshalBinary() ([]byte, error) {
+	mf.lock.RLock()
+	defer mf.lock.RUnlock()
+	current, err := mf.load()
+	if err != nil {
+		return nil, err
+	}
+	return encodeState(current)
+}
+
+// UnmarshalBinary replaces the state of a family the aggregate created with
+// one MarshalBinary encoded, for a storage reading it back. The family must
+// keep its name and type, and its estimated size is left as it was.
+func (mf *Family) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data)
+	if err != nil {
+		return err
+	}
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	if head := mf.head(); head != nil && (head.name != state.name || head.ty != state.ty) {
+		return fmt.Errorf("cannot read %s %s back into %s %s", state.ty.String(), state.name, head.ty.String(), head.name)
+	}
+	mf.publish(state)
+	if mf.metricCount != nil {
+		mf.metricCount.Set(float64(len(state.series)))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sample is the value of a series, as a MergeStrategy sees it
+type Sample struct {
+	// Value is the counter, gauge or untyped value, or the histogram or summary sum
+	Value float64
+	// Count is the histogram or summary sample count
+	Count uint64
+	// Buckets are the histogram's cumulative buckets, sorted by upper bound
+	Buckets []Bucket
+}
+
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// MergeStrategy merges a pushed sample into the aggregated one of the same
+// series. Labels, created timestamps, exemplars and timestamps are merged
+// around it the same way whatever the strategy.
+type MergeStrategy interface {
+	Merge(aggregated, pushed Sample) Sample
+}
+
+// MergeStrategyFunc adapts a function to a MergeStrategy
+type MergeStrategyFunc func(aggregated, pushed Sample) Sample
+
+func (f MergeStrategyFunc) Merge(aggregated, pushed Sample) Sample {
+	return f(aggregated, pushed)
+}
+
+var (
+	// SumStrategy adds samples up, histogram buckets by upper bound, it is
+	// what every type is merged with by default
+	SumStrategy MergeStrategy = sumStrategy{}
+	// MaxStrategy keeps the larger value, the sample with more observations
+	// for histograms and summaries
+	MaxStrategy = MergeStrategyFunc(func(aggregated, pushed Sample) Sample {
+		if pushed.larger(aggregated) {
+			return pushed
+		}
+		return aggregated
+	})
+	// MinStrategy keeps the smaller value, the sample with fewer observations
+	// for histograms and summaries
+	MinStrategy = MergeStrategyFunc(func(aggregated, pushed Sample) Sample {
+		if aggregated.larger(pushed) {
+			return pushed
+		}
+		return aggregated
+	})
+	// LastStrategy keeps the pushed sample, as the Prometheus Pushgateway does
+	LastStrategy = MergeStrategyFunc(func(_, pushed Sample) Sample {
+		return pushed
+	})
+)
+
+type sumStrategy struct{}
+
+func (sumStrategy) Merge(aggregated, pushed Sample) Sample {
+	merged := Sample{Value: aggregated.Value + pushed.Value, Count: aggregated.Count + pushed.Count}
+	i, j := 0, 0
+	for i < len(aggregated.Buckets) && j < len(pushed.Buckets) {
+		a, b := aggregated.Buckets[i], pushed.Buckets[j]
+		switch {
+		case a.UpperBound < b.UpperBound:
+			merged.Buckets = append(merged.Buckets, a)
+			i++
+		case a.UpperBound > b.UpperBound:
+			merged.Buckets = append(merged.Buckets, b)
+			j++
+		default:
+			merged.Buckets = append(merged.Buckets, Bucket{UpperBound: a.UpperBound, Count: a.Count + b.Count})
+			i++
+			j++
+		}
+	}
+	merged.Buckets = append(merged.Buckets, aggregated.Buckets[i:]...)
+	merged.Buckets = append(merged.Buckets, pushed.Buckets[j:]...)
+	return merged
+}
+
+func (s Sample) larger(than Sample) bool {
+	if s.Count != than.Count {
+		return s.Count > than.Count
+	}
+	return s.Value > than.Value
+}
+
+var strategies = struct {
+	lock   sync.RWMutex
+	byName map[string]MergeStrategy
+}{byName: map[string]MergeStrategy{
+	"sum":  SumStrategy,
+	"max":  MaxStrategy,
+	"min":  MinStrategy,
+	"last": LastStrategy,
+}}
+
+// RegisterMergeStrategy makes a custom strategy selectable by name, e.g. with
+// --mergeStrategies, typically from an init function
+func RegisterMergeStrategy(name string, strategy MergeStrategy) {
+	strategies.lock.Lock()
+	defer strategies.lock.Unlock()
+	strategies.byName[name] = strategy
+}
+
+// MergeStrategyByName returns the built-in or registered strategy of that name
+func MergeStrategyByName(name string) (MergeStrategy, error) {
+	strategies.lock.RLock()
+	defer strategies.lock.RUnlock()
+	if strategy, ok := strategies.byName[name]; ok {
+		return strategy, nil
+	}
+	names := make([]string, 0, len(strategies.byName))
+	for name := range strategies.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown merge strategy %q, must be one of: %s", name, strings.Join(names, ", "))
+}
+
+// SetMergeStrategy merges the series of families of type ty with strategy
+// instead of SumStrategy
+func SetMergeStrategy(ty dto.MetricType, strategy MergeStrategy) Option {
+	return func(a *Aggregate) {
+		if a.options.mergeStrategies == nil {
+			a.options.mergeStrategies = map[dto.MetricType]MergeStrategy{}
+		}
+		a.options.mergeStrategies[ty] = strategy
+	}
+}
+
+// mergeStrategy returns the strategy for a type, nil for the built-in sum
+func (ao *aggregateOptions) mergeStrategy(ty dto.MetricType) MergeStrategy {
+	strategy := ao.mergeStrategies[ty]
+	if strategy == SumStrategy {
+		return nil
+	}
+	return strategy
+}
+
+func (s *compactSeries) sample() Sample {
+	sample := Sample{Value: s.value, Count: s.count}
+	if buckets := s.buckets(); len(buckets) > 0 {
+		sample.Buckets = make([]Bucket, len(buckets))
+		for i, b := range buckets {
+			sample.Buckets[i] = Bucket{UpperBound: b.upperBound, Count: b.count}
+		}
+	}
+	return sample
+}
+
+// mergeWithStrategy merges b into a with strategy, carrying the exemplars of
+// the buckets the merged sample keeps over
+func mergeWithStrategy(ty dto.MetricType, a, b *compactSeries, strategy MergeStrategy) compactSeries {
+	sample := strategy.Merge(a.sample(), b.sample())
+	merged := compactSeries{labels: a.labels, value: sample.Value}
+
+	switch ty {
+	case dto.MetricType_COUNTER:
+		merged.created = a.created
+		if exemplar := latestExemplar(a.exemplar(), b.exemplar()); exemplar != nil {
+			merged.extra = &seriesExtra{exemplar: exemplar}
+		}
+	case dto.MetricType_HISTOGRAM:
+		merged.count = sample.Count
+		merged.created = a.created
+		exemplars := map[float64]*dto.Exemplar{}
+		for _, series := range []*compactSeries{a, b} {
+			for _, bucket := range series.buckets() {
+				exemplars[bucket.upperBound] = latestExemplar(exemplars[bucket.upperBound], bucket.exemplar)
+			}
+		}
+		buckets := make([]compactBucket, len(sample.Buckets))
+		for i, bucket := range sample.Buckets {
+			buckets[i] = compactBucket{upperBound: bucket.UpperBound, count: bucket.Count, exemplar: exemplars[bucket.UpperBound]}
+		}
+		merged.extra = &seriesExtra{buckets: buckets}
+	case dto.MetricType_SUMMARY:
+		merged.count = sample.Count
+		merged.created = a.created
+	}
+	return merged
+}
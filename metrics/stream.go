@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// familyChunker splits a text exposition stream into chunks that each hold a
+// single metric family (as announced by its HELP/TYPE comments), so a push is
+// parsed family by family rather than by a single parser holding all of it.
+type familyChunker struct {
+	reader  *bufio.Reader
+	chunk   bytes.Buffer
+	lineBuf []byte
+	carry   []byte // first line of the next chunk, read while closing the current one
+	family  string
+	line    int
+	err     error
+}
+
+var chunkerPool = sync.Pool{
+	New: func() any {
+		return &familyChunker{reader: bufio.NewReaderSize(nil, 16*1024)}
+	},
+}
+
+func getFamilyChunker(r io.Reader) *familyChunker {
+	fc := chunkerPool.Get().(*familyChunker)
+	fc.reader.Reset(r)
+	fc.chunk.Reset()
+	fc.carry = fc.carry[:0]
+	fc.family = ""
+	fc.line = 0
+	fc.err = nil
+	return fc
+}
+
+func (fc *familyChunker) release() {
+	fc.reader.Reset(nil)
+	chunkerPool.Put(fc)
+}
+
+func (fc *familyChunker) readLine() ([]byte, error) {
+	fc.lineBuf = fc.lineBuf[:0]
+	for {
+		part, err := fc.reader.ReadSlice('\n')
+		fc.lineBuf = append(fc.lineBuf, part...)
+		if err != bufio.ErrBufferFull {
+			return fc.lineBuf, err
+		}
+	}
+}
+
+// next returns the next chunk along with the input line it starts at. The
+// chunk is only valid until the following call. Once the input is exhausted
+// the last chunk is returned together with io.EOF.
+func (fc *familyChunker) next() ([]byte, int, error) {
+	fc.chunk.Reset()
+	start := fc.line + 1
+	if len(fc.carry) > 0 {
+		fc.chunk.Write(fc.carry)
+		fc.carry = fc.carry[:0]
+		start = fc.line
+	}
+
+	for fc.err == nil {
+		line, err := fc.readLine()
+		fc.err = err
+		if len(line) == 0 {
+			continue
+		}
+		fc.line++
+
+		if name, ok := commentFamilyName(line); ok && name != fc.family {
+			fc.family = name
+			// Leading blank lines don't warrant a chunk of their own
+			if len(bytes.TrimSpace(fc.chunk.Bytes())) > 0 {
+				fc.carry = append(fc.carry, line...)
+				return fc.chunk.Bytes(), start, nil
+			}
+		}
+		fc.chunk.Write(line)
+	}
+
+	return fc.chunk.Bytes(), start, fc.err
+}
+
+// commentFamilyName extracts the family name from a HELP or TYPE comment line
+func commentFamilyName(line []byte) (string, bool) {
+	trimmed := bytes.TrimLeft(line, " \t")
+	if len(trimmed) == 0 || trimmed[0] != '#' {
+		return "", false
+	}
+
+	fields := bytes.Fields(trimmed[1:])
+	if len(fields) < 2 {
+		return "", false
+	}
+	if keyword := string(fields[0]); keyword != "HELP" && keyword != "TYPE" {
+		return "", false
+	}
+	return string(fields[1]), true
+}
+
+// parseChunk parses a single chunk, rewriting parse error line numbers so
+// they refer to the whole push rather than the chunk
+func parseChunk(chunk []byte, startLine int) (map[string]*dto.MetricFamily, error) {
+	parser := parserPool.Get().(*expfmt.TextParser)
+	inFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(chunk))
+	parserPool.Put(parser)
+
+	if err != nil {
+		var parseErr expfmt.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, expfmt.ParseError{Line: parseErr.Line + startLine - 1, Msg: parseErr.Msg}
+		}
+		return nil, err
+	}
+	return inFamilies, nil
+}
+
+func errFamilyRepeated(name string) error {
+	return fmt.Errorf("metric family %s appears more than once in the push", name)
+}
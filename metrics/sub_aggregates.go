@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+// SubAggregate is a separate aggregate the pushes with a label path label
+// set to a value are routed to instead of the main one, e.g. env=prod,
+// rendered on its own path, /metrics/env/prod. It has the options of the
+// main aggregate, overridden by its own.
+type SubAggregate struct {
+	// Label and Value select the pushes of the sub-aggregate, by their
+	// label path
+	Label string `yaml:"label"`
+	Value string `yaml:"value"`
+	// MetricTTL overrides the metric TTL, 0 disabling expiry
+	MetricTTL *time.Duration `yaml:"metric_ttl"`
+	// IgnoredLabels override the ignored labels
+	IgnoredLabels []string `yaml:"ignored_labels"`
+	// HonorLabels overrides whether pushed labels win over those of the
+	// label path
+	HonorLabels *bool `yaml:"honor_labels"`
+	// MergeStrategies override the merge strategy of metric types, by
+	// lowercase type name, e.g. gauge: max
+	MergeStrategies map[string]string `yaml:"merge_strategies"`
+
+	options []Option
+}
+
+type subAggregatesFile struct {
+	SubAggregates []SubAggregate `yaml:"sub_aggregates"`
+}
+
+// LoadSubAggregates reads the sub_aggregates list of a YAML file
+func LoadSubAggregates(path string) ([]SubAggregate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := subAggregatesFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing sub-aggregates %s: %w", path, err)
+	}
+	seen := map[[2]string]bool{}
+	for i := range file.SubAggregates {
+		sub := &file.SubAggregates[i]
+		if err := sub.compile(); err != nil {
+			return nil, fmt.Errorf("invalid sub-aggregate %d in %s: %w", i+1, path, err)
+		}
+		if seen[[2]string{sub.Label, sub.Value}] {
+			return nil, fmt.Errorf("invalid sub-aggregate %d in %s: %s=%s is defined twice", i+1, path, sub.Label, sub.Value)
+		}
+		seen[[2]string{sub.Label, sub.Value}] = true
+	}
+	return file.SubAggregates, nil
+}
+
+func (s *SubAggregate) compile() error {
+	if s.Label == "" || s.Value == "" {
+		return fmt.Errorf("label and value are required")
+	}
+	if labelNameSafe(s.Label) != s.Label {
+		return fmt.Errorf("invalid label name %q", s.Label)
+	}
+	if strings.Contains(s.Value, "/") {
+		return fmt.Errorf("invalid value %q, label paths can't carry a slash", s.Value)
+	}
+
+	s.options = nil
+	if s.MetricTTL != nil {
+		s.options = append(s.options, SetTTLMetricTime(s.MetricTTL))
+	}
+	if s.IgnoredLabels != nil {
+		s.options = append(s.options, AddIgnoredLabels(s.IgnoredLabels...))
+	}
+	if s.HonorLabels != nil {
+		s.options = append(s.options, SetHonorLabels(s.HonorLabels))
+	}
+	for typeName, strategyName := range s.MergeStrategies {
+		ty, ok := dto.MetricType_value[strings.ToUpper(typeName)]
+		if !ok {
+			return fmt.Errorf("unknown metric type %q", typeName)
+		}
+		strategy, err := MergeStrategyByName(strategyName)
+		if err != nil {
+			return err
+		}
+		s.options = append(s.options, SetMergeStrategy(dto.MetricType(ty), strategy))
+	}
+	return nil
+}
+
+// SetSubAggregates routes the pushes selected by each of subs to an
+// aggregate of its own. Invalid sub-aggregates are left out.
+func SetSubAggregates(subs []SubAggregate) Option {
+	return func(a *Aggregate) {
+		a.options.subAggregates = nil
+		for _, sub := range subs {
+			if sub.options == nil {
+				if err := sub.compile(); err != nil {
+					log.Printf("Ignoring sub-aggregate %s=%s: %s\n", sub.Label, sub.Value, err.Error())
+					continue
+				}
+			}
+			a.options.subAggregates = append(a.options.subAggregates, sub)
+		}
+	}
+}
+
+type subAggregate struct {
+	label, value string
+	agg          *Aggregate
+}
+
+// newSubAggregate builds the aggregate of sub. It keeps its families in
+// memory, and persists them next to the main aggregate's snapshot, but
+// doesn't replicate, proxy, log pushes, keep history or run a shadow.
+func newSubAggregate(primaryOpts []Option, sub SubAggregate) subAggregate {
+	opts := append(append([]Option{}, primaryOpts...), sub.options...)
+	opts = append(opts, withUnregisteredMetrics(), func(s *Aggregate) {
+		s.families = newFamilyShards()
+		s.options.subAggregates = nil
+		s.options.shadowOptions = nil
+		s.options.replicaOf = ""
+		s.options.upstreamURL = ""
+		s.options.pushLogEntries = 0
+		s.options.historySize = 0
+		if s.options.persistPath != "" {
+			s.options.persistPath += "." + labelNameSafe(sub.Label) + "-" + labelNameSafe(sub.Value)
+		}
+	})
+	return subAggregate{label: sub.Label, value: sub.Value, agg: NewAggregate(opts...)}
+}
+
+// subAggregateFor returns the sub-aggregate a push with the labels of its
+// label path is routed to, nil for the main aggregate
+func (a *Aggregate) subAggregateFor(labels []labelPair) *Aggregate {
+	for _, sub := range a.subAggregates {
+		for _, l := range labels {
+			if l.name == sub.label && l.value == sub.value {
+				return sub.agg
+			}
+		}
+	}
+	return nil
+}
+
+// serveSubAggregateAdmin serves an admin request selecting a sub-aggregate
+// with ?sub_aggregate=<label>=<value> by calling serve on it, reporting
+// whether the request selected one. Unknown sub-aggregates are answered
+// with 404.
+func (a *Aggregate) serveSubAggregateAdmin(w http.ResponseWriter, r *http.Request, serve func(*Aggregate, http.ResponseWriter, *http.Request)) bool {
+	query := r.URL.Query()
+	selector := query.Get("sub_aggregate")
+	if selector == "" {
+		return false
+	}
+	label, value, _ := strings.Cut(selector, "=")
+	sub := a.subAggregateFor([]labelPair{{name: label, value: value}})
+	if sub == nil {
+		http.Error(w, fmt.Sprintf("no sub-aggregate %s", selector), http.StatusNotFound)
+		return true
+	}
+	query.Del("sub_aggregate")
+	r.URL.RawQuery = query.Encode()
+	serve(sub, w, r)
+	return true
+}
+
+// serveSubAggregateRender renders the sub-aggregate of a label path made of
+// its label and value
+func (a *Aggregate) serveSubAggregateRender(w http.ResponseWriter, r *http.Request) {
+	labels, _, err := parseLabelsInPath(r.PathValue("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var sub *Aggregate
+	if len(labels) == 1 {
+		sub = a.subAggregateFor(labels)
+	}
+	if sub == nil {
+		http.Error(w, fmt.Sprintf("no sub-aggregate is rendered on %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	r.SetPathValue("labels", "")
+	sub.ServeRender(w, r)
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zapier/prom-aggregation-gateway/query"
+)
+
+// TenantHeader carries the tenant in Cortex and Mimir
+const TenantHeader = "X-Scope-OrgID"
+
+// tenantIDPattern is what Mimir accepts as a tenant ID, '|' aside which it
+// uses to query several tenants at once
+var tenantIDPattern = regexp.MustCompile(`^[a-zA-Z0-9!._*'()-]{1,150}$`)
+
+// SetTenantLabel keeps the series of each X-Scope-OrgID tenant apart under
+// label: pushes carrying the header get it as label, overriding the series'
+// own, and renders carrying it only see that tenant's series, without the
+// label. Requests without the header are served as before. "" ignores the
+// header.
+func SetTenantLabel(label string) Option {
+	return func(a *Aggregate) {
+		a.options.tenantLabel = label
+	}
+}
+
+// requestTenant returns the request's tenant, empty when tenants are not
+// enabled or it has none
+func (a *Aggregate) requestTenant(r *http.Request) (string, error) {
+	if a.opts().tenantLabel == "" {
+		return "", nil
+	}
+	tenant := r.Header.Get(TenantHeader)
+	if tenant != "" && !tenantIDPattern.MatchString(tenant) {
+		return "", fmt.Errorf("invalid %s %q", TenantHeader, tenant)
+	}
+	return tenant, nil
+}
+
+// renderTenant is the tenant of a render, which scrapers that can't set
+// the header, such as those found through ServeSD, may pass as ?tenant
+func (a *Aggregate) renderTenant(r *http.Request) (string, error) {
+	tenant, err := a.requestTenant(r)
+	if err != nil || tenant != "" || a.opts().tenantLabel == "" {
+		return tenant, err
+	}
+	tenant = r.URL.Query().Get("tenant")
+	if tenant != "" && !tenantIDPattern.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant %q", tenant)
+	}
+	return tenant, nil
+}
+
+// withTenantLabel sets the tenant label on a push, in place of any label of
+// the same name in its path
+func (a *Aggregate) withTenantLabel(labels []labelPair, tenant string) []labelPair {
+	label := a.opts().tenantLabel
+	kept := make([]labelPair, 0, len(labels)+1)
+	for _, l := range labels {
+		if l.name != label {
+			kept = append(kept, l)
+		}
+	}
+	return append(kept, labelPair{name: label, value: tenant, override: true})
+}
+
+// serveTenantRender renders the tenant's series only. It bypasses the render
+// cache, and scrapes of a single tenant don't count as the scrape completed
+// groups wait for.
+func (a *Aggregate) serveTenantRender(w http.ResponseWriter, r *http.Request, tenant string) {
+	a.expireFamilies(time.Now())
+	contentType := a.negotiateFormat(r.Header)
+	snapshot, err := a.pointInTime()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	opts := a.opts()
+	var families []*compactFamily
+	for _, family := range snapshot {
+		if family := tenantFamily(opts.overrideMetadata(opts.collapseIgnored(family)), opts.tenantLabel, tenant); family != nil {
+			families = append(families, family)
+		}
+	}
+	families = a.withPusherUp(families, opts, tenant)
+	serveFamilies(w, r, contentType, opts.limitRenderSeries(opts.filterRenderAll(families)), opts)
+}
+
+// gatherTenant is Gather restricted to the series of tenant, every series
+// when it is ""
+func (a *Aggregate) gatherTenant(tenant string) ([]*dto.MetricFamily, error) {
+	if tenant == "" {
+		return a.Gather()
+	}
+	snapshot, err := a.pointInTime()
+	if err != nil {
+		return nil, err
+	}
+	opts := a.opts()
+	var kept []*compactFamily
+	for _, family := range snapshot {
+		if family := tenantFamily(opts.overrideMetadata(opts.collapseIgnored(family)), opts.tenantLabel, tenant); family != nil {
+			kept = append(kept, family)
+		}
+	}
+	kept = a.withPusherUp(kept, opts, tenant)
+	families := make([]*dto.MetricFamily, len(kept))
+	for i, family := range kept {
+		families[i] = family.toDTO()
+	}
+	return families, nil
+}
+
+// ServeQuery serves the instant query API of package query against the
+// series of the request's tenant, every series without one
+func (a *Aggregate) ServeQuery(w http.ResponseWriter, r *http.Request) {
+	tenant, err := a.renderTenant(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"status":    "error",
+			"errorType": "bad_data",
+			"error":     err.Error(),
+		})
+		return
+	}
+	query.Handler(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return a.gatherTenant(tenant)
+	}))(w, r)
+}
+
+// tenantFamily is the family restricted to the tenant's series, with the
+// tenant label removed, nil when it has none
+func tenantFamily(family *compactFamily, label, tenant string) *compactFamily {
+	var series []compactSeries
+	for _, s := range family.series {
+		pairs := s.labels.pairs()
+		kept := pairs[:0]
+		matched := false
+		for _, l := range pairs {
+			if l.GetName() == label {
+				matched = l.GetValue() == tenant
+				continue
+			}
+			kept = append(kept, l)
+		}
+		if !matched {
+			continue
+		}
+		s.labels = makeLabelSet(kept)
+		series = append(series, s)
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
+	// without the label series may sort differently
+	sort.Slice(series, func(i, j int) bool { return series[i].labels.less(series[j].labels) })
+	filtered := *family
+	filtered.series = series
+	return &filtered
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// TimestampsPush renders each series at the time of its last contributing push
+	TimestampsPush = "push"
+	// TimestampsAggregation renders every series of a family at the time the
+	// family was last merged into
+	TimestampsAggregation = "aggregation"
+)
+
+// SetRenderTimestamps renders series with an explicit timestamp, so
+// downstream staleness handling follows slow pushers instead of the scrape
+// time. mode is TimestampsPush, TimestampsAggregation or "" to render
+// without timestamps. Series pushed with their own timestamp always keep it
+// in the aggregation mode.
+func SetRenderTimestamps(mode string) Option {
+	return func(a *Aggregate) {
+		a.options.renderTimestamps = mode
+	}
+}
+
+// stampPushed sets every series of a pushed family to now, merges keep the
+// latest timestamp of the series they merge
+func stampPushed(family *dto.MetricFamily, now time.Time) {
+	ms := now.UnixMilli()
+	for _, m := range family.Metric {
+		m.TimestampMs = &ms
+	}
+}
+
+// latestTimestamp keeps the newest timestamp of two merged series
+func latestTimestamp(a, b *compactSeries) *int64 {
+	var ta, tb *int64
+	if a.extra != nil {
+		ta = a.extra.timestampMs
+	}
+	if b.extra != nil {
+		tb = b.extra.timestampMs
+	}
+	if ta == nil || (tb != nil && *tb > *ta) {
+		return tb
+	}
+	return ta
+}
@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// SetTombstoneTTL keeps a tombstone of every series deleted with
+// DELETE /api/v1/admin/series for d, dropping pushes of that exact label set
+// meanwhile, so a producer still pushing garbage doesn't bring it right
+// back. 0 deletes series without tombstones.
+func SetTombstoneTTL(d time.Duration) Option {
+	return func(a *Aggregate) {
+		a.options.tombstoneTTL = d
+	}
+}
+
+// tombstones are the label sets of deleted series, per family, with when
+// their tombstone expires
+type tombstones struct {
+	lock     sync.RWMutex
+	families map[string]map[labelSet]time.Time
+}
+
+type tombstone struct {
+	Family  string            `json:"family"`
+	Labels  map[string]string `json:"labels"`
+	Expires time.Time         `json:"expires"`
+}
+
+// add tombstones the label sets of a family until expires, dropping the
+// expired tombstones of every family meanwhile
+func (t *tombstones) add(name string, labels []labelSet, expires time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sweep(time.Now())
+	if t.families == nil {
+		t.families = map[string]map[labelSet]time.Time{}
+	}
+	family := t.families[name]
+	if family == nil {
+		family = map[labelSet]time.Time{}
+		t.families[name] = family
+	}
+	for _, ls := range labels {
+		family[ls] = expires
+	}
+}
+
+func anyLive(family map[labelSet]time.Time, now time.Time) bool {
+	for _, expires := range family {
+		if now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweep drops the expired tombstones, the lock being held
+func (t *tombstones) sweep(now time.Time) {
+	for name, family := range t.families {
+		for ls, expires := range family {
+			if !now.Before(expires) {
+				delete(family, ls)
+			}
+		}
+		if len(family) == 0 {
+			delete(t.families, name)
+		}
+	}
+}
+
+// buried reports whether the family has live tombstones, and for which
+// label sets. A family whose tombstones all expired has them dropped, so
+// pushes of a family deleted long ago stop checking them.
+func (t *tombstones) buried(name string, now time.Time) (func(labelSet) bool, bool) {
+	t.lock.RLock()
+	family, ok := t.families[name]
+	live := ok && anyLive(family, now)
+	t.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if !live {
+		t.lock.Lock()
+		// unless tombstoned again meanwhile
+		if !anyLive(family, now) {
+			delete(t.families, name)
+		}
+		t.lock.Unlock()
+		return nil, false
+	}
+	return func(ls labelSet) bool {
+		t.lock.RLock()
+		defer t.lock.RUnlock()
+		expires, ok := family[ls]
+		return ok && now.Before(expires)
+	}, true
+}
+
+// lift removes the tombstones of a family, of every family when name is
+// empty
+func (t *tombstones) lift(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for family := range t.families {
+		if name == "" || family == name {
+			delete(t.families, family)
+		}
+	}
+}
+
+// list drops the expired tombstones and returns the others sorted by family
+// and labels
+func (t *tombstones) list(now time.Time) []tombstone {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sweep(now)
+
+	type entry struct {
+		name   string
+		labels labelSet
+		tombstone
+	}
+	var entries []entry
+	for name, family := range t.families {
+		for ls, expires := range family {
+			entries = append(entries, entry{name: name, labels: ls, tombstone: tombstone{Family: name, Expires: expires}})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].name != entries[j].name {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].labels.less(entries[j].labels)
+	})
+
+	list := make([]tombstone, len(entries))
+	for i, e := range entries {
+		list[i] = e.tombstone
+		list[i].Labels = labelMap(e.labels)
+	}
+	return list
+}
+
+// dropTombstoned drops the pushed series of a family with sorted labels that
+// match a tombstone, warning the push. It reports false when none are left.
+func (a *Aggregate) dropTombstoned(family *dto.MetricFamily, ack *pushAck) bool {
+	buried, ok := a.tombstones.buried(family.GetName(), time.Now())
+	if !ok {
+		return true
+	}
+	before := len(family.Metric)
+	family.Metric = slices.DeleteFunc(family.Metric, func(m *dto.Metric) bool {
+		return buried(makeLabelSet(m.Label))
+	})
+	if dropped := before - len(family.Metric); dropped > 0 {
+		TombstonedSeries.WithLabelValues(family.GetName()).Add(float64(dropped))
+		ack.warnings = append(ack.warnings, fmt.Sprintf("%d series of family %s were deleted and are tombstoned, they were not merged", dropped, family.GetName()))
+	}
+	return len(family.Metric) > 0
+}
+
+// seriesSampleSize is how many of the series a bulk operation affects it
+// returns
+const seriesSampleSize = 10
+
+// seriesSample is a series affected by a bulk operation
+type seriesSample struct {
+	Family string            `json:"family"`
+	Labels map[string]string `json:"labels"`
+}
+
+// deleteSeries removes the series of the family name, of every family when
+// it is empty, carrying every label of the group, and tombstones them for
+// ttl. It returns how many series were deleted and a sample of them, even
+// when a spilled family can't be read back, those of the families before it
+// being deleted. With dryRun, it only counts and samples them.
+func (a *Aggregate) deleteSeries(name string, group []labelPair, ttl time.Duration, dryRun bool) (int, []seriesSample, error) {
+	expires := time.Now().Add(ttl)
+	deleted := 0
+	sample := []seriesSample{}
+	for _, f := range a.snapshot() {
+		if name != "" && f.name != name {
+			continue
+		}
+		var labels []labelSet
+		matches := func(s *compactSeries) bool {
+			if !s.inGroup(group) {
+				return false
+			}
+			labels = append(labels, s.labels)
+			return true
+		}
+		var err error
+		if dryRun {
+			var current *compactFamily
+			if current, err = f.family.load(); err == nil {
+				for i := range current.series {
+					matches(&current.series[i])
+				}
+			}
+		} else {
+			var sizeDelta int64
+			var remaining int
+			sizeDelta, remaining, err = f.family.removeSeries(matches)
+			if len(labels) > 0 {
+				a.addMemoryBytes(sizeDelta)
+				if remaining == 0 {
+					a.removeFamilyIfEmpty(f.name)
+				}
+				if ttl > 0 {
+					a.tombstones.add(f.name, labels, expires)
+				}
+			}
+		}
+
+		for _, ls := range labels {
+			if len(sample) == seriesSampleSize {
+				break
+			}
+			sample = append(sample, seriesSample{Family: f.name, Labels: labelMap(ls)})
+		}
+		deleted += len(labels)
+		if err != nil {
+			if deleted > 0 && !dryRun {
+				a.generation.Add(1)
+			}
+			return deleted, sample, err
+		}
+	}
+	if deleted > 0 && !dryRun {
+		a.generation.Add(1)
+	}
+	return deleted, sample, nil
+}
+
+// ServeSeries deletes the series of the family ?name carrying the labels of
+// the label path, e.g. DELETE /api/v1/admin/series/job/<name>?name=<family>.
+// Either may be left out, not both. The deleted series are tombstoned for
+// the tombstone TTL. With ?dry_run=true, it only answers how many series
+// would be deleted, and a sample of them.
+func (a *Aggregate) ServeSeries(w http.ResponseWriter, r *http.Request) {
+	if a.replica != nil {
+		http.Error(w, ErrReadOnlyReplica.Error(), http.StatusForbidden)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	group, _, err := parseLabelsInPath(r.PathValue("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sub := a.subAggregateFor(group); sub != nil {
+		sub.ServeSeries(w, r)
+		return
+	}
+	if name == "" && len(group) == 0 {
+		http.Error(w, "name or a label path is required", http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := a.opts().tombstoneTTL
+	deleted, sample, err := a.deleteSeries(name, group, ttl, dryRun)
+	if err != nil {
+		log.Printf("Deleted %d series of family %q under %q before failing: %s\n", deleted, name, r.PathValue("labels"), err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		http.Error(w, "no series matched", http.StatusNotFound)
+		return
+	}
+	if !dryRun {
+		log.Printf("Deleted %d series of family %q under %q, tombstoned for %s\n", deleted, name, r.PathValue("labels"), ttl)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": deleted, "sample": sample, "dry_run": dryRun, "tombstone_ttl": ttl.String()})
+}
+
+// ServeTombstones lists the live tombstones. A DELETE lifts those of the
+// family ?name, every tombstone without it.
+func (a *Aggregate) ServeTombstones(w http.ResponseWriter, r *http.Request) {
+	if a.serveSubAggregateAdmin(w, r, (*Aggregate).ServeTombstones) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		a.tombstones.lift(r.URL.Query().Get("name"))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tombstones": a.tombstones.list(time.Now())})
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// SetUpstream proxies the pushes this gateway doesn't own to the gateway at
+// upstreamURL, so ownership can be split across gateways gradually. A push is
+// owned when its X-Scope-OrgID tenant is one of ownedTenants and its label
+// path starts with one of ownedPaths (e.g. "job/ci"), an empty list owning
+// every tenant or path. An empty upstreamURL owns every push.
+func SetUpstream(upstreamURL string, ownedTenants, ownedPaths []string) Option {
+	return func(a *Aggregate) {
+		a.options.upstreamURL = upstreamURL
+		a.options.ownedTenants = ownedTenants
+		a.options.ownedPaths = nil
+		for _, path := range ownedPaths {
+			if path = strings.Trim(path, "/"); path != "" {
+				a.options.ownedPaths = append(a.options.ownedPaths, path)
+			}
+		}
+	}
+}
+
+func newUpstreamProxy(upstreamURL string) *httputil.ReverseProxy {
+	target, err := url.Parse(upstreamURL)
+	if err != nil || target.Host == "" {
+		log.Printf("Ignoring invalid upstream %q, every push is merged here\n", upstreamURL)
+		return nil
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			// the body may have been decompressed on the way in
+			if pr.Out.ContentLength != 0 {
+				pr.Out.ContentLength = -1
+				pr.Out.Header.Del("Content-Length")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ProxiedPushes.WithLabelValues("error").Inc()
+			log.Printf("Could not proxy push to %s: %s\n", upstreamURL, err.Error())
+			http.Error(w, "upstream gateway unavailable", http.StatusBadGateway)
+		},
+		ModifyResponse: func(*http.Response) error {
+			ProxiedPushes.WithLabelValues("ok").Inc()
+			return nil
+		},
+	}
+}
+
+// proxyUnowned forwards the push upstream when this gateway doesn't own it,
+// and reports whether it did
+func (a *Aggregate) proxyUnowned(w http.ResponseWriter, r *http.Request, tenant string) bool {
+	if a.upstream == nil || a.owns(tenant, r.PathValue("labels")) {
+		return false
+	}
+	a.upstream.ServeHTTP(w, r)
+	return true
+}
+
+func (a *Aggregate) owns(tenant, labelPath string) bool {
+	opts := a.opts()
+	if len(opts.ownedTenants) > 0 && !slices.Contains(opts.ownedTenants, tenant) {
+		return false
+	}
+	if len(opts.ownedPaths) == 0 {
+		return true
+	}
+	labelPath = strings.Trim(labelPath, "/")
+	for _, owned := range opts.ownedPaths {
+		if labelPath == owned || strings.HasPrefix(labelPath, owned+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SetUsageAccounting tracks the bytes and samples merged per job, tenant
+// and source, the host pushing, for chargeback and finding the heaviest
+// producers. Sources that haven't pushed within the metric TTL are
+// forgotten.
+func SetUsageAccounting(enabled bool) Option {
+	return func(a *Aggregate) {
+		a.options.usageAccounting = enabled
+	}
+}
+
+type producerKey struct {
+	job, tenant, source string
+}
+
+type sourceUsage struct {
+	Job      string    `json:"job"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Source   string    `json:"source"`
+	Pushes   uint64    `json:"pushes"`
+	Bytes    uint64    `json:"bytes"`
+	Samples  uint64    `json:"samples"`
+	LastPush time.Time `json:"last_push"`
+}
+
+type usageAccounting struct {
+	lock    sync.Mutex
+	sources map[producerKey]*sourceUsage
+	// pruned is when sources last had the idle ones dropped
+	pruned time.Time
+}
+
+func newUsageAccounting() *usageAccounting {
+	return &usageAccounting{sources: map[producerKey]*sourceUsage{}}
+}
+
+// record accounts a push, forgetting the sources idle for ttl once per ttl
+// when it is positive, so they don't pile up between reports
+func (u *usageAccounting) record(key producerKey, bytes, samples int, now time.Time, ttl time.Duration) {
+	IngestedBytes.WithLabelValues(key.job, key.tenant).Add(float64(bytes))
+	IngestedSamples.WithLabelValues(key.job, key.tenant).Add(float64(samples))
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if ttl > 0 && now.Sub(u.pruned) >= ttl {
+		u.prune(now, ttl)
+	}
+
+	source, ok := u.sources[key]
+	if !ok {
+		source = &sourceUsage{Job: key.job, Tenant: key.tenant, Source: key.source}
+		u.sources[key] = source
+	}
+	source.Pushes++
+	source.Bytes += uint64(bytes)
+	source.Samples += uint64(samples)
+	source.LastPush = now
+}
+
+// report returns the usage of every source, heaviest first, forgetting
+// those idle for ttl when it is positive
+func (u *usageAccounting) report(now time.Time, ttl time.Duration) []sourceUsage {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if ttl > 0 {
+		u.prune(now, ttl)
+	}
+	sources := make([]sourceUsage, 0, len(u.sources))
+	for _, source := range u.sources {
+		sources = append(sources, *source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Bytes != sources[j].Bytes {
+			return sources[i].Bytes > sources[j].Bytes
+		}
+		return sources[i].Samples > sources[j].Samples
+	})
+	return sources
+}
+
+// prune drops the sources idle for ttl, it must be called with the lock held
+func (u *usageAccounting) prune(now time.Time, ttl time.Duration) {
+	for key, source := range u.sources {
+		if now.Sub(source.LastPush) > ttl {
+			delete(u.sources, key)
+		}
+	}
+	u.pruned = now
+}
+
+// requestProducer returns who a push comes from
+func (a *Aggregate) requestProducer(r *http.Request, job, tenant string) producerKey {
+	return producerKey{job: job, tenant: tenant, source: a.clientAddr(r)}
+}
+
+// noteUsage accounts a merged push
+func (a *Aggregate) noteUsage(key producerKey, bytes int, ack *pushAck) {
+	if a.usage != nil {
+		a.usage.record(key, bytes, ack.samples, time.Now(), a.metricTTL())
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// ServeUsage reports the usage of every source pushing, heaviest first.
+// ?limit=N keeps the N heaviest.
+func (a *Aggregate) ServeUsage(w http.ResponseWriter, r *http.Request) {
+	if a.usage == nil {
+		http.Error(w, "usage accounting is disabled, see --usageAccounting", http.StatusNotFound)
+		return
+	}
+	sources := a.usage.report(time.Now(), a.metricTTL())
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		sources = sources[:min(limit, len(sources))]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"sources": sources})
+}
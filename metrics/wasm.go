@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/zapier/prom-aggregation-gateway/wasm"
+)
+
+var ErrFilterFailed = errors.New("an ingest filter failed")
+
+// wasmFilterTimeout bounds a single call of a filter, a module stuck in a
+// loop failing it rather than holding the push or render forever
+const wasmFilterTimeout = time.Second
+
+// SetWASMFilters passes every pushed family through the filters exporting
+// filter_ingest, in order, after the ingest hooks, and every rendered one
+// through those exporting filter_render. The filters stay owned by the
+// caller, which closes them after the aggregate.
+func SetWASMFilters(filters []*wasm.Filter) Option {
+	return func(a *Aggregate) {
+		a.options.ingestFilters, a.options.renderFilters = nil, nil
+		for _, f := range filters {
+			if f.Ingests() {
+				a.options.ingestFilters = append(a.options.ingestFilters, f)
+			}
+			if f.Renders() {
+				a.options.renderFilters = append(a.options.renderFilters, f)
+			}
+		}
+	}
+}
+
+// filterIngest returns the pushed family once through the ingest filters,
+// nil when one of them drops it. Failures are the gateway's, not the
+// pusher's, and reject the push with ErrFilterFailed.
+func (ao *aggregateOptions) filterIngest(family *dto.MetricFamily) (*dto.MetricFamily, error) {
+	for _, f := range ao.ingestFilters {
+		ctx, cancel := context.WithTimeout(context.Background(), wasmFilterTimeout)
+		filtered, err := f.Ingest(ctx, family)
+		cancel()
+		if err != nil {
+			WASMFilterErrors.WithLabelValues("ingest").Inc()
+			log.Printf("Could not filter pushed family %s: %s\n", family.GetName(), err.Error())
+			return nil, fmt.Errorf("%w: %s", ErrFilterFailed, err)
+		}
+		if filtered == nil {
+			return nil, nil
+		}
+		family = tidyFiltered(family, filtered)
+	}
+	return family, nil
+}
+
+// filterRender returns the family rendered once through the render
+// filters, nil when one of them drops it. A failing filter is skipped, so
+// the family is still scraped, unfiltered by it.
+func (ao *aggregateOptions) filterRender(family *compactFamily) *compactFamily {
+	if len(ao.renderFilters) == 0 {
+		return family
+	}
+
+	rendered := family.toDTO()
+	for _, f := range ao.renderFilters {
+		ctx, cancel := context.WithTimeout(context.Background(), wasmFilterTimeout)
+		filtered, err := f.Render(ctx, rendered)
+		cancel()
+		if err != nil {
+			WASMFilterErrors.WithLabelValues("render").Inc()
+			log.Printf("Could not filter rendered family %s: %s\n", family.name, err.Error())
+			continue
+		}
+		if filtered == nil {
+			return nil
+		}
+		rendered = tidyFiltered(rendered, filtered)
+	}
+	return compactFamilyFromDTO(rendered)
+}
+
+// filterRenderAll filters families for a render, in place
+func (ao *aggregateOptions) filterRenderAll(families []*compactFamily) []*compactFamily {
+	if len(ao.renderFilters) == 0 {
+		return families
+	}
+	kept := families[:0]
+	for _, family := range families {
+		if family = ao.filterRender(family); family != nil {
+			kept = append(kept, family)
+		}
+	}
+	return kept
+}
+
+// tidyFiltered sorts the series a filter returned and merges those left
+// with the same labels. The text format carries no unit, the original's is
+// kept when the filter gives none.
+func tidyFiltered(original, filtered *dto.MetricFamily) *dto.MetricFamily {
+	if filtered.Unit == nil {
+		filtered.Unit = original.Unit
+	}
+	for _, m := range filtered.Metric {
+		if !labelsSorted(m.Label) {
+			sort.Sort(byName(m.Label))
+		}
+	}
+	collapseSeries(filtered)
+	return filtered
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultWatchDuration is how long a family is watched without ?duration
+	defaultWatchDuration = 10 * time.Minute
+	// maxWatchDuration bounds how long a family may be watched, watches
+	// log every series pushed
+	maxWatchDuration = time.Hour
+	// watchEvents is how many of the latest events a watch keeps
+	watchEvents = 100
+)
+
+// watches are the families whose pushes are traced for a while, to find
+// who keeps setting a series to a surprising value: every series pushed to
+// them is logged, with its value before and after the merge
+type watches struct {
+	// active counts the watches, pushes don't take the lock without any
+	active atomic.Int64
+
+	lock     sync.Mutex
+	families map[string]*familyWatch
+}
+
+type familyWatch struct {
+	Family string    `json:"family"`
+	Until  time.Time `json:"until"`
+	// Events are the latest series pushed, oldest first
+	Events []watchEvent `json:"events"`
+}
+
+// watchEvent is a series pushed to a watched family. The value after the
+// merge includes the pushes merged in the same pass.
+type watchEvent struct {
+	Time   time.Time         `json:"time"`
+	Job    string            `json:"job,omitempty"`
+	Tenant string            `json:"tenant,omitempty"`
+	Source string            `json:"source,omitempty"`
+	Labels map[string]string `json:"labels"`
+	Pushed float64           `json:"pushed"`
+	// Before is nil for a series the push created
+	Before *float64 `json:"before"`
+	After  float64  `json:"after"`
+}
+
+func (w *watches) start(name string, until time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.families == nil {
+		w.families = map[string]*familyWatch{}
+	}
+	if watch, ok := w.families[name]; ok {
+		watch.Until = until
+		return
+	}
+	w.families[name] = &familyWatch{Family: name, Until: until, Events: []watchEvent{}}
+	w.active.Add(1)
+}
+
+// stop reports whether the family was watched
+func (w *watches) stop(name string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.families[name]; !ok {
+		return false
+	}
+	delete(w.families, name)
+	w.active.Add(-1)
+	return true
+}
+
+// watching reports whether the family is watched, ending its watch once it
+// is over
+func (w *watches) watching(name string, now time.Time) bool {
+	if w.active.Load() == 0 {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	watch, ok := w.families[name]
+	if ok && !now.Before(watch.Until) {
+		log.Printf("Stopped watching family %s\n", name)
+		delete(w.families, name)
+		w.active.Add(-1)
+		return false
+	}
+	return ok
+}
+
+// record logs the series producer pushed to the family, with their values
+// before and after the merge, and the values of the redact labels redacted
+// as the push log has them
+func (w *watches) record(name string, producer producerKey, pushed []compactSeries, before, after map[labelSet]float64, now time.Time, redact []string) {
+	job := producer.job
+	if slices.Contains(redact, "job") {
+		job = redactedValue
+	}
+	events := make([]watchEvent, 0, len(pushed))
+	for _, s := range pushed {
+		labels := labelMap(s.labels)
+		for _, label := range redact {
+			if _, ok := labels[label]; ok {
+				labels[label] = redactedValue
+			}
+		}
+		event := watchEvent{Time: now, Job: job, Tenant: producer.tenant, Source: producer.source, Labels: labels, Pushed: s.value, After: after[s.labels]}
+		previous := "none"
+		if value, ok := before[s.labels]; ok {
+			event.Before = &value
+			previous = formatFloat(value)
+		}
+		log.Printf("Watched family %s: job %q of tenant %q from %s pushed %v %g, %s before the merge, %g after\n", name, event.Job, event.Tenant, event.Source, event.Labels, event.Pushed, previous, event.After)
+		events = append(events, event)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if watch, ok := w.families[name]; ok {
+		watch.Events = append(watch.Events, events...)
+		if over := len(watch.Events) - watchEvents; over > 0 {
+			watch.Events = append(watch.Events[:0:0], watch.Events[over:]...)
+		}
+	}
+}
+
+// list returns the watches sorted by family, with copies of their events
+func (w *watches) list() []familyWatch {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	list := make([]familyWatch, 0, len(w.families))
+	for _, watch := range w.families {
+		copied := *watch
+		copied.Events = append([]watchEvent{}, watch.Events...)
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Family < list[j].Family })
+	return list
+}
+
+// seriesValues returns the value of every series of the family, the sum of
+// histograms and summaries
+func (a *Aggregate) seriesValues(name string) map[labelSet]float64 {
+	family, ok := a.families.Get(name)
+	if !ok {
+		return nil
+	}
+	current, err := family.load()
+	if err != nil {
+		return nil
+	}
+	values := make(map[labelSet]float64, len(current.series))
+	for _, s := range current.series {
+		values[s.labels] = s.value
+	}
+	return values
+}
+
+// ServeWatch lists the watched families with their latest events. A POST
+// with ?name watches that family, which needn't exist yet, for ?duration
+// (10m by default, 1h at most), logging every series pushed to it with its
+// value before and after the merge, until a DELETE with ?name stops it.
+func (a *Aggregate) ServeWatch(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodPost:
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		duration := defaultWatchDuration
+		if value := r.URL.Query().Get("duration"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 || duration > maxWatchDuration {
+				http.Error(w, fmt.Sprintf("duration must be a positive duration of at most %s", maxWatchDuration), http.StatusBadRequest)
+				return
+			}
+		}
+		a.watches.start(name, time.Now().Add(duration))
+		log.Printf("Watching family %s for %s\n", name, duration)
+	case http.MethodDelete:
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if !a.watches.stop(name) {
+			http.Error(w, fmt.Sprintf("family %s is not watched", name), http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"watches": a.watches.list()})
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// webhookTimeout bounds a single webhook notification
+const webhookTimeout = 5 * time.Second
+
+// webhook posts notifications to a URL as JSON, one after another from a
+// queue, dropping those it has no room for rather than slowing the gateway
+// down. Each is counted in results as ok, error or dropped.
+type webhook struct {
+	url string
+	// about is what the notifications are about, for the logs
+	about   string
+	results *prometheus.CounterVec
+	client  *http.Client
+	queue   chan any
+	wg      sync.WaitGroup
+}
+
+// newWebhook returns the webhook of url, nil when it is empty
+func newWebhook(url, about string, queue int, results *prometheus.CounterVec) *webhook {
+	if url == "" {
+		return nil
+	}
+	h := &webhook{url: url, about: about, results: results, client: &http.Client{Timeout: webhookTimeout}, queue: make(chan any, queue)}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for message := range h.queue {
+			if err := h.post(message); err != nil {
+				h.results.WithLabelValues("error").Inc()
+				log.Printf("Could not notify %s of %s: %s\n", h.url, h.about, err.Error())
+				continue
+			}
+			h.results.WithLabelValues("ok").Inc()
+		}
+	}()
+	return h
+}
+
+// send queues a notification, a nil webhook dropping it silently
+func (h *webhook) send(message any) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.queue <- message:
+	default:
+		h.results.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (h *webhook) post(message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// close sends the notifications still waiting
+func (h *webhook) close() {
+	if h != nil {
+		close(h.queue)
+		h.wg.Wait()
+	}
+}
@@ -0,0 +1,18 @@
+// Package aggregation embeds the gateway's aggregation endpoint in other Go
+// services: New returns an aggregate, taking the same options as the flags
+// (the metrics.Set* functions), and NewHandler serves the gateway's API for
+// it on net/http, without gin.
+package aggregation
+
+import "github.com/zapier/prom-aggregation-gateway/metrics"
+
+// Aggregate merges the pushed families and renders them
+type Aggregate = metrics.Aggregate
+
+// Option configures an Aggregate
+type Option = metrics.Option
+
+// New returns an aggregate with options, to Close once done with it
+func New(options ...Option) *Aggregate {
+	return metrics.NewAggregate(options...)
+}
@@ -0,0 +1,156 @@
+package aggregation
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+func TestNewHandler(t *testing.T) {
+	agg := New()
+	defer agg.Close()
+	require.NoError(t, agg.Push(bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 1\n"), map[string]string{"job": "embedded"}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/", NewHandler(agg, HandlerConfig{CorsDomain: "*"}))
+	// handlers share the request metrics of their registry rather than
+	// register them again
+	mux.Handle("/other/", http.StripPrefix("/other", NewHandler(agg, HandlerConfig{CorsDomain: "*"})))
+
+	req, err := http.NewRequest("POST", "/metrics/job/embedded", bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 2\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "# TYPE some_counter counter\nsome_counter{job=\"embedded\"} 3\n", w.Body.String())
+
+	req, err = http.NewRequest("GET", "/other/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+}
+
+func TestPriorityClasses(t *testing.T) {
+	users, err := ParsePriorities([]string{"payments=high"})
+	require.NoError(t, err)
+	_, err = ParsePriorities([]string{"payments=urgent"})
+	require.ErrorContains(t, err, "unknown priority class")
+
+	s := NewScheduler(HandlerConfig{MaxConcurrentRequests: 1, RequestQueueTimeout: time.Second, UserPriorities: users})
+	var served []string
+	var servedLock sync.Mutex
+	hold := make(chan struct{})
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			servedLock.Lock()
+			served = append(served, name)
+			servedLock.Unlock()
+			if name == "first" {
+				<-hold
+			}
+		}
+	}
+	push := Route{HandlerID: "postMetrics", Kind: PushRoute}
+	render := Route{HandlerID: "getMetrics", Kind: RenderRoute}
+	serve := func(route Route, name, user string) chan int {
+		code := make(chan int, 1)
+		go func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			if user != "" {
+				req = req.WithContext(metrics.WithAuthUser(req.Context(), user))
+			}
+			// neither tenants nor unchecked credentials are an identity
+			req.Header.Set(metrics.TenantHeader, "payments")
+			req.SetBasicAuth("payments", "unchecked")
+			w := httptest.NewRecorder()
+			s.Admit(route, handler(name))(w, req)
+			code <- w.Code
+		}()
+		return code
+	}
+	busy := func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.free == 0
+	}
+	queued := func(n int) {
+		require.Eventually(t, func() bool {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			waiting := 0
+			for i := range s.waiting {
+				waiting += s.waiting[i].Len()
+			}
+			return waiting == n
+		}, time.Second, time.Millisecond)
+	}
+
+	first := serve(push, "first", "")
+	require.Eventually(t, busy, time.Second, time.Millisecond)
+	bestEffort := serve(push, "push", "")
+	queued(1)
+	scrape := serve(render, "scrape", "")
+	queued(2)
+	user := serve(push, "user", "payments")
+	queued(3)
+	close(hold)
+	for _, code := range []chan int{first, bestEffort, scrape, user} {
+		require.Equal(t, http.StatusOK, <-code)
+	}
+	// scrapes and high priority users go before pushes, in order
+	require.Equal(t, []string{"first", "scrape", "user", "push"}, served)
+	require.False(t, busy())
+
+	// the last slot is kept for high requests
+	s = NewScheduler(HandlerConfig{MaxConcurrentRequests: 2, RequestQueueTimeout: time.Second})
+	hold = make(chan struct{})
+	served = nil
+	first = serve(push, "first", "ci")
+	require.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.free == 1
+	}, time.Second, time.Millisecond)
+	bestEffort = serve(push, "push", "ci")
+	queued(1)
+	require.Equal(t, http.StatusOK, <-serve(render, "scrape", ""))
+	close(hold)
+	require.Equal(t, http.StatusOK, <-first)
+	require.Equal(t, http.StatusOK, <-bestEffort)
+	require.Equal(t, []string{"first", "scrape", "push"}, served)
+	require.Equal(t, 2, s.free)
+
+	s = NewScheduler(HandlerConfig{MaxConcurrentRequests: 1, RequestQueueTimeout: 10 * time.Millisecond})
+	hold = make(chan struct{})
+	served = nil
+	first = serve(push, "first", "")
+	require.Eventually(t, busy, time.Second, time.Millisecond)
+	require.Equal(t, http.StatusServiceUnavailable, <-serve(push, "push", ""))
+	// pushes are shed in the aggregate's push error format
+	for _, route := range Routes(New(metrics.SetErrorFormat(metrics.ErrorFormatJSON))) {
+		if route.Kind == PushRoute {
+			push = route
+		}
+	}
+	w := httptest.NewRecorder()
+	s.Admit(push, handler("json"))(w, httptest.NewRequest("POST", "/metrics", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Contains(t, w.Body.String(), `"code":"overloaded"`)
+	close(hold)
+	require.Equal(t, http.StatusOK, <-first)
+	require.Equal(t, []string{"first"}, served)
+}
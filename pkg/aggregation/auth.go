@@ -0,0 +1,47 @@
+package aggregation
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+// Credentials are the passwords of the auth users, by user. Unlike
+// gin.Accounts they leave the net/http handler free of gin.
+type Credentials map[string]string
+
+// ParseCredentials parses "user=password" items, skipping malformed ones
+func ParseCredentials(authList []string) Credentials {
+	authAccounts := Credentials{}
+	if len(authList) == 0 {
+		return authAccounts
+	}
+
+	for _, item := range authList {
+		i := strings.Split(item, "=")
+		if len(i) == 2 {
+			authAccounts[i[0]] = i[1]
+		}
+	}
+
+	return authAccounts
+}
+
+// basicAuth mirrors gin.BasicAuth, passing the verified user on to next as
+// metrics.AuthUser
+func basicAuth(accounts Credentials, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			if expected, found := accounts[user]; found && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+				next.ServeHTTP(w, r.WithContext(metrics.WithAuthUser(r.Context(), user)))
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Authorization Required"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,26 @@
+package aggregation
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		authList []string
+		accounts Credentials
+	}{
+		{"basic 1", []string{"user=password"}, Credentials{"user": "password"}},
+		{"two", []string{"user=password", "user1=password1"}, Credentials{"user": "password", "user1": "password1"}},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			a := ParseCredentials(test.authList)
+			assert.Equal(t, test.accounts, a)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package aggregation
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promMetrics "github.com/slok/go-http-metrics/metrics/prometheus"
+	"github.com/slok/go-http-metrics/middleware"
+	"github.com/slok/go-http-metrics/middleware/std"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+// HandlerConfig is how NewHandler serves the API
+type HandlerConfig struct {
+	// CorsDomain is the allowed origin, "*" allowing every origin
+	CorsDomain string
+	// Accounts are "user=password" items pushes and the admin API must
+	// authenticate as, none serving pushes to anyone and no admin API
+	Accounts []string
+	// MaxBodySize bounds the (decompressed) bytes of a push, 0 for no bound
+	MaxBodySize int64
+	// GzipIngest decompresses pushes sent with 'Content-Encoding: gzip'
+	GzipIngest bool
+	// MaxConcurrentRequests bounds the API requests served at once, those
+	// over it waiting by priority class, 0 serving every request right away
+	MaxConcurrentRequests int
+	// RequestQueueTimeout is how long a request waits before a 503, 0 waiting
+	// for as long as the client does
+	RequestQueueTimeout time.Duration
+	// RoutePriorities and UserPriorities map route handler IDs and auth
+	// users to priority classes, the class of the user a request
+	// authenticated as winning over its route's
+	RoutePriorities map[string]string
+	UserPriorities  map[string]string
+	// Registry is where the request metrics are registered,
+	// metrics.PromRegistry when nil
+	Registry prometheus.Registerer
+	// Scheduler, when set, is a concurrency limit shared with other
+	// handlers, instead of one of MaxConcurrentRequests
+	Scheduler *Scheduler
+}
+
+var (
+	requestMetricsLock sync.Mutex
+	requestMetrics     = map[prometheus.Registerer]middleware.Middleware{}
+)
+
+// RequestMetrics returns the middleware recording request metrics in
+// registry. Its collectors are only registered once, every handler of the
+// same registry sharing them, so a service may build as many handlers as it
+// likes.
+func RequestMetrics(registry prometheus.Registerer) middleware.Middleware {
+	if registry == nil {
+		registry = metrics.PromRegistry
+	}
+	requestMetricsLock.Lock()
+	defer requestMetricsLock.Unlock()
+	m, ok := requestMetrics[registry]
+	if !ok {
+		m = middleware.New(middleware.Config{
+			Recorder: promMetrics.NewRecorder(promMetrics.Config{Registry: registry}),
+		})
+		requestMetrics[registry] = m
+	}
+	return m
+}
+
+// NewHandler serves the gateway's API for agg using only net/http, so Go
+// services can embed an aggregation endpoint in their own server
+func NewHandler(agg *Aggregate, cfg HandlerConfig) http.Handler {
+	accounts := ParseCredentials(cfg.Accounts)
+
+	metricsMiddleware := RequestMetrics(cfg.Registry)
+	scheduler := cfg.RequestScheduler()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", std.Handler("noRoute", metricsMiddleware, http.NotFoundHandler()))
+
+	for _, route := range Routes(agg) {
+		if route.Kind == AdminRoute && len(accounts) == 0 {
+			continue
+		}
+		var h http.Handler = scheduler.Admit(route, route.Handler)
+
+		if route.Kind == PushRoute {
+			if cfg.MaxBodySize > 0 {
+				h = limitBodySize(cfg.MaxBodySize, h)
+			}
+			if cfg.GzipIngest {
+				h = decodeGzip(route, h)
+			}
+		}
+		if (route.Kind == PushRoute || route.Kind == AdminRoute) && len(accounts) > 0 {
+			h = basicAuth(accounts, h)
+		}
+		h = cors(cfg.CorsDomain, h)
+		h = std.Handler(route.HandlerID, metricsMiddleware, h)
+
+		for _, method := range route.Methods {
+			mux.Handle(method+" "+route.Path, h)
+			if route.LabelPath {
+				mux.Handle(method+" "+route.Path+"/{labels...}", h)
+			}
+		}
+	}
+
+	return mux
+}
+
+// cors mirrors the gin-contrib/cors behaviour of the gin router: requests
+// from other origins are refused, allowed ones get the origin header back
+func cors(corsDomain string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if corsDomain == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin == corsDomain {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		} else {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GunzipBody transparently swaps a 'Content-Encoding: gzip' body for its
+// decompressed stream, failing with metrics.ErrBadEncoding when it isn't
+// gzip
+func GunzipBody(r *http.Request) error {
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %w", metrics.ErrBadEncoding, err)
+	}
+
+	r.Body = gz
+	r.Header.Del("Content-Encoding")
+	return nil
+}
+
+func decodeGzip(route Route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := GunzipBody(r); err != nil {
+			route.Reject(w, r, http.StatusBadRequest, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func limitBodySize(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
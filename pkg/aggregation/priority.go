@@ -0,0 +1,208 @@
+package aggregation
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+// Priority classes of API requests, served in this order when they queue
+// for the concurrency limit
+const (
+	PriorityHigh       = "high"
+	PriorityNormal     = "normal"
+	PriorityBestEffort = "best-effort"
+)
+
+var priorityClasses = [...]string{PriorityHigh, PriorityNormal, PriorityBestEffort}
+
+// defaultPriority is the class of a route kind's requests: scrapes first,
+// then the admin API, then pushes
+func defaultPriority(kind RouteKind) string {
+	switch kind {
+	case RenderRoute:
+		return PriorityHigh
+	case AdminRoute:
+		return PriorityNormal
+	default:
+		return PriorityBestEffort
+	}
+}
+
+// ParsePriorities parses "name=class" items, names being route handler IDs
+// or auth users
+func ParsePriorities(items []string) (map[string]string, error) {
+	priorities := map[string]string{}
+	for _, item := range items {
+		name, class, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid priority %q, must be name=class", item)
+		}
+		if priorityRank(class) < 0 {
+			return nil, fmt.Errorf("unknown priority class %q, must be %q, %q or %q", class, PriorityHigh, PriorityNormal, PriorityBestEffort)
+		}
+		priorities[name] = class
+	}
+	return priorities, nil
+}
+
+func priorityRank(class string) int {
+	for i, c := range priorityClasses {
+		if c == class {
+			return i
+		}
+	}
+	return -1
+}
+
+// Scheduler bounds how many API requests are served at once, requests over
+// the limit waiting for a slot in priority order, first come first served
+// within a class. The last reserved slots only serve high requests, so a
+// flood of lower ones taking every slot doesn't keep scrapes waiting.
+type Scheduler struct {
+	timeout  time.Duration
+	routes   map[string]string
+	users    map[string]string
+	reserved int
+
+	lock sync.Mutex
+	free int
+	// waiting holds the channels of the requests waiting, per class
+	waiting [len(priorityClasses)]list.List
+}
+
+// RequestScheduler returns cfg.Scheduler when set, else a scheduler of its
+// own concurrency limit
+func (cfg HandlerConfig) RequestScheduler() *Scheduler {
+	if cfg.Scheduler != nil {
+		return cfg.Scheduler
+	}
+	return NewScheduler(cfg)
+}
+
+// NewScheduler returns the scheduler of cfg's concurrency limit and
+// priorities, nil, admitting every request, without a limit
+func NewScheduler(cfg HandlerConfig) *Scheduler {
+	if cfg.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	return &Scheduler{
+		timeout:  cfg.RequestQueueTimeout,
+		routes:   cfg.RoutePriorities,
+		users:    cfg.UserPriorities,
+		reserved: reservedSlots(cfg.MaxConcurrentRequests),
+		free:     cfg.MaxConcurrentRequests,
+	}
+}
+
+// reservedSlots is how many of limit slots are kept for high requests, a
+// tenth of them, at least one unless there is a single slot
+func reservedSlots(limit int) int {
+	if limit < 2 {
+		return 0
+	}
+	return max(limit/10, 1)
+}
+
+// class is the priority of a request to route: that of the user the auth
+// middleware verified it as, else the route's
+func (s *Scheduler) class(route Route, r *http.Request) string {
+	if class, ok := s.users[metrics.AuthUser(r)]; ok {
+		return class
+	}
+	if class, ok := s.routes[route.HandlerID]; ok {
+		return class
+	}
+	return defaultPriority(route.Kind)
+}
+
+// acquire takes a slot for a request of class, waiting up to the queue
+// timeout, or until the request is canceled, for one to free up
+func (s *Scheduler) acquire(r *http.Request, class string) bool {
+	rank := priorityRank(class)
+	s.lock.Lock()
+	if s.available(rank) {
+		s.free--
+		s.lock.Unlock()
+		return true
+	}
+	granted := make(chan struct{})
+	queue := &s.waiting[rank]
+	waiter := queue.PushBack(granted)
+	s.lock.Unlock()
+
+	metrics.QueuedRequests.WithLabelValues(class).Inc()
+	defer metrics.QueuedRequests.WithLabelValues(class).Dec()
+	start := time.Now()
+	defer func() { metrics.RequestQueueSeconds.WithLabelValues(class).Observe(time.Since(start).Seconds()) }()
+
+	var timeout <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-granted:
+		return true
+	case <-timeout:
+	case <-r.Context().Done():
+	}
+
+	s.lock.Lock()
+	select {
+	case <-granted:
+		// granted while giving up, hand the slot on
+		s.lock.Unlock()
+		s.release()
+	default:
+		queue.Remove(waiter)
+		s.lock.Unlock()
+	}
+	return false
+}
+
+// available reports whether a request of rank may take a free slot, the
+// lock being held
+func (s *Scheduler) available(rank int) bool {
+	return s.free > s.reserved || (rank == 0 && s.free > 0)
+}
+
+// release hands the slot to the first waiter of the highest class it may
+// serve
+func (s *Scheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.free++
+	for i := range s.waiting {
+		if front := s.waiting[i].Front(); front != nil && s.available(i) {
+			close(s.waiting[i].Remove(front).(chan struct{}))
+			s.free--
+			return
+		}
+	}
+}
+
+// Admit serves route's requests once the scheduler gives them a slot, 503
+// for those still waiting at the queue timeout
+func (s *Scheduler) Admit(route Route, next http.HandlerFunc) http.HandlerFunc {
+	if s == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		class := s.class(route, r)
+		if !s.acquire(r, class) {
+			metrics.ShedRequests.WithLabelValues(class).Inc()
+			w.Header().Set("Retry-After", "1")
+			route.Reject(w, r, http.StatusServiceUnavailable, fmt.Errorf("%w, %s requests were not served within %s", metrics.ErrOverloaded, class, s.timeout))
+			return
+		}
+		defer s.release()
+		next(w, r)
+	}
+}
@@ -0,0 +1,275 @@
+package aggregation
+
+import (
+	"net/http"
+
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+// RouteKind is how a route is protected and which middlewares it goes
+// through
+type RouteKind int
+
+const (
+	// RenderRoute is readable by anyone allowed by CORS
+	RenderRoute RouteKind = iota
+	// PushRoute additionally requires auth and goes through the ingest middlewares
+	PushRoute
+	// AdminRoute requires auth, without the ingest middlewares, and isn't
+	// served at all without auth users
+	AdminRoute
+)
+
+// Route describes an API endpoint independently of the router serving it,
+// so the gin and net/http routers always expose the same API
+type Route struct {
+	Methods   []string
+	Path      string
+	LabelPath bool // also serve path + "/*labels", exposing the rest as the "labels" path value
+	HandlerID string
+	Kind      RouteKind
+	Handler   http.HandlerFunc
+
+	// pushError answers the pushes refused before Handler, nil for routes
+	// other than pushes
+	pushError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// Reject answers a request of the route refused before its handler, pushes
+// in the push error format of the aggregate, so clients parsing JSON errors
+// get them whichever middleware refused the push
+func (route Route) Reject(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if route.pushError != nil {
+		route.pushError(w, r, status, err)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Routes are the API endpoints of agg, for routers other than NewHandler's
+// to serve
+func Routes(agg *metrics.Aggregate) []Route {
+	routes := []Route{
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/metrics",
+			LabelPath: true,
+			HandlerID: "getMetrics",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeRender,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/shadow/metrics",
+			HandlerID: "getShadowMetrics",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeShadowRender,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/metrics.json",
+			HandlerID: "getMetricsJSON",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeRenderJSON,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/metrics.csv",
+			HandlerID: "getMetricsCSV",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeRenderCSV,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/metrics.graphite",
+			HandlerID: "getMetricsGraphite",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeRenderGraphite,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/history",
+			HandlerID: "getHistory",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeHistory,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodPost},
+			Path:      "/api/v1/query",
+			HandlerID: "getQuery",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeQuery,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/metadata",
+			HandlerID: "getMetadata",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeMetadata,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/sd",
+			HandlerID: "getSD",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeSD,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/checksum",
+			HandlerID: "getChecksum",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeChecksum,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/selftest",
+			HandlerID: "getSelftest",
+			Kind:      RenderRoute,
+			Handler:   agg.ServeSelftest,
+		},
+		{
+			Methods:   []string{http.MethodPost, http.MethodPut},
+			Path:      "/metrics",
+			LabelPath: true,
+			HandlerID: "postMetrics",
+			Kind:      PushRoute,
+			Handler:   agg.ServeInsert,
+		},
+		{
+			Methods:   []string{http.MethodPost},
+			Path:      "/api/v1/complete",
+			LabelPath: true,
+			HandlerID: "postComplete",
+			Kind:      PushRoute,
+			Handler:   agg.ServeComplete,
+		},
+		{
+			Methods:   []string{http.MethodPost},
+			Path:      "/api/v1/debug/parse",
+			LabelPath: true,
+			HandlerID: "postDebugParse",
+			Kind:      PushRoute,
+			Handler:   agg.ServeDebugParse,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/receipt",
+			HandlerID: "getReceipt",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeReceipt,
+		},
+		{
+			Methods:   []string{http.MethodPost},
+			Path:      "/api/v1/admin/snapshot",
+			HandlerID: "postSnapshot",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeSnapshot,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodPost},
+			Path:      "/api/v1/admin/maintenance",
+			HandlerID: "maintenance",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeMaintenance,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodPost},
+			Path:      "/api/v1/admin/options",
+			HandlerID: "options",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeOptions,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/pushes",
+			HandlerID: "getPushLog",
+			Kind:      AdminRoute,
+			Handler:   agg.ServePushLog,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/usage",
+			HandlerID: "getUsage",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeUsage,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodDelete},
+			Path:      "/api/v1/admin/quarantine",
+			HandlerID: "quarantine",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeQuarantine,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/inventory",
+			HandlerID: "getInventory",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeInventory,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/duplicates",
+			HandlerID: "getDuplicates",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeDuplicates,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/export",
+			HandlerID: "getExport",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeExport,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/raw",
+			HandlerID: "getRawRender",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeRawRender,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			Path:      "/api/v1/admin/freeze",
+			HandlerID: "freeze",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeFreeze,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+			Path:      "/api/v1/admin/watch",
+			HandlerID: "watch",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeWatch,
+		},
+		{
+			Methods:   []string{http.MethodDelete},
+			Path:      "/api/v1/admin/series",
+			LabelPath: true,
+			HandlerID: "deleteSeries",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeSeries,
+		},
+		{
+			Methods:   []string{http.MethodGet, http.MethodDelete},
+			Path:      "/api/v1/admin/tombstones",
+			HandlerID: "tombstones",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeTombstones,
+		},
+		{
+			Methods:   []string{http.MethodGet},
+			Path:      "/api/v1/admin/diff",
+			HandlerID: "getDiff",
+			Kind:      AdminRoute,
+			Handler:   agg.ServeDiff,
+		},
+	}
+	for i := range routes {
+		if routes[i].Kind == PushRoute {
+			routes[i].pushError = agg.PushError
+		}
+	}
+	return routes
+}
@@ -0,0 +1,85 @@
+// Package query evaluates a limited PromQL subset against the aggregate, so
+// dashboards and scripts can read it without a full Prometheus
+package query
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+type response struct {
+	Status    string `json:"status"`
+	Data      any    `json:"data,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type vectorData struct {
+	ResultType string       `json:"resultType"`
+	Result     model.Vector `json:"result"`
+}
+
+// Handler serves the Prometheus instant query API, GET or POST with a query
+// parameter. The aggregate only holds current values, so the query is always
+// evaluated now and the time parameter is ignored.
+func Handler(gatherer prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		input := r.FormValue("query")
+		if input == "" {
+			writeError(w, http.StatusBadRequest, "bad_data", "query parameter is missing")
+			return
+		}
+		expr, err := Parse(input)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+
+		vector, err := Eval(gatherer, expr, time.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		writeResponse(w, http.StatusOK, response{
+			Status: "success",
+			Data:   vectorData{ResultType: model.ValVector.String(), Result: vector},
+		})
+	}
+}
+
+// Eval evaluates expr against the gathered families, stamping the result with now
+func Eval(gatherer prometheus.Gatherer, expr Expr, now time.Time) (model.Vector, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	vector, err := expfmt.ExtractSamples(&expfmt.DecodeOptions{}, families...)
+	if err != nil {
+		// the families of unsupported types are left out of the result
+		log.Printf("Could not extract all samples to query: %s\n", err.Error())
+	}
+	ts := model.TimeFromUnixNano(now.UnixNano())
+	for _, sample := range vector {
+		// an instant vector is stamped with the evaluation time
+		sample.Timestamp = ts
+	}
+	return expr.eval(vector), nil
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	writeResponse(w, status, response{Status: "error", ErrorType: errorType, Error: message})
+}
+
+func writeResponse(w http.ResponseWriter, status int, body response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("An error has occurred while writing the response:\n\n%s\n", err.Error())
+	}
+}
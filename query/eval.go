@@ -0,0 +1,96 @@
+package query
+
+import (
+	"math"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+func (s *selector) eval(vector model.Vector) model.Vector {
+	out := model.Vector{}
+	for _, sample := range vector {
+		if s.matches(sample.Metric) {
+			out = append(out, sample)
+		}
+	}
+	return out
+}
+
+func (s *selector) matches(metric model.Metric) bool {
+	for _, m := range s.matchers {
+		// a missing label matches as the empty value
+		if !m.matches(string(metric[m.name])) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *aggregation) eval(vector model.Vector) model.Vector {
+	groups := map[model.Fingerprint]*model.Sample{}
+	counts := map[model.Fingerprint]int{}
+	for _, sample := range a.expr.eval(vector) {
+		metric := a.groupLabels(sample.Metric)
+		fp := metric.Fingerprint()
+		group, ok := groups[fp]
+		if !ok {
+			group = &model.Sample{Metric: metric, Value: sample.Value, Timestamp: sample.Timestamp}
+			groups[fp] = group
+		}
+		counts[fp]++
+
+		switch a.op {
+		case "sum":
+			if ok {
+				group.Value += sample.Value
+			}
+		case "min":
+			if sample.Value < group.Value || math.IsNaN(float64(group.Value)) {
+				group.Value = sample.Value
+			}
+		case "max":
+			if sample.Value > group.Value || math.IsNaN(float64(group.Value)) {
+				group.Value = sample.Value
+			}
+		}
+	}
+
+	out := make(model.Vector, 0, len(groups))
+	for fp, group := range groups {
+		if a.op == "count" {
+			group.Value = model.SampleValue(counts[fp])
+		}
+		out = append(out, group)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Metric.String() < out[j].Metric.String()
+	})
+	return out
+}
+
+// groupLabels are the labels of the output series a sample is aggregated
+// into, an aggregation always drops the metric name
+func (a *aggregation) groupLabels(metric model.Metric) model.Metric {
+	group := model.Metric{}
+	if a.by {
+		for _, name := range a.labels {
+			if value, ok := metric[name]; ok && name != model.MetricNameLabel {
+				group[name] = value
+			}
+		}
+		return group
+	}
+	if !a.grouped {
+		return group
+	}
+
+	for name, value := range metric {
+		group[name] = value
+	}
+	delete(group, model.MetricNameLabel)
+	for _, name := range a.labels {
+		delete(group, name)
+	}
+	return group
+}
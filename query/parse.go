@@ -0,0 +1,348 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/common/model"
+)
+
+// Expr is a parsed query: a vector selector, or an aggregation over an Expr
+type Expr interface {
+	eval(vector model.Vector) model.Vector
+}
+
+type matchType int
+
+const (
+	matchEqual matchType = iota
+	matchNotEqual
+	matchRegexp
+	matchNotRegexp
+)
+
+type matcher struct {
+	name  model.LabelName
+	ty    matchType
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *matcher) matches(value string) bool {
+	switch m.ty {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+type selector struct {
+	matchers []*matcher
+}
+
+type aggregation struct {
+	op      string
+	by      bool
+	labels  []model.LabelName
+	grouped bool
+	expr    Expr
+}
+
+var aggregations = map[string]struct{}{"sum": {}, "min": {}, "max": {}, "count": {}}
+
+// Parse parses the supported PromQL subset: vector selectors, wrapped in any
+// number of sum, min, max or count aggregations, each with an optional by or
+// without clause
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	tok := p.next()
+	if tok.kind != kind || (text != "" && tok.text != text) {
+		want := text
+		if want == "" {
+			want = kind.String()
+		}
+		return fmt.Errorf("expected %s at position %d, got %s", want, tok.pos, tok)
+	}
+	return nil
+}
+
+func (p *parser) expr() (Expr, error) {
+	if tok := p.peek(); tok.kind == tokenIdent {
+		// an aggregation operator is only one when followed by its clause or
+		// argument, otherwise it is a metric name
+		after := p.tokens[p.pos+1]
+		if _, ok := aggregations[tok.text]; ok && (after.isGrouping() || after.is(tokenPunct, "(")) {
+			return p.aggregation()
+		}
+	}
+	return p.selector()
+}
+
+func (p *parser) aggregation() (Expr, error) {
+	agg := &aggregation{op: p.next().text}
+	if p.peek().isGrouping() {
+		if err := p.grouping(agg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect(tokenPunct, "("); err != nil {
+		return nil, err
+	}
+	inner, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	agg.expr = inner
+	if err := p.expect(tokenPunct, ")"); err != nil {
+		return nil, err
+	}
+
+	if p.peek().isGrouping() {
+		if agg.grouped {
+			return nil, fmt.Errorf("aggregation %s has more than one by or without clause", agg.op)
+		}
+		if err := p.grouping(agg); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) grouping(agg *aggregation) error {
+	agg.grouped = true
+	agg.by = p.next().text == "by"
+	if err := p.expect(tokenPunct, "("); err != nil {
+		return err
+	}
+	for !p.peek().is(tokenPunct, ")") {
+		tok := p.next()
+		if tok.kind != tokenIdent {
+			return fmt.Errorf("expected label name at position %d, got %s", tok.pos, tok)
+		}
+		agg.labels = append(agg.labels, model.LabelName(tok.text))
+		if !p.peek().is(tokenPunct, ",") {
+			break
+		}
+		p.next()
+	}
+	return p.expect(tokenPunct, ")")
+}
+
+func (p *parser) selector() (Expr, error) {
+	sel := &selector{}
+	if tok := p.peek(); tok.kind == tokenIdent {
+		p.next()
+		sel.matchers = append(sel.matchers, &matcher{name: model.MetricNameLabel, ty: matchEqual, value: tok.text})
+	}
+
+	if p.peek().is(tokenPunct, "{") {
+		p.next()
+		for !p.peek().is(tokenPunct, "}") {
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.matchers = append(sel.matchers, m)
+			if !p.peek().is(tokenPunct, ",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(tokenPunct, "}"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sel.matchers) == 0 {
+		tok := p.peek()
+		return nil, fmt.Errorf("expected a selector at position %d, got %s", tok.pos, tok)
+	}
+	for _, m := range sel.matchers {
+		// as in Prometheus, a selector must not match every series
+		if !m.matches("") {
+			return sel, nil
+		}
+	}
+	return nil, fmt.Errorf("vector selector must contain at least one non-empty matcher")
+}
+
+func (p *parser) matcher() (*matcher, error) {
+	name := p.next()
+	if name.kind != tokenIdent {
+		return nil, fmt.Errorf("expected label name at position %d, got %s", name.pos, name)
+	}
+	op := p.next()
+	m := &matcher{name: model.LabelName(name.text)}
+	switch {
+	case op.is(tokenPunct, "="):
+		m.ty = matchEqual
+	case op.is(tokenPunct, "!="):
+		m.ty = matchNotEqual
+	case op.is(tokenPunct, "=~"):
+		m.ty = matchRegexp
+	case op.is(tokenPunct, "!~"):
+		m.ty = matchNotRegexp
+	default:
+		return nil, fmt.Errorf("expected label matching operator at position %d, got %s", op.pos, op)
+	}
+
+	value := p.next()
+	if value.kind != tokenString {
+		return nil, fmt.Errorf("expected label value at position %d, got %s", value.pos, value)
+	}
+	m.value = value.text
+	if m.ty == matchRegexp || m.ty == matchNotRegexp {
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", m.value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenPunct
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenIdent:
+		return "identifier"
+	case tokenString:
+		return "string"
+	case tokenPunct:
+		return "punctuation"
+	default:
+		return "end of input"
+	}
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return t.kind.String()
+	}
+	return strconv.Quote(t.text)
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+func (t token) isGrouping() bool {
+	return t.kind == tokenIdent && (t.text == "by" || t.text == "without")
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '_' || c == ':' || isLetter(c):
+			start := i
+			for i < len(input) && (input[i] == '_' || input[i] == ':' || isLetter(input[i]) || isDigit(input[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, input[start:i], start})
+		case c == '"' || c == '\'' || c == '`':
+			start := i
+			i++
+			for i < len(input) && input[i] != c {
+				if input[i] == '\\' && c != '`' {
+					i++
+				}
+				i++
+			}
+			if i >= len(input) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			value, err := unquote(input[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %w", start, err)
+			}
+			tokens = append(tokens, token{tokenString, value, start})
+		case strings.HasPrefix(input[i:], "!=") || strings.HasPrefix(input[i:], "=~") || strings.HasPrefix(input[i:], "!~"):
+			tokens = append(tokens, token{tokenPunct, input[i : i+2], i})
+			i += 2
+		case strings.IndexByte("{}(),=", c) >= 0:
+			tokens = append(tokens, token{tokenPunct, input[i : i+1], i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+// unquote handles the quoting styles PromQL accepts
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		// turn it into a double quoted string for strconv
+		inner := strings.ReplaceAll(s[1:len(s)-1], `\'`, `'`)
+		s = `"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
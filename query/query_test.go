@@ -0,0 +1,136 @@
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exposition = `# TYPE requests_total counter
+requests_total{job="api",instance="a",code="200"} 10
+requests_total{job="api",instance="b",code="200"} 5
+requests_total{job="api",instance="b",code="500"} 2
+requests_total{job="worker",instance="c",code="200"} 7
+# TYPE latency_seconds histogram
+latency_seconds_bucket{job="api",le="1"} 3
+latency_seconds_bucket{job="api",le="+Inf"} 4
+latency_seconds_sum{job="api"} 2.5
+latency_seconds_count{job="api"} 4
+`
+
+func gatherer(t *testing.T) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		parser := expfmt.TextParser{}
+		parsed, err := parser.TextToMetricFamilies(strings.NewReader(exposition))
+		require.NoError(t, err)
+		families := []*dto.MetricFamily{}
+		for _, f := range parsed {
+			families = append(families, f)
+		}
+		return families, nil
+	})
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		query string
+		want  map[string]float64
+	}{
+		{`requests_total{code="500"}`, map[string]float64{`requests_total{code="500", instance="b", job="api"}`: 2}},
+		{`{__name__=~"requests_.*", job!="api"}`, map[string]float64{`requests_total{code="200", instance="c", job="worker"}`: 7}},
+		{`requests_total{instance!~"a|b"}`, map[string]float64{`requests_total{code="200", instance="c", job="worker"}`: 7}},
+		{`sum(requests_total)`, map[string]float64{`{}`: 24}},
+		{`sum by (job) (requests_total)`, map[string]float64{`{job="api"}`: 17, `{job="worker"}`: 7}},
+		{`max(requests_total) by (code)`, map[string]float64{`{code="200"}`: 10, `{code="500"}`: 2}},
+		{`min without (instance) (requests_total{job="api"})`, map[string]float64{`{code="200", job="api"}`: 5, `{code="500", job="api"}`: 2}},
+		{`count(count by (instance) (requests_total))`, map[string]float64{`{}`: 3}},
+		{`latency_seconds_bucket{le="+Inf"}`, map[string]float64{`latency_seconds_bucket{job="api", le="+Inf"}`: 4}},
+		{`sum(latency_seconds_count)`, map[string]float64{`{}`: 4}},
+		{`sum(missing_metric)`, map[string]float64{}},
+	}
+
+	now := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			require.NoError(t, err)
+			vector, err := Eval(gatherer(t), expr, now)
+			require.NoError(t, err)
+
+			got := map[string]float64{}
+			for _, s := range vector {
+				got[s.Metric.String()] = float64(s.Value)
+				assert.Equal(t, model.TimeFromUnixNano(now.UnixNano()), s.Timestamp)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{
+		``,
+		`sum(`,
+		`{job=~".*"}`,
+		`requests_total{job="api"`,
+		`requests_total{job=~"("}`,
+		`sum by (job) (requests_total) by (code)`,
+		`rate(requests_total[5m])`,
+		`requests_total > 5`,
+	} {
+		_, err := Parse(query)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(gatherer(t))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`sum by (job) (requests_total)`), nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var body struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []any             `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "success", body.Status)
+	assert.Equal(t, "vector", body.Data.ResultType)
+	require.Len(t, body.Data.Result, 2)
+	assert.Equal(t, map[string]string{"job": "api"}, body.Data.Result[0].Metric)
+	assert.Equal(t, "17", body.Data.Result[0].Value[1])
+
+	// POST with a form body, as Grafana sends long queries
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader("query=count(requests_total)"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"4"`)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=sum(", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"errorType":"bad_data"`)
+}
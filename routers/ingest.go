@@ -0,0 +1,28 @@
+package routers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zapier/prom-aggregation-gateway/pkg/aggregation"
+)
+
+// decodeGzip transparently decompresses request bodies sent with 'Content-Encoding: gzip'
+func decodeGzip(route aggregation.Route) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := aggregation.GunzipBody(c.Request); err != nil {
+			route.Reject(c.Writer, c.Request, http.StatusBadRequest, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// limitBodySize caps how many (decompressed) bytes a single push may contain
+func limitBodySize(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
@@ -0,0 +1,107 @@
+package routers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Listener is an address the API is served on besides --apiListen, with its
+// own TLS and auth settings, e.g. an IPv6 or DMZ facing interface
+type Listener struct {
+	// Address is the host:port to listen on, "[::]:443" listening on every
+	// interface over both IPv4 and IPv6
+	Address string `yaml:"address"`
+	// TLSCertFile and TLSKeyFile serve the listener over TLS
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	// ClientCAFile, when set, requires clients to present a certificate
+	// signed by one of its CAs
+	ClientCAFile string `yaml:"client_ca_file"`
+	// AuthUsers replace --AuthUsers on this listener when set, "user=password"
+	// items, an empty list requiring no auth
+	AuthUsers *[]string `yaml:"auth_users"`
+
+	tlsConfig *tls.Config
+}
+
+type listenersFile struct {
+	Listeners []Listener `yaml:"listeners"`
+}
+
+// LoadListeners reads the listeners list of a YAML file
+func LoadListeners(path string) ([]Listener, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := listenersFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing listeners %s: %w", path, err)
+	}
+	seen := map[string]struct{}{}
+	for i := range file.Listeners {
+		l := &file.Listeners[i]
+		if err := l.compile(); err != nil {
+			return nil, fmt.Errorf("invalid listener %d in %s: %w", i+1, path, err)
+		}
+		if _, ok := seen[l.Address]; ok {
+			return nil, fmt.Errorf("listener %s is listed twice in %s", l.Address, path)
+		}
+		seen[l.Address] = struct{}{}
+	}
+	return file.Listeners, nil
+}
+
+func (l *Listener) compile() error {
+	if l.Address == "" {
+		return errors.New("address is missing")
+	}
+	if (l.TLSCertFile == "") != (l.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	if l.TLSCertFile == "" {
+		if l.ClientCAFile != "" {
+			return errors.New("client_ca_file requires tls_cert_file and tls_key_file")
+		}
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.TLSCertFile, l.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	l.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if l.ClientCAFile != "" {
+		pem, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", l.ClientCAFile)
+		}
+		l.tlsConfig.ClientCAs = pool
+		l.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// routerConfig is cfg with the listener's auth settings
+func (l *Listener) routerConfig(cfg ApiRouterConfig) ApiRouterConfig {
+	if l.AuthUsers != nil {
+		cfg.Accounts = *l.AuthUsers
+	}
+	return cfg
+}
+
+// server serves handler on the listener, over TLS when it has a certificate
+func (l *Listener) server(handler http.Handler) *http.Server {
+	return &http.Server{Addr: l.Address, Handler: handler, TLSConfig: l.tlsConfig}
+}
@@ -1,6 +1,8 @@
 package routers
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -37,12 +39,23 @@ type HealthResponse struct {
 	CommitSHA string `json:"commitSHA"`
 }
 
-func handleHealthCheck(c *gin.Context) {
-	c.Header("Content-Type", "application/json")
-	c.JSON(http.StatusOK, HealthResponse{
+func healthResponse() HealthResponse {
+	return HealthResponse{
 		Name:      config.Name,
 		Version:   config.Version,
 		CommitSHA: config.CommitSHA,
 		IsAlive:   true,
-	})
+	}
+}
+
+func handleHealthCheck(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	c.JSON(http.StatusOK, healthResponse())
+}
+
+func serveHealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(healthResponse()); err != nil {
+		log.Printf("failed to write health check: %v", err)
+	}
 }
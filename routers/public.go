@@ -1,21 +1,70 @@
 package routers
 
 import (
+	"net"
+	"time"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	promMetrics "github.com/slok/go-http-metrics/metrics/prometheus"
-	"github.com/slok/go-http-metrics/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 	mGin "github.com/slok/go-http-metrics/middleware/gin"
+	"github.com/zapier/prom-aggregation-gateway/handoff"
 	"github.com/zapier/prom-aggregation-gateway/metrics"
+	"github.com/zapier/prom-aggregation-gateway/pkg/aggregation"
 )
 
 type ApiRouterConfig struct {
-	CorsDomain   string
-	Accounts     []string
-	authAccounts gin.Accounts
+	CorsDomain  string
+	Accounts    []string
+	MaxBodySize int64
+	GzipIngest  bool
+	Router      string
+	// Stop shuts the servers down when closed, as an interrupt or term signal does
+	Stop <-chan struct{}
+	// Listeners are served the API besides the API listen address
+	Listeners []Listener
+	// Inherited are the listeners handed off by the previous process, by
+	// address, served instead of listening anew
+	Inherited map[string]net.Listener
+	// Handoff hands the listeners and the aggregate off to the next process
+	// when it asks, stopping the servers
+	Handoff *handoff.Server
+	// ReadSocket is the Unix socket the read API is served on, "" for none
+	ReadSocket string
+	// MaxConcurrentRequests bounds the API requests served at once, those
+	// over it waiting by priority class, 0 serving every request right away
+	MaxConcurrentRequests int
+	// RequestQueueTimeout is how long a request waits before a 503, 0 waiting
+	// for as long as the client does
+	RequestQueueTimeout time.Duration
+	// RoutePriorities and UserPriorities map route handler IDs and auth
+	// users to priority classes, the class of the user a request
+	// authenticated as winning over its route's
+	RoutePriorities map[string]string
+	UserPriorities  map[string]string
+
+	// scheduler is the concurrency limit shared by every listener
+	scheduler *aggregation.Scheduler
+}
+
+// handlerConfig is how cfg's API is served, its request metrics registered
+// in registry
+func (cfg ApiRouterConfig) handlerConfig(registry prometheus.Registerer) aggregation.HandlerConfig {
+	return aggregation.HandlerConfig{
+		CorsDomain:            cfg.CorsDomain,
+		Accounts:              cfg.Accounts,
+		MaxBodySize:           cfg.MaxBodySize,
+		GzipIngest:            cfg.GzipIngest,
+		MaxConcurrentRequests: cfg.MaxConcurrentRequests,
+		RequestQueueTimeout:   cfg.RequestQueueTimeout,
+		RoutePriorities:       cfg.RoutePriorities,
+		UserPriorities:        cfg.UserPriorities,
+		Registry:              registry,
+		Scheduler:             cfg.scheduler,
+	}
 }
 
-func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig promMetrics.Config) *gin.Engine {
+func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, registry prometheus.Registerer) *gin.Engine {
 	corsConfig := cors.Config{}
 	if cfg.CorsDomain != "*" {
 		corsConfig.AllowOrigins = []string{cfg.CorsDomain}
@@ -23,11 +72,11 @@ func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig prom
 		corsConfig.AllowAllOrigins = true
 	}
 	corsHandler := cors.New(corsConfig)
-	cfg.authAccounts = processAuthConfig(cfg.Accounts)
+	handlerCfg := cfg.handlerConfig(registry)
+	accounts := aggregation.ParseCredentials(cfg.Accounts)
 
-	metricsMiddleware := middleware.New(middleware.Config{
-		Recorder: promMetrics.NewRecorder(promConfig),
-	})
+	metricsMiddleware := aggregation.RequestMetrics(registry)
+	scheduler := handlerCfg.RequestScheduler()
 
 	r := gin.New()
 	r.RedirectTrailingSlash = false
@@ -37,25 +86,51 @@ func setupAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, promConfig prom
 
 	neededHandlers := []gin.HandlerFunc{corsHandler}
 	if len(cfg.Accounts) > 0 {
-		neededHandlers = append(neededHandlers, gin.BasicAuth(cfg.authAccounts))
+		neededHandlers = append(neededHandlers, gin.BasicAuth(gin.Accounts(accounts)), verifiedUser)
 	}
 
-	r.GET("/metrics",
-		mGin.Handler("getMetrics", metricsMiddleware),
-		corsHandler,
-		agg.HandleRender,
-	)
+	for _, route := range aggregation.Routes(agg) {
+		if route.Kind == aggregation.AdminRoute && len(accounts) == 0 {
+			continue
+		}
+		handlers := []gin.HandlerFunc{
+			mGin.Handler(route.HandlerID, metricsMiddleware),
+		}
 
-	postHandlers := []gin.HandlerFunc{
-		mGin.Handler("postMetrics", metricsMiddleware),
-	}
-	postHandlers = append(postHandlers, neededHandlers...)
-	postHandlers = append(postHandlers, agg.HandleInsert)
+		switch route.Kind {
+		case aggregation.RenderRoute:
+			handlers = append(handlers, corsHandler)
+		case aggregation.PushRoute:
+			handlers = append(handlers, neededHandlers...)
+			if cfg.GzipIngest {
+				handlers = append(handlers, decodeGzip(route))
+			}
+			if cfg.MaxBodySize > 0 {
+				handlers = append(handlers, limitBodySize(cfg.MaxBodySize))
+			}
+		case aggregation.AdminRoute:
+			handlers = append(handlers, neededHandlers...)
+		}
+
+		handler := scheduler.Admit(route, route.Handler)
+		handlers = append(handlers, func(c *gin.Context) {
+			c.Request.SetPathValue("labels", c.Param("labels"))
+			handler(c.Writer, c.Request)
+		})
 
-	r.POST("/metrics", postHandlers...)
-	r.POST("/metrics/*labels", postHandlers...)
-	r.PUT("/metrics", postHandlers...)
-	r.PUT("/metrics/*labels", postHandlers...)
+		for _, method := range route.Methods {
+			r.Handle(method, route.Path, handlers...)
+			if route.LabelPath {
+				r.Handle(method, route.Path+"/*labels", handlers...)
+			}
+		}
+	}
 
 	return r
 }
+
+// verifiedUser passes the user gin.BasicAuth verified on to the handlers, as
+// metrics.AuthUser
+func verifiedUser(c *gin.Context) {
+	c.Request = c.Request.WithContext(metrics.WithAuthUser(c.Request.Context(), c.GetString(gin.AuthUserKey)))
+}
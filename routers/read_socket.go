@@ -0,0 +1,58 @@
+package routers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+// unixAddrPrefix starts the address of servers listening on a Unix socket,
+// followed by its path
+const unixAddrPrefix = "unix:"
+
+// NewReadHandler serves the read API of agg, for sidecar processes reading
+// the aggregate over the read socket: GET /v1/families lists the families
+// and GET /v1/series streams their series. It has no auth, access to the
+// socket file decides who may read.
+func NewReadHandler(agg *metrics.Aggregate) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/families", agg.ServeReadFamilies)
+	mux.HandleFunc("GET /v1/series", agg.ServeReadSeries)
+	mux.HandleFunc("GET /healthy", serveHealthCheck)
+	return mux
+}
+
+// listenUnix listens on the Unix socket at path, replacing the socket of a
+// previous process, for its owner and group only. Anything else at path is
+// left alone, the socket path pointing at the wrong file failing the start
+// rather than deleting it.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket, refusing to replace it", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// bound with the owner and group permissions only, rather than chmod-ed
+	// once anyone may have connected. The umask is the process's, files
+	// created meanwhile are at most more restricted.
+	umask := syscall.Umask(0o117)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	// a process the listener is handed off to serves the same socket
+	l.SetUnlinkOnClose(false)
+	return l, nil
+}
@@ -2,16 +2,29 @@ package routers
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
-	promMetrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/zapier/prom-aggregation-gateway/metrics"
@@ -19,10 +32,7 @@ import (
 
 func setupTestRouter(cfg ApiRouterConfig) *gin.Engine {
 	agg := metrics.NewAggregate()
-	promConfig := promMetrics.Config{
-		Registry: prometheus.NewRegistry(),
-	}
-	return setupAPIRouter(cfg, agg, promConfig)
+	return setupAPIRouter(cfg, agg, prometheus.NewRegistry())
 }
 
 func TestHealthCheck(t *testing.T) {
@@ -252,3 +262,368 @@ func TestCorsRouter(t *testing.T) {
 		})
 	}
 }
+
+func TestIngestOptions(t *testing.T) {
+	gzipped := new(bytes.Buffer)
+	gz := gzip.NewWriter(gzipped)
+	_, err := gz.Write([]byte("# TYPE some_counter counter\nsome_counter 1\n"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	tests := []struct {
+		name       string
+		cfg        ApiRouterConfig
+		body       []byte
+		encoding   string
+		statusCode int
+	}{
+		{"gzip accepted", ApiRouterConfig{GzipIngest: true}, gzipped.Bytes(), "gzip", 202},
+		{"gzip disabled", ApiRouterConfig{}, gzipped.Bytes(), "gzip", 400},
+		{"body within limit", ApiRouterConfig{MaxBodySize: 1024}, []byte("some_counter 1\n"), "", 202},
+		{"body over limit", ApiRouterConfig{MaxBodySize: 8}, []byte("some_counter 1\n"), "", 413},
+	}
+
+	for idx, test := range tests {
+		t.Run(fmt.Sprintf("test #%d: %s", idx+1, test.name), func(t *testing.T) {
+			test.cfg.CorsDomain = "*"
+			router := setupTestRouter(test.cfg)
+
+			req, err := http.NewRequest("POST", "/metrics", bytes.NewReader(test.body))
+			require.NoError(t, err)
+			if test.encoding != "" {
+				req.Header.Set("Content-Encoding", test.encoding)
+			}
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Code)
+		})
+	}
+
+	// bodies that aren't gzip fail like any other push
+	cfg := ApiRouterConfig{CorsDomain: "*", GzipIngest: true}
+	agg := metrics.NewAggregate(metrics.SetErrorFormat(metrics.ErrorFormatJSON))
+	for _, router := range []http.Handler{
+		setupAPIRouter(cfg, agg, prometheus.NewRegistry()),
+		setupStdAPIRouter(cfg, agg, prometheus.NewRegistry()),
+	} {
+		req, err := http.NewRequest("POST", "/metrics", bytes.NewBufferString("some_counter 1\n"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, "bad_encoding", body["code"])
+	}
+}
+
+func TestRenderETag(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+
+	req, err := http.NewRequest("PUT", "/metrics", bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 1\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestRenderGzip(t *testing.T) {
+	router := setupTestRouter(ApiRouterConfig{CorsDomain: "*"})
+
+	req, err := http.NewRequest("PUT", "/metrics", bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 1\n"))
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, "# TYPE some_counter counter\nsome_counter 1\n", string(body))
+
+	// each encoding has its own ETag, a cached gzip body doesn't revalidate
+	// an identity one
+	etag := w.Header().Get("ETag")
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+}
+
+func TestStdlibRouterParity(t *testing.T) {
+	type request struct {
+		method, path, body string
+		origin             string
+		user, password     string
+	}
+	requests := []request{
+		{method: "PUT", path: "/metrics/label1/value1/label2/value2", body: "# TYPE some_counter counter\nsome_counter 1\n", user: "user", password: "password"},
+		{method: "POST", path: "/metrics/job/someJob", body: "# TYPE some_counter counter\nsome_counter 1\n", user: "user", password: "password"},
+		{method: "POST", path: "/metrics/", body: "# TYPE other_counter counter\nother_counter 2\n", user: "user", password: "password"},
+		{method: "POST", path: "/metrics/odd", body: "some_counter 1\n", user: "user", password: "password"},
+		{method: "POST", path: "/metrics", body: "some_counter 1\n", user: "user", password: "wrong"},
+		{method: "POST", path: "/api/v1/complete/job/someJob", user: "user", password: "password"},
+		{method: "POST", path: "/api/v1/complete", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/receipt?id=unknown", user: "user", password: "password"},
+		{method: "POST", path: "/api/v1/debug/parse/job/someJob", body: "# TYPE some_counter counter\nsome_counter{instance=\"a\"} 1\n", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/pushes", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/usage", user: "user", password: "password"},
+		{method: "POST", path: "/api/v1/admin/options?metric_ttl=1h", user: "user", password: "password"},
+		{method: "DELETE", path: "/api/v1/admin/quarantine", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/inventory", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/duplicates", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/raw?name=some_counter", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/export", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/diff", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/freeze", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/watch", user: "user", password: "password"},
+		{method: "GET", path: "/metrics/env/prod", origin: "https://cors-domain"},
+		{method: "DELETE", path: "/api/v1/admin/series/job/missing?name=some_counter", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/admin/tombstones", user: "user", password: "password"},
+		{method: "GET", path: "/api/v1/shadow/metrics", origin: "https://cors-domain"},
+		{method: "GET", path: "/api/v1/metrics.json", origin: "https://cors-domain"},
+		{method: "GET", path: "/api/v1/metrics.csv?name=missing_counter"},
+		{method: "GET", path: "/api/v1/metrics.graphite?name=missing_counter"},
+		{method: "GET", path: "/api/v1/history?ts=1700000000"},
+		{method: "GET", path: "/api/v1/metadata?limit=1", origin: "https://cors-domain"},
+		{method: "GET", path: "/api/v1/sd", origin: "https://cors-domain"},
+		{method: "GET", path: "/api/v1/checksum?families=true", origin: "https://cors-domain"},
+		{method: "GET", path: "/api/v1/selftest", origin: "https://cors-domain"},
+		{method: "GET", path: "/api/v1/query?query=sum(some_counter", origin: "https://cors-domain"},
+		{method: "POST", path: "/api/v1/admin/snapshot", user: "user", password: "wrong"},
+		{method: "GET", path: "/api/v1/admin/maintenance", user: "user", password: "password"},
+		{method: "GET", path: "/metrics", origin: "https://cors-domain"},
+		{method: "GET", path: "/metrics", origin: "https://invalid-domain"},
+		{method: "GET", path: "/metrics"},
+		{method: "GET", path: "/unknown"},
+	}
+
+	cfg := ApiRouterConfig{CorsDomain: "https://cors-domain", Accounts: []string{"user=password"}}
+	ginRouter := setupAPIRouter(cfg, metrics.NewAggregate(), prometheus.NewRegistry())
+	stdRouter := setupStdAPIRouter(cfg, metrics.NewAggregate(), prometheus.NewRegistry())
+
+	for idx, r := range requests {
+		t.Run(fmt.Sprintf("request #%d: %s %s", idx+1, r.method, r.path), func(t *testing.T) {
+			recorders := []*httptest.ResponseRecorder{}
+			for _, router := range []http.Handler{ginRouter, stdRouter} {
+				req, err := http.NewRequest(r.method, r.path, bytes.NewBufferString(r.body))
+				require.NoError(t, err)
+				if r.origin != "" {
+					req.Header.Set("Origin", r.origin)
+				}
+				if r.user != "" {
+					req.SetBasicAuth(r.user, r.password)
+				}
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				recorders = append(recorders, w)
+			}
+
+			ginResponse, stdResponse := recorders[0], recorders[1]
+			assert.Equal(t, ginResponse.Code, stdResponse.Code)
+			assert.Equal(t, ginResponse.Header().Get("Access-Control-Allow-Origin"), stdResponse.Header().Get("Access-Control-Allow-Origin"))
+			if ginResponse.Code == 200 {
+				assert.Equal(t, ginResponse.Body.String(), stdResponse.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminRoutesRequireAuth(t *testing.T) {
+	cfg := ApiRouterConfig{CorsDomain: "*"}
+	for _, router := range []http.Handler{
+		setupAPIRouter(cfg, metrics.NewAggregate(), prometheus.NewRegistry()),
+		setupStdAPIRouter(cfg, metrics.NewAggregate(), prometheus.NewRegistry()),
+	} {
+		for _, path := range []string{"/api/v1/admin/export", "/api/v1/admin/options", "/api/v1/receipt?id=unknown"} {
+			req, err := http.NewRequest("GET", path, nil)
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusNotFound, w.Code, path)
+		}
+		// pushes and renders are still served without auth
+		req, err := http.NewRequest("POST", "/metrics", bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 1\n"))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+	path := filepath.Join(dir, "listeners.yaml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	write(fmt.Sprintf(`listeners:
+  - address: "127.0.0.1:0"
+    auth_users: []
+  - address: "[::1]:0"
+    tls_cert_file: %s
+    tls_key_file: %s
+`, certFile, keyFile))
+	listeners, err := LoadListeners(path)
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+
+	cfg := ApiRouterConfig{CorsDomain: "*", Accounts: []string{"user=password"}}
+	registry := prometheus.NewRegistry()
+	get := func(l Listener, network, address string) int {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			t.Skipf("cannot listen on %s: %s", address, err)
+		}
+		server := l.server(setupAPIRouter(l.routerConfig(cfg), metrics.NewAggregate(), registry))
+		client := http.DefaultClient
+		url := "http://" + ln.Addr().String()
+		if server.TLSConfig != nil {
+			go func() { _ = server.ServeTLS(ln, "", "") }()
+			client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+			url = "https://" + ln.Addr().String()
+		} else {
+			go func() { _ = server.Serve(ln) }()
+		}
+		defer server.Close()
+
+		resp, err := client.Post(url+"/metrics", "text/plain", bytes.NewBufferString("# TYPE some_counter counter\nsome_counter 1\n"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// the first listener drops the auth, the second keeps it
+	require.Equal(t, http.StatusAccepted, get(listeners[0], "tcp4", "127.0.0.1:0"))
+	require.Equal(t, http.StatusUnauthorized, get(listeners[1], "tcp6", "[::1]:0"))
+
+	for content, message := range map[string]string{
+		"listeners:\n  - tls_cert_file: a\n":                                           "address is missing",
+		"listeners:\n  - address: \":1\"\n    tls_cert_file: a\n":                      "must be set together",
+		"listeners:\n  - address: \":1\"\n    client_ca_file: a\n":                     "client_ca_file requires",
+		"listeners:\n  - address: \":1\"\n  - address: \":1\"\n":                       "listed twice",
+		"listeners:\n  - address: \":1\"\n    tls_cert_file: a\n    tls_key_file: b\n": "no such file",
+	} {
+		write(content)
+		_, err := LoadListeners(path)
+		require.ErrorContains(t, err, message)
+	}
+}
+
+func TestReadSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "read")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// anything besides a socket is left alone
+	path := filepath.Join(dir, "read.sock")
+	require.NoError(t, os.WriteFile(path, []byte("keep"), 0o600))
+	_, err = listenUnix(path)
+	require.ErrorContains(t, err, "not a socket")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "keep", string(content))
+	require.NoError(t, os.Remove(path))
+
+	// a socket left by a previous process is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := listenUnix(path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+
+	agg := metrics.NewAggregate()
+	server := &http.Server{Handler: NewReadHandler(agg)}
+	go func() { _ = server.Serve(ln) }()
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/metrics/job/test", bytes.NewBufferString("# TYPE queue_depth gauge\nqueue_depth 4\n"))
+	req.SetPathValue("labels", "/job/test")
+	agg.ServeInsert(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://read/v1/series")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"family":"queue_depth","type":"gauge","labels":{"job":"test"},"value":"4"}`, string(body))
+
+	// pushes aren't served on the read socket
+	resp, err = client.Post("http://read/metrics/job/test", "text/plain", bytes.NewBufferString("queue_depth 5\n"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// writeTestCertificate writes a self-signed certificate for localhost and
+// its key to dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
@@ -1,39 +1,170 @@
 package routers
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/gin-gonic/gin"
-	promMetrics "github.com/slok/go-http-metrics/metrics/prometheus"
+	"github.com/zapier/prom-aggregation-gateway/handoff"
 	"github.com/zapier/prom-aggregation-gateway/metrics"
+	"github.com/zapier/prom-aggregation-gateway/pkg/aggregation"
 )
 
-func RunServers(cfg ApiRouterConfig, apiListen string, lifecycleListen string) {
+// handoffShutdownTimeout bounds how long the requests being served delay a
+// handoff, within the handoff.Timeout the next process waits
+const handoffShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout bounds how long the requests being served delay closing
+// the aggregate on stop
+const shutdownTimeout = 30 * time.Second
+
+// RunServers serves the API and lifecycle routers until an interrupt or term
+// signal, or cfg.Stop, then finishes the requests being served and closes
+// agg, so no acknowledged push misses its final snapshot. It reports whether it handed the
+// listeners and agg off to the next process instead.
+func RunServers(cfg ApiRouterConfig, agg *metrics.Aggregate, apiListen string, lifecycleListen string) bool {
 	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, syscall.SIGTERM, syscall.SIGINT)
 
-	agg := metrics.NewAggregate()
+	// shared by the API routers of every listener
+	cfg.scheduler = aggregation.NewScheduler(cfg.handlerConfig(metrics.PromRegistry))
+	var lifecycleRouter http.Handler
+	switch cfg.Router {
+	case StdlibRouter:
+		lifecycleRouter = setupStdLifecycleRouter(metrics.PromRegistry)
+	default:
+		lifecycleRouter = setupLifecycleRouter(metrics.PromRegistry)
+	}
+
+	var servers []*runningServer
+	if apiListen != "" {
+		servers = append(servers, startServer(cfg, "api", &http.Server{Addr: apiListen, Handler: newAPIHandler(cfg, agg)}))
+	}
+	for _, l := range cfg.Listeners {
+		servers = append(servers, startServer(cfg, "api", l.server(newAPIHandler(l.routerConfig(cfg), agg))))
+	}
+	servers = append(servers, startServer(cfg, "lifecycle", &http.Server{Addr: lifecycleListen, Handler: lifecycleRouter}))
+	if cfg.ReadSocket != "" {
+		servers = append(servers, startServer(cfg, "read", &http.Server{Addr: unixAddrPrefix + cfg.ReadSocket, Handler: NewReadHandler(agg)}))
+	}
+	for address, l := range cfg.Inherited {
+		if !slices.ContainsFunc(servers, func(s *runningServer) bool { return s.server.Addr == address }) {
+			log.Printf("No server listens at %s anymore, closing its inherited listener\n", address)
+			l.Close()
+		}
+	}
+
+	// Block until an interrupt or term signal is sent, we're told to stop, or
+	// the next process takes over
+	for {
+		select {
+		case <-sigChannel:
+		case <-cfg.Stop:
+		case h := <-cfg.Handoff.Requests():
+			if handOff(h, servers, agg) {
+				return true
+			}
+			continue
+		}
+		shutdownServers(servers, shutdownTimeout)
+		agg.Close()
+		return false
+	}
+}
+
+// runningServer is a server with its listener, which may be handed off
+type runningServer struct {
+	label    string
+	server   *http.Server
+	listener net.Listener
+}
 
-	promMetricsConfig := promMetrics.Config{
-		Registry: metrics.PromRegistry,
+// startServer serves server on the listener inherited for its address, or
+// a new one
+func startServer(cfg ApiRouterConfig, label string, server *http.Server) *runningServer {
+	scheme := "http"
+	if server.TLSConfig != nil {
+		scheme = "https"
+	}
+	l, ok := cfg.Inherited[server.Addr]
+	if !ok {
+		var err error
+		if path, unix := strings.CutPrefix(server.Addr, unixAddrPrefix); unix {
+			l, err = listenUnix(path)
+		} else {
+			l, err = net.Listen("tcp", server.Addr)
+		}
+		if err != nil {
+			log.Panicf("error while serving %s: %v", label, err)
+		}
+	}
+	if strings.HasPrefix(server.Addr, unixAddrPrefix) {
+		log.Printf("%s server listening at %s", label, server.Addr)
+	} else {
+		log.Printf("%s server listening at %s://%s", label, scheme, server.Addr)
 	}
 
-	apiRouter := setupAPIRouter(cfg, agg, promMetricsConfig)
-	go runServer("api", apiRouter, apiListen)
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(l, "", "")
+		} else {
+			err = server.Serve(l)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Panicf("error while serving %s at %s: %v", label, server.Addr, err)
+		}
+	}()
+	return &runningServer{label: label, server: server, listener: l}
+}
 
-	lifecycleRouter := setupLifecycleRouter(metrics.PromRegistry)
-	go runServer("lifecycle", lifecycleRouter, lifecycleListen)
+// handOff passes the listeners to the next process, then finishes the
+// requests being served and hands the aggregate off. It reports false when
+// the listeners couldn't be passed, the servers then going on.
+func handOff(h *handoff.Handoff, servers []*runningServer, agg *metrics.Aggregate) bool {
+	defer h.Close()
+	listeners := make(map[string]net.Listener, len(servers))
+	for _, s := range servers {
+		listeners[s.server.Addr] = s.listener
+	}
+	if err := h.SendListeners(listeners); err != nil {
+		log.Printf("Could not hand the listeners off: %s\n", err.Error())
+		return false
+	}
+	log.Println("Handing off to the next process")
 
-	// Block until an interrupt or term signal is sent
-	<-sigChannel
+	shutdownServers(servers, handoffShutdownTimeout)
+	if err := agg.Handoff(h); err != nil {
+		log.Printf("Could not hand the aggregate off: %s\n", err.Error())
+	}
+	return true
+}
+
+// shutdownServers stops the servers accepting requests and waits, up to
+// timeout, for those being served
+func shutdownServers(servers []*runningServer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.Printf("Could not finish the requests of the %s server at %s: %s\n", s.label, s.server.Addr, err.Error())
+		}
+	}
 }
 
-func runServer(label string, r *gin.Engine, listen string) {
-	log.Printf("%s server listening at %s", label, listen)
-	if err := r.Run(listen); err != nil {
-		log.Panicf("error while serving %s: %v", label, err)
+// newAPIHandler serves the gateway's API for agg with the cfg.Router router,
+// its request metrics registered in metrics.PromRegistry
+func newAPIHandler(cfg ApiRouterConfig, agg *metrics.Aggregate) http.Handler {
+	if cfg.Router == StdlibRouter {
+		return setupStdAPIRouter(cfg, agg, metrics.PromRegistry)
 	}
+	return setupAPIRouter(cfg, agg, metrics.PromRegistry)
 }
@@ -0,0 +1,35 @@
+package routers
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+	"github.com/zapier/prom-aggregation-gateway/pkg/aggregation"
+)
+
+const (
+	GinRouter    = "gin"
+	StdlibRouter = "stdlib"
+)
+
+// setupStdAPIRouter serves the same API as setupAPIRouter using only net/http,
+// skipping gin's per-request overhead
+func setupStdAPIRouter(cfg ApiRouterConfig, agg *metrics.Aggregate, registry prometheus.Registerer) http.Handler {
+	return aggregation.NewHandler(agg, cfg.handlerConfig(registry))
+}
+
+func setupStdLifecycleRouter(promRegistry *prometheus.Registry) http.Handler {
+	metricsHandler := promhttp.InstrumentMetricHandler(
+		promRegistry,
+		promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}),
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthy", serveHealthCheck)
+	mux.HandleFunc("GET /ready", serveHealthCheck)
+	mux.Handle("GET /metrics", metricsHandler)
+
+	return mux
+}
@@ -0,0 +1,106 @@
+package scrape
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultScrapeInterval = model.Duration(time.Minute)
+	defaultScrapeTimeout  = model.Duration(10 * time.Second)
+	defaultMetricsPath    = "/metrics"
+	defaultScheme         = "http"
+)
+
+// Config is the subset of Prometheus' scrape configuration the gateway
+// understands: static targets only, without relabeling
+type Config struct {
+	Global        GlobalConfig    `yaml:"global"`
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs"`
+}
+
+type GlobalConfig struct {
+	ScrapeInterval model.Duration `yaml:"scrape_interval"`
+	ScrapeTimeout  model.Duration `yaml:"scrape_timeout"`
+}
+
+type ScrapeConfig struct {
+	// JobName is set as the job label of everything scraped for this config
+	JobName        string         `yaml:"job_name"`
+	ScrapeInterval model.Duration `yaml:"scrape_interval"`
+	ScrapeTimeout  model.Duration `yaml:"scrape_timeout"`
+	MetricsPath    string         `yaml:"metrics_path"`
+	Scheme         string         `yaml:"scheme"`
+	// HonorLabels keeps the target's own labels when they clash with the job
+	// and static config labels, instead of renaming them to exported_<name>
+	HonorLabels   bool            `yaml:"honor_labels"`
+	StaticConfigs []*StaticConfig `yaml:"static_configs"`
+}
+
+type StaticConfig struct {
+	Targets []string `yaml:"targets"`
+	// Labels are added to everything scraped from these targets
+	Labels map[string]string `yaml:"labels"`
+}
+
+// LoadConfig reads a scrape configuration file, filling in Prometheus'
+// defaults for what it leaves out
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("parsing scrape config %s: %w", path, err)
+	}
+	if err := cfg.setDefaults(); err != nil {
+		return nil, fmt.Errorf("invalid scrape config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) setDefaults() error {
+	if c.Global.ScrapeInterval == 0 {
+		c.Global.ScrapeInterval = defaultScrapeInterval
+	}
+	if c.Global.ScrapeTimeout == 0 {
+		c.Global.ScrapeTimeout = min(defaultScrapeTimeout, c.Global.ScrapeInterval)
+	}
+
+	jobs := map[string]struct{}{}
+	for _, sc := range c.ScrapeConfigs {
+		if sc.JobName == "" {
+			return fmt.Errorf("job_name is missing")
+		}
+		if _, ok := jobs[sc.JobName]; ok {
+			return fmt.Errorf("job_name %q is used more than once", sc.JobName)
+		}
+		jobs[sc.JobName] = struct{}{}
+
+		if sc.ScrapeInterval == 0 {
+			sc.ScrapeInterval = c.Global.ScrapeInterval
+		}
+		if sc.ScrapeTimeout == 0 {
+			sc.ScrapeTimeout = min(c.Global.ScrapeTimeout, sc.ScrapeInterval)
+		}
+		if sc.ScrapeTimeout > sc.ScrapeInterval {
+			return fmt.Errorf("scrape_timeout of job %q is longer than its scrape_interval", sc.JobName)
+		}
+		if sc.MetricsPath == "" {
+			sc.MetricsPath = defaultMetricsPath
+		}
+		if sc.Scheme == "" {
+			sc.Scheme = defaultScheme
+		}
+		if sc.Scheme != "http" && sc.Scheme != "https" {
+			return fmt.Errorf("scheme of job %q must be http or https, got %q", sc.JobName, sc.Scheme)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package scrape
+
+import (
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Targets expose cumulative values, while the aggregate adds up whatever it
+// is given. Each scrape is therefore folded in as the difference with the
+// previous scrape of the same target, which keeps the aggregate at the sum of
+// the targets' current values. A counter that went down was reset, and its
+// new value is the delta. A family the aggregate dropped since, e.g.
+// expired, lost what the target sent before, so it is folded in from no
+// previous scrape again.
+
+// seriesKey identifies a series within a family by its labels
+func seriesKey(m *dto.Metric) string {
+	var b strings.Builder
+	for _, l := range m.Label {
+		b.WriteString(l.GetName())
+		b.WriteByte(0)
+		b.WriteString(l.GetValue())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// delta returns the families to merge for a scrape of current, given the
+// previous scrape of the same target (nil on the first one). Gauges of series
+// gone since the previous scrape are withdrawn.
+func delta(previous, current map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	out := make(map[string]*dto.MetricFamily, len(current))
+	for name, family := range current {
+		prev := previous[name]
+		if prev != nil && prev.GetType() != family.GetType() {
+			prev = nil
+		}
+
+		prevSeries := map[string]*dto.Metric{}
+		if prev != nil {
+			for _, m := range prev.Metric {
+				prevSeries[seriesKey(m)] = m
+			}
+		}
+
+		d := &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Unit: family.Unit}
+		for _, m := range family.Metric {
+			key := seriesKey(m)
+			d.Metric = append(d.Metric, deltaMetric(family.GetType(), prevSeries[key], m))
+			delete(prevSeries, key)
+		}
+		for _, m := range prev.GetMetric() {
+			if _, gone := prevSeries[seriesKey(m)]; gone && isGauge(family.GetType()) {
+				d.Metric = append(d.Metric, withdrawGauge(family.GetType(), m))
+			}
+		}
+		out[name] = d
+	}
+
+	// whole gauge families gone from the target are withdrawn as well
+	for name, prev := range previous {
+		if _, ok := current[name]; ok || !isGauge(prev.GetType()) {
+			continue
+		}
+		d := &dto.MetricFamily{Name: prev.Name, Help: prev.Help, Type: prev.Type, Unit: prev.Unit}
+		for _, m := range prev.Metric {
+			d.Metric = append(d.Metric, withdrawGauge(prev.GetType(), m))
+		}
+		out[name] = d
+	}
+	return out
+}
+
+func isGauge(ty dto.MetricType) bool {
+	return ty == dto.MetricType_GAUGE || ty == dto.MetricType_UNTYPED
+}
+
+func withdrawGauge(ty dto.MetricType, m *dto.Metric) *dto.Metric {
+	d := &dto.Metric{Label: cloneLabels(m.Label)}
+	if ty == dto.MetricType_GAUGE {
+		d.Gauge = &dto.Gauge{Value: proto.Float64(-m.GetGauge().GetValue())}
+	} else {
+		d.Untyped = &dto.Untyped{Value: proto.Float64(-m.GetUntyped().GetValue())}
+	}
+	return d
+}
+
+// deltaMetric returns a new metric holding the change from prev to cur
+func deltaMetric(ty dto.MetricType, prev, cur *dto.Metric) *dto.Metric {
+	d := &dto.Metric{Label: cloneLabels(cur.Label)}
+	switch ty {
+	case dto.MetricType_COUNTER:
+		d.Counter = &dto.Counter{Value: proto.Float64(counterDelta(prev.GetCounter().GetValue(), cur.GetCounter().GetValue(), prev == nil))}
+	case dto.MetricType_GAUGE:
+		d.Gauge = &dto.Gauge{Value: proto.Float64(cur.GetGauge().GetValue() - prev.GetGauge().GetValue())}
+	case dto.MetricType_UNTYPED:
+		d.Untyped = &dto.Untyped{Value: proto.Float64(cur.GetUntyped().GetValue() - prev.GetUntyped().GetValue())}
+	case dto.MetricType_SUMMARY:
+		p, c := prev.GetSummary(), cur.GetSummary()
+		if prev == nil || c.GetSampleCount() < p.GetSampleCount() {
+			p = &dto.Summary{}
+		}
+		d.Summary = &dto.Summary{
+			SampleCount: proto.Uint64(c.GetSampleCount() - p.GetSampleCount()),
+			SampleSum:   proto.Float64(c.GetSampleSum() - p.GetSampleSum()),
+		}
+	case dto.MetricType_HISTOGRAM:
+		d.Histogram = histogramDelta(prev.GetHistogram(), cur.GetHistogram())
+	default:
+		return proto.Clone(cur).(*dto.Metric)
+	}
+	return d
+}
+
+func counterDelta(prev, cur float64, first bool) float64 {
+	if first || cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func histogramDelta(p, c *dto.Histogram) *dto.Histogram {
+	prevBuckets := map[float64]uint64{}
+	for _, b := range p.GetBucket() {
+		prevBuckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	// a lower count, or a changed layout, means the histogram was reset
+	reset := p == nil || c.GetSampleCount() < p.GetSampleCount() || len(p.GetBucket()) != len(c.GetBucket())
+	for _, b := range c.GetBucket() {
+		if prevCount, ok := prevBuckets[b.GetUpperBound()]; !ok || b.GetCumulativeCount() < prevCount {
+			reset = true
+		}
+	}
+	if reset {
+		p = &dto.Histogram{}
+		clear(prevBuckets)
+	}
+
+	d := &dto.Histogram{
+		SampleCount: proto.Uint64(c.GetSampleCount() - p.GetSampleCount()),
+		SampleSum:   proto.Float64(c.GetSampleSum() - p.GetSampleSum()),
+	}
+	for _, b := range c.GetBucket() {
+		d.Bucket = append(d.Bucket, &dto.Bucket{
+			UpperBound:      b.UpperBound,
+			CumulativeCount: proto.Uint64(b.GetCumulativeCount() - prevBuckets[b.GetUpperBound()]),
+		})
+	}
+	return d
+}
+
+func cloneLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	out := make([]*dto.LabelPair, len(labels))
+	for i, l := range labels {
+		out[i] = &dto.LabelPair{Name: proto.String(l.GetName()), Value: proto.String(l.GetValue())}
+	}
+	return out
+}
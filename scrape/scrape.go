@@ -0,0 +1,189 @@
+// Package scrape pulls metrics from a static list of targets and folds them
+// into the aggregate alongside pushed ones, for fleets mixing pushers and
+// targets that can only be scraped
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+)
+
+var Scrapes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: metrics.MetricsNamespace,
+		Name:      "scrapes",
+		Help:      "Total number of target scrapes, per job and result",
+	},
+	[]string{
+		"job",
+		"result",
+	},
+)
+
+func init() {
+	metrics.PromRegistry.MustRegister(Scrapes)
+}
+
+// Merger is what scraped metrics are folded into, usually a *metrics.Aggregate
+type Merger interface {
+	MergeFamilies(families map[string]*dto.MetricFamily, labels map[string]string, honorLabels bool) error
+	// FamilyIncarnations identifies the families of names it holds, a
+	// family dropped and created again getting another identifier
+	FamilyIncarnations(names []string) map[string]uint64
+}
+
+type Scraper struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type target struct {
+	cfg    *ScrapeConfig
+	url    string
+	labels map[string]string
+	client *http.Client
+
+	// previous is the last successful scrape, deltas are taken against it
+	previous map[string]*dto.MetricFamily
+	// incarnations are those of the families merged into by that scrape
+	incarnations map[string]uint64
+}
+
+// Start scrapes every target of cfg on its job's interval until Stop
+func Start(cfg *Config, merger Merger) *Scraper {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scraper{cancel: cancel}
+
+	for _, sc := range cfg.ScrapeConfigs {
+		client := &http.Client{Timeout: time.Duration(sc.ScrapeTimeout)}
+		for _, static := range sc.StaticConfigs {
+			for _, address := range static.Targets {
+				// as in Prometheus, a static config's labels may override the job
+				labels := map[string]string{model.JobLabel: sc.JobName}
+				for name, value := range static.Labels {
+					labels[name] = value
+				}
+				t := &target{
+					cfg:    sc,
+					url:    sc.Scheme + "://" + address + sc.MetricsPath,
+					labels: labels,
+					client: client,
+				}
+
+				s.wg.Add(1)
+				go func() {
+					defer s.wg.Done()
+					t.run(ctx, merger)
+				}()
+			}
+		}
+	}
+
+	return s
+}
+
+// Stop ends the scrape loops and waits for in-flight scrapes to be merged
+func (s *Scraper) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (t *target) run(ctx context.Context, merger Merger) {
+	ticker := time.NewTicker(time.Duration(t.cfg.ScrapeInterval))
+	defer ticker.Stop()
+	for {
+		if err := t.scrape(ctx, merger); err != nil && ctx.Err() == nil {
+			log.Printf("Could not scrape %s: %s\n", t.url, err.Error())
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *target) scrape(ctx context.Context, merger Merger) error {
+	current, err := t.fetch(ctx)
+	if err != nil {
+		Scrapes.WithLabelValues(t.cfg.JobName, "error").Inc()
+		return err
+	}
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	if err := merger.MergeFamilies(delta(t.intact(merger), current), t.labels, t.cfg.HonorLabels); err != nil {
+		Scrapes.WithLabelValues(t.cfg.JobName, "rejected").Inc()
+		return err
+	}
+	t.previous, t.incarnations = current, merger.FamilyIncarnations(names)
+	Scrapes.WithLabelValues(t.cfg.JobName, "ok").Inc()
+	return nil
+}
+
+// intact returns the previous scrape without the families the merger
+// dropped since, e.g. expired or evicted, or never held, e.g. rejected:
+// what the target sent of those is gone from the aggregate, so they are
+// merged in full again rather than as deltas
+func (t *target) intact(merger Merger) map[string]*dto.MetricFamily {
+	names := make([]string, 0, len(t.previous))
+	for name := range t.previous {
+		names = append(names, name)
+	}
+	incarnations := merger.FamilyIncarnations(names)
+	previous := make(map[string]*dto.MetricFamily, len(t.previous))
+	for name, family := range t.previous {
+		if id, ok := incarnations[name]; ok && id == t.incarnations[name] {
+			previous[name] = family
+		}
+	}
+	return previous
+}
+
+func (t *target) fetch(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(time.Duration(t.cfg.ScrapeTimeout).Seconds(), 'f', -1, 64))
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	families := map[string]*dto.MetricFamily{}
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		family := &dto.MetricFamily{}
+		if err := dec.Decode(family); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if _, ok := families[family.GetName()]; ok {
+			return nil, fmt.Errorf("metric family %s is exposed more than once", family.GetName())
+		}
+		families[family.GetName()] = family
+	}
+	return families, nil
+}
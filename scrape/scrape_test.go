@@ -0,0 +1,157 @@
+package scrape
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zapier/prom-aggregation-gateway/metrics"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scrape.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+global:
+  scrape_interval: 30s
+scrape_configs:
+  - job_name: node
+    static_configs:
+      - targets: ["a:9100", "b:9100"]
+        labels:
+          env: prod
+  - job_name: app
+    scrape_interval: 5s
+    metrics_path: /stats
+    scheme: https
+`), 0o644))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Len(t, cfg.ScrapeConfigs, 2)
+
+	node, app := cfg.ScrapeConfigs[0], cfg.ScrapeConfigs[1]
+	assert.Equal(t, model.Duration(30*time.Second), node.ScrapeInterval)
+	assert.Equal(t, model.Duration(10*time.Second), node.ScrapeTimeout)
+	assert.Equal(t, "/metrics", node.MetricsPath)
+	assert.Equal(t, "http", node.Scheme)
+	assert.Equal(t, []string{"a:9100", "b:9100"}, node.StaticConfigs[0].Targets)
+	assert.Equal(t, map[string]string{"env": "prod"}, node.StaticConfigs[0].Labels)
+
+	assert.Equal(t, model.Duration(5*time.Second), app.ScrapeInterval)
+	assert.Equal(t, model.Duration(5*time.Second), app.ScrapeTimeout)
+	assert.Equal(t, "/stats", app.MetricsPath)
+
+	require.NoError(t, os.WriteFile(path, []byte("scrape_configs:\n  - job_name: a\n  - job_name: a\n"), 0o644))
+	_, err = LoadConfig(path)
+	require.Error(t, err)
+}
+
+func TestScrapeFoldsDeltas(t *testing.T) {
+	var exposition atomic.Value
+	exposition.Store("# TYPE requests counter\nrequests 5\n# TYPE in_flight gauge\nin_flight 3\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(exposition.Load().(string)))
+	}))
+	defer srv.Close()
+
+	agg := metrics.NewAggregate()
+	render := func() string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	target := &target{
+		cfg:    &ScrapeConfig{JobName: "app", ScrapeTimeout: model.Duration(time.Second)},
+		url:    srv.URL,
+		labels: map[string]string{"job": "app"},
+		client: srv.Client(),
+	}
+
+	// another instance of the job pushes too
+	push := httptest.NewRequest("POST", "/metrics/job/app", strings.NewReader("# TYPE requests counter\nrequests 1\n"))
+	push.SetPathValue("labels", "job/app")
+	agg.ServeInsert(httptest.NewRecorder(), push)
+
+	require.NoError(t, target.scrape(context.Background(), agg))
+	assert.Equal(t, "# TYPE in_flight gauge\nin_flight{job=\"app\"} 3\n# TYPE requests counter\nrequests{job=\"app\"} 6\n", render())
+
+	exposition.Store("# TYPE requests counter\nrequests 8\n# TYPE in_flight gauge\nin_flight 1\n")
+	require.NoError(t, target.scrape(context.Background(), agg))
+	assert.Equal(t, "# TYPE in_flight gauge\nin_flight{job=\"app\"} 1\n# TYPE requests counter\nrequests{job=\"app\"} 9\n", render())
+
+	// the target restarted: its counter starts over and its gauge is gone
+	exposition.Store("# TYPE requests counter\nrequests 2\n")
+	require.NoError(t, target.scrape(context.Background(), agg))
+	assert.Equal(t, "# TYPE in_flight gauge\nin_flight{job=\"app\"} 0\n# TYPE requests counter\nrequests{job=\"app\"} 11\n", render())
+}
+
+func TestScrapeReseedsDroppedFamilies(t *testing.T) {
+	var exposition atomic.Value
+	exposition.Store("# TYPE requests counter\nrequests 5\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(exposition.Load().(string)))
+	}))
+	defer srv.Close()
+
+	// families expire once scraped since their last merge
+	agg := metrics.NewAggregate(metrics.SetScrapeTTL(1))
+	defer agg.Close()
+	render := func() string {
+		w := httptest.NewRecorder()
+		agg.ServeRender(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	target := &target{
+		cfg:    &ScrapeConfig{JobName: "app", ScrapeTimeout: model.Duration(time.Second)},
+		url:    srv.URL,
+		labels: map[string]string{"job": "app"},
+		client: srv.Client(),
+	}
+
+	require.NoError(t, target.scrape(context.Background(), agg))
+	assert.Equal(t, "# TYPE requests counter\nrequests{job=\"app\"} 5\n", render())
+	assert.Empty(t, render())
+
+	// the expired family is merged in full again, not as the delta
+	exposition.Store("# TYPE requests counter\nrequests 8\n")
+	require.NoError(t, target.scrape(context.Background(), agg))
+	assert.Equal(t, "# TYPE requests counter\nrequests{job=\"app\"} 8\n", render())
+}
+
+func TestHistogramDelta(t *testing.T) {
+	histogram := func(counts []uint64, sum float64) *dto.Histogram {
+		h := &dto.Histogram{SampleCount: proto.Uint64(counts[len(counts)-1]), SampleSum: proto.Float64(sum)}
+		for i, c := range counts {
+			h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(float64(i + 1)), CumulativeCount: proto.Uint64(c)})
+		}
+		return h
+	}
+	counts := func(h *dto.Histogram) []uint64 {
+		var out []uint64
+		for _, b := range h.Bucket {
+			out = append(out, b.GetCumulativeCount())
+		}
+		return out
+	}
+
+	d := histogramDelta(histogram([]uint64{1, 2, 4}, 6), histogram([]uint64{2, 4, 7}, 10))
+	assert.Equal(t, []uint64{1, 2, 3}, counts(d))
+	assert.Equal(t, uint64(3), d.GetSampleCount())
+	assert.Equal(t, 4.0, d.GetSampleSum())
+
+	// fewer observations than before: the target restarted
+	d = histogramDelta(histogram([]uint64{1, 2, 4}, 6), histogram([]uint64{1, 1, 1}, 0.5))
+	assert.Equal(t, []uint64{1, 1, 1}, counts(d))
+	assert.Equal(t, 0.5, d.GetSampleSum())
+}
@@ -0,0 +1,301 @@
+// Package wasm runs compiled WebAssembly modules as ingest and render
+// filters, so transformations the gateway doesn't know about, like label
+// enrichment from a proprietary inventory, ship without rebuilding it.
+//
+// A filter module exports its memory as "memory", an "alloc" function
+// taking a size and returning a pointer to that many bytes the gateway
+// writes the input to, and at least one of "filter_ingest" and
+// "filter_render". Both take the pointer and length of one metric family in
+// the text exposition format and return the pointer and length of its
+// replacement packed as ptr<<32 | len, in the same format. An empty
+// replacement drops the family. A module exporting "free" gets the input
+// and output buffers back once the gateway has read the output. Exemplars
+// and created timestamps, which the text format doesn't carry, are kept on
+// the series the replacement leaves with the same labels.
+//
+// A call running past the deadline of its context is aborted, and the
+// module instantiated again for the next call, losing its state.
+//
+// Modules may import WASI, which gets no filesystem, arguments or
+// environment, their stdout and stderr going to the gateway's stderr.
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Filter is a loaded filter module. Module instances are single threaded,
+// calls through a filter are serialized.
+type Filter struct {
+	// Name is the path or name the module was loaded from
+	Name string
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	config   wazero.ModuleConfig
+	ingests  bool
+	renders  bool
+
+	// module is instantiated again once an aborted call closed it
+	lock   sync.Mutex
+	module api.Module
+	alloc  api.Function
+	free   api.Function
+}
+
+// Load compiles and instantiates the module at path
+func Load(ctx context.Context, path string) (*Filter, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(ctx, path, code)
+}
+
+// New compiles and instantiates a module from its binary
+func New(ctx context.Context, name string, code []byte) (*Filter, error) {
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := r.CompileModule(ctx, code)
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("compiling wasm filter %s: %w", name, err)
+	}
+	// reactor modules built by TinyGo or Rust initialize in _initialize,
+	// start functions the module doesn't export are skipped
+	config := wazero.NewModuleConfig().
+		WithName(name).
+		WithStartFunctions("_initialize").
+		WithStdout(os.Stderr).
+		WithStderr(os.Stderr)
+	f := &Filter{Name: name, runtime: r, compiled: compiled, config: config}
+	if err := f.instantiate(ctx); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	if err := f.check(); err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("invalid wasm filter %s: %w", name, err)
+	}
+	f.ingests = f.module.ExportedFunction("filter_ingest") != nil
+	f.renders = f.module.ExportedFunction("filter_render") != nil
+	return f, nil
+}
+
+func (f *Filter) instantiate(ctx context.Context) error {
+	module, err := f.runtime.InstantiateModule(ctx, f.compiled, f.config)
+	if err != nil {
+		return fmt.Errorf("instantiating wasm filter %s: %w", f.Name, err)
+	}
+	f.module = module
+	f.alloc = module.ExportedFunction("alloc")
+	f.free = module.ExportedFunction("free")
+	return nil
+}
+
+func (f *Filter) check() error {
+	if f.module.Memory() == nil {
+		return fmt.Errorf("the module doesn't export its memory")
+	}
+	if f.alloc == nil {
+		return fmt.Errorf("the module doesn't export alloc")
+	}
+	if !signature(f.alloc, []api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}) {
+		return fmt.Errorf("alloc must take and return an i32")
+	}
+	if f.free != nil && !signature(f.free, []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, nil) {
+		return fmt.Errorf("free must take two i32 and return nothing")
+	}
+	ingest, render := f.module.ExportedFunction("filter_ingest"), f.module.ExportedFunction("filter_render")
+	if ingest == nil && render == nil {
+		return fmt.Errorf("the module exports neither filter_ingest nor filter_render")
+	}
+	for _, fn := range []api.Function{ingest, render} {
+		if fn != nil && !signature(fn, []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}) {
+			return fmt.Errorf("%s must take two i32 and return an i64", fn.Definition().ExportNames()[0])
+		}
+	}
+	return nil
+}
+
+func signature(fn api.Function, params, results []api.ValueType) bool {
+	def := fn.Definition()
+	return bytes.Equal(def.ParamTypes(), params) && bytes.Equal(def.ResultTypes(), results)
+}
+
+// Ingests reports whether the module filters pushed families
+func (f *Filter) Ingests() bool {
+	return f.ingests
+}
+
+// Renders reports whether the module filters rendered families
+func (f *Filter) Renders() bool {
+	return f.renders
+}
+
+// Ingest passes a pushed family through the module, returning nil when
+// the module drops it
+func (f *Filter) Ingest(ctx context.Context, family *dto.MetricFamily) (*dto.MetricFamily, error) {
+	return f.call(ctx, "filter_ingest", f.Ingests(), family)
+}
+
+// Render passes a rendered family through the module, returning nil when
+// the module drops it
+func (f *Filter) Render(ctx context.Context, family *dto.MetricFamily) (*dto.MetricFamily, error) {
+	return f.call(ctx, "filter_render", f.Renders(), family)
+}
+
+func (f *Filter) call(ctx context.Context, export string, exported bool, family *dto.MetricFamily) (*dto.MetricFamily, error) {
+	if !exported {
+		return family, nil
+	}
+
+	in := new(bytes.Buffer)
+	if err := expfmt.NewEncoder(in, expfmt.NewFormat(expfmt.TypeTextPlain)).Encode(family); err != nil {
+		return nil, err
+	}
+
+	out, err := f.invoke(ctx, export, in.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("wasm filter %s: %w", f.Name, err)
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, nil
+	}
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("wasm filter %s returned invalid metrics: %w", f.Name, err)
+	}
+	replaced, ok := families[family.GetName()]
+	if len(families) != 1 || !ok {
+		return nil, fmt.Errorf("wasm filter %s must return the %s family only", f.Name, family.GetName())
+	}
+	keepUntextual(family, replaced)
+	return replaced, nil
+}
+
+// keepUntextual copies what the text format drops, exemplars and created
+// timestamps, from the series of in to those of out with the same labels,
+// unless the filter set them
+func keepUntextual(in, out *dto.MetricFamily) {
+	byLabels := make(map[string]*dto.Metric, len(in.Metric))
+	for _, m := range in.Metric {
+		byLabels[labelsKey(m)] = m
+	}
+	for _, m := range out.Metric {
+		from, ok := byLabels[labelsKey(m)]
+		if !ok {
+			continue
+		}
+		switch {
+		case m.Counter != nil && from.Counter != nil:
+			if m.Counter.Exemplar == nil {
+				m.Counter.Exemplar = from.Counter.Exemplar
+			}
+			if m.Counter.CreatedTimestamp == nil {
+				m.Counter.CreatedTimestamp = from.Counter.CreatedTimestamp
+			}
+		case m.Histogram != nil && from.Histogram != nil:
+			if m.Histogram.CreatedTimestamp == nil {
+				m.Histogram.CreatedTimestamp = from.Histogram.CreatedTimestamp
+			}
+			exemplars := map[float64]*dto.Exemplar{}
+			for _, b := range from.Histogram.Bucket {
+				if b.Exemplar != nil {
+					exemplars[b.GetUpperBound()] = b.Exemplar
+				}
+			}
+			for _, b := range m.Histogram.Bucket {
+				if b.Exemplar == nil {
+					b.Exemplar = exemplars[b.GetUpperBound()]
+				}
+			}
+		case m.Summary != nil && from.Summary != nil:
+			if m.Summary.CreatedTimestamp == nil {
+				m.Summary.CreatedTimestamp = from.Summary.CreatedTimestamp
+			}
+		}
+	}
+}
+
+func labelsKey(m *dto.Metric) string {
+	pairs := make([]string, len(m.Label))
+	for i, l := range m.Label {
+		pairs[i] = l.GetName() + "\xff" + l.GetValue()
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// invoke copies in to the module's memory, runs its export over it and
+// copies its output back
+func (f *Filter) invoke(ctx context.Context, export string, in []byte) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.module.IsClosed() {
+		if err := f.instantiate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	fn := f.module.ExportedFunction(export)
+
+	mem := f.module.Memory()
+	res, err := f.alloc.Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	inPtr := uint32(res[0])
+	if !mem.Write(inPtr, in) {
+		return nil, fmt.Errorf("alloc returned %d bytes out of memory", len(in))
+	}
+
+	res, err = fn.Call(ctx, uint64(inPtr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+
+	var out []byte
+	if outLen > 0 {
+		view, ok := mem.Read(outPtr, outLen)
+		if !ok {
+			return nil, fmt.Errorf("the output is out of memory")
+		}
+		out = bytes.Clone(view)
+	}
+
+	if f.free != nil {
+		if _, err := f.free.Call(ctx, uint64(inPtr), uint64(len(in))); err != nil {
+			return nil, fmt.Errorf("free: %w", err)
+		}
+		if outLen > 0 && outPtr != inPtr {
+			if _, err := f.free.Call(ctx, uint64(outPtr), uint64(outLen)); err != nil {
+				return nil, fmt.Errorf("free: %w", err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Close releases the module
+func (f *Filter) Close(ctx context.Context) error {
+	return f.runtime.Close(ctx)
+}
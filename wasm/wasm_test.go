@@ -0,0 +1,219 @@
+package wasm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// returns its input
+	identityBody = []byte{0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad, 0x84}
+	// returns an empty output
+	dropBody = []byte{0x42, 0x00}
+	// never returns
+	loopBody = []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x42, 0x00}
+)
+
+// constantBody returns the module's data segment
+func constantBody(data string) []byte {
+	return append([]byte{0x42}, sleb(int64(len(data)))...)
+}
+
+func uleb(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if v == 0 {
+			return out
+		}
+	}
+}
+
+func sleb(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func vec(items ...[]byte) []byte {
+	out := uleb(uint64(len(items)))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func name(s string) []byte {
+	return append(uleb(uint64(len(s))), s...)
+}
+
+func section(id byte, content []byte) []byte {
+	return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+}
+
+// filterModule assembles a module exporting memory, an alloc always
+// returning 1024, and the filters whose bodies are given, with data at
+// offset 0
+func filterModule(ingest, render []byte, data string) []byte {
+	types := vec(
+		[]byte{0x60, 0x01, 0x7f, 0x01, 0x7f},
+		[]byte{0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e},
+	)
+	funcs := [][]byte{{0x00}}
+	exports := [][]byte{
+		append(name("memory"), 0x02, 0x00),
+		append(name("alloc"), 0x00, 0x00),
+	}
+	code := [][]byte{append([]byte{0x00, 0x41}, append(sleb(1024), 0x0b)...)}
+	for _, filter := range []struct {
+		name string
+		body []byte
+	}{{"filter_ingest", ingest}, {"filter_render", render}} {
+		if filter.body == nil {
+			continue
+		}
+		exports = append(exports, append(name(filter.name), 0x00, byte(len(funcs))))
+		funcs = append(funcs, []byte{0x01})
+		code = append(code, append([]byte{0x00}, append(filter.body, 0x0b)...))
+	}
+	for i, body := range code {
+		code[i] = append(uleb(uint64(len(body))), body...)
+	}
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, types)...)
+	module = append(module, section(3, vec(funcs...))...)
+	module = append(module, section(5, vec([]byte{0x00, 0x01}))...)
+	module = append(module, section(7, vec(exports...))...)
+	module = append(module, section(10, vec(code...))...)
+	if data != "" {
+		segment := append([]byte{0x00, 0x41, 0x00, 0x0b}, name(data)...)
+		module = append(module, section(11, vec(segment))...)
+	}
+	return module
+}
+
+func family(t *testing.T, text string) *dto.MetricFamily {
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	require.NoError(t, err)
+	require.Len(t, families, 1)
+	for _, f := range families {
+		return f
+	}
+	return nil
+}
+
+func TestFilter(t *testing.T) {
+	ctx := context.Background()
+	builds := "# TYPE builds counter\nbuilds{job=\"ci\"} 3\n"
+
+	t.Run("identity", func(t *testing.T) {
+		f, err := New(ctx, "identity", filterModule(identityBody, nil, ""))
+		require.NoError(t, err)
+		defer f.Close(ctx)
+		assert.True(t, f.Ingests())
+		assert.False(t, f.Renders())
+
+		in := family(t, builds)
+		out, err := f.Ingest(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, in.String(), out.String())
+
+		// families pass through filters a module doesn't export
+		out, err = f.Render(ctx, in)
+		require.NoError(t, err)
+		assert.Same(t, in, out)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		enriched := "# TYPE builds counter\nbuilds{job=\"ci\",team=\"infra\"} 3\n"
+		f, err := New(ctx, "enrich", filterModule(nil, constantBody(enriched), enriched))
+		require.NoError(t, err)
+		defer f.Close(ctx)
+
+		out, err := f.Render(ctx, family(t, builds))
+		require.NoError(t, err)
+		assert.Equal(t, family(t, enriched).String(), out.String())
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		f, err := New(ctx, "drop", filterModule(dropBody, nil, ""))
+		require.NoError(t, err)
+		defer f.Close(ctx)
+
+		out, err := f.Ingest(ctx, family(t, builds))
+		require.NoError(t, err)
+		assert.Nil(t, out)
+	})
+
+	t.Run("other family", func(t *testing.T) {
+		other := "# TYPE deploys counter\ndeploys 1\n"
+		f, err := New(ctx, "rename", filterModule(constantBody(other), nil, other))
+		require.NoError(t, err)
+		defer f.Close(ctx)
+
+		_, err = f.Ingest(ctx, family(t, builds))
+		require.ErrorContains(t, err, "must return the builds family only")
+	})
+
+	t.Run("keeps what text drops", func(t *testing.T) {
+		f, err := New(ctx, "identity", filterModule(identityBody, nil, ""))
+		require.NoError(t, err)
+		defer f.Close(ctx)
+
+		in := family(t, builds)
+		in.Metric[0].Counter.Exemplar = &dto.Exemplar{Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}}, Value: proto.Float64(1)}
+		in.Metric[0].Counter.CreatedTimestamp = timestamppb.New(time.Unix(1700000000, 0))
+		out, err := f.Ingest(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, in.String(), out.String())
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		f, err := New(ctx, "loop", filterModule(loopBody, identityBody, ""))
+		require.NoError(t, err)
+		defer f.Close(ctx)
+
+		deadline, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = f.Ingest(deadline, family(t, builds))
+		require.Error(t, err)
+
+		// the next call gets a fresh instance
+		in := family(t, builds)
+		out, err := f.Render(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, in.String(), out.String())
+	})
+
+	t.Run("no filter", func(t *testing.T) {
+		_, err := New(ctx, "empty", filterModule(nil, nil, ""))
+		require.ErrorContains(t, err, "exports neither filter_ingest nor filter_render")
+	})
+
+	t.Run("not wasm", func(t *testing.T) {
+		_, err := New(ctx, "text", []byte("builds 3\n"))
+		require.Error(t, err)
+	})
+}